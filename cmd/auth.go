@@ -20,10 +20,12 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/pkg/term"
 	"github.com/wercker/wercker/api"
@@ -86,8 +88,39 @@ func readPassword() string {
 	return input
 }
 
-// retrieves a basic access token from the wercker API
+const accessTokenAttempts = 4
+
+// accessTokenBackoff is the wait before the first retry, it doubles with
+// every attempt
+var accessTokenBackoff = 500 * time.Millisecond
+
+// errBadCredentials is returned when the API refuses the username and password
+var errBadCredentials = errors.New("Bad credentials, check your username and password")
+
+// retrieves a basic access token from the wercker API, transient failures
+// (network errors and 5xx responses) are retried with a jittered backoff
 func getAccessToken(username, password, url string) (string, error) {
+	// The global source is unseeded, every process would wait just as long
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano()))
+	backoff := accessTokenBackoff
+	for attempt := 1; ; attempt++ {
+		token, retry, err := requestAccessToken(username, password, url)
+		if err == nil || !retry || attempt == accessTokenAttempts {
+			return token, err
+		}
+
+		// Sleep somewhere between half and all of the backoff so concurrent
+		// logins don't retry in lockstep
+		wait := backoff/2 + time.Duration(jitter.Int63n(int64(backoff/2)))
+		authLogger.WithField("Error", err).Warnf("Unable to reach wercker API, retrying in %s", wait)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+// requestAccessToken does a single token request, retry tells whether the
+// error is worth retrying
+func requestAccessToken(username, password, url string) (token string, retry bool, err error) {
 	creds := Credentials{
 		Username: username,
 		Password: password,
@@ -97,13 +130,13 @@ func getAccessToken(username, password, url string) (string, error) {
 	b, err := json.Marshal(creds)
 	if err != nil {
 		authLogger.WithField("Error", err).Debug("Unable to serialize credentials")
-		return "", err
+		return "", false, err
 	}
 
 	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
 	if err != nil {
 		authLogger.WithField("Error", err).Debug("Unable to post request to wercker API")
-		return "", err
+		return "", false, err
 	}
 
 	req.SetBasicAuth(creds.Username, creds.Password)
@@ -115,30 +148,38 @@ func getAccessToken(username, password, url string) (string, error) {
 	resp, err := client.Do(req)
 	if err != nil {
 		authLogger.WithField("Error", err).Debug("Unable read from wercker API")
-		return "", err
+		return "", true, err
 	}
 	defer resp.Body.Close()
 
+	switch {
+	case resp.StatusCode == 401 || resp.StatusCode == 403:
+		authLogger.WithField("Error", errBadCredentials).Debug("Authentication failed")
+		return "", false, errBadCredentials
+	case resp.StatusCode >= 500:
+		return "", true, fmt.Errorf("wercker API returned status code %d", resp.StatusCode)
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		authLogger.WithField("Error", err).Debug("Unable to read response")
-		return "", err
+		return "", true, err
 	}
 
 	var response = &Response{}
 	err = json.Unmarshal(body, response)
 	if err != nil {
 		authLogger.WithField("Error", err).Debug("Unable to serialize response")
-		return "", err
+		return "", false, err
 
 	}
 	if response.Success == false {
 		err := errors.New("Invalid credentials")
 		authLogger.WithField("Error", err).Debug("Authentication failed")
-		return "", err
+		return "", false, err
 	}
 
-	return strings.TrimSpace(response.Result.Token), nil
+	return strings.TrimSpace(response.Result.Token), false, nil
 }
 
 // creates directory when needed, overwrites file when it already exists
@@ -0,0 +1,92 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type AuthSuite struct {
+	*util.TestSuite
+}
+
+func TestAuthSuite(t *testing.T) {
+	suiteTester := &AuthSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+// tokenServer responds with the next status code of statuses to every
+// request, the last one is repeated. It returns the number of requests it
+// got so far.
+func tokenServer(statuses ...int) (*httptest.Server, func() int) {
+	var l sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		requests++
+		l.Unlock()
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"success": true, "result": {"token": "the-token"}}`)
+	}))
+	return server, func() int {
+		l.Lock()
+		defer l.Unlock()
+		return requests
+	}
+}
+
+func (s *AuthSuite) TestGetAccessTokenRetries() {
+	defer func(backoff time.Duration) { accessTokenBackoff = backoff }(accessTokenBackoff)
+	accessTokenBackoff = 2 * time.Millisecond
+
+	server, requests := tokenServer(http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK)
+	defer server.Close()
+	token, err := getAccessToken("user", "pass", server.URL)
+	s.Nil(err)
+	s.Equal("the-token", token)
+	s.Equal(3, requests())
+
+	// It gives up eventually
+	server, requests = tokenServer(http.StatusInternalServerError)
+	defer server.Close()
+	_, err = getAccessToken("user", "pass", server.URL)
+	s.Error(err)
+	s.Equal(accessTokenAttempts, requests())
+}
+
+func (s *AuthSuite) TestGetAccessTokenBadCredentials() {
+	defer func(backoff time.Duration) { accessTokenBackoff = backoff }(accessTokenBackoff)
+	accessTokenBackoff = 2 * time.Millisecond
+
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		server, requests := tokenServer(status)
+		_, err := getAccessToken("user", "wrong", server.URL)
+		s.Equal(errBadCredentials, err)
+		s.Equal(1, requests())
+		server.Close()
+	}
+}
@@ -172,10 +172,14 @@ func stringifyFlags(flags []cli.Flag) ([]cli.StringFlag, error) {
 		default:
 			return nil, fmt.Errorf("unexpected type %T", t)
 		case cli.StringSliceFlag:
+			value := ""
+			if t.Value != nil {
+				value = strings.Join(*t.Value, ",")
+			}
 			usefulFlags = append(usefulFlags, cli.StringFlag{
 				Name:  t.Name,
 				Usage: t.Usage,
-				Value: strings.Join(*t.Value, ","),
+				Value: value,
 			})
 		case cli.BoolFlag:
 			usefulFlags = append(usefulFlags, cli.StringFlag{
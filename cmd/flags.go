@@ -32,6 +32,7 @@ var (
 	AuthFlags = []cli.Flag{
 		cli.StringFlag{Name: "auth-token", Usage: "Authentication token to use."},
 		cli.StringFlag{Name: "auth-token-store", Value: "~/.wercker/token", Usage: "Where to store the token after a login.", Hidden: true},
+		cli.StringFlag{Name: "token-storage", Value: "file", Usage: "Where login keeps the token: file (--auth-token-store) or keychain (macOS Keychain or libsecret, not supported on Windows)."},
 	}
 
 	DockerFlags = []cli.Flag{
@@ -40,11 +41,29 @@ var (
 		cli.StringFlag{Name: "docker-cert-path", Value: "", Usage: "Docker api cert path.", EnvVar: "DOCKER_CERT_PATH"},
 		cli.StringSliceFlag{Name: "docker-dns", Value: &cli.StringSlice{0: "8.8.8.8", 1: "8.8.4.4"}, Usage: "Docker DNS server.", EnvVar: "DOCKER_DNS", Hidden: true},
 		cli.BoolFlag{Name: "docker-local", Usage: "Don't interact with remote repositories"},
+		cli.Float64Flag{Name: "docker-op-timeout", Value: 0, Usage: "Fail the build when creating, starting, stopping, restarting or committing a box, service or step container takes more than this many minutes (0 disables)."},
+		cli.IntFlag{Name: "docker-connect-retries", Value: 3, Usage: "Retry this many times, with a backoff, when the Docker daemon doesn't respond yet (0 disables)."},
+		cli.StringFlag{Name: "hostname", Value: "", Usage: "Hostname of the box container."},
+		cli.StringSliceFlag{Name: "add-host", Usage: "Add a name:ip entry to /etc/hosts of the box container, same format as docker --add-host."},
+		cli.BoolFlag{Name: "box-privileged", Usage: "Run the box container in privileged mode. This gives the steps full access to the host, only use it for trusted code."},
+		cli.StringSliceFlag{Name: "cap-add", Usage: "Add a Linux capability to the box container, can be repeated. Every capability widens what the steps can do to the host."},
+		cli.StringSliceFlag{Name: "cap-drop", Usage: "Drop a Linux capability from the box container, can be repeated."},
+		cli.Float64Flag{Name: "service-poll-interval", Value: 1, Usage: "Seconds between checks whether a service with a ready-port or ready-command is ready."},
+		cli.Float64Flag{Name: "service-ready-timeout", Value: 2, Usage: "Fail the build if a service with a ready-port or ready-command isn't ready after this many minutes."},
+		cli.StringFlag{Name: "box-shm-size", Value: "", Usage: "Size of /dev/shm in the box container, like 512m or 2g, same format as docker --shm-size."},
+		cli.BoolFlag{Name: "registry-auth-from-token-store", Usage: "Authenticate against the registry with the token saved by login."},
+		cli.StringFlag{Name: "registry-auth-host", Value: "wcr.io", Usage: "The wercker registry, the only registry --registry-auth-from-token-store sends the token to."},
+		cli.Float64Flag{Name: "registry-timeout", Value: 0, Usage: "Fail registry pulls and pushes that take more than this many minutes, pushes are retried (0 disables)."},
+		cli.IntFlag{Name: "registry-push-concurrency", Value: 1, Usage: "Push this many tags or registries at the same time. The layers of a single push are uploaded as concurrently as the Docker daemon allows (its max-concurrent-uploads)."},
+		cli.StringFlag{Name: "max-image-size", Value: "", Usage: "Fail the build instead of pushing when the committed image is larger than this, like 512m or 2g.", EnvVar: "WERCKER_MAX_IMAGE_SIZE"},
+		cli.Float64Flag{Name: "registry-token-refresh", Value: 30, Usage: "Read the token saved by login again before pushing if it was read more than this many minutes ago (0 disables)."},
 	}
 
 	// These flags control where we store local files
 	LocalPathFlags = []cli.Flag{
 		cli.StringFlag{Name: "working-dir", Value: "./.wercker", Usage: "Path where we store working files.", EnvVar: "WERCKER_WORKING_DIR"},
+		cli.StringFlag{Name: "cache-dir", Value: "", Usage: "Path where steps with a cache_key record their results, defaults to step-cache in the working dir."},
+		cli.StringFlag{Name: "step-store", Value: "", Usage: "Path of a store for fetched steps that is shared by all projects, every step version is only downloaded once.", EnvVar: "WERCKER_STEP_STORE"},
 	}
 
 	// These flags control paths on the guest and probably shouldn't change
@@ -85,14 +104,60 @@ var (
 	// These flags affect our registry interactions
 	RegistryFlags = []cli.Flag{
 		cli.StringFlag{Name: "commit", Value: "", Usage: "Commit the build result locally."},
+		cli.BoolFlag{Name: "keep-failed-images", Usage: "Only keep the image committed with --commit if the build failed."},
 		cli.StringFlag{Name: "tag", Value: "", Usage: "Tag for this build.", EnvVar: "WERCKER_GIT_BRANCH"},
+		cli.StringSliceFlag{Name: "commit-tag", Usage: "Also tag the image committed with --commit with this tag, can be repeated."},
+		cli.BoolFlag{Name: "push", Usage: "Push the image committed with --commit with --tag and all --commit-tag tags."},
+		cli.StringSliceFlag{Name: "registry", Usage: "Also push the image pushed with --push to this registry, as [username:password@]host[/namespace], environment variables are expanded, can be repeated."},
+		cli.BoolFlag{Name: "dry-run-push", Usage: "Check the registry credentials for --push and --push-before-steps before running any steps."},
 		cli.StringFlag{Name: "message", Value: "", Usage: "Message for this build."},
+		cli.BoolFlag{Name: "annotate-commit", Usage: "Put a JSON blob with the build id, git commit and a hash of the steps in the WERCKER_BUILD_INFO env of the image committed with --commit."},
+		cli.StringSliceFlag{Name: "label", Usage: "Add a key=value label to committed images, can be repeated."},
+		cli.StringSliceFlag{Name: "container-label", Usage: "Add a key=value label to the containers and images wercker creates, can be repeated."},
+		cli.StringSliceFlag{Name: "oci-annotation", Usage: "Set a key=value OCI annotation on committed images, overriding the ones wercker derives from the build, can be repeated. The docker API can't annotate the pushed manifest, so they are only set as image labels."},
+		cli.StringFlag{Name: "label-file", Value: "", Usage: "Read key=value labels for committed images from this file, one per line."},
+		cli.StringFlag{Name: "commit-paths", Value: "", Usage: "Only commit these comma separated absolute paths of the container, into an image built from scratch."},
+		cli.BoolFlag{Name: "checkpoint", Usage: "Commit the container locally after each successful step."},
+		cli.BoolFlag{Name: "retry-failed-build", Usage: "Only run the step that failed in the previous run and the steps after it, in a fresh environment."},
+		cli.StringSliceFlag{Name: "checkpoint-on-step", Usage: "Commit the container as repo:tag right after the step passes, as step:repo:tag, can be repeated."},
+		cli.BoolFlag{Name: "push-checkpoint-on-step", Usage: "Push the images committed by --checkpoint-on-step."},
+		cli.StringFlag{Name: "resume-from", Value: "", Usage: "Resume from this step using the checkpoint of a previous run."},
+		cli.StringFlag{Name: "commit-before-steps", Value: "", Usage: "Commit the prepared environment as repo:tag before running any steps."},
+		cli.BoolFlag{Name: "push-before-steps", Usage: "Push the image committed by --commit-before-steps."},
+		cli.StringFlag{Name: "scan-command", Value: "", Usage: "Run this command on committed images before they are pushed, {image} is replaced with the image."},
+		cli.BoolFlag{Name: "scan-nonblocking", Usage: "Only warn when --scan-command fails."},
+		cli.StringFlag{Name: "pull-policy", Value: "always", Usage: "When to pull the box, service and step images: always, if-not-present or never."},
+		cli.Float64Flag{Name: "box-pull-timeout", Value: 0, Usage: "Fail the build if pulling the box takes more than this many minutes (0 disables)."},
 	}
 
 	// These flags affect our artifact interactions
 	ArtifactFlags = []cli.Flag{
 		cli.BoolFlag{Name: "artifacts", Usage: "Store artifacts."},
+		cli.BoolFlag{Name: "no-store", Usage: "Never push or upload anything, regardless of other flags."},
 		cli.BoolFlag{Name: "no-remove", Usage: "Don't remove the containers."},
+		cli.StringFlag{Name: "annotation-format", Value: "", Usage: "Print the annotations written by steps to $WERCKER_REPORT_ANNOTATIONS_FILE in this format: json or github."},
+		cli.BoolFlag{Name: "print-metadata", Usage: "Print the build id, image, artifact url and result as KEY=value lines on stdout when finished, for use with eval."},
+		cli.StringFlag{Name: "notify-webhook", Value: "", Usage: "POST the result of the build as JSON to this URL."},
+		cli.StringFlag{Name: "notify-on", Value: "failure,success", Usage: "Results to notify --notify-webhook of: failure, success or both."},
+		cli.StringFlag{Name: "failure-message-template", Value: "", Usage: "Go template for the message of a failed step, with {{.Step}}, {{.ExitCode}}, {{.Message}} and the last lines of output in {{.Output}}."},
+		cli.StringFlag{Name: "summary-json", Value: "", Usage: "Write a JSON summary of the run to this path."},
+		cli.StringFlag{Name: "step-log-dir", Value: "", Usage: "Also write the output of each step to its own file in this directory."},
+		cli.StringFlag{Name: "otlp-endpoint", Value: "", Usage: "Export OpenTelemetry traces of the build and its steps to this OTLP/HTTP collector."},
+		cli.BoolFlag{Name: "otlp-logs", Usage: "Also export the output of the steps to the --otlp-endpoint, as logs correlated to the step spans."},
+		cli.StringFlag{Name: "log-server", Value: "", Usage: "Stream the build events to viewers on this address, as server-sent events on /events and over a websocket on /ws."},
+		cli.StringFlag{Name: "secrets-file", Value: "", Usage: "Mask the variables or values listed in this file, one per line, in all output."},
+		cli.StringFlag{Name: "dump-env", Value: "", Usage: "Write the environment used for the steps to this path, it can be passed back in with --environment."},
+		cli.BoolFlag{Name: "dump-env-unmasked", Usage: "Include the values of hidden variables in --dump-env."},
+		cli.BoolFlag{Name: "fail-on-empty-artifact", Usage: "Fail the build if the artifact has no files or is smaller than --min-artifact-size."},
+		cli.BoolFlag{Name: "warn-on-empty-artifact", Usage: "Warn if the artifact has no files or is smaller than --min-artifact-size."},
+		cli.IntFlag{Name: "min-artifact-size", Value: 0, Usage: "Minimum size in bytes of the files in the artifact."},
+		cli.BoolFlag{Name: "upload-partial-on-timeout", Usage: "Collect and upload the artifact of a build that hit --build-timeout, marked as partial."},
+		cli.IntFlag{Name: "max-concurrent-uploads", Value: 4, Usage: "Upload at most this many step artifacts at the same time."},
+		cli.StringFlag{Name: "input-artifact", Value: "", Usage: "Extract this artifact, a URL or a path to a tarball, into the source before the steps run."},
+		cli.StringFlag{Name: "input-artifact-dir", Value: "", Usage: "Directory relative to the source to extract --input-artifact to."},
+		cli.StringFlag{Name: "artifact-retention", Value: "", Usage: "Store a retention hint in days, e.g. 30d, with the uploaded artifacts for the lifecycle rules of the store."},
+		cli.BoolFlag{Name: "concurrent-upload", Usage: "Upload the artifact while the box restarts for the after-steps, an upload failure still fails the main steps."},
+		cli.BoolFlag{Name: "reproducible-artifacts", Usage: "Sort the entries of artifact tarballs and reset their mtimes, owners and permissions so identical inputs produce identical tarballs."},
 		cli.BoolFlag{Name: "store-s3",
 			Usage: `Store artifacts and containers on s3.
 			This requires access to aws credentials, pulled from any of the usual places
@@ -108,11 +173,17 @@ var (
 		cli.BoolFlag{Name: "no-colors", Usage: "Wercker output will not use colors (does not apply to step output)."},
 		cli.BoolFlag{Name: "debug", Usage: "Print additional debug information."},
 		cli.BoolFlag{Name: "journal", Usage: "Send logs to systemd-journald. Suppresses stdout logging."},
+		cli.BoolFlag{Name: "env-case-insensitive", Usage: "Treat environment variable names that only differ in casing, like Path and PATH, as the same variable."},
+		cli.BoolTFlag{Name: "env-expand", Usage: "Expand $VAR in wercker.yml values, use --env-expand=false to keep them literal. Use $$ for a literal $."},
+		cli.StringFlag{Name: "tmp-dir", Usage: "Directory for temporary files, defaults to the system temp dir."},
+		cli.IntFlag{Name: "crash-log-lines", Value: 200, Usage: "Number of log lines to keep for the crash log (0 disables)."},
+		cli.StringFlag{Name: "crash-log", Value: "wercker-crash.log", Usage: "Write the last log lines, the current step and the stack trace to this file when wercker crashes."},
 	}
 
 	// These flags are advanced dev settings
 	InternalDevFlags = []cli.Flag{
 		cli.BoolTFlag{Name: "direct-mount", Usage: "Mount our binds read-write to the pipeline path."},
+		cli.StringFlag{Name: "build-dir-mode", Value: "", Usage: "How the source gets into the container: ro (read-only mount), copy (writable copy) or rw (read-write mount), defaults to rw with --direct-mount and copy otherwise."},
 		cli.StringSliceFlag{Name: "publish", Value: &cli.StringSlice{}, Usage: "Publish a port from the main container, same format as docker --publish."},
 		cli.BoolFlag{Name: "attach-on-error", Usage: "Attach shell to container if a step fails.", Hidden: true},
 		cli.BoolFlag{Name: "enable-volumes", Usage: "Mount local files and directories as volumes to your wercker container, specified in your wercker.yml."},
@@ -126,6 +197,10 @@ var (
 	// These flags are advanced build settings
 	InternalBuildFlags = []cli.Flag{
 		cli.BoolFlag{Name: "direct-mount", Usage: "Mount our binds read-write to the pipeline path."},
+		cli.StringFlag{Name: "build-dir-mode", Value: "", Usage: "How the source gets into the container: ro (read-only mount), copy (writable copy) or rw (read-write mount), defaults to rw with --direct-mount and copy otherwise."},
+		cli.BoolFlag{Name: "fail-on-dirty-source", Usage: "Abort if the source is a git checkout with uncommitted changes."},
+		cli.BoolFlag{Name: "skip-checkout", Usage: "Use the project directory as-is instead of copying it to the working dir first."},
+		cli.StringFlag{Name: "source-archive", Value: "", Usage: "Build the source in this .tar or .tar.gz archive instead of the project directory."},
 		cli.StringSliceFlag{Name: "publish", Value: &cli.StringSlice{}, Usage: "Publish a port from the main container, same format as docker --publish."},
 		cli.BoolFlag{Name: "attach-on-error", Usage: "Attach shell to container if a step fails.", Hidden: true},
 		cli.BoolFlag{Name: "enable-volumes", Usage: "Mount local files and directories as volumes to your wercker container, specified in your wercker.yml."},
@@ -159,7 +234,14 @@ var (
 	KeenFlags = []cli.Flag{
 		cli.BoolFlag{Name: "keen-metrics", Usage: "Report metrics to keen.io.", Hidden: true},
 		cli.StringFlag{Name: "keen-project-write-key", Value: "", Usage: "Keen write key.", Hidden: true},
+		cli.StringFlag{Name: "keen-write-key-file", Value: "", Usage: "Read the keen write key from this file instead of --keen-project-write-key.", Hidden: true},
 		cli.StringFlag{Name: "keen-project-id", Value: "", Usage: "Keen project id.", Hidden: true},
+		cli.StringFlag{Name: "keen-build-collection", Value: "build-events", Usage: "Keen collection for build events.", Hidden: true},
+		cli.StringFlag{Name: "keen-deploy-collection", Value: "deploy-events", Usage: "Keen collection for deploy events.", Hidden: true},
+		cli.IntFlag{Name: "keen-stack", Value: 5, Usage: "Stack reported with the keen events.", Hidden: true},
+		cli.StringFlag{Name: "keen-environment", Value: "", Usage: "Environment, like staging or production, reported with the keen events.", Hidden: true},
+		cli.StringSliceFlag{Name: "keen-extra-field", Usage: "Add a key=value field to the extra map of every keen event, can be repeated.", Hidden: true},
+		cli.IntFlag{Name: "keen-log-sampling", Value: 0, Usage: "Attach the first and last N output lines of a step, and up to N error lines, to its buildStepFinished event (0 disables).", Hidden: true},
 	}
 
 	// Wercker Reporter settings
@@ -169,12 +251,31 @@ var (
 		cli.StringFlag{Name: "wercker-token", Usage: "Wercker token to use for wercker reporter.", Hidden: true},
 	}
 
+	// These options can't be set from the wercker.yml
+	PipelineFlags = []cli.Flag{
+		cli.StringFlag{Name: "explain-env", Value: "", Usage: "Print where the value of this environment variable comes from."},
+		cli.BoolFlag{Name: "expand-env-files", Usage: "Set FOO to the contents of the host file in FOO_FILE for all variables, not just the X_ and XXX_ passthru ones. Only use it with a trusted wercker.yml."},
+	}
+
 	// These options might be overwritten by the wercker.yml
 	ConfigFlags = []cli.Flag{
 		cli.StringFlag{Name: "source-dir", Value: "", Usage: "Source path relative to checkout root."},
+		cli.StringFlag{Name: "step-order-strategy", Value: "declared", Usage: "Order of the steps: declared, alphabetical or dependency (uses depends-on)."},
+		cli.BoolTFlag{Name: "warn-on-latest-tag", Usage: "Warn when the box uses the latest tag or no tag, use --warn-on-latest-tag=false to silence it."},
+		cli.BoolFlag{Name: "forbid-latest-tag", Usage: "Fail the build when the box uses the latest tag or no tag."},
+		cli.BoolFlag{Name: "allow-empty-pipeline", Usage: "Let a pipeline without any steps pass instead of failing it."},
+		cli.StringFlag{Name: "step-network", Value: "default", Usage: "Networking of steps without a network property: default or none (no network access)."},
+		cli.StringFlag{Name: "box-tag-from-env", Value: "", Usage: "Use the value of this environment variable as the box tag, if it is set."},
 		cli.Float64Flag{Name: "no-response-timeout", Value: 5, Usage: "Timeout if no script output is received in this many minutes."},
 		cli.Float64Flag{Name: "command-timeout", Value: 25, Usage: "Timeout if command does not complete in this many minutes."},
-		cli.StringFlag{Name: "wercker-yml", Value: "", Usage: "Specify a specific yaml file.", EnvVar: "WERCKER_YML_FILE"},
+		cli.Float64Flag{Name: "step-working-timeout", Value: 0, Usage: "Kill a step that produces no output for this many minutes, across all its commands (0 disables)."},
+		cli.IntFlag{Name: "step-timeout-grace", Value: 10, Usage: "Seconds the processes of a timed out step get to shut down after SIGTERM before they are killed, the box keeps running."},
+		cli.Float64Flag{Name: "build-timeout", Value: 0, Usage: "Fail the build if its steps don't complete in this many minutes (0 disables)."},
+		cli.StringFlag{Name: "cancel-file", Value: "", Usage: "Cancel the build, like an interrupt does, as soon as this file exists."},
+		cli.Float64Flag{Name: "cancel-file-interval", Value: 1, Usage: "Check for the --cancel-file every this many seconds."},
+		cli.StringFlag{Name: "prebuild-script", Value: "", Usage: "Run this script on the host before the box is started, with the build metadata in its environment. The build is aborted if it fails."},
+		cli.StringFlag{Name: "config-overlay", Value: "", Usage: "Apply this JSON or YAML merge patch (RFC 7386) to the wercker.yml: maps are merged, null removes a key, anything else replaces it."},
+		cli.StringFlag{Name: "wercker-yml, config", Value: "", Usage: "Specify a specific config file (yaml, json or toml).", EnvVar: "WERCKER_YML_FILE"},
 	}
 
 	PullFlagSet = [][]cli.Flag{
@@ -187,6 +288,28 @@ var (
 		},
 	}
 
+	VerifyArtifactFlagSet = [][]cli.Flag{
+		[]cli.Flag{
+			cli.StringFlag{Name: "file", Value: "", Usage: "Path to the artifact to verify."},
+			cli.StringFlag{Name: "sha256", Value: "", Usage: "Expected sha256 of the artifact."},
+			cli.StringFlag{Name: "manifest", Value: "", Usage: "Read the expected sha256 from this sha256sum manifest."},
+			cli.BoolFlag{Name: "list", Usage: "List the top-level contents of the artifact."},
+		},
+	}
+
+	LoginFlagSet = [][]cli.Flag{
+		[]cli.Flag{
+			cli.StringFlag{Name: "login-endpoint", Value: "", Usage: "URL to request the access token from, instead of the one derived from --base-url."},
+		},
+	}
+
+	ExecStepFlagSet = [][]cli.Flag{
+		[]cli.Flag{
+			cli.StringFlag{Name: "container", Value: "", Usage: "ID of the prepared container to run the step in."},
+			cli.StringFlag{Name: "step", Value: "", Usage: "Name of the step to run."},
+		},
+	}
+
 	GlobalFlagSet = [][]cli.Flag{
 		DevFlags,
 		EndpointFlags,
@@ -206,6 +329,7 @@ var (
 		RegistryFlags,
 		ArtifactFlags,
 		AWSFlags,
+		PipelineFlags,
 		ConfigFlags,
 	}
 
@@ -218,6 +342,7 @@ var (
 		RegistryFlags,
 		ArtifactFlags,
 		AWSFlags,
+		PipelineFlags,
 		ConfigFlags,
 	}
 
@@ -230,6 +355,7 @@ var (
 		RegistryFlags,
 		ArtifactFlags,
 		AWSFlags,
+		PipelineFlags,
 		ConfigFlags,
 	}
 
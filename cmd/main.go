@@ -129,6 +129,131 @@ var (
 		Flags: FlagsFor(PipelineFlagSet, WerckerInternalFlagSet),
 	}
 
+	graphCommand = cli.Command{
+		Name:  "graph",
+		Usage: "print the steps of a pipeline as a Graphviz DOT graph",
+		Action: func(c *cli.Context) {
+			envfile := c.GlobalString("environment")
+			_ = godotenv.Load(envfile)
+
+			settings := util.NewCLISettings(c)
+			env := util.NewEnvironment(os.Environ()...)
+			opts, err := core.NewCheckConfigOptions(settings, env)
+			if err != nil {
+				cliLogger.Errorln("Invalid options\n", err)
+				os.Exit(1)
+			}
+			err = cmdGraph(opts)
+			if err != nil {
+				os.Exit(1)
+			}
+		},
+		Flags: FlagsFor(PipelineFlagSet, WerckerInternalFlagSet),
+	}
+
+	deployTargetsCommand = cli.Command{
+		Name:  "deploy-targets",
+		Usage: "list the deploy targets in the wercker.yml",
+		Action: func(c *cli.Context) {
+			envfile := c.GlobalString("environment")
+			_ = godotenv.Load(envfile)
+
+			settings := util.NewCLISettings(c)
+			env := util.NewEnvironment(os.Environ()...)
+			opts, err := core.NewCheckConfigOptions(settings, env)
+			if err != nil {
+				cliLogger.Errorln("Invalid options\n", err)
+				os.Exit(1)
+			}
+			err = cmdDeployTargets(opts, c.Bool("json"))
+			if err != nil {
+				os.Exit(1)
+			}
+		},
+		Flags: append(FlagsFor(PipelineFlagSet, WerckerInternalFlagSet),
+			cli.BoolFlag{Name: "json", Usage: "Output the deploy targets as JSON."},
+		),
+	}
+
+	artifactsCommand = cli.Command{
+		Name:  "artifacts",
+		Usage: "list the files a build would collect as its artifact",
+		Action: func(c *cli.Context) {
+			envfile := c.GlobalString("environment")
+			_ = godotenv.Load(envfile)
+
+			settings := util.NewCLISettings(c)
+			env := util.NewEnvironment(os.Environ()...)
+			opts, err := core.NewCheckConfigOptions(settings, env)
+			if err != nil {
+				cliLogger.Errorln("Invalid options\n", err)
+				os.Exit(1)
+			}
+			err = cmdArtifacts(opts)
+			if err != nil {
+				os.Exit(1)
+			}
+		},
+		Flags: FlagsFor(PipelineFlagSet, WerckerInternalFlagSet),
+	}
+
+	configDumpCommand = cli.Command{
+		Name:  "config-dump",
+		Usage: "print the wercker.yml as a pipeline would see it, with overlays, anchors and variables resolved",
+		Action: func(c *cli.Context) {
+			envfile := c.GlobalString("environment")
+			_ = godotenv.Load(envfile)
+
+			settings := util.NewCLISettings(c)
+			env := util.NewEnvironment(os.Environ()...)
+			opts, err := core.NewBuildOptions(settings, env)
+			if err != nil {
+				cliLogger.Errorln("Invalid options\n", err)
+				os.Exit(1)
+			}
+			dockerOptions, err := dockerlocal.NewDockerOptions(settings, env)
+			if err != nil {
+				cliLogger.Errorln("Invalid options\n", err)
+				os.Exit(1)
+			}
+			err = cmdConfigDump(opts, dockerOptions, c.String("output"))
+			if err != nil {
+				os.Exit(1)
+			}
+		},
+		Flags: append(FlagsFor(PipelineFlagSet, WerckerInternalFlagSet),
+			cli.StringFlag{Name: "output", Value: "", Usage: "Write the config to this file instead of stdout."},
+		),
+	}
+
+	execStepCommand = cli.Command{
+		Name:        "exec-step",
+		Usage:       "run a single step in an existing container",
+		Description: "run a single step in a container prepared by an earlier run, e.g. with --no-remove",
+		Action: func(c *cli.Context) {
+			envfile := c.GlobalString("environment")
+			_ = godotenv.Load(envfile)
+
+			settings := util.NewCLISettings(c)
+			env := util.NewEnvironment(os.Environ()...)
+			opts, err := core.NewExecStepOptions(settings, env)
+			if err != nil {
+				cliLogger.Errorln("Invalid options\n", err)
+				os.Exit(1)
+			}
+			dockerOptions, err := dockerlocal.NewDockerOptions(settings, env)
+			if err != nil {
+				cliLogger.Errorln("Invalid options\n", err)
+				os.Exit(1)
+			}
+			err = cmdExecStep(context.Background(), opts, dockerOptions)
+			if err != nil {
+				os.Exit(1)
+			}
+		},
+		Flags: FlagsFor(ExecStepFlagSet, PipelineFlagSet, WerckerInternalFlagSet),
+	}
+
 	deployCommand = cli.Command{
 		Name:      "deploy",
 		ShortName: "d",
@@ -161,7 +286,10 @@ var (
 		Name:      "detect",
 		ShortName: "de",
 		Usage:     "detect the type of project",
-		Flags:     []cli.Flag{},
+		Flags: []cli.Flag{
+			cli.BoolFlag{Name: "json", Usage: "Output the detected stack and the files that triggered it as JSON."},
+			cli.BoolFlag{Name: "no-write", Usage: "Only detect the stack, don't fetch and write a wercker.yml."},
+		},
 		Action: func(c *cli.Context) {
 			settings := util.NewCLISettings(c)
 			env := util.NewEnvironment(os.Environ()...)
@@ -209,7 +337,7 @@ var (
 		Name:      "login",
 		ShortName: "l",
 		Usage:     "log into wercker",
-		Flags:     []cli.Flag{},
+		Flags:     FlagsFor(LoginFlagSet),
 		Action: func(c *cli.Context) {
 			settings := util.NewCLISettings(c)
 			env := util.NewEnvironment(os.Environ()...)
@@ -276,6 +404,26 @@ var (
 		},
 	}
 
+	verifyArtifactCommand = cli.Command{
+		Name:        "verify-artifact",
+		Usage:       "verify-artifact --file <path>",
+		Description: "check the checksum and contents of a downloaded artifact",
+		Flags:       FlagsFor(VerifyArtifactFlagSet),
+		Action: func(c *cli.Context) {
+			settings := util.NewCLISettings(c)
+			env := util.NewEnvironment(os.Environ()...)
+			opts, err := core.NewVerifyArtifactOptions(settings, env)
+			if err != nil {
+				cliLogger.Errorln("Invalid options\n", err)
+				os.Exit(1)
+			}
+			err = cmdVerifyArtifact(opts)
+			if err != nil {
+				cliLogger.Fatal(err)
+			}
+		},
+	}
+
 	versionCommand = cli.Command{
 		Name:      "version",
 		ShortName: "v",
@@ -346,12 +494,18 @@ func GetApp() *cli.App {
 		buildCommand,
 		devCommand,
 		checkConfigCommand,
+		graphCommand,
 		deployCommand,
+		deployTargetsCommand,
+		artifactsCommand,
+		configDumpCommand,
+		execStepCommand,
 		detectCommand,
 		// inspectCommand,
 		loginCommand,
 		logoutCommand,
 		pullCommand,
+		verifyArtifactCommand,
 		versionCommand,
 		documentCommand(app),
 	}
@@ -367,6 +521,17 @@ func GetApp() *cli.App {
 			util.RootLogger().Hooks.Add(&journalhook.JournalHook{})
 			util.RootLogger().Out = ioutil.Discard
 		}
+		util.SetEnvExpand(ctx.GlobalBoolT("env-expand"))
+		util.SetEnvCaseInsensitive(ctx.GlobalBool("env-case-insensitive"))
+		if tmpDir := ctx.GlobalString("tmp-dir"); tmpDir != "" {
+			if err := util.SetTempDir(tmpDir); err != nil {
+				return fmt.Errorf("Invalid --tmp-dir %s: %s", tmpDir, err)
+			}
+		}
+		if lines := ctx.GlobalInt("crash-log-lines"); lines > 0 {
+			util.SetCrashLog(util.NewCrashLog(ctx.GlobalString("crash-log"), lines))
+			util.SetCrashContext("args", strings.Join(maskArgs(os.Args), " "))
+		}
 		// Register the global signal handler
 		util.GlobalSigint().Register(os.Interrupt)
 		util.GlobalSigterm().Register(unix.SIGTERM)
@@ -375,6 +540,54 @@ func GetApp() *cli.App {
 	return app
 }
 
+// secretArgNames are substrings of flag names whose values maskArgs hides.
+var secretArgNames = []string{"token", "key", "secret", "password"}
+
+// maskArgs hides the values of flags that look like they contain secrets.
+func maskArgs(args []string) []string {
+	masked := make([]string, len(args))
+	maskNext := false
+	for i, arg := range args {
+		if maskNext {
+			masked[i] = "********"
+			maskNext = false
+			continue
+		}
+		masked[i] = arg
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.ToLower(strings.SplitN(arg, "=", 2)[0])
+		for _, secret := range secretArgNames {
+			if !strings.Contains(name, secret) {
+				continue
+			}
+			if strings.Contains(arg, "=") {
+				masked[i] = strings.SplitN(arg, "=", 2)[0] + "=********"
+			} else {
+				maskNext = true
+			}
+			break
+		}
+	}
+	return masked
+}
+
+// HandleCrash writes the crash log when wercker panics, then lets the panic
+// continue. It has to be deferred in main.
+func HandleCrash() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if path, err := util.WriteCrashLog(r); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to write crash log:", err)
+	} else if path != "" {
+		fmt.Fprintln(os.Stderr, "Wrote crash log to", path)
+	}
+	panic(r)
+}
+
 // SoftExit is a helper for determining when to show stack traces
 type SoftExit struct {
 	options *core.GlobalOptions
@@ -430,20 +643,21 @@ func cmdCheckConfig(options *core.PipelineOptions, dockerOptions *dockerlocal.Do
 	//               runner.GetConfig step, we should probably refactor
 	var werckerYaml []byte
 	var err error
-	if options.WerckerYml != "" {
-		werckerYaml, err = ioutil.ReadFile(options.WerckerYml)
+	werckerYml := options.WerckerYml
+	if werckerYml != "" {
+		werckerYaml, err = ioutil.ReadFile(werckerYml)
 		if err != nil {
 			return soft.Exit(err)
 		}
 	} else {
-		werckerYaml, err = core.ReadWerckerYaml([]string{"."}, false)
+		werckerYml, werckerYaml, err = core.ReadWerckerConfig([]string{"."})
 		if err != nil {
 			return soft.Exit(err)
 		}
 	}
 
 	// Parse that bad boy.
-	rawConfig, err := core.ConfigFromYaml(werckerYaml)
+	rawConfig, err := core.ConfigFromFile(werckerYml, werckerYaml)
 	if err != nil {
 		return soft.Exit(err)
 	}
@@ -462,56 +676,307 @@ func cmdCheckConfig(options *core.PipelineOptions, dockerOptions *dockerlocal.Do
 	return nil
 }
 
-// detectProject inspects the the current directory that wercker is running in
-// and detects the project's programming language
-func cmdDetect(options *core.DetectOptions) error {
+// cmdExecStep runs a single step of the pipeline in an already prepared
+// container, skipping everything else.
+func cmdExecStep(ctx context.Context, options *core.ExecStepOptions, dockerOptions *dockerlocal.DockerOptions) error {
 	soft := NewSoftExit(options.GlobalOptions)
 	logger := util.RootLogger().WithField("Logger", "Main")
+	f := &util.Formatter{options.GlobalOptions.ShowColors}
+
+	if options.Pipeline == "" {
+		options.Pipeline = "build"
+	}
+	ctx = core.NewEmitterContext(ctx)
+
+	r, err := NewRunner(ctx, options.PipelineOptions, dockerOptions, GetBuildPipelineFactory(options.Pipeline))
+	if err != nil {
+		return soft.Exit(err)
+	}
+
+	shared, err := r.SetupExistingContainer(ctx, options.ContainerID)
+	if err != nil {
+		return soft.Exit(err)
+	}
+
+	steps := append(shared.pipeline.Steps(), shared.pipeline.AfterSteps()...)
+	for i, step := range steps {
+		if step.DisplayName() != options.StepName && step.Name() != options.StepName {
+			continue
+		}
+
+		hostPath, err := step.Fetch()
+		if err != nil {
+			return soft.Exit(err)
+		}
+		// The container was mounted with the steps of the run that started
+		// it, this one's fetched step is under a different path
+		if hostPath != "" {
+			artificer := dockerlocal.NewArtificer(options.PipelineOptions, dockerOptions)
+			if err := artificer.UploadStep(step, hostPath, shared.containerID); err != nil {
+				return soft.Exit(err)
+			}
+		}
 
-	logger.Println("########### Detecting your project! #############")
+		logger.Printf(f.Info("Running step", step.DisplayName()))
+		timer := util.NewTimer()
+		sr, err := r.RunStep(shared, step, i+3)
+		if sr.Message != "" {
+			logger.Println(sr.Message)
+		}
+		if err == nil {
+			err = r.WaitStepArtifacts()
+		}
+		if err != nil {
+			logger.Printf(f.Fail("Step failed", step.DisplayName(), timer.String()))
+			return soft.Exit(err)
+		}
+		logger.Printf(f.Success("Step passed", step.DisplayName(), timer.String()))
+		return nil
+	}
+
+	return soft.Exit(fmt.Errorf("No step named %s in pipeline %s", options.StepName, options.Pipeline))
+}
 
-	detected := ""
+// cmdGraph prints the DOT graph of the steps in the pipeline selected with
+// --pipeline, which defaults to the build pipeline.
+func cmdGraph(options *core.PipelineOptions) error {
+	soft := NewSoftExit(options.GlobalOptions)
 
-	d, err := os.Open(".")
+	werckerYml := options.WerckerYml
+	var werckerYaml []byte
+	var err error
+	if werckerYml != "" {
+		werckerYaml, err = ioutil.ReadFile(werckerYml)
+	} else {
+		werckerYml, werckerYaml, err = core.ReadWerckerConfig([]string{"."})
+	}
 	if err != nil {
-		logger.WithField("Error", err).Error("Unable to open directory")
-		soft.Exit(err)
+		return soft.Exit(err)
 	}
-	defer d.Close()
 
-	files, err := d.Readdir(-1)
+	rawConfig, err := core.ConfigFromFile(werckerYml, werckerYaml)
 	if err != nil {
-		logger.WithField("Error", err).Error("Unable to read directory")
-		soft.Exit(err)
+		return soft.Exit(err)
 	}
-outer:
-	for _, f := range files {
-		switch {
-		case f.Name() == "package.json":
-			detected = "nodejs"
-			break outer
 
-		case f.Name() == "requirements.txt":
-			detected = "python"
-			break outer
+	name := options.Pipeline
+	if name == "" {
+		name = "build"
+	}
+	pipeline, ok := rawConfig.PipelinesMap[name]
+	if !ok {
+		return soft.Exit(fmt.Errorf("No pipeline named %s", name))
+	}
 
-		case f.Name() == "Gemfile":
-			detected = "ruby"
-			break outer
+	fmt.Print(core.PipelineGraph(name, pipeline.PipelineConfig))
+	return nil
+}
+
+// cmdArtifacts lists the files of the artifact a build would collect before
+// any step ran: the source dir, as the output dir starts out empty, and the
+// step artifacts declared in the wercker.yml.
+func cmdArtifacts(options *core.PipelineOptions) error {
+	soft := NewSoftExit(options.GlobalOptions)
+	logger := util.RootLogger().WithField("Logger", "Main")
 
-		case filepath.Ext(f.Name()) == ".go":
-			detected = "golang"
-			break outer
+	werckerYml := options.WerckerYml
+	var werckerYaml []byte
+	var err error
+	if werckerYml != "" {
+		werckerYaml, err = ioutil.ReadFile(werckerYml)
+	} else {
+		werckerYml, werckerYaml, err = core.ReadWerckerConfig([]string{options.ProjectPath})
+	}
+	if err != nil {
+		return soft.Exit(err)
+	}
+
+	rawConfig, err := core.ConfigFromFile(werckerYml, werckerYaml)
+	if err != nil {
+		return soft.Exit(err)
+	}
+
+	name := options.Pipeline
+	if name == "" {
+		name = "build"
+	}
+	pipeline, ok := rawConfig.PipelinesMap[name]
+	if !ok {
+		return soft.Exit(fmt.Errorf("No pipeline named %s", name))
+	}
+
+	sourceDir := options.SourceDir
+	if rawConfig.SourceDir != "" {
+		sourceDir = rawConfig.SourceDir
+	}
+	sourcePath := filepath.Join(options.ProjectPath, sourceDir)
+
+	// The working dir is never copied into the container
+	files, err := util.ListFiles(sourcePath, []string{options.WorkingDir})
+	if err != nil {
+		return soft.Exit(err)
+	}
+	logger.Println("Artifact of pipeline", name, "if the steps don't write to $WERCKER_OUTPUT_DIR:")
+	printListedFiles(logger, files)
+
+	for _, step := range append(pipeline.Steps, pipeline.AfterSteps...) {
+		for _, p := range step.Artifacts {
+			if filepath.IsAbs(p) {
+				logger.Println("Step artifact", p, "of", step.ID, "only exists in the container")
+				continue
+			}
+			files, err := util.ListFiles(filepath.Join(sourcePath, p), nil)
+			if os.IsNotExist(err) {
+				logger.Println("Step artifact", p, "of", step.ID, "doesn't exist yet")
+				continue
+			}
+			if err != nil {
+				return soft.Exit(err)
+			}
+			logger.Println("Step artifact", p, "of", step.ID+":")
+			printListedFiles(logger, files)
 		}
 	}
-	if detected == "" {
-		logger.Println("No stack detected, generating default wercker.yml")
-		detected = "default"
+	return nil
+}
+
+func printListedFiles(logger *util.LogEntry, files []util.ListedFile) {
+	var total int64
+	for _, file := range files {
+		logger.Printf("  %10d  %s", file.Size, file.Path)
+		total += file.Size
+	}
+	logger.Printf("  %d files, %d bytes", len(files), total)
+}
+
+// cmdConfigDump writes the wercker.yml the way SetupEnvironment resolves it,
+// interpolated with the environment of the pipeline.
+func cmdConfigDump(options *core.PipelineOptions, dockerOptions *dockerlocal.DockerOptions, output string) error {
+	soft := NewSoftExit(options.GlobalOptions)
+
+	if options.Pipeline == "" {
+		options.Pipeline = "build"
+	}
+	ctx := core.NewEmitterContext(context.Background())
+	r, err := NewRunner(ctx, options, dockerOptions, GetBuildPipelineFactory(options.Pipeline))
+	if err != nil {
+		return soft.Exit(err)
+	}
+
+	// The source isn't copied, read the config from the project itself
+	werckerYml, werckerYaml, err := r.ReadConfig(options.ProjectPath)
+	if err != nil {
+		return soft.Exit(err)
+	}
+	rawConfig, err := core.ConfigFromFile(werckerYml, werckerYaml)
+	if err != nil {
+		return soft.Exit(err)
+	}
+	pipeline, err := r.GetPipeline(rawConfig)
+	if err != nil {
+		return soft.Exit(err)
+	}
+	pipeline.InitEnv(options.HostEnv)
+
+	b, err := core.DumpConfig(werckerYml, werckerYaml, pipeline.Env())
+	if err != nil {
+		return soft.Exit(err)
+	}
+	if output == "" {
+		_, err = os.Stdout.Write(b)
 	} else {
-		logger.Println("Detected:", detected)
-		logger.Println("Generating wercker.yml")
+		err = ioutil.WriteFile(output, b, 0644)
+	}
+	if err != nil {
+		return soft.Exit(err)
 	}
-	getYml(detected, options)
+	return nil
+}
+
+// cmdDeployTargets lists the deploy targets of all pipelines, these are the
+// valid values for --deploy-target.
+func cmdDeployTargets(options *core.PipelineOptions, outputJSON bool) error {
+	soft := NewSoftExit(options.GlobalOptions)
+	logger := util.RootLogger().WithField("Logger", "Main")
+
+	werckerYml := options.WerckerYml
+	var werckerYaml []byte
+	var err error
+	if werckerYml != "" {
+		werckerYaml, err = ioutil.ReadFile(werckerYml)
+	} else {
+		werckerYml, werckerYaml, err = core.ReadWerckerConfig([]string{"."})
+	}
+	if err != nil {
+		return soft.Exit(err)
+	}
+
+	rawConfig, err := core.ConfigFromFile(werckerYml, werckerYaml)
+	if err != nil {
+		return soft.Exit(err)
+	}
+
+	targets := rawConfig.DeployTargets()
+	if outputJSON {
+		b, err := json.MarshalIndent(targets, "", "  ")
+		if err != nil {
+			return soft.Exit(err)
+		}
+		os.Stdout.Write(b)
+		os.Stdout.WriteString("\n")
+		return nil
+	}
+
+	if len(targets) == 0 {
+		logger.Println("No deploy targets found in", werckerYml)
+		return nil
+	}
+	for _, target := range targets {
+		logger.Printf("%s (pipeline: %s, steps: %d)", target.Name, target.Pipeline, target.Steps)
+	}
+	return nil
+}
+
+// detectProject inspects the the current directory that wercker is running in
+// and detects the project's programming language
+func cmdDetect(options *core.DetectOptions) error {
+	soft := NewSoftExit(options.GlobalOptions)
+	logger := util.RootLogger().WithField("Logger", "Main")
+
+	if !options.OutputJSON {
+		logger.Println("########### Detecting your project! #############")
+	}
+
+	detection, err := core.DetectProject(".")
+	if err != nil {
+		logger.WithField("Error", err).Error("Unable to read directory")
+		return soft.Exit(err)
+	}
+
+	if options.OutputJSON {
+		b, err := json.MarshalIndent(detection, "", "  ")
+		if err != nil {
+			return soft.Exit(err)
+		}
+		os.Stdout.Write(b)
+		os.Stdout.WriteString("\n")
+	} else if detection.Detected == core.DetectedDefault {
+		logger.Println("No stack detected")
+	} else {
+		logger.Println("Detected:", detection.Detected, "from", strings.Join(detection.Markers, ", "))
+	}
+
+	if options.NoWrite {
+		return nil
+	}
+	if !options.OutputJSON {
+		if detection.Detected == core.DetectedDefault {
+			logger.Println("Generating default wercker.yml")
+		} else {
+			logger.Println("Generating wercker.yml")
+		}
+	}
+	getYml(detection.Detected, options)
 	return nil
 }
 
@@ -532,7 +997,10 @@ func cmdLogin(options *core.LoginOptions) error {
 	logger := util.RootLogger().WithField("Logger", "Main")
 
 	logger.Println("########### Logging into wercker! #############")
-	url := fmt.Sprintf("%s/api/1.0/%s", options.BaseURL, "oauth/basicauthaccesstoken")
+	url := options.LoginEndpoint
+	if url == "" {
+		url = fmt.Sprintf("%s/api/1.0/%s", options.BaseURL, "oauth/basicauthaccesstoken")
+	}
 
 	username := readUsername()
 	password := readPassword()
@@ -543,6 +1011,10 @@ func cmdLogin(options *core.LoginOptions) error {
 		return soft.Exit(err)
 	}
 
+	if options.TokenStorage == core.TokenStorageKeychain {
+		logger.Println("Saving token to the OS keychain")
+		return util.KeychainSet(core.KeychainService, options.BaseURL, token)
+	}
 	logger.Println("Saving token to: ", options.AuthTokenStore)
 	return saveToken(options.AuthTokenStore, token)
 }
@@ -553,7 +1025,12 @@ func cmdLogout(options *core.LogoutOptions) error {
 
 	logger.Println("Logging out")
 
-	err := removeToken(options.GlobalOptions.AuthTokenStore)
+	var err error
+	if options.TokenStorage == core.TokenStorageKeychain {
+		err = util.KeychainDelete(core.KeychainService, options.BaseURL)
+	} else {
+		err = removeToken(options.GlobalOptions.AuthTokenStore)
+	}
 	if err != nil {
 		return soft.Exit(err)
 	}
@@ -713,6 +1190,52 @@ func askForConfirmation() bool {
 
 // emitProgress will keep emitting progress until a value is send into the
 // returned channel.
+// cmdVerifyArtifact checks that an artifact matches its expected checksum and
+// is a well-formed, optionally gzipped, tarball.
+func cmdVerifyArtifact(options *core.VerifyArtifactOptions) error {
+	soft := NewSoftExit(options.GlobalOptions)
+	logger := util.RootLogger().WithField("Logger", "Main")
+
+	expected := options.Sha256
+	if options.Manifest != "" {
+		digest, err := util.ManifestDigest(options.Manifest, options.File)
+		if err != nil {
+			return soft.Exit(err)
+		}
+		expected = digest
+	}
+
+	if expected != "" {
+		calculated, err := util.FileSha256(options.File)
+		if err != nil {
+			return soft.Exit(err)
+		}
+		if calculated != expected {
+			return soft.Exit(fmt.Errorf("Calculated hash did not match expected hash (calculated: %s ; expected: %s)", calculated, expected))
+		}
+		logger.Println("Checksum OK:", calculated)
+	}
+
+	f, err := os.Open(options.File)
+	if err != nil {
+		return soft.Exit(err)
+	}
+	defer f.Close()
+
+	topLevel, err := util.VerifyTarball(f)
+	if err != nil {
+		return soft.Exit(fmt.Errorf("%s is not a valid archive: %s", options.File, err))
+	}
+	logger.Println("Archive OK:", options.File)
+
+	if options.List {
+		for _, name := range topLevel {
+			logger.Println(" ", name)
+		}
+	}
+	return nil
+}
+
 func emitProgress(counter *util.CounterReader, total int64, logger *util.Logger) chan<- bool {
 	stop := make(chan bool)
 	go func(stop chan bool, counter *util.CounterReader, total int64) {
@@ -826,7 +1349,7 @@ func DumpOptions(options interface{}, indent ...string) {
 	for i := 0; i < s.NumField(); i++ {
 		// f := s.Field(i)
 		fieldName := typeOfT.Field(i).Name
-		if fieldName != "HostEnv" {
+		if fieldName != "HostEnv" && fieldName != "Secrets" {
 			names = append(names, fieldName)
 		}
 	}
@@ -848,10 +1371,26 @@ func DumpOptions(options interface{}, indent ...string) {
 	}
 }
 
+// firstStepOrder is the order of the first step of a pipeline, step 1 is
+// "get code" and step 2 is "setup environment".
+const firstStepOrder = 3
+
+// newStepCounter numbers the steps of pipeline, the store step comes
+// between the steps and the after-steps.
+func newStepCounter(pipeline core.Pipeline) *util.Counter {
+	total := firstStepOrder + len(pipeline.Steps()) + len(pipeline.AfterSteps())
+	return &util.Counter{Current: firstStepOrder, Total: total}
+}
+
+// stepLabel renders a step as "[3/10] name" for the output.
+func stepLabel(counter *util.Counter, order int, step core.Step) string {
+	return fmt.Sprintf("[%d/%d] %s", order, counter.Total, step.DisplayName())
+}
+
 func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dockerOptions *dockerlocal.DockerOptions, getter pipelineGetter) (*RunnerShared, error) {
 	// Boilerplate
 	soft := NewSoftExit(options.GlobalOptions)
-	logger := util.RootLogger().WithField("Logger", "Main")
+	logger := util.RootLogger().WithField("Logger", "Main").WithFields(options.LogFields())
 	e, err := core.EmitterFromContext(cmdCtx)
 	if err != nil {
 		return nil, err
@@ -868,6 +1407,15 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 	mainTimer := util.NewTimer()
 	timer := util.NewTimer()
 
+	// The build timeout ends the session of the main steps, the after-steps
+	// get a new session and still run
+	buildCtx := cmdCtx
+	if options.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		buildCtx, cancel = context.WithTimeout(cmdCtx, time.Duration(options.BuildTimeout)*time.Millisecond)
+		defer cancel()
+	}
+
 	// These will be emitted at the end of the execution, we're going to be
 	// pessimistic and report that we failed, unless overridden at the end of the
 	// execution.
@@ -881,6 +1429,7 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 
 	// Debug information
 	DumpOptions(options)
+	util.SetCrashContext("pipeline", fmt.Sprintf("%s %s", options.Pipeline, options.PipelineID))
 
 	// Do some sanity checks before starting
 	err = dockerlocal.RequireDockerEndpoint(dockerOptions)
@@ -888,10 +1437,58 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 		return nil, soft.Exit(err)
 	}
 
+	// Creating the cancel file interrupts the build like a SIGINT would
+	if options.CancelFile != "" {
+		if _, err := os.Stat(options.CancelFile); err == nil {
+			err = fmt.Errorf("Cancel file %s already exists, remove it before starting a build", options.CancelFile)
+			e.Emit(core.Logs, &core.LogsArgs{
+				Stream: "stderr",
+				Logs:   err.Error() + "\n",
+			})
+			return nil, soft.Exit(err)
+		}
+		interval := time.Duration(options.CancelFileInterval) * time.Millisecond
+		stopCancelWatch := util.WatchCancelFile(options.CancelFile, interval, func() {
+			logger.Errorln(f.Fail("Build cancelled", options.CancelFile, "exists"))
+			util.GlobalSigint().Trigger()
+		})
+		defer stopCancelWatch()
+	}
+
+	// Find out about bad registry credentials now rather than after the build
+	if options.DryRunPush {
+		for _, repository := range options.PushRepositories() {
+			err = dockerlocal.CheckRegistryAuth(dockerOptions, repository, "", "")
+			if err != nil {
+				e.Emit(core.Logs, &core.LogsArgs{
+					Stream: "stderr",
+					Logs:   err.Error() + "\n",
+				})
+				return nil, soft.Exit(err)
+			}
+			logger.Println(f.Info("Registry credentials accepted", repository))
+		}
+		for _, registry := range options.Registries {
+			repository := registry.Repository(options.Repository)
+			err = dockerlocal.CheckRegistryAuth(dockerOptions, repository, registry.Username, registry.Password)
+			if err != nil {
+				e.Emit(core.Logs, &core.LogsArgs{
+					Stream: "stderr",
+					Logs:   err.Error() + "\n",
+				})
+				return nil, soft.Exit(err)
+			}
+			logger.Println(f.Info("Registry credentials accepted", repository))
+		}
+	}
+
 	// Start copying code
 	logger.Println(f.Info("Executing pipeline"))
 	timer.Reset()
-	_, err = r.EnsureCode()
+	projectDir, err := r.EnsureCode()
+	if err == nil && options.InputArtifact != "" {
+		err = r.FetchInputArtifact(projectDir)
+	}
 	if err != nil {
 		e.Emit(core.Logs, &core.LogsArgs{
 			Stream: "stderr",
@@ -903,11 +1500,28 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 		logger.Printf(f.Success("Copied working dir", timer.String()))
 	}
 
+	// Let the host prepare for the build before the box is started
+	if options.PrebuildScript != "" {
+		logger.Println(f.Info("Running prebuild script", options.PrebuildScript))
+		timer.Reset()
+		err = r.RunPrebuildScript(projectDir)
+		if err != nil {
+			e.Emit(core.Logs, &core.LogsArgs{
+				Stream: "stderr",
+				Logs:   err.Error() + "\n",
+			})
+			return nil, soft.Exit(err)
+		}
+		if options.Verbose {
+			logger.Printf(f.Success("Prebuild script passed", timer.String()))
+		}
+	}
+
 	// Setup environment is still a fairly special step, it needs
 	// to start our boxes and get everything set up
 	logger.Println(f.Info("Running step", "setup environment"))
 	timer.Reset()
-	shared, err := r.SetupEnvironment(cmdCtx)
+	shared, err := r.SetupEnvironment(buildCtx)
 	if shared.box != nil {
 		if options.ShouldRemove {
 			defer shared.box.Clean()
@@ -926,6 +1540,48 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 		logger.Printf(f.Success("Step passed", "setup environment", timer.String()))
 	}
 
+	// The first step is always the init step, a pipeline without any other
+	// steps usually means they got lost in the wercker.yml
+	if len(shared.pipeline.Steps()) <= 1 && !options.AllowEmptyPipeline {
+		err = fmt.Errorf("Pipeline %s has no steps, check the steps of %s in your wercker.yml or pass --allow-empty-pipeline", options.Pipeline, options.Pipeline)
+		e.Emit(core.Logs, &core.LogsArgs{
+			Stream: "stderr",
+			Logs:   err.Error() + "\n",
+		})
+		return nil, soft.Exit(err)
+	}
+
+	if options.ExplainEnv != "" {
+		r.ExplainEnvironment(shared.pipeline)
+	}
+
+	if options.DumpEnv != "" {
+		err = r.DumpEnvironment(shared.pipeline.Env())
+		if err != nil {
+			logger.WithField("Error", err).Warnln("Unable to dump environment")
+		}
+	}
+
+	// Store the prepared environment before any step touches it
+	if options.PreparedRepository != "" {
+		prepared := fmt.Sprintf("%s:%s", options.PreparedRepository, options.PreparedTag)
+		_, err = shared.box.Commit(options.PreparedRepository, options.PreparedTag, "Prepared environment")
+		if err != nil {
+			logger.Errorln("Failed to commit prepared environment:", err.Error())
+			return nil, soft.Exit(err)
+		}
+		logger.Println(f.Info("Committed prepared environment", prepared))
+
+		if options.ShouldPushPrepared {
+			err = shared.box.Push(cmdCtx, options.PreparedRepository, options.PreparedTag)
+			if err != nil {
+				logger.Errorln("Failed to push prepared environment:", err.Error())
+				return nil, soft.Exit(err)
+			}
+			logger.Println(f.Info("Pushed prepared environment", prepared))
+		}
+	}
+
 	// Expand our context object
 	box := shared.box
 	buildFinishedArgs.Box = box
@@ -934,7 +1590,7 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 	tag := pipeline.DockerTag()
 	message := pipeline.DockerMessage()
 
-	shouldStore := options.ShouldArtifacts
+	shouldStore := options.ShouldArtifacts && !options.NoStore
 
 	// TODO(termie): hack for now, probably can be made into a naive class
 	var storeStep core.Step
@@ -961,40 +1617,258 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 		FailedStepName:    "",
 		FailedStepMessage: "",
 	}
+	failedStepIndex := -1
 
-	// stepCounter starts at 3, step 1 is "get code", step 2 is "setup
-	// environment".
-	stepCounter := &util.Counter{Current: 3}
-	for _, step := range pipeline.Steps() {
-		logger.Printf(f.Info("Running step", step.DisplayName()))
+	resumeIndex := 0
+	if options.ResumeFrom != "" {
+		resumeIndex, err = core.FindResumeStep(pipeline.Steps(), options.ResumeFrom)
+		if err != nil {
+			return nil, soft.Exit(err)
+		}
+	}
+	if options.RetryFailedBuild {
+		resumeIndex, err = r.FindRetryStep(pipeline)
+		if err != nil {
+			return nil, soft.Exit(err)
+		}
+	}
+
+	stepCheckpoints, err := core.StepCheckpointsByIndex(pipeline.Steps(), options.StepCheckpoints)
+	if err != nil {
+		return nil, soft.Exit(err)
+	}
+
+	stepCounter := newStepCounter(pipeline)
+	for i, step := range pipeline.Steps() {
+		stepLogger := logger.WithField("step", step.DisplayName())
+		order := stepCounter.Increment()
+		label := stepLabel(stepCounter, order, step)
+
+		// With --resume-from the work of these steps is in the checkpoint the
+		// box starts from, --retry-failed-build skips them in a fresh box.
+		// The init step still needs to run to set up the new container
+		if i > 0 && i < resumeIndex {
+			stepLogger.Printf(f.Info("Skipping step", label))
+			continue
+		}
+
+		if !r.StepEnabled(pipeline.Env(), step) {
+			stepLogger.Printf(f.Info("Skipping step", label, "not enabled"))
+			continue
+		}
+
+		stepLogger.Printf(f.Info("Running step", label))
 		timer.Reset()
-		sr, err := r.RunStep(shared, step, stepCounter.Increment())
+		sr, err := r.RunStep(shared, step, order)
 		if err != nil {
 			pr.Success = false
 			pr.FailedStepName = step.DisplayName()
 			pr.FailedStepMessage = sr.Message
-			logger.Printf(f.Fail("Step failed", step.DisplayName(), timer.String()))
+			failedStepIndex = i
+			stepLogger.Printf(f.Fail("Step failed", label, timer.String()))
 			break
 		}
 
 		if options.Verbose {
-			logger.Printf(f.Success("Step passed", step.DisplayName(), timer.String()))
+			stepLogger.Printf(f.Success("Step passed", label, timer.String()))
+		}
+
+		// A --checkpoint-on-step also gets the regular checkpoint so the next
+		// step can be resumed from with --resume-from
+		if options.ShouldCheckpoint || len(stepCheckpoints[i]) > 0 {
+			checkpointTag := core.CheckpointTag(i, step)
+			_, err = box.Commit(core.CheckpointRepository(options), checkpointTag, fmt.Sprintf("Checkpoint after %s", step.DisplayName()))
+			if err != nil {
+				stepLogger.WithField("Error", err).Warnln("Unable to commit checkpoint", checkpointTag)
+			}
+		}
+
+		for _, checkpoint := range stepCheckpoints[i] {
+			name := fmt.Sprintf("%s:%s", checkpoint.Repository, checkpoint.Tag)
+			_, err = box.Commit(checkpoint.Repository, checkpoint.Tag, fmt.Sprintf("Checkpoint after %s", step.DisplayName()))
+			if err != nil {
+				stepLogger.WithField("Error", err).Warnln("Unable to commit checkpoint", name)
+				continue
+			}
+			stepLogger.Println(f.Info("Committed checkpoint", name))
+
+			if options.PushStepCheckpoints {
+				err = box.Push(cmdCtx, checkpoint.Repository, checkpoint.Tag)
+				if err != nil {
+					stepLogger.WithField("Error", err).Warnln("Unable to push checkpoint", name)
+					continue
+				}
+				stepLogger.Println(f.Info("Pushed checkpoint", name))
+			}
+		}
+	}
+
+	if err := r.WaitStepArtifacts(); err != nil && pr.Success {
+		pr.Success = false
+		pr.FailedStepName = "store step artifacts"
+		pr.FailedStepMessage = err.Error()
+	}
+
+	if buildCtx.Err() == context.DeadlineExceeded {
+		pr.Success = false
+		pr.FailedStepMessage = fmt.Sprintf("Build timed out after %s", time.Duration(options.BuildTimeout)*time.Millisecond)
+		logger.Errorln(pr.FailedStepMessage)
+		if options.UploadPartialOnTimeout {
+			logger.Println(f.Info("Storing partial artifacts"))
+			err = r.StorePartialArtifact(shared)
+			if err != nil {
+				logger.WithField("Error", err).Errorln("Unable to store partial artifacts")
+			}
 		}
 	}
 
 	if options.ShouldCommit {
+		if pr.Success {
+			box.SetResult("passed")
+		} else {
+			box.SetResult("failed")
+		}
+		if options.AnnotateCommit {
+			box.SetBuildInfo(core.NewBuildInfo(options, pipeline.Steps()))
+		}
 		_, err = box.Commit(repoName, tag, message)
 		if err != nil {
 			logger.Errorln("Failed to commit:", err.Error())
+		} else if pr.Success {
+			err = dockerlocal.CheckImageSize(dockerOptions, fmt.Sprintf("%s:%s", repoName, tag))
+			if err != nil {
+				logger.Errorln(err.Error())
+				box.SetResult("failed")
+				pr.Success = false
+				pr.FailedStepName = "store"
+				pr.FailedStepMessage = err.Error()
+			}
+		}
+		if err == nil && pr.Success {
+			err = dockerlocal.ScanImage(options, e, fmt.Sprintf("%s:%s", repoName, tag))
+			if err != nil {
+				logger.Errorln(err.Error())
+				box.SetResult("failed")
+				pr.Success = false
+				pr.FailedStepName = "scan image"
+				pr.FailedStepMessage = err.Error()
+			}
+		}
+
+		pushTags := append([]string{tag}, options.CommitTags...)
+		if err == nil && pr.Success && options.ShouldPush {
+			pushes := []func() error{}
+			for _, pushTag := range pushTags {
+				pushTag := pushTag
+				pushes = append(pushes, func() error {
+					err := box.Push(cmdCtx, repoName, pushTag)
+					if err == nil {
+						logger.Println(f.Info("Pushed", fmt.Sprintf("%s:%s", repoName, pushTag)))
+					}
+					return err
+				})
+			}
+			for _, pushErr := range dockerOptions.PushConcurrently(pushes) {
+				if pushErr != nil {
+					err = pushErr
+					logger.Errorln("Failed to push:", err.Error())
+					pr.Success = false
+					pr.FailedStepName = "push image"
+					pr.FailedStepMessage = err.Error()
+					break
+				}
+			}
+		}
+
+		// Push to the extra registries, one failing doesn't stop the others
+		if err == nil && pr.Success && len(options.Registries) > 0 {
+			pushes := []func() error{}
+			for _, registry := range options.Registries {
+				registry := registry
+				pushes = append(pushes, func() error {
+					for _, pushTag := range pushTags {
+						name, err := box.PushTo(cmdCtx, registry, repoName, pushTag)
+						if err != nil {
+							return err
+						}
+						logger.Println(f.Info("Pushed", fmt.Sprintf("%s:%s", name, pushTag)))
+					}
+					return nil
+				})
+			}
+			failed := []string{}
+			for i, pushErr := range dockerOptions.PushConcurrently(pushes) {
+				if pushErr != nil {
+					registry := options.Registries[i]
+					logger.Errorln("Failed to push to", registry.Address+":", pushErr.Error())
+					failed = append(failed, fmt.Sprintf("%s (%s)", registry.Address, pushErr))
+				}
+			}
+			if len(failed) > 0 {
+				pr.Success = false
+				pr.FailedStepName = "push image"
+				pr.FailedStepMessage = fmt.Sprintf("Failed to push to %d of %d registries: %s", len(failed), len(options.Registries), strings.Join(failed, ", "))
+			}
 		}
 	}
 
 	// We need to wind the counter to where it should be if we failed a step
-	// so that is the number of steps + get code + setup environment + store
 	// TODO(termie): remove all the this "order" stuff completely
-	stepCounter.Current = len(pipeline.Steps()) + 3
+	stepCounter.Current = len(pipeline.Steps()) + firstStepOrder
+
+	if options.NoStore {
+		logger.Println(f.Info("Skipping store step", "--no-store is set"))
+	}
 
-	if pr.Success && options.ShouldArtifacts {
+	defer func() {
+		if err := core.WriteRunStatus(options, pr, failedStepIndex); err != nil {
+			logger.WithField("Error", err).Warnln("Unable to write run status")
+		}
+	}()
+
+	// With --concurrent-upload the artifact uploads while the box restarts
+	// for the after-steps. The store step only covers collecting the
+	// artifact, a failed upload is reported when joining, before the result
+	// of the main steps is decided.
+	var uploadErr chan error
+	joinUpload := func() {
+		if uploadErr == nil {
+			return
+		}
+		err := <-uploadErr
+		uploadErr = nil
+		if err != nil {
+			logger.WithField("Error", err).Error("Unable to store pipeline output")
+			pr.Success = false
+			pr.FailedStepName = storeStep.Name()
+			pr.FailedStepMessage = "Unable to store pipeline output"
+		}
+	}
+	defer joinUpload()
+
+	restartBox := func() *RunnerShared {
+		// The container may have died, either way we'll have a fresh env
+		container, err := box.Restart()
+		if err != nil {
+			logger.Panicln(err)
+		}
+
+		newSessCtx, newSess, err := r.GetSession(cmdCtx, container.ID)
+		if err != nil {
+			logger.Panicln(err)
+		}
+
+		return &RunnerShared{
+			box:         shared.box,
+			pipeline:    shared.pipeline,
+			sess:        newSess,
+			sessionCtx:  newSessCtx,
+			containerID: shared.containerID,
+			config:      shared.config,
+		}
+	}
+
+	if pr.Success && shouldStore {
 		// At this point the build has effectively passed but we can still mess it
 		// up by being unable to deliver the artifacts
 
@@ -1017,6 +1891,13 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 			})
 
 			artifact, err := pipeline.CollectArtifact(shared.containerID)
+			if err == nil || err == util.ErrEmptyTarball {
+				if checkErr := r.CheckArtifact(artifact, err); checkErr != nil {
+					pr.FailedStepMessage = checkErr.Error()
+					return checkErr
+				}
+			}
+
 			// Ignore ErrEmptyTarball errors
 			if err != util.ErrEmptyTarball {
 				if err != nil {
@@ -1025,9 +1906,16 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 
 				if options.ShouldStoreS3 {
 					artificer := dockerlocal.NewArtificer(options, dockerOptions)
-					err = artificer.Upload(artifact)
-					if err != nil {
-						return err
+					if options.ConcurrentUpload && len(pipeline.AfterSteps()) > 0 {
+						uploadErr = make(chan error, 1)
+						go func() {
+							uploadErr <- artificer.Upload(artifact)
+						}()
+					} else {
+						err = artificer.Upload(artifact)
+						if err != nil {
+							return err
+						}
 					}
 				}
 
@@ -1051,6 +1939,13 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 		stepCounter.Increment()
 	}
 
+	var newShared *RunnerShared
+	if uploadErr != nil {
+		newShared = restartBox()
+		logger.Println(f.Info("Waiting for artifact upload"))
+		joinUpload()
+	}
+
 	// We're sending our build finished but we're not done yet,
 	// now is time to run after-steps if we have any
 	if pr.Success {
@@ -1089,47 +1984,41 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 	pipelineArgs.RanAfterSteps = true
 
 	logger.Println(f.Info("Starting after-steps"))
-	// The container may have died, either way we'll have a fresh env
-	container, err := box.Restart()
-	if err != nil {
-		logger.Panicln(err)
-	}
-
-	newSessCtx, newSess, err := r.GetSession(cmdCtx, container.ID)
-	if err != nil {
-		logger.Panicln(err)
-	}
-
-	newShared := &RunnerShared{
-		box:         shared.box,
-		pipeline:    shared.pipeline,
-		sess:        newSess,
-		sessionCtx:  newSessCtx,
-		containerID: shared.containerID,
-		config:      shared.config,
+	if newShared == nil {
+		newShared = restartBox()
 	}
 
 	// Set up the base environment
-	err = pipeline.ExportEnvironment(newSessCtx, newSess)
+	err = pipeline.ExportEnvironment(newShared.sessionCtx, newShared.sess)
 	if err != nil {
 		return nil, err
 	}
 
 	// Add the After-Step parts
-	err = pr.ExportEnvironment(newSessCtx, newSess)
+	err = pr.ExportEnvironment(newShared.sessionCtx, newShared.sess)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, step := range pipeline.AfterSteps() {
-		logger.Println(f.Info("Running after-step", step.DisplayName()))
+		stepLogger := logger.WithField("step", step.DisplayName())
+		order := stepCounter.Increment()
+		label := stepLabel(stepCounter, order, step)
+		if !r.StepEnabled(pipeline.Env(), step) {
+			stepLogger.Println(f.Info("Skipping after-step", label, "not enabled"))
+			continue
+		}
+		stepLogger.Println(f.Info("Running after-step", label))
 		timer.Reset()
-		_, err := r.RunStep(newShared, step, stepCounter.Increment())
+		_, err := r.RunStep(newShared, step, order)
 		if err != nil {
-			logger.Println(f.Fail("After-step failed", step.DisplayName(), timer.String()))
+			stepLogger.Println(f.Fail("After-step failed", label, timer.String()))
 			break
 		}
-		logger.Println(f.Success("After-step passed", step.DisplayName(), timer.String()))
+		stepLogger.Println(f.Success("After-step passed", label, timer.String()))
+	}
+	if err := r.WaitStepArtifacts(); err != nil {
+		logger.WithField("Error", err).Error("Unable to store after-step artifacts")
 	}
 
 	// We're about to end the build, so pull the cache and explode it
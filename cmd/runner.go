@@ -17,10 +17,18 @@ package cmd
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/joho/godotenv"
 	"github.com/pborman/uuid"
 	"github.com/termie/go-shutil"
 	"github.com/wercker/wercker/core"
@@ -84,6 +92,17 @@ type Runner struct {
 	logger        *util.LogEntry
 	emitter       *core.NormalizedEmitter
 	formatter     *util.Formatter
+
+	// Artifacts of steps with `collect: async`, collected in the background
+	stepArtifacts     sync.WaitGroup
+	stepArtifactsLock sync.Mutex
+	stepArtifactsErrs []string
+
+	// Listeners for the output of steps, see onStepLogs
+	stepLogsOnce      sync.Once
+	stepLogsLock      sync.Mutex
+	stepLogListeners  map[int]func(*core.LogsArgs)
+	stepLogListenerID int
 }
 
 // NewRunner from global options
@@ -92,7 +111,7 @@ func NewRunner(ctx context.Context, options *core.PipelineOptions, dockerOptions
 	if err != nil {
 		return nil, err
 	}
-	logger := util.RootLogger().WithField("Logger", "Runner")
+	logger := util.RootLogger().WithField("Logger", "Runner").WithFields(options.LogFields())
 	// h, err := NewLogHandler()
 	// if err != nil {
 	//   p.logger.WithField("Error", err).Panic("Unable to LogHandler")
@@ -114,11 +133,52 @@ func NewRunner(ctx context.Context, options *core.PipelineOptions, dockerOptions
 	if options.ShouldKeenMetrics {
 		mh, err = event.NewMetricsHandler(options)
 		if err != nil {
-			logger.WithField("Error", err).Panic("Unable to MetricsHandler")
+			logger.WithField("Error", err).Infoln("Unable to MetricsHandler, metrics disabled")
+			mh = nil
+		} else {
+			mh.ListenTo(e)
+		}
+	}
+
+	if options.SummaryJSON != "" {
+		sh, err := event.NewSummaryHandler(options.SummaryJSON)
+		if err != nil {
+			logger.WithField("Error", err).Panic("Unable to event.SummaryHandler")
 		}
+		sh.ListenTo(e)
+	}
+
+	if options.PrintMetadata {
+		mh := event.NewMetadataHandler(os.Stdout)
 		mh.ListenTo(e)
 	}
 
+	if options.AnnotationFormat != "" {
+		ah := event.NewAnnotationHandler(options.AnnotationFormat, os.Stdout)
+		ah.ListenTo(e)
+	}
+
+	if options.NotifyWebhook != "" {
+		wh := event.NewWebhookHandler(options.NotifyWebhook, options.NotifyOn)
+		wh.ListenTo(e)
+	}
+
+	if options.LogServer != "" {
+		ls, err := event.NewLogServer(options.LogServer)
+		if err != nil {
+			return nil, err
+		}
+		ls.ListenTo(e)
+	}
+
+	if options.OTLPEndpoint != "" {
+		th, err := event.NewTraceHandler(options.OTLPEndpoint, options.OTLPLogs)
+		if err != nil {
+			return nil, err
+		}
+		th.ListenTo(e)
+	}
+
 	var r *event.ReportHandler
 	if options.ShouldReport {
 		r, err := event.NewReportHandler(options.ReporterHost, options.ReporterKey)
@@ -143,10 +203,12 @@ func NewRunner(ctx context.Context, options *core.PipelineOptions, dockerOptions
 
 // ProjectDir returns the directory where we expect to find the code for this project
 func (p *Runner) ProjectDir() string {
-	if p.options.DirectMount {
+	if p.options.DirectMount || p.options.SkipCheckout {
 		return p.options.ProjectPath
 	}
-	return fmt.Sprintf("%s/%s", p.options.ProjectDownloadPath(), p.options.ApplicationID)
+	// Every run gets its own copy, so runs of the same project can happen at
+	// the same time without moving the source out from under each other
+	return fmt.Sprintf("%s/%s/%s", p.options.ProjectDownloadPath(), p.options.ApplicationID, p.options.PipelineID)
 }
 
 // EnsureCode makes sure the code is in the ProjectDir.
@@ -157,7 +219,12 @@ func (p *Runner) ProjectDir() string {
 // with the local dir.
 func (p *Runner) EnsureCode() (string, error) {
 	projectDir := p.ProjectDir()
-	if p.options.DirectMount {
+	if p.options.FailOnDirtySource && p.options.ProjectURL == "" && p.options.SourceArchive == "" {
+		if err := checkCleanSource(p.options.ProjectPath, p.options.WorkingDir); err != nil {
+			return projectDir, err
+		}
+	}
+	if p.options.DirectMount || p.options.SkipCheckout {
 		return projectDir, nil
 	}
 
@@ -171,6 +238,11 @@ func (p *Runner) EnsureCode() (string, error) {
 		if err != nil {
 			return projectDir, err
 		}
+	} else if p.options.SourceArchive != "" {
+		err := p.extractSourceArchive(projectDir)
+		if err != nil {
+			return projectDir, err
+		}
 	} else {
 		// We were pointed at a path with ProjectPath, copy it to projectDir
 
@@ -223,25 +295,187 @@ func (p *Runner) EnsureCode() (string, error) {
 	return projectDir, nil
 }
 
-// GetConfig parses and returns the wercker.yml file.
-func (p *Runner) GetConfig() (*core.Config, string, error) {
+// extractSourceArchive checks that the --source-archive is a complete tarball
+// and extracts it as the project dir.
+func (p *Runner) extractSourceArchive(projectDir string) error {
+	source := p.options.SourceArchive
+	p.logger.Debugln("Extracting source archive:", source)
+
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := util.VerifyTarball(f); err != nil {
+		return fmt.Errorf("Invalid source archive %s: %s", source, err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+
+	os.Rename(projectDir, fmt.Sprintf("%s-%s", projectDir, uuid.NewRandom().String()))
+	if err := util.ExtractTarball(projectDir, f); err != nil {
+		return fmt.Errorf("Unable to extract source archive %s: %s", source, err)
+	}
+	return nil
+}
+
+// FetchInputArtifact extracts the --input-artifact, a URL or a local path,
+// into the project dir so the steps start with the output of an earlier
+// build.
+func (p *Runner) FetchInputArtifact(projectDir string) error {
+	source := p.options.InputArtifact
+	p.logger.Debugln("Fetching input artifact:", source)
+
+	var r io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := util.FetchTarball(source)
+		if err != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return err
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	target := filepath.Join(projectDir, p.options.InputArtifactDir)
+	if err := util.ExtractTarball(target, r); err != nil {
+		return fmt.Errorf("Unable to extract input artifact %s: %s", source, err)
+	}
+	return nil
+}
+
+// logsWriter emits everything written to it as Logs on a stream.
+type logsWriter struct {
+	emitter *core.NormalizedEmitter
+	stream  string
+}
+
+func (w *logsWriter) Write(p []byte) (int, error) {
+	w.emitter.Emit(core.Logs, &core.LogsArgs{
+		Stream: w.stream,
+		Logs:   string(p),
+	})
+	return len(p), nil
+}
+
+// RunPrebuildScript runs the --prebuild-script on the host in projectDir,
+// with the build metadata added to the host environment.
+func (p *Runner) RunPrebuildScript(projectDir string) error {
+	cmd := exec.Command(p.options.PrebuildScript)
+	cmd.Dir = projectDir
+	cmd.Env = append(os.Environ(), p.options.PrebuildEnv(projectDir)...)
+	cmd.Stdout = &logsWriter{emitter: p.emitter, stream: "stdout"}
+	cmd.Stderr = &logsWriter{emitter: p.emitter, stream: "stderr"}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Prebuild script %s failed: %s", p.options.PrebuildScript, err)
+	}
+	return nil
+}
+
+// checkCleanSource returns an error if path is inside a git working tree that
+// has uncommitted changes. Paths outside of a git working tree are ignored,
+// as is our own workingDir when it is inside the working tree.
+func checkCleanSource(path, workingDir string) error {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return fmt.Errorf("git is required for --fail-on-dirty-source: %s", err)
+	}
+
+	cmd := exec.Command(git, "rev-parse", "--is-inside-work-tree")
+	cmd.Dir = path
+	if err := cmd.Run(); err != nil {
+		// Not a git checkout, nothing to check
+		return nil
+	}
+
+	pathspecs := []string{":/"}
+	if rel, ok := relativeSubdir(path, workingDir); ok {
+		pathspecs = append(pathspecs, ":(exclude)"+filepath.ToSlash(rel))
+	}
+
+	var out bytes.Buffer
+	cmd = exec.Command(git, append([]string{"status", "--porcelain", "--"}, pathspecs...)...)
+	cmd.Dir = path
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if dirty := strings.TrimSpace(out.String()); dirty != "" {
+		return fmt.Errorf("Source directory %s has uncommitted changes:\n%s", path, dirty)
+	}
+	return nil
+}
+
+// relativeSubdir returns dir relative to path if it is inside path.
+func relativeSubdir(path, dir string) (string, bool) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(absPath, absDir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// ReadConfig returns the name and the contents of the wercker.yml file in
+// projectDir, with the --config-overlay applied.
+func (p *Runner) ReadConfig(projectDir string) (string, []byte, error) {
 	// Return a []byte of the yaml we find or create.
 	var werckerYaml []byte
 	var err error
-	if p.options.WerckerYml != "" {
-		werckerYaml, err = ioutil.ReadFile(p.options.WerckerYml)
+	werckerYml := p.options.WerckerYml
+	if werckerYml != "" {
+		werckerYaml, err = ioutil.ReadFile(werckerYml)
 		if err != nil {
-			return nil, "", err
+			return "", nil, err
 		}
 	} else {
-		werckerYaml, err = core.ReadWerckerYaml([]string{p.ProjectDir()}, false)
+		werckerYml, werckerYaml, err = core.ReadWerckerConfig([]string{projectDir})
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	if p.options.ConfigOverlay != "" {
+		overlay, err := ioutil.ReadFile(p.options.ConfigOverlay)
 		if err != nil {
-			return nil, "", err
+			return "", nil, err
 		}
+		werckerYaml, err = core.ApplyConfigOverlay(werckerYml, werckerYaml, overlay)
+		if err != nil {
+			return "", nil, err
+		}
+		// The result is always yaml
+		werckerYml = "wercker.yml"
+	}
+	return werckerYml, werckerYaml, nil
+}
+
+// GetConfig parses and returns the wercker.yml file.
+func (p *Runner) GetConfig() (*core.Config, string, error) {
+	werckerYml, werckerYaml, err := p.ReadConfig(p.ProjectDir())
+	if err != nil {
+		return nil, "", err
 	}
 
 	// Parse that bad boy.
-	rawConfig, err := core.ConfigFromYaml(werckerYaml)
+	rawConfig, err := core.ConfigFromFile(werckerYml, werckerYaml)
 	if err != nil {
 		return nil, "", err
 	}
@@ -370,6 +604,7 @@ type RunnerShared struct {
 
 // StartStep emits BuildStepStarted and returns a Finisher for the end event.
 func (p *Runner) StartStep(ctx *RunnerShared, step core.Step, order int) *util.Finisher {
+	util.SetCrashContext("step", fmt.Sprintf("%d %s", order, step.DisplayName()))
 	p.emitter.Emit(core.BuildStepStarted, &core.BuildStepStartedArgs{
 		Box:   ctx.box,
 		Step:  step,
@@ -381,11 +616,17 @@ func (p *Runner) StartStep(ctx *RunnerShared, step core.Step, order int) *util.F
 		if r.Artifact != nil {
 			artifactURL = r.Artifact.URL()
 		}
+		artifactURLs := []string{}
+		for _, artifact := range r.Artifacts {
+			artifactURLs = append(artifactURLs, artifact.URL())
+		}
 		p.emitter.Emit(core.BuildStepFinished, &core.BuildStepFinishedArgs{
 			Box:                 ctx.box,
 			Successful:          r.Success,
 			Message:             r.Message,
 			ArtifactURL:         artifactURL,
+			ArtifactURLs:        artifactURLs,
+			Annotations:         r.Annotations,
 			PackageURL:          r.PackageURL,
 			WerckerYamlContents: r.WerckerYamlContents,
 		})
@@ -418,6 +659,136 @@ func (p *Runner) StartFullPipeline(options *core.PipelineOptions) *util.Finisher
 	})
 }
 
+// DumpEnvironment writes the pipeline environment to the --dump-env path.
+func (p *Runner) DumpEnvironment(env *util.Environment) error {
+	lines := env.DotEnv(p.options.DumpEnvUnmasked)
+	if !p.options.DumpEnvUnmasked {
+		for i, line := range lines {
+			lines[i] = p.options.MaskSecrets(line)
+		}
+	}
+	content := strings.Join(lines, "\n") + "\n"
+	return ioutil.WriteFile(p.options.DumpEnv, []byte(content), 0600)
+}
+
+// ExplainEnvironment logs where the value of the --explain-env variable comes
+// from. The step env_files are listed last, they only apply to their step.
+func (p *Runner) ExplainEnvironment(pipeline core.Pipeline) {
+	key := p.options.ExplainEnv
+	lines := core.ExplainEnv(key, pipeline.EnvSources(p.options.HostEnv))
+
+	steps := append(append([]core.Step{}, pipeline.Steps()...), pipeline.AfterSteps()...)
+	for _, step := range steps {
+		envFileEnv, err := p.ReadStepEnvFile(step)
+		if err != nil {
+			p.logger.WithField("Error", err).Warnln("Unable to read env_file")
+			continue
+		}
+		for _, pair := range envFileEnv {
+			if pair[0] == key {
+				lines = append(lines, fmt.Sprintf("  env_file of step %s: %s=%s", step.DisplayName(), key, pair[1]))
+			}
+		}
+	}
+
+	p.logger.Println(fmt.Sprintf("Environment variable %s:", key))
+	for _, line := range lines {
+		p.logger.Println(p.options.MaskSecrets(line))
+	}
+}
+
+// FindRetryStep returns the index of the step that failed in the previous
+// run, for --retry-failed-build. If it passed or failed outside of the main
+// steps everything runs again.
+func (p *Runner) FindRetryStep(pipeline core.Pipeline) (int, error) {
+	status, err := core.ReadRunStatus(p.options)
+	if err != nil {
+		return 0, err
+	}
+	if status.Success {
+		p.logger.Warnln("The previous run passed, running all steps")
+		return 0, nil
+	}
+	index, err := status.RetryStep(pipeline.Steps())
+	if err != nil {
+		p.logger.Warnln(fmt.Sprintf("The previous run failed in %s, running all steps", status.FailedStepName))
+		return 0, nil
+	}
+	p.logger.Println(fmt.Sprintf("Retrying from %s, the step that failed in the previous run", status.FailedStepName))
+	return index, nil
+}
+
+// CheckArtifact guards against storing an empty or suspiciously small
+// artifact. Depending on the options it fails or only warns.
+func (p *Runner) CheckArtifact(artifact *core.Artifact, collectErr error) error {
+	if !p.options.FailOnEmptyArtifact && !p.options.WarnOnEmptyArtifact {
+		return nil
+	}
+
+	var err error
+	if collectErr == util.ErrEmptyTarball {
+		err = fmt.Errorf("Artifact contains no files")
+	} else {
+		err = dockerlocal.CheckArtifact(artifact, p.options.MinArtifactSize)
+	}
+	if err == nil {
+		return nil
+	}
+
+	if p.options.FailOnEmptyArtifact {
+		return err
+	}
+	p.logger.WithField("Error", err).Warnln("Artifact looks empty, check the output directory")
+	return nil
+}
+
+// FetchBox fetches the box image, failing if it takes longer than the
+// configured box pull timeout.
+func (p *Runner) FetchBox(runnerCtx context.Context, box core.Box, env *util.Environment) error {
+	if p.options.BoxPullTimeout <= 0 {
+		_, err := box.Fetch(runnerCtx, env)
+		return err
+	}
+
+	timeout := time.Duration(p.options.BoxPullTimeout) * time.Millisecond
+	pullCtx, cancel := context.WithTimeout(runnerCtx, timeout)
+	defer cancel()
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := box.Fetch(pullCtx, env)
+		errChan <- err
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-pullCtx.Done():
+		// If the runner context is done the build itself was stopped or
+		// timed out, that takes precedence over our own deadline
+		if runnerCtx.Err() != nil {
+			return runnerCtx.Err()
+		}
+		return fmt.Errorf("box pull timed out after %s", timeout)
+	}
+}
+
+// checkLatestTag warns about or, with --forbid-latest-tag, refuses a box
+// without a pinned tag. The box defaults to latest when it has no tag.
+func (p *Runner) checkLatestTag(box core.Box) error {
+	if box.GetTag() != "latest" {
+		return nil
+	}
+	if p.options.ForbidLatestTag {
+		return fmt.Errorf("Box %s uses the latest tag, which is forbidden by --forbid-latest-tag. Pin the box to a specific tag.", box.GetName())
+	}
+	if p.options.WarnOnLatestTag {
+		f := &util.Formatter{p.options.GlobalOptions.ShowColors}
+		p.logger.Warnln(f.Fail("Warning", fmt.Sprintf("Box %s uses the latest tag, builds may change when the image is updated. Pin the box to a specific tag.", box.GetName())))
+	}
+	return nil
+}
+
 // SetupEnvironment does a lot of boilerplate legwork and returns a pipeline,
 // box, and session. This is a bit of a long method, but it is pretty much
 // the entire "Setup Environment" step.
@@ -478,7 +849,11 @@ func (p *Runner) SetupEnvironment(runnerCtx context.Context) (*RunnerShared, err
 	// Fetch the box
 	timer.Reset()
 	box := pipeline.Box()
-	_, err = box.Fetch(runnerCtx, pipeline.Env())
+	if err := p.checkLatestTag(box); err != nil {
+		sr.Message = err.Error()
+		return shared, err
+	}
+	err = p.FetchBox(runnerCtx, box, pipeline.Env())
 	if err != nil {
 		sr.Message = err.Error()
 		return shared, err
@@ -603,18 +978,422 @@ func (p *Runner) SetupEnvironment(runnerCtx context.Context) (*RunnerShared, err
 	return shared, nil
 }
 
+// SetupExistingContainer loads the pipeline and attaches a session to a
+// container that was prepared by an earlier run, starting it if needed.
+func (p *Runner) SetupExistingContainer(runnerCtx context.Context, containerID string) (*RunnerShared, error) {
+	shared := &RunnerShared{}
+
+	rawConfig, _, err := p.GetConfig()
+	if err != nil {
+		return shared, err
+	}
+	shared.config = rawConfig
+
+	pipeline, err := p.GetPipeline(rawConfig)
+	if err != nil {
+		return shared, err
+	}
+	pipeline.InitEnv(p.options.HostEnv)
+	shared.pipeline = pipeline
+
+	client, err := dockerlocal.NewDockerClient(p.dockerOptions)
+	if err != nil {
+		return shared, err
+	}
+	container, err := client.InspectContainer(containerID)
+	if err != nil {
+		return shared, err
+	}
+	if !container.State.Running {
+		p.logger.Debugln("Starting container:", container.ID)
+		err = client.StartContainer(container.ID, nil)
+		if err != nil {
+			return shared, err
+		}
+	}
+	shared.containerID = container.ID
+
+	// Steps with an image, network: none or a timeout need the box
+	box := pipeline.Box()
+	box.UseContainer(container)
+	shared.box = box
+
+	sessionCtx, sess, err := p.GetSession(runnerCtx, container.ID)
+	if err != nil {
+		return shared, err
+	}
+	shared.sess = sess
+	shared.sessionCtx = sessionCtx
+
+	err = pipeline.ExportEnvironment(sessionCtx, sess)
+	if err != nil {
+		return shared, err
+	}
+
+	return shared, nil
+}
+
 // StepResult holds the info we need to report on steps
 type StepResult struct {
 	Success             bool
 	Artifact            *core.Artifact
+	Artifacts           []*core.Artifact
+	Annotations         []*core.Annotation
 	PackageURL          string
 	Message             string
 	ExitCode            int
 	WerckerYamlContents string
 }
 
+// ReadStepEnvFile reads the dotenv file configured for a step with
+// `env_file`. Relative paths are resolved against the project source.
+func (p *Runner) ReadStepEnvFile(step core.Step) ([][]string, error) {
+	envFile := step.EnvFile()
+	if envFile == "" {
+		return nil, nil
+	}
+
+	if !filepath.IsAbs(envFile) {
+		envFile = filepath.Join(p.ProjectDir(), p.options.SourceDir, envFile)
+	}
+
+	m, err := godotenv.Read(envFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read env_file for step %s: %s", step.DisplayName(), err)
+	}
+
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	env := [][]string{}
+	for _, k := range keys {
+		env = append(env, []string{k, m[k]})
+	}
+	return env, nil
+}
+
+// StepEnabled evaluates the `enabled` expression of step against env plus its
+// env_file, like the environment the step runs in. A failure to read the
+// env_file is left for RunStep to report.
+func (p *Runner) StepEnabled(env *util.Environment, step core.Step) bool {
+	stepEnv := util.NewEnvironment()
+	stepEnv.Update(env.Ordered())
+	stepEnv.Hidden = env.Hidden
+	if envFileEnv, err := p.ReadStepEnvFile(step); err == nil {
+		stepEnv.Update(envFileEnv)
+	}
+	return step.IsEnabled(stepEnv)
+}
+
+// ResetStepEnv restores the variables loaded from a step's env_file to their
+// pipeline values, or unsets them if the pipeline doesn't define them.
+func (p *Runner) ResetStepEnv(shared *RunnerShared, env [][]string) error {
+	pipelineEnv := shared.pipeline.Env()
+	cmds := []string{}
+	for _, pair := range env {
+		key := pair[0]
+		if value, ok := pipelineEnv.Map[key]; ok {
+			cmds = append(cmds, fmt.Sprintf(`export %s=%q`, key, value))
+		} else if value, ok := pipelineEnv.Hidden.Map[key]; ok {
+			cmds = append(cmds, fmt.Sprintf(`export %s=%q`, key, value))
+		} else {
+			cmds = append(cmds, fmt.Sprintf(`unset %s`, key))
+		}
+	}
+	_, _, err := shared.sess.SendChecked(shared.sessionCtx, cmds...)
+	return err
+}
+
+// SetupStepContainer starts the container for a step that overrides the box
+// image and prepares it like the box: the guest is set up with the source,
+// cache and output dirs of the box and the pipeline environment is exported.
+// The returned RunnerShared points at the step container.
+func (p *Runner) SetupStepContainer(shared *RunnerShared, step core.Step) (*RunnerShared, error) {
+	container, err := shared.box.RunStepContainer(shared.sessionCtx, shared.pipeline.Env(), step)
+	if err != nil {
+		return nil, err
+	}
+
+	stepShared := &RunnerShared{
+		box:         shared.box,
+		pipeline:    shared.pipeline,
+		config:      shared.config,
+		containerID: container.ID,
+	}
+
+	sessionCtx, sess, err := p.GetSession(shared.sessionCtx, container.ID)
+	if err != nil {
+		shared.box.RemoveStepContainer(container.ID)
+		return nil, err
+	}
+	stepShared.sess = sess
+	stepShared.sessionCtx = sessionCtx
+
+	err = shared.pipeline.SetupGuest(sessionCtx, sess)
+	if err == nil {
+		err = shared.box.CopyGuestDirs(shared.containerID, container.ID)
+	}
+	if err == nil {
+		err = shared.pipeline.ExportEnvironment(sessionCtx, sess)
+	}
+	if err != nil {
+		shared.box.RemoveStepContainer(container.ID)
+		return nil, err
+	}
+
+	return stepShared, nil
+}
+
+// partialArtifactTimeout bounds collecting and uploading the artifact of a
+// timed out build.
+const partialArtifactTimeout = 5 * time.Minute
+
+// StorePartialArtifact collects whatever the timed out build left in the
+// output dir and uploads it, marked as partial.
+func (p *Runner) StorePartialArtifact(shared *RunnerShared) error {
+	errs := make(chan error, 1)
+	go func() {
+		artifact, err := shared.pipeline.CollectArtifact(shared.containerID)
+		if err != nil {
+			errs <- err
+			return
+		}
+		partial := "true"
+		if artifact.Meta == nil {
+			artifact.Meta = map[string]*string{}
+		}
+		artifact.Meta["Partial"] = &partial
+
+		if p.options.ShouldStoreS3 {
+			artificer := dockerlocal.NewArtificer(p.options, p.dockerOptions)
+			err = artificer.Upload(artifact)
+			if err != nil {
+				errs <- err
+				return
+			}
+			p.logger.Println("Partial artifact stored at", artifact.URL())
+		}
+		errs <- nil
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(partialArtifactTimeout):
+		return fmt.Errorf("Timed out storing partial artifact after %s", partialArtifactTimeout)
+	}
+}
+
+// onStepLogs calls f with the output of step, its input is left out. The
+// returned func stops listening.
+func (p *Runner) onStepLogs(step core.Step, f func(args *core.LogsArgs)) func() {
+	// The emitter tells listeners apart by their code, so it can't remove one
+	// of the closures made here while others are listening. It gets a single
+	// listener that passes the output on instead.
+	p.stepLogsOnce.Do(func() {
+		p.emitter.AddListener(core.Logs, p.dispatchStepLogs)
+	})
+
+	p.stepLogsLock.Lock()
+	defer p.stepLogsLock.Unlock()
+	if p.stepLogListeners == nil {
+		p.stepLogListeners = make(map[int]func(*core.LogsArgs))
+	}
+	p.stepLogListenerID++
+	id := p.stepLogListenerID
+	p.stepLogListeners[id] = func(args *core.LogsArgs) {
+		if args.Stream == "stdin" || args.Step != step {
+			return
+		}
+		f(args)
+	}
+	return func() {
+		p.stepLogsLock.Lock()
+		defer p.stepLogsLock.Unlock()
+		delete(p.stepLogListeners, id)
+	}
+}
+
+func (p *Runner) dispatchStepLogs(args *core.LogsArgs) {
+	p.stepLogsLock.Lock()
+	listeners := make([]func(*core.LogsArgs), 0, len(p.stepLogListeners))
+	for _, listener := range p.stepLogListeners {
+		listeners = append(listeners, listener)
+	}
+	p.stepLogsLock.Unlock()
+
+	for _, listener := range listeners {
+		listener(args)
+	}
+}
+
+// stepLogNameRe matches the characters we don't want in step log file names
+var stepLogNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// TeeStepLogs writes the visible output of step to its own file in
+// StepLogDir, until the returned func is called.
+func (p *Runner) TeeStepLogs(step core.Step, order int) (func(), error) {
+	if err := os.MkdirAll(p.options.StepLogDir, 0755); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%02d-%s.log", order, stepLogNameRe.ReplaceAllString(step.DisplayName(), "-"))
+	f, err := os.Create(filepath.Join(p.options.StepLogDir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	var l sync.Mutex
+	stop := p.onStepLogs(step, func(args *core.LogsArgs) {
+		if args.Hidden {
+			return
+		}
+		l.Lock()
+		defer l.Unlock()
+		f.WriteString(args.Logs)
+	})
+
+	return func() {
+		stop()
+		l.Lock()
+		defer l.Unlock()
+		f.Close()
+	}, nil
+}
+
+// failureOutputLines is the amount of output lines of a failed step passed to
+// the --failure-message-template
+const failureOutputLines = 10
+
+// failureOutputLineLength is the amount of bytes kept of the end of each of
+// those lines, output without newlines can go on for a long time.
+const failureOutputLineLength = 1000
+
+func truncateTailLine(line string) string {
+	if len(line) > failureOutputLineLength {
+		return line[len(line)-failureOutputLineLength:]
+	}
+	return line
+}
+
+// stepTail keeps the last lines of the visible output of a step.
+type stepTail struct {
+	l       sync.Mutex
+	max     int
+	lines   []string
+	partial string
+}
+
+func (t *stepTail) add(logs string) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	parts := strings.Split(t.partial+logs, "\n")
+	t.partial = truncateTailLine(parts[len(parts)-1])
+	for _, line := range parts[:len(parts)-1] {
+		t.lines = append(t.lines, truncateTailLine(line))
+	}
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// Lines returns the last lines, including an unterminated last one.
+func (t *stepTail) Lines() []string {
+	t.l.Lock()
+	defer t.l.Unlock()
+	lines := append([]string{}, t.lines...)
+	if t.partial != "" {
+		lines = append(lines, t.partial)
+	}
+	if len(lines) > t.max {
+		lines = lines[len(lines)-t.max:]
+	}
+	return lines
+}
+
+// tailStepLogs keeps the last n lines of the visible output of step, until
+// the returned func is called.
+func (p *Runner) tailStepLogs(step core.Step, n int) (*stepTail, func()) {
+	tail := &stepTail{max: n}
+	stop := p.onStepLogs(step, func(args *core.LogsArgs) {
+		if !args.Hidden {
+			tail.add(args.Logs)
+		}
+	})
+	return tail, stop
+}
+
+// watchStepOutput returns a context that is cancelled once the step has
+// produced no output for the step working timeout. Unlike the no response
+// timeout this spans all of the step's commands. The returned function stops
+// watching and reports whether the step was considered hung.
+func (p *Runner) watchStepOutput(ctx context.Context, step core.Step) (context.Context, func() bool) {
+	timeout := time.Duration(p.options.StepWorkingTimeout) * time.Millisecond
+	watchCtx, cancel := context.WithCancel(ctx)
+	var lock sync.Mutex
+	hung := false
+	timer := time.AfterFunc(timeout, func() {
+		lock.Lock()
+		hung = true
+		lock.Unlock()
+		cancel()
+	})
+	stop := p.onStepLogs(step, func(args *core.LogsArgs) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !hung {
+			timer.Reset(timeout)
+		}
+	})
+	return watchCtx, func() bool {
+		stop()
+		timer.Stop()
+		cancel()
+		lock.Lock()
+		defer lock.Unlock()
+		return hung
+	}
+}
+
+// collectStepArtifactsAsync collects and uploads the `artifacts` of step on a
+// goroutine, for steps with `collect: async`. WaitStepArtifacts joins it.
+func (p *Runner) collectStepArtifactsAsync(step core.Step, containerID string) {
+	p.stepArtifacts.Add(1)
+	go func() {
+		defer p.stepArtifacts.Done()
+		artificer := dockerlocal.NewArtificer(p.options, p.dockerOptions)
+		artifacts, err := artificer.CollectStepArtifacts(step, containerID)
+		if err == nil && p.options.ShouldStoreS3 {
+			err = artificer.UploadAll(artifacts)
+		}
+		if err != nil {
+			p.logger.WithField("Error", err).Errorln("Unable to store artifacts of", step.DisplayName())
+			p.stepArtifactsLock.Lock()
+			p.stepArtifactsErrs = append(p.stepArtifactsErrs, fmt.Sprintf("%s: %s", step.DisplayName(), err))
+			p.stepArtifactsLock.Unlock()
+		}
+	}()
+}
+
+// WaitStepArtifacts waits for the step artifacts that are collected in the
+// background and returns their failures as one error.
+func (p *Runner) WaitStepArtifacts() error {
+	p.stepArtifacts.Wait()
+	p.stepArtifactsLock.Lock()
+	defer p.stepArtifactsLock.Unlock()
+	if len(p.stepArtifactsErrs) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("Unable to store step artifacts: %s", strings.Join(p.stepArtifactsErrs, "; "))
+	p.stepArtifactsErrs = nil
+	return err
+}
+
 // RunStep runs a step and tosses error if it fails
 func (p *Runner) RunStep(shared *RunnerShared, step core.Step, order int) (*StepResult, error) {
+	logger := p.logger.WithField("step", step.DisplayName())
 	finisher := p.StartStep(shared, step, order)
 	sr := &StepResult{
 		Success:  false,
@@ -624,24 +1403,151 @@ func (p *Runner) RunStep(shared *RunnerShared, step core.Step, order int) (*Step
 	}
 	defer finisher.Finish(sr)
 
+	// Runs before the finisher, so the step finished event gets the message
+	if p.options.FailureMessageTemplate != "" {
+		tail, stopTail := p.tailStepLogs(step, failureOutputLines)
+		defer func() {
+			stopTail()
+			if sr.Success {
+				return
+			}
+			message, err := p.options.FailureMessage(&core.FailureMessageData{
+				Step:     step.DisplayName(),
+				ExitCode: sr.ExitCode,
+				Message:  sr.Message,
+				Output:   tail.Lines(),
+			})
+			if err != nil {
+				logger.WithField("Error", err).Warn("Unable to render --failure-message-template")
+				return
+			}
+			sr.Message = message
+		}()
+	}
+
+	if p.options.StepLogDir != "" {
+		closeLog, err := p.TeeStepLogs(step, order)
+		if err != nil {
+			sr.Message = err.Error()
+			return sr, err
+		}
+		defer closeLog()
+	}
+
 	if step.ShouldSyncEnv() {
 		err := shared.pipeline.SyncEnvironment(shared.sessionCtx, shared.sess)
 		if err != nil {
 			// If an error occured, just log and ignore it
-			p.logger.WithField("Error", err).Warn("Unable to sync environment")
+			logger.WithField("Error", err).Warn("Unable to sync environment")
+		}
+	}
+
+	// Steps with their own image run in a separate container
+	var boxShared *RunnerShared
+	if step.Image() != "" {
+		stepShared, err := p.SetupStepContainer(shared, step)
+		if err != nil {
+			sr.Message = err.Error()
+			return sr, err
+		}
+		defer shared.box.RemoveStepContainer(stepShared.containerID)
+		boxShared = shared
+		shared = stepShared
+	}
+
+	if core.StepNetwork(step, p.options) == core.StepNetworkNone {
+		reconnect, err := shared.box.DisconnectNetworks(shared.containerID)
+		if err != nil {
+			sr.Message = err.Error()
+			return sr, err
 		}
+		defer func() {
+			if err := reconnect(); err != nil {
+				logger.WithField("Error", err).Warn("Unable to reconnect container to its networks")
+			}
+		}()
 	}
 
 	step.InitEnv(shared.pipeline.Env())
-	p.logger.Debugln("Step Environment")
+
+	envFileEnv, err := p.ReadStepEnvFile(step)
+	if err != nil {
+		sr.Message = err.Error()
+		return sr, err
+	}
+	if len(envFileEnv) > 0 {
+		step.Env().Update(envFileEnv)
+		// Make sure the env_file variables don't leak into later steps
+		defer func() {
+			err := p.ResetStepEnv(shared, envFileEnv)
+			if err != nil {
+				logger.WithField("Error", err).Warn("Unable to reset step environment")
+			}
+		}()
+	}
+
+	logger.Debugln("Step Environment")
 	for _, pair := range step.Env().Ordered() {
-		p.logger.Debugln(" ", pair[0], pair[1])
+		logger.Debugln(" ", pair[0], pair[1])
+	}
+
+	// Steps with a cache_key are skipped when they succeeded before with the
+	// same inputs, their outputs are restored instead
+	var stepCache *core.StepCache
+	var cacheKey string
+	if len(step.CacheKey()) > 0 {
+		stepCache = core.NewStepCache(p.options.StepCachePath())
+		cacheKey, err = stepCache.Key(step, shared.box.GetImageID(), p.options.HostPath("source", p.options.SourceDir))
+		if err != nil {
+			sr.Message = err.Error()
+			return sr, err
+		}
+		if stepCache.Hit(cacheKey) {
+			// The outputs are for the steps after this one, so they go
+			// straight to the box
+			restoreID := shared.containerID
+			if boxShared != nil {
+				restoreID = boxShared.containerID
+			}
+			artificer := dockerlocal.NewArtificer(p.options, p.dockerOptions)
+			err = artificer.RestoreStepCache(stepCache, cacheKey, step, restoreID)
+			if err == nil {
+				p.emitter.Emit(core.Logs, &core.LogsArgs{
+					Logs: fmt.Sprintf("Skipping step, its cache_key inputs are unchanged (%s)\n", cacheKey[:12]),
+				})
+				sr.Success = true
+				sr.ExitCode = 0
+				return sr, nil
+			}
+			logger.WithField("Error", err).Warnln("Unable to restore cached step outputs, running the step")
+		}
 	}
 
-	exit, err := step.Execute(shared.sessionCtx, shared.sess)
+	execCtx := shared.sessionCtx
+	stopWatching := func() bool { return false }
+	if p.options.StepWorkingTimeout > 0 {
+		execCtx, stopWatching = p.watchStepOutput(execCtx, step)
+	}
+	exit, err := step.Execute(execCtx, shared.sess)
+	if stopWatching() {
+		err = core.ErrStepWorkingTimeout
+	}
+	if err == core.ErrCommandTimeout || err == core.ErrNoResponseTimeout || err == core.ErrStepWorkingTimeout {
+		logger.Warnln("Step timed out, terminating it with a grace period of", p.options.StepTimeoutGrace, "seconds")
+		if termErr := shared.box.TerminateStep(shared.containerID); termErr != nil {
+			logger.WithField("Error", termErr).Warn("Unable to terminate timed out step")
+		}
+	}
+	// The steps after this one continue with what the step container left
+	if boxShared != nil {
+		copyErr := shared.box.CopyGuestDirs(shared.containerID, boxShared.containerID)
+		if copyErr != nil && err == nil {
+			err = copyErr
+		}
+	}
 	if exit != 0 {
 		sr.ExitCode = exit
-		if p.options.AttachOnError {
+		if p.options.AttachOnError && shared.box != nil {
 			shared.box.RecoverInteractive(
 				p.options.SourcePath(),
 				shared.pipeline,
@@ -663,6 +1569,22 @@ func (p *Runner) RunStep(shared *RunnerShared, step core.Step, order int) (*Step
 	}
 	sr.Message = message.String()
 
+	var annotations bytes.Buffer
+	annotationsErr := step.CollectFile(shared.containerID, step.ReportPath(), "annotations", &annotations)
+	if annotationsErr != nil && annotationsErr != util.ErrEmptyTarball {
+		return sr, annotationsErr
+	}
+	if annotations.Len() > 0 {
+		parsed, parseErr := core.ParseAnnotations(&annotations)
+		if parseErr != nil {
+			logger.WithField("Error", parseErr).Warnln("Unable to read step annotations")
+		}
+		sr.Annotations = parsed
+		for _, annotation := range sr.Annotations {
+			annotation.Step = step.DisplayName()
+		}
+	}
+
 	// This is the error from the step.Execute above
 	if err != nil {
 		if sr.Message == "" {
@@ -671,6 +1593,13 @@ func (p *Runner) RunStep(shared *RunnerShared, step core.Step, order int) (*Step
 		return sr, err
 	}
 
+	if stepCache != nil && sr.Success {
+		artificer := dockerlocal.NewArtificer(p.options, p.dockerOptions)
+		if cacheErr := artificer.SaveStepCache(stepCache, cacheKey, step, shared.containerID); cacheErr != nil {
+			logger.WithField("Error", cacheErr).Warnln("Unable to cache step result")
+		}
+	}
+
 	// Grab artifacts if we want them
 	if p.options.ShouldArtifacts {
 		artifact, err := step.CollectArtifact(shared.containerID)
@@ -686,6 +1615,25 @@ func (p *Runner) RunStep(shared *RunnerShared, step core.Step, order int) (*Step
 			}
 		}
 		sr.Artifact = artifact
+
+		// The container of a step with its own image is removed when we
+		// return, so those can't be collected in the background
+		if len(step.Artifacts()) > 0 && step.CollectAsync() && step.Image() == "" {
+			p.collectStepArtifactsAsync(step, shared.containerID)
+		} else if len(step.Artifacts()) > 0 {
+			artificer := dockerlocal.NewArtificer(p.options, p.dockerOptions)
+			artifacts, err := artificer.CollectStepArtifacts(step, shared.containerID)
+			if err != nil {
+				return sr, err
+			}
+			if p.options.ShouldStoreS3 {
+				err = artificer.UploadAll(artifacts)
+				if err != nil {
+					return sr, err
+				}
+			}
+			sr.Artifacts = artifacts
+		}
 	}
 
 	if !sr.Success {
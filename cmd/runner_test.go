@@ -0,0 +1,141 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+)
+
+type RunnerSuite struct {
+	*util.TestSuite
+}
+
+func TestRunnerSuite(t *testing.T) {
+	suiteTester := &RunnerSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *RunnerSuite) TestCheckCleanSource() {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		s.T().Skip("git not available, skipping test")
+	}
+	repo := s.WorkingDir()
+	runGit := func(args ...string) {
+		cmd := exec.Command(git, append([]string{"-c", "user.name=wercker", "-c", "user.email=wercker@example.com"}, args...)...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		s.Nil(err, string(out))
+	}
+	runGit("init", "-q")
+	s.Nil(ioutil.WriteFile(filepath.Join(repo, "main.go"), []byte("package main\n"), 0644))
+	runGit("add", "main.go")
+	runGit("commit", "-q", "-m", "initial")
+
+	// The working dir of a previous run isn't a change
+	workingDir := filepath.Join(repo, ".wercker")
+	s.Nil(os.MkdirAll(workingDir, 0755))
+	s.Nil(ioutil.WriteFile(filepath.Join(workingDir, "wercker.log"), nil, 0644))
+	s.Error(checkCleanSource(repo, filepath.Join(repo, "other")))
+	s.Nil(checkCleanSource(repo, workingDir))
+
+	s.Nil(ioutil.WriteFile(filepath.Join(repo, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644))
+	s.Error(checkCleanSource(repo, workingDir))
+}
+
+func (s *RunnerSuite) TestStepEnabled() {
+	dir, err := ioutil.TempDir("", "wercker-")
+	s.Require().Nil(err)
+	defer os.RemoveAll(dir)
+	envFile := filepath.Join(dir, "integration.env")
+	s.Nil(ioutil.WriteFile(envFile, []byte("RUN_INTEGRATION=1\n"), 0644))
+	newStep := func(envFile string) core.Step {
+		step, err := core.NewStep(&core.StepConfig{ID: "script", Enabled: "$RUN_INTEGRATION", EnvFile: envFile}, core.EmptyPipelineOptions())
+		s.Require().Nil(err)
+		return step
+	}
+	r := &Runner{options: core.EmptyPipelineOptions()}
+
+	// Host variables reach the pipeline env through the passthru
+	hostEnv := util.NewEnvironment("RUN_INTEGRATION=1")
+	env := util.NewEnvironment()
+	env.Update(hostEnv.GetPassthru().Ordered())
+	s.False(r.StepEnabled(env, newStep("")))
+
+	hostEnv = util.NewEnvironment("X_RUN_INTEGRATION=1")
+	env.Update(hostEnv.GetPassthru().Ordered())
+	s.True(r.StepEnabled(env, newStep("")))
+
+	// The env_file of the step counts, but doesn't change env
+	env = util.NewEnvironment()
+	s.True(r.StepEnabled(env, newStep(envFile)))
+	s.Equal("", env.Get("RUN_INTEGRATION"))
+
+	env.Hidden = util.NewEnvironment("RUN_INTEGRATION=yes")
+	s.True(r.StepEnabled(env, newStep("")))
+}
+
+func (s *RunnerSuite) TestOnStepLogs() {
+	r := &Runner{emitter: core.NewNormalizedEmitter()}
+	newStep := func(name string) core.Step {
+		step, err := core.NewStep(&core.StepConfig{ID: "script", Name: name}, core.EmptyPipelineOptions())
+		s.Require().Nil(err)
+		return step
+	}
+	compile, test := newStep("compile"), newStep("test")
+
+	var tee, tail, other []string
+	stopTee := r.onStepLogs(compile, func(args *core.LogsArgs) { tee = append(tee, args.Logs) })
+	stopTail := r.onStepLogs(compile, func(args *core.LogsArgs) { tail = append(tail, args.Logs) })
+	stopOther := r.onStepLogs(test, func(args *core.LogsArgs) { other = append(other, args.Logs) })
+	defer stopOther()
+
+	r.emitter.Emit(core.Logs, &core.LogsArgs{Step: compile, Logs: "make\n", Stream: "stdin"})
+	r.emitter.Emit(core.Logs, &core.LogsArgs{Step: compile, Logs: "compiling\n"})
+	// Stopping one listener leaves the others made the same way alone
+	stopTee()
+	r.emitter.Emit(core.Logs, &core.LogsArgs{Step: compile, Logs: "done\n"})
+	stopTail()
+	r.emitter.Emit(core.Logs, &core.LogsArgs{Step: compile, Logs: "late\n"})
+
+	s.Equal([]string{"compiling\n"}, tee)
+	s.Equal([]string{"compiling\n", "done\n"}, tail)
+	s.Empty(other)
+}
+
+func (s *RunnerSuite) TestStepTail() {
+	tail := &stepTail{max: 2}
+	tail.add("one\ntw")
+	tail.add("o\nthree\nfou")
+	s.Equal([]string{"three", "fou"}, tail.Lines())
+
+	// Output without newlines only keeps the end of the line
+	for i := 0; i < 1000; i++ {
+		tail.add(strings.Repeat("=", 100))
+	}
+	tail.add("> 100%")
+	lines := tail.Lines()
+	s.Len(lines[1], failureOutputLineLength)
+	s.True(strings.HasSuffix(lines[1], "=> 100%"))
+}
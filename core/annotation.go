@@ -0,0 +1,130 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Formats for --annotation-format
+const (
+	AnnotationFormatJSON   = "json"
+	AnnotationFormatGitHub = "github"
+)
+
+// Annotation points at a location in the source with a message, for CI
+// systems to show inline. Steps write them to $WERCKER_REPORT_ANNOTATIONS_FILE.
+type Annotation struct {
+	Step    string `json:"step,omitempty"`
+	Level   string `json:"level"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// ParseAnnotations reads annotations, one per line. A line is either a JSON
+// object or a GitHub workflow command like
+// `::error file=main.go,line=10,col=2::message`. Blank lines are skipped.
+func ParseAnnotations(r io.Reader) ([]*Annotation, error) {
+	annotations := []*Annotation{}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var a *Annotation
+		var err error
+		if strings.HasPrefix(line, "::") {
+			a, err = parseGitHubAnnotation(line)
+		} else {
+			a = &Annotation{}
+			err = json.Unmarshal([]byte(line), a)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid annotation on line %d: %s", lineNumber, err)
+		}
+		if a.Level == "" {
+			a.Level = "error"
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, scanner.Err()
+}
+
+func parseGitHubAnnotation(line string) (*Annotation, error) {
+	parts := strings.SplitN(line[2:], "::", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected ::level params::message")
+	}
+	a := &Annotation{Message: parts[1]}
+	command := strings.SplitN(parts[0], " ", 2)
+	a.Level = command[0]
+	if len(command) == 1 {
+		return a, nil
+	}
+	for _, param := range strings.Split(command[1], ",") {
+		pair := strings.SplitN(param, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid parameter %q", param)
+		}
+		var err error
+		switch strings.TrimSpace(pair[0]) {
+		case "file":
+			a.File = pair[1]
+		case "line":
+			a.Line, err = strconv.Atoi(pair[1])
+		case "col":
+			a.Column, err = strconv.Atoi(pair[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter %q", param)
+		}
+	}
+	return a, nil
+}
+
+// FormatAnnotation renders a as a single line in format.
+func FormatAnnotation(a *Annotation, format string) string {
+	if format == AnnotationFormatGitHub {
+		params := []string{}
+		if a.File != "" {
+			params = append(params, fmt.Sprintf("file=%s", a.File))
+		}
+		if a.Line > 0 {
+			params = append(params, fmt.Sprintf("line=%d", a.Line))
+		}
+		if a.Column > 0 {
+			params = append(params, fmt.Sprintf("col=%d", a.Column))
+		}
+		command := a.Level
+		if len(params) > 0 {
+			command = fmt.Sprintf("%s %s", command, strings.Join(params, ","))
+		}
+		// Newlines would end the workflow command
+		message := strings.Replace(a.Message, "\n", "%0A", -1)
+		return fmt.Sprintf("::%s::%s", command, message)
+	}
+	b, _ := json.Marshal(a)
+	return string(b)
+}
@@ -0,0 +1,61 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type AnnotationSuite struct {
+	*util.TestSuite
+}
+
+func TestAnnotationSuite(t *testing.T) {
+	suiteTester := &AnnotationSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *AnnotationSuite) TestParseAnnotations() {
+	input := `{"file": "main.go", "line": 10, "message": "undefined: foo"}
+
+::warning file=util.go,line=3,col=7::unused variable
+::error::tests failed
+`
+	annotations, err := ParseAnnotations(strings.NewReader(input))
+	s.Require().Nil(err)
+	s.Require().Len(annotations, 3)
+
+	s.Equal(&Annotation{Level: "error", File: "main.go", Line: 10, Message: "undefined: foo"}, annotations[0])
+	s.Equal(&Annotation{Level: "warning", File: "util.go", Line: 3, Column: 7, Message: "unused variable"}, annotations[1])
+	s.Equal(&Annotation{Level: "error", Message: "tests failed"}, annotations[2])
+}
+
+func (s *AnnotationSuite) TestParseAnnotationsInvalid() {
+	_, err := ParseAnnotations(strings.NewReader("not an annotation\n"))
+	s.Error(err)
+
+	_, err = ParseAnnotations(strings.NewReader("::error line=ten::message\n"))
+	s.Error(err)
+}
+
+func (s *AnnotationSuite) TestFormatAnnotation() {
+	a := &Annotation{Level: "error", File: "main.go", Line: 10, Message: "undefined: foo\nin main"}
+	s.Equal("::error file=main.go,line=10::undefined: foo%0Ain main", FormatAnnotation(a, AnnotationFormatGitHub))
+	s.Equal(`{"level":"error","file":"main.go","line":10,"message":"undefined: foo\nin main"}`, FormatAnnotation(a, AnnotationFormatJSON))
+}
@@ -28,12 +28,23 @@ type BoxOptions struct {
 type Box interface {
 	GetName() string
 	GetTag() string
+	GetImageID() string
 	Clean() error
 	Stop()
 	Commit(string, string, string) (*docker.Image, error)
+	SetResult(string)
+	SetBuildInfo(*BuildInfo)
+	Push(context.Context, string, string) error
+	PushTo(context.Context, *PushRegistry, string, string) (string, error)
+	RunStepContainer(context.Context, *util.Environment, Step) (*docker.Container, error)
+	RemoveStepContainer(string) error
+	CopyGuestDirs(string, string) error
+	TerminateStep(string) error
+	DisconnectNetworks(string) (func() error, error)
 	Restart() (*docker.Container, error)
 	AddService(ServiceBox)
 	Fetch(context.Context, *util.Environment) (*docker.Image, error)
 	Run(context.Context, *util.Environment) (*docker.Container, error)
+	UseContainer(*docker.Container)
 	RecoverInteractive(string, Pipeline, Step) error
 }
@@ -0,0 +1,71 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// BuildInfoEnv is the env var of the committed image that --annotate-commit
+// puts the build info in.
+const BuildInfoEnv = "WERCKER_BUILD_INFO"
+
+// BuildInfo is the provenance of a committed image, kept small so it fits
+// in the image config.
+type BuildInfo struct {
+	BuildID    string `json:"buildId,omitempty"`
+	DeployID   string `json:"deployId,omitempty"`
+	PipelineID string `json:"pipelineId,omitempty"`
+	Pipeline   string `json:"pipeline,omitempty"`
+	GitCommit  string `json:"gitCommit,omitempty"`
+	GitBranch  string `json:"gitBranch,omitempty"`
+	StepsHash  string `json:"stepsHash,omitempty"`
+}
+
+// NewBuildInfo describes the build of options that runs steps.
+func NewBuildInfo(options *PipelineOptions, steps []Step) *BuildInfo {
+	info := &BuildInfo{
+		BuildID:    options.BuildID,
+		DeployID:   options.DeployID,
+		PipelineID: options.PipelineID,
+		Pipeline:   options.Pipeline,
+		StepsHash:  StepsHash(steps),
+	}
+	if options.GitOptions != nil {
+		info.GitCommit = options.GitCommit
+		info.GitBranch = options.GitBranch
+	}
+	return info
+}
+
+// StepsHash is the hex encoded sha256 of the names, versions and display
+// names of steps, in order. It changes when a step is added, removed,
+// reordered or upgraded.
+func StepsHash(steps []Step) string {
+	h := sha256.New()
+	for _, step := range steps {
+		fmt.Fprintf(h, "%s/%s@%s %s\n", step.Owner(), step.Name(), step.Version(), step.DisplayName())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// JSON returns the build info as compact JSON.
+func (i *BuildInfo) JSON() string {
+	b, _ := json.Marshal(i)
+	return string(b)
+}
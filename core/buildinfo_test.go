@@ -0,0 +1,56 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type BuildInfoSuite struct {
+	*util.TestSuite
+}
+
+func TestBuildInfoSuite(t *testing.T) {
+	suiteTester := &BuildInfoSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *BuildInfoSuite) TestBuildInfo() {
+	options := &PipelineOptions{
+		GitOptions: &GitOptions{GitCommit: "abc123", GitBranch: "master"},
+		BuildID:    "build-1",
+		Pipeline:   "build",
+	}
+	steps := []Step{
+		checkpointTestStep("install", "script"),
+		checkpointTestStep("test", "script"),
+	}
+
+	info := NewBuildInfo(options, steps)
+	decoded := map[string]string{}
+	s.Nil(json.Unmarshal([]byte(info.JSON()), &decoded))
+	s.Equal("build-1", decoded["buildId"])
+	s.Equal("abc123", decoded["gitCommit"])
+	s.Equal(StepsHash(steps), decoded["stepsHash"])
+	_, hasDeployID := decoded["deployId"]
+	s.False(hasDeployID)
+
+	reordered := []Step{steps[1], steps[0]}
+	s.NotEqual(StepsHash(steps), StepsHash(reordered))
+}
@@ -0,0 +1,150 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var checkpointInvalidChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// checkpointName makes s safe to use in a Docker repository name or tag.
+func checkpointName(s string) string {
+	s = checkpointInvalidChars.ReplaceAllString(strings.ToLower(s), "-")
+	return strings.Trim(s, "-_.")
+}
+
+// CheckpointRepository returns the local Docker repository checkpoints for
+// this application and pipeline are committed to.
+func CheckpointRepository(options *PipelineOptions) string {
+	return checkpointName(fmt.Sprintf("wercker-checkpoint-%s-%s", options.ApplicationName, options.Pipeline))
+}
+
+// IsCheckpointRepository returns whether name is the repository of the
+// checkpoints or of a --checkpoint-on-step, images that need to outlive the
+// run.
+func (o *PipelineOptions) IsCheckpointRepository(name string) bool {
+	if name == CheckpointRepository(o) {
+		return true
+	}
+	for _, checkpoint := range o.StepCheckpoints {
+		if name == checkpoint.Repository {
+			return true
+		}
+	}
+	return false
+}
+
+// StepCheckpointsByIndex matches the --checkpoint-on-step steps to the index
+// of the first step in steps with that name.
+func StepCheckpointsByIndex(steps []Step, checkpoints []*StepCheckpoint) (map[int][]*StepCheckpoint, error) {
+	byIndex := make(map[int][]*StepCheckpoint)
+	for _, checkpoint := range checkpoints {
+		index, err := FindResumeStep(steps, checkpoint.Step)
+		if err != nil {
+			return nil, fmt.Errorf("No step named %s to checkpoint after", checkpoint.Step)
+		}
+		byIndex[index] = append(byIndex[index], checkpoint)
+	}
+	return byIndex, nil
+}
+
+// CheckpointTag returns the tag of the checkpoint committed after the step at
+// index in the pipeline's steps.
+func CheckpointTag(index int, step Step) string {
+	tag := fmt.Sprintf("%d-%s", index, checkpointName(step.DisplayName()))
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
+}
+
+// FindResumeStep returns the index of the first step in steps matching name,
+// either by display name or by step name.
+func FindResumeStep(steps []Step, name string) (int, error) {
+	for i, step := range steps {
+		if step.DisplayName() == name || step.Name() == name {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("No step named %s to resume from", name)
+}
+
+// RunStatus is what is remembered about the last run of a pipeline, so the
+// next run can retry the step that failed with --retry-failed-build.
+type RunStatus struct {
+	Pipeline       string `json:"pipeline"`
+	Success        bool   `json:"success"`
+	FailedStepName string `json:"failedStepName,omitempty"`
+	// FailedStepIndex is the index of the failed step in the main steps, -1
+	// if the run failed outside of them.
+	FailedStepIndex int `json:"failedStepIndex"`
+}
+
+// RetryStep returns the index of the main step that failed in the run. Display
+// names don't have to be unique, so the step is found by its index and only
+// retried if it still has the same display name.
+func (s *RunStatus) RetryStep(steps []Step) (int, error) {
+	i := s.FailedStepIndex
+	if s.Success || i < 0 || i >= len(steps) || steps[i].DisplayName() != s.FailedStepName {
+		return -1, fmt.Errorf("No step %s at %d to retry", s.FailedStepName, i)
+	}
+	return i, nil
+}
+
+// RunStatusPath returns where the status of the last run of this pipeline
+// is stored.
+func RunStatusPath(options *PipelineOptions) string {
+	return options.WorkingPath(fmt.Sprintf("last-run-%s.json", checkpointName(options.Pipeline)))
+}
+
+// WriteRunStatus stores the outcome of the main steps of this run,
+// failedStepIndex is -1 unless one of them failed.
+func WriteRunStatus(options *PipelineOptions, pr *PipelineResult, failedStepIndex int) error {
+	b, err := json.MarshalIndent(&RunStatus{
+		Pipeline:        options.Pipeline,
+		Success:         pr.Success,
+		FailedStepName:  pr.FailedStepName,
+		FailedStepIndex: failedStepIndex,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(options.WorkingDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(RunStatusPath(options), b, 0644)
+}
+
+// ReadRunStatus reads the status of the last run of this pipeline.
+func ReadRunStatus(options *PipelineOptions) (*RunStatus, error) {
+	b, err := ioutil.ReadFile(RunStatusPath(options))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("No previous run of %s to retry", options.Pipeline)
+		}
+		return nil, err
+	}
+	status := &RunStatus{}
+	if err := json.Unmarshal(b, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
@@ -0,0 +1,129 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type CheckpointSuite struct {
+	*util.TestSuite
+}
+
+func TestCheckpointSuite(t *testing.T) {
+	suiteTester := &CheckpointSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func checkpointTestStep(displayName, name string) Step {
+	return &ExternalStep{
+		BaseStep: NewBaseStep(BaseStepOptions{
+			DisplayName: displayName,
+			Name:        name,
+		}),
+	}
+}
+
+func (s *CheckpointSuite) TestCheckpointRepository() {
+	options := &PipelineOptions{ApplicationName: "My App", Pipeline: "build"}
+	s.Equal("wercker-checkpoint-my-app-build", CheckpointRepository(options))
+}
+
+func (s *CheckpointSuite) TestCheckpointTag() {
+	step := checkpointTestStep("go test ./...", "script")
+	s.Equal("3-go-test", CheckpointTag(3, step))
+}
+
+func (s *CheckpointSuite) TestFindResumeStep() {
+	steps := []Step{
+		checkpointTestStep("wercker-init", "wercker-init"),
+		checkpointTestStep("install", "script"),
+		checkpointTestStep("test", "script"),
+	}
+
+	index, err := FindResumeStep(steps, "test")
+	s.Nil(err)
+	s.Equal(2, index)
+
+	index, err = FindResumeStep(steps, "script")
+	s.Nil(err)
+	s.Equal(1, index)
+
+	_, err = FindResumeStep(steps, "deploy")
+	s.Error(err)
+}
+
+func (s *CheckpointSuite) TestStepCheckpointsByIndex() {
+	steps := []Step{
+		checkpointTestStep("wercker-init", "wercker-init"),
+		checkpointTestStep("install", "script"),
+		checkpointTestStep("test", "script"),
+	}
+	deps := &StepCheckpoint{Step: "install", Repository: "app-deps", Tag: "latest"}
+
+	byIndex, err := StepCheckpointsByIndex(steps, []*StepCheckpoint{deps})
+	s.Nil(err)
+	s.Equal([]*StepCheckpoint{deps}, byIndex[1])
+	s.Equal(0, len(byIndex[2]))
+
+	_, err = StepCheckpointsByIndex(steps, []*StepCheckpoint{{Step: "deploy", Repository: "app", Tag: "latest"}})
+	s.Error(err)
+}
+
+func (s *CheckpointSuite) TestRunStatus() {
+	options := &PipelineOptions{Pipeline: "build", WorkingDir: s.WorkingDir()}
+
+	_, err := ReadRunStatus(options)
+	s.Error(err)
+
+	err = WriteRunStatus(options, &PipelineResult{Success: false, FailedStepName: "test"}, 2)
+	s.Require().Nil(err)
+
+	status, err := ReadRunStatus(options)
+	s.Require().Nil(err)
+	s.Equal(&RunStatus{Pipeline: "build", Success: false, FailedStepName: "test", FailedStepIndex: 2}, status)
+}
+
+func (s *CheckpointSuite) TestRunStatusRetryStep() {
+	steps := []Step{}
+	for _, name := range []string{"setup", "test", "test", "deploy"} {
+		step, err := NewStep(&StepConfig{ID: "script", Name: name}, EmptyPipelineOptions())
+		s.Require().Nil(err)
+		steps = append(steps, step)
+	}
+
+	// The second step with the same display name failed
+	status := &RunStatus{FailedStepName: "test", FailedStepIndex: 2}
+	index, err := status.RetryStep(steps)
+	s.Nil(err)
+	s.Equal(2, index)
+
+	// The steps changed since the run
+	status = &RunStatus{FailedStepName: "lint", FailedStepIndex: 2}
+	_, err = status.RetryStep(steps)
+	s.Error(err)
+
+	// Failed outside of the main steps
+	status = &RunStatus{FailedStepName: "store", FailedStepIndex: -1}
+	_, err = status.RetryStep(steps)
+	s.Error(err)
+
+	status = &RunStatus{Success: true, FailedStepIndex: -1}
+	_, err = status.RetryStep(steps)
+	s.Error(err)
+}
@@ -15,12 +15,17 @@
 package core
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/BurntSushi/toml"
 	"github.com/wercker/wercker/util"
 	"gopkg.in/yaml.v2"
 )
@@ -43,6 +48,14 @@ type BoxConfig struct {
 	Entrypoint string
 	URL        string
 	Volumes    string
+	// Inherits names a box in the top level boxes section to take the
+	// properties this box doesn't set from
+	Inherits string
+	// ReadyPort and ReadyCommand are the readiness check of a service, the
+	// steps don't start before something listens on the port or the command
+	// exits with 0 in the service container
+	ReadyPort    int    `yaml:"ready-port"`
+	ReadyCommand string `yaml:"ready-command"`
 }
 
 // IsExternal tells us if the box (service) is located on disk
@@ -68,10 +81,18 @@ type RawStepConfig struct {
 
 // StepConfig holds our step configs
 type StepConfig struct {
-	ID   string
-	Cwd  string
-	Name string
-	Data map[string]string
+	ID        string
+	Cwd       string
+	Name      string
+	EnvFile   string
+	Image     string
+	DependsOn []string
+	Artifacts []string
+	CacheKey  []string
+	Enabled   string
+	Network   string
+	Collect   string
+	Data      map[string]string
 }
 
 // ifaceToString takes a value from yaml and makes it a string (currently
@@ -95,6 +116,27 @@ func ifaceToString(dataValue interface{}) string {
 	}
 }
 
+// ifaceToStringMap takes a map value from yaml and converts its values with
+// ifaceToString. Returns an empty map if dataValue is not a map.
+func ifaceToStringMap(dataValue interface{}) map[string]string {
+	m := make(map[string]string)
+	switch v := dataValue.(type) {
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			m[ifaceToString(key)] = ifaceToString(value)
+		}
+	case map[string]interface{}:
+		for key, value := range v {
+			m[key] = ifaceToString(value)
+		}
+	case yaml.MapSlice:
+		for _, item := range v {
+			m[ifaceToString(item.Key)] = ifaceToString(item.Value)
+		}
+	}
+	return m
+}
+
 // UnmarshalYAML is fun, for this one as we're supporting three different
 // types of yaml structures, a string, a map[string]map[string]string,
 // and a map[string]string, these basically equate to these three styles
@@ -119,22 +161,38 @@ func (r *RawStepConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	stepData := make(map[string]string)
 	var topMap yaml.MapSlice
 	err = unmarshal(&topMap)
-	if len(topMap) == 1 {
+	if err != nil {
+		return err
+	}
+
+	// yaml.MapSlice drops the keys pulled in by `<<` merge keys, so we read
+	// the step again as a regular map which has anchors, aliases and merges
+	// fully resolved. The MapSlice is only used to find the first key.
+	var fullMap map[string]interface{}
+	err = unmarshal(&fullMap)
+	if err != nil {
+		return err
+	}
+
+	if len(fullMap) == 1 {
 		// The only item's key will be the stepID, value is data
-		item := topMap[0]
-		stepID = item.Key
-		interData := item.Value.(yaml.MapSlice)
-		for _, item := range interData {
-			stepData[item.Key] = ifaceToString(item.Value)
+		for k, v := range fullMap {
+			stepID = k
+			stepData = ifaceToStringMap(v)
 		}
 	} else {
 		// Otherwise the first element's key is the id, and the rest
 		// of the elements are the data
 		// TODO(termie): Throw a deprecation/bad usage warning
-		firstItem := topMap[0]
-		stepID = firstItem.Key
-		for _, item := range topMap[1:] {
-			stepData[item.Key] = ifaceToString(item.Value)
+		if len(topMap) == 0 {
+			return fmt.Errorf("Unable to determine step id")
+		}
+		stepID = topMap[0].Key
+		for k, v := range fullMap {
+			if k == stepID {
+				continue
+			}
+			stepData[k] = ifaceToString(v)
 		}
 	}
 
@@ -149,6 +207,49 @@ func (r *RawStepConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		r.Name = v
 		delete(stepData, "name")
 	}
+	// display_name wins over name, which some steps also take as a parameter
+	if v, ok := stepData["display_name"]; ok {
+		r.Name = v
+		delete(stepData, "display_name")
+	}
+	if v, ok := stepData["env_file"]; ok {
+		r.EnvFile = v
+		delete(stepData, "env_file")
+	}
+	if v, ok := stepData["image"]; ok {
+		r.Image = v
+		delete(stepData, "image")
+	}
+	if v, ok := stepData["depends-on"]; ok {
+		r.DependsOn = util.SplitSpaceOrComma(v)
+		delete(stepData, "depends-on")
+	}
+	if v, ok := stepData["artifacts"]; ok {
+		r.Artifacts = util.SplitSpaceOrComma(v)
+		delete(stepData, "artifacts")
+	}
+	if v, ok := stepData["cache_key"]; ok {
+		r.CacheKey = util.SplitSpaceOrComma(v)
+		delete(stepData, "cache_key")
+	}
+	if v, ok := stepData["enabled"]; ok {
+		r.Enabled = v
+		delete(stepData, "enabled")
+	}
+	if v, ok := stepData["network"]; ok {
+		if err := validateStepNetwork(v); err != nil {
+			return fmt.Errorf("Step %s: %s", stepID, err)
+		}
+		r.Network = v
+		delete(stepData, "network")
+	}
+	if v, ok := stepData["collect"]; ok {
+		if err := validateStepCollect(v); err != nil {
+			return fmt.Errorf("Step %s: %s", stepID, err)
+		}
+		r.Collect = v
+		delete(stepData, "collect")
+	}
 	r.Data = stepData
 	return nil
 }
@@ -171,10 +272,14 @@ type PipelineConfig struct {
 	AfterSteps RawStepsConfig `yaml:"after-steps"`
 	StepsMap   map[string][]*RawStepConfig
 	Services   []*RawBoxConfig `yaml:"services"`
+	// Env holds default environment variables for the pipeline, they have
+	// the lowest precedence of all environment sources.
+	Env map[string]string `yaml:"env"`
 }
 
 var pipelineReservedWords = map[string]struct{}{
 	"box":         struct{}{},
+	"env":         struct{}{},
 	"services":    struct{}{},
 	"steps":       struct{}{},
 	"after-steps": struct{}{},
@@ -224,11 +329,12 @@ func (r *RawPipelineConfig) UnmarshalYAML(unmarshal func(interface{}) error) err
 
 // Config is the data type for wercker.yml
 type Config struct {
-	Box               *RawBoxConfig   `yaml:"box"`
-	CommandTimeout    int             `yaml:"command-timeout"`
-	NoResponseTimeout int             `yaml:"no-response-timeout"`
-	Services          []*RawBoxConfig `yaml:"services"`
-	SourceDir         string          `yaml:"source-dir"`
+	Box               *RawBoxConfig            `yaml:"box"`
+	Boxes             map[string]*RawBoxConfig `yaml:"boxes"`
+	CommandTimeout    int                      `yaml:"command-timeout"`
+	NoResponseTimeout int                      `yaml:"no-response-timeout"`
+	Services          []*RawBoxConfig          `yaml:"services"`
+	SourceDir         string                   `yaml:"source-dir"`
 	PipelinesMap      map[string]*RawPipelineConfig
 }
 
@@ -239,6 +345,7 @@ type RawConfig struct {
 
 var configReservedWords = map[string]struct{}{
 	"box":                 struct{}{},
+	"boxes":               struct{}{},
 	"command-timeout":     struct{}{},
 	"no-response-timeout": struct{}{},
 	"services":            struct{}{},
@@ -275,6 +382,122 @@ func (r *RawConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// DeployTarget is a named list of steps inside a pipeline that is picked
+// with --deploy-target.
+type DeployTarget struct {
+	Name     string `json:"name"`
+	Pipeline string `json:"pipeline"`
+	Steps    int    `json:"steps"`
+}
+
+// DeployTargets returns the deploy targets of all pipelines, sorted by
+// pipeline and target name.
+func (c *Config) DeployTargets() []*DeployTarget {
+	targets := []*DeployTarget{}
+	for pipelineName, pipeline := range c.PipelinesMap {
+		if pipeline == nil || pipeline.PipelineConfig == nil {
+			continue
+		}
+		for name, steps := range pipeline.StepsMap {
+			targets = append(targets, &DeployTarget{
+				Name:     name,
+				Pipeline: pipelineName,
+				Steps:    len(steps),
+			})
+		}
+	}
+	sort.Sort(deployTargetsByName(targets))
+	return targets
+}
+
+type deployTargetsByName []*DeployTarget
+
+func (t deployTargetsByName) Len() int      { return len(t) }
+func (t deployTargetsByName) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t deployTargetsByName) Less(i, j int) bool {
+	if t[i].Pipeline != t[j].Pipeline {
+		return t[i].Pipeline < t[j].Pipeline
+	}
+	return t[i].Name < t[j].Name
+}
+
+// ResolveBoxes replaces every box that inherits from a box in the boxes
+// section with the merged result.
+func (c *Config) ResolveBoxes() error {
+	boxes := []*RawBoxConfig{c.Box}
+	boxes = append(boxes, c.Services...)
+	for _, pipeline := range c.PipelinesMap {
+		if pipeline == nil || pipeline.PipelineConfig == nil {
+			continue
+		}
+		boxes = append(boxes, pipeline.Box)
+		boxes = append(boxes, pipeline.Services...)
+	}
+
+	for _, box := range boxes {
+		if box == nil || box.BoxConfig == nil {
+			continue
+		}
+		resolved, err := c.resolveBox(box.BoxConfig, nil)
+		if err != nil {
+			return err
+		}
+		box.BoxConfig = resolved
+	}
+	return nil
+}
+
+// resolveBox merges box with the boxes it inherits from, seen holds the
+// names of the boxes we came through to detect cycles.
+func (c *Config) resolveBox(box *BoxConfig, seen []string) (*BoxConfig, error) {
+	if box.Inherits == "" {
+		return box, nil
+	}
+	for _, name := range seen {
+		if name == box.Inherits {
+			return nil, fmt.Errorf("Box inheritance cycle: %s -> %s", strings.Join(seen, " -> "), box.Inherits)
+		}
+	}
+	parentConfig, ok := c.Boxes[box.Inherits]
+	if !ok || parentConfig == nil || parentConfig.BoxConfig == nil {
+		return nil, fmt.Errorf("Box inherits from unknown box: %s", box.Inherits)
+	}
+	parent, err := c.resolveBox(parentConfig.BoxConfig, append(seen, box.Inherits))
+	if err != nil {
+		return nil, err
+	}
+
+	merged := *parent
+	merged.Inherits = ""
+	merged.Env = map[string]string{}
+	for k, v := range parent.Env {
+		merged.Env[k] = v
+	}
+	for k, v := range box.Env {
+		merged.Env[k] = v
+	}
+	override := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	override(&merged.ID, box.ID)
+	override(&merged.Name, box.Name)
+	override(&merged.Tag, box.Tag)
+	override(&merged.Cmd, box.Cmd)
+	override(&merged.Username, box.Username)
+	override(&merged.Password, box.Password)
+	override(&merged.Registry, box.Registry)
+	override(&merged.Entrypoint, box.Entrypoint)
+	override(&merged.URL, box.URL)
+	override(&merged.Volumes, box.Volumes)
+	override(&merged.ReadyCommand, box.ReadyCommand)
+	if box.ReadyPort != 0 {
+		merged.ReadyPort = box.ReadyPort
+	}
+	return &merged, nil
+}
+
 // IsValid ensures that the underlying Config is populated properly
 func (r *RawConfig) IsValid() error {
 	if r.Config == nil {
@@ -285,7 +508,7 @@ func (r *RawConfig) IsValid() error {
 }
 
 func findYaml(searchDirs []string) (string, error) {
-	possibleYaml := []string{"ewok.yml", "wercker.yml", ".wercker.yml"}
+	possibleYaml := []string{"ewok.yml", "wercker.yml", ".wercker.yml", "wercker.json", "wercker.toml"}
 
 	for _, v := range searchDirs {
 		for _, y := range possibleYaml {
@@ -320,6 +543,115 @@ func ReadWerckerYaml(searchDirs []string, allowDefault bool) ([]byte, error) {
 	return ioutil.ReadFile(foundYaml)
 }
 
+// ReadWerckerConfig will try to find a wercker.yml, wercker.json or
+// wercker.toml file and return its path and bytes.
+func ReadWerckerConfig(searchDirs []string) (string, []byte, error) {
+	foundConfig, err := findYaml(searchDirs)
+	if err != nil {
+		return "", nil, err
+	}
+
+	file, err := ioutil.ReadFile(foundConfig)
+	if err != nil {
+		return "", nil, err
+	}
+	return foundConfig, file, nil
+}
+
+// ConfigFromFile turns the contents of filename into a Config object, the
+// format is detected by the extension of filename and defaults to yaml.
+func ConfigFromFile(filename string, file []byte) (*Config, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return ConfigFromJSON(file)
+	case ".toml":
+		return ConfigFromTOML(file)
+	default:
+		return ConfigFromYaml(file)
+	}
+}
+
+// ConfigFromJSON reads a []byte as json and turns it into a Config object.
+// The json is converted to yaml first so that both are parsed identically.
+func ConfigFromJSON(file []byte) (*Config, error) {
+	decoder := json.NewDecoder(bytes.NewReader(file))
+	decoder.UseNumber()
+	data, err := decodeJSONValue(decoder)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing your wercker.json:\n  %s", err)
+	}
+
+	b, err := yaml.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing your wercker.json:\n  %s", err)
+	}
+	return ConfigFromYaml(b)
+}
+
+// decodeJSONValue reads the next value from decoder, objects are returned as
+// yaml.MapSlice so that the order of keys is kept.
+func decodeJSONValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := token.(type) {
+	case json.Delim:
+		switch v {
+		case '{':
+			m := yaml.MapSlice{}
+			for decoder.More() {
+				keyToken, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeJSONValue(decoder)
+				if err != nil {
+					return nil, err
+				}
+				m = append(m, yaml.MapItem{Key: keyToken.(string), Value: value})
+			}
+			// Consume the closing delimiter
+			_, err = decoder.Token()
+			return m, err
+		case '[':
+			a := []interface{}{}
+			for decoder.More() {
+				value, err := decodeJSONValue(decoder)
+				if err != nil {
+					return nil, err
+				}
+				a = append(a, value)
+			}
+			_, err = decoder.Token()
+			return a, err
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	}
+	return token, nil
+}
+
+// ConfigFromTOML reads a []byte as toml and turns it into a Config object.
+// The toml is converted to yaml first so that both are parsed identically.
+func ConfigFromTOML(file []byte) (*Config, error) {
+	var data map[string]interface{}
+	_, err := toml.Decode(string(file), &data)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing your wercker.toml:\n  %s", err)
+	}
+
+	b, err := yaml.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing your wercker.toml:\n  %s", err)
+	}
+	return ConfigFromYaml(b)
+}
+
 // ConfigFromYaml reads a []byte as yaml and turn it into a Config object
 func ConfigFromYaml(file []byte) (*Config, error) {
 	var m RawConfig
@@ -328,6 +660,9 @@ func ConfigFromYaml(file []byte) (*Config, error) {
 	if err == nil {
 		err = m.IsValid()
 	}
+	if err == nil {
+		err = m.ResolveBoxes()
+	}
 	if err != nil {
 		errStr := err.Error()
 		err = fmt.Errorf("Error parsing your wercker.yml:\n  %s", errStr)
@@ -20,6 +20,7 @@ import (
 
 	"github.com/stretchr/testify/suite"
 	"github.com/wercker/wercker/util"
+	"gopkg.in/yaml.v2"
 )
 
 type ConfigSuite struct {
@@ -55,6 +56,397 @@ func (s *ConfigSuite) TestConfigBoxStructs() {
 	s.Equal(pipeline.Steps[2].ID, "script")
 }
 
+func (s *ConfigSuite) TestConfigAnchors() {
+	b, err := ioutil.ReadFile("../tests/anchors.yml")
+	s.Nil(err)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	s.Equal("anchors_box", config.Box.ID)
+	s.Equal("anchors_box", config.Services[0].ID)
+
+	build := config.PipelinesMap["build"]
+	s.Equal("anchors_box", build.Box.ID)
+	s.Equal("latest", build.Box.Tag)
+	s.Equal("shared", build.Box.Env["SHARED"])
+
+	s.Require().Len(build.Steps, 3)
+	s.Equal("script", build.Steps[0].ID)
+	s.Equal("base", build.Steps[0].Name)
+	s.Equal("src", build.Steps[0].Cwd)
+	s.Equal("echo base", build.Steps[0].Data["code"])
+
+	// A merge overriding a single key
+	s.Equal("nested", build.Steps[1].Name)
+	s.Equal("src", build.Steps[1].Cwd)
+	s.Equal("echo base", build.Steps[1].Data["code"])
+
+	// A merge of a merge
+	s.Equal("nested", build.Steps[2].Name)
+	s.Equal("src", build.Steps[2].Cwd)
+	s.Equal("echo nested", build.Steps[2].Data["code"])
+	_, ok := build.Steps[2].Data["<<"]
+	s.False(ok)
+
+	s.Require().Len(build.AfterSteps, 1)
+	s.Equal("base", build.AfterSteps[0].Name)
+
+	deploy := config.PipelinesMap["deploy"]
+	s.Require().Len(deploy.Steps, 1)
+	s.Equal("nested", deploy.Steps[0].Name)
+	s.Equal("echo base", deploy.Steps[0].Data["code"])
+}
+
+func (s *ConfigSuite) TestConfigStepEnvFile() {
+	b := []byte(`
+build:
+  steps:
+    - script:
+        code: env
+        env_file: build.env
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	step := config.PipelinesMap["build"].Steps[0]
+	s.Equal("build.env", step.EnvFile)
+	_, ok := step.Data["env_file"]
+	s.False(ok)
+}
+
+func (s *ConfigSuite) TestConfigStepDependsOn() {
+	b := []byte(`
+build:
+  steps:
+    - script:
+        name: test
+        code: make test
+        depends-on: build, lint
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	step := config.PipelinesMap["build"].Steps[0]
+	s.Equal([]string{"build", "lint"}, step.DependsOn)
+	_, ok := step.Data["depends-on"]
+	s.False(ok)
+}
+
+func (s *ConfigSuite) TestConfigBoxInherits() {
+	b := []byte(`
+boxes:
+  base:
+    id: golang
+    tag: "1.7"
+    env:
+      GOPATH: /go
+      CGO_ENABLED: "0"
+  tools:
+    inherits: base
+    cmd: /bin/bash
+box:
+  inherits: tools
+  tag: "1.8"
+  env:
+    CGO_ENABLED: "1"
+build:
+  steps:
+    - script:
+        code: make
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	s.Equal("golang", config.Box.ID)
+	s.Equal("1.8", config.Box.Tag)
+	s.Equal("/bin/bash", config.Box.Cmd)
+	s.Equal(map[string]string{"GOPATH": "/go", "CGO_ENABLED": "1"}, config.Box.Env)
+	_, ok := config.PipelinesMap["boxes"]
+	s.False(ok)
+}
+
+func (s *ConfigSuite) TestConfigBoxInheritsCycle() {
+	b := []byte(`
+boxes:
+  a:
+    inherits: b
+  b:
+    inherits: a
+box:
+  inherits: a
+`)
+	_, err := ConfigFromYaml(b)
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "cycle")
+}
+
+func (s *ConfigSuite) TestConfigServiceReady() {
+	b := []byte(`
+services:
+  - id: postgres
+    ready-port: 5432
+  - id: redis
+    ready-command: redis-cli ping
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	s.Equal(5432, config.Services[0].ReadyPort)
+	s.Equal("redis-cli ping", config.Services[1].ReadyCommand)
+}
+
+func (s *ConfigSuite) TestConfigServiceReadyInherits() {
+	b := []byte(`
+boxes:
+  postgres:
+    id: postgres
+    ready-port: 5432
+    ready-command: pg_isready
+services:
+  - inherits: postgres
+    tag: "9.6"
+  - inherits: postgres
+    ready-port: 5433
+    ready-command: pg_isready -p 5433
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	s.Equal(5432, config.Services[0].ReadyPort)
+	s.Equal("pg_isready", config.Services[0].ReadyCommand)
+	s.Equal(5433, config.Services[1].ReadyPort)
+	s.Equal("pg_isready -p 5433", config.Services[1].ReadyCommand)
+}
+
+func (s *ConfigSuite) TestConfigStepNetwork() {
+	b := []byte(`
+build:
+  steps:
+    - script:
+        name: hermetic
+        network: none
+        code: make
+    - script:
+        code: make test
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	build := config.PipelinesMap["build"]
+	s.Equal("none", build.Steps[0].Network)
+	s.Equal("", build.Steps[0].Data["network"])
+	s.Equal("", build.Steps[1].Network)
+
+	b = []byte(`
+build:
+  steps:
+    - script:
+        network: host
+        code: make
+`)
+	_, err = ConfigFromYaml(b)
+	s.NotNil(err)
+}
+
+func (s *ConfigSuite) TestConfigStepCollect() {
+	b := []byte(`
+build:
+  steps:
+    - script:
+        code: make
+        artifacts: dist/app
+        collect: async
+    - script:
+        code: make test
+        artifacts: coverage.out
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	build := config.PipelinesMap["build"]
+	s.Equal("async", build.Steps[0].Collect)
+	s.Equal("", build.Steps[0].Data["collect"])
+
+	options := EmptyPipelineOptions()
+	step, err := NewStep(build.Steps[0].StepConfig, options)
+	s.Require().Nil(err)
+	s.True(step.CollectAsync())
+	step, err = NewStep(build.Steps[1].StepConfig, options)
+	s.Require().Nil(err)
+	s.False(step.CollectAsync())
+
+	b = []byte(`
+build:
+  steps:
+    - script:
+        code: make
+        collect: later
+`)
+	_, err = ConfigFromYaml(b)
+	s.NotNil(err)
+}
+
+func (s *ConfigSuite) TestConfigStepDisplayName() {
+	b := []byte(`
+build:
+  steps:
+    - script:
+        name: build
+        display_name: compile the app
+        code: make
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	step := config.PipelinesMap["build"].Steps[0]
+	s.Equal("compile the app", step.Name)
+	s.Equal("", step.Data["display_name"])
+}
+
+func (s *ConfigSuite) TestDumpConfig() {
+	file := []byte(`
+defaults: &defaults
+  box: golang:$GO_VERSION
+build:
+  <<: *defaults
+  steps:
+    - script:
+        code: echo $TOKEN $HOME
+`)
+	env := util.NewEnvironment("GO_VERSION=1.6")
+	env.Hidden.Add("TOKEN", "secret")
+	b, err := DumpConfig("wercker.yml", file, env)
+	s.Require().Nil(err)
+
+	var dumped struct {
+		Build struct {
+			Box   string
+			Steps []map[string]map[string]string
+		}
+	}
+	s.Require().Nil(yaml.Unmarshal(b, &dumped))
+	s.Equal("golang:1.6", dumped.Build.Box)
+	s.Equal("echo <masked> ${HOME}", dumped.Build.Steps[0]["script"]["code"])
+}
+
+func (s *ConfigSuite) TestApplyConfigOverlay() {
+	b := []byte(`
+box:
+  id: golang
+  tag: "1.7"
+command-timeout: 10
+build:
+  steps:
+    - script:
+        code: make
+`)
+	overlay := []byte(`
+box:
+  tag: "1.8"
+command-timeout: null
+build:
+  steps:
+    - script:
+        code: make ci
+`)
+	patched, err := ApplyConfigOverlay("wercker.yml", b, overlay)
+	s.Require().Nil(err)
+	config, err := ConfigFromYaml(patched)
+	s.Require().Nil(err)
+	s.Equal("golang", config.Box.ID)
+	s.Equal("1.8", config.Box.Tag)
+	s.Equal(0, config.CommandTimeout)
+	s.Equal("make ci", config.PipelinesMap["build"].Steps[0].Data["code"])
+
+	_, err = ApplyConfigOverlay("wercker.yml", b, []byte(`- not a map`))
+	s.NotNil(err)
+}
+
+func (s *ConfigSuite) TestConfigStepArtifacts() {
+	b := []byte(`
+build:
+  steps:
+    - script:
+        code: make test
+        artifacts: reports/junit.xml coverage
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	step := config.PipelinesMap["build"].Steps[0]
+	s.Equal([]string{"reports/junit.xml", "coverage"}, step.Artifacts)
+	_, ok := step.Data["artifacts"]
+	s.False(ok)
+}
+
+func (s *ConfigSuite) TestConfigStepCacheKey() {
+	b := []byte(`
+build:
+  steps:
+    - npm-install:
+        cache_key: package.json, package-lock.json
+        artifacts: node_modules
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	step := config.PipelinesMap["build"].Steps[0]
+	s.Equal([]string{"package.json", "package-lock.json"}, step.CacheKey)
+	_, ok := step.Data["cache_key"]
+	s.False(ok)
+}
+
+func (s *ConfigSuite) TestConfigStepImage() {
+	b := []byte(`
+build:
+  steps:
+    - script:
+        name: lint
+        image: golang:1.6
+        code: golint ./...
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	step := config.PipelinesMap["build"].Steps[0]
+	s.Equal("golang:1.6", step.Image)
+	_, ok := step.Data["image"]
+	s.False(ok)
+}
+
+func (s *ConfigSuite) TestConfigPipelineEnv() {
+	b := []byte(`
+build:
+  env:
+    GREETING: hello
+    RETRIES: 3
+  steps:
+    - script:
+        code: env
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	pipeline := config.PipelinesMap["build"]
+	s.Equal(map[string]string{"GREETING": "hello", "RETRIES": "3"}, pipeline.Env)
+	_, ok := pipeline.StepsMap["env"]
+	s.False(ok)
+}
+
+func (s *ConfigSuite) TestConfigFormats() {
+	for _, name := range []string{"box_structs.yml", "box_structs.json", "box_structs.toml"} {
+		b, err := ioutil.ReadFile("../tests/" + name)
+		s.Nil(err)
+		config, err := ConfigFromFile(name, b)
+		s.Require().Nil(err, name)
+		s.Equal("structs_box", config.Box.ID, name)
+		s.Equal("structs_service", config.Services[0].ID, name)
+
+		pipeline := config.PipelinesMap["pipeline"]
+		s.Equal("blue", pipeline.Box.ID, name)
+		s.Equal("$DOCKER_USERNAME", pipeline.Box.Username, name)
+		s.Require().Len(pipeline.Steps, 3, name)
+		s.Equal("string-step", pipeline.Steps[0].ID, name)
+		s.Equal("script", pipeline.Steps[1].ID, name)
+		s.Equal("done right", pipeline.Steps[1].Data["code"], name)
+		s.Equal("script", pipeline.Steps[2].ID, name)
+		s.Equal("done wrong", pipeline.Steps[2].Data["code"], name)
+		s.Require().Len(pipeline.StepsMap["alternate-deploy"], 2, name)
+	}
+}
+
+func (s *ConfigSuite) TestConfigFromJSONInvalid() {
+	_, err := ConfigFromJSON([]byte(`{"box": `))
+	s.Error(err)
+}
+
 func (s *ConfigSuite) TestIfaceToString() {
 	tests := []struct {
 		input    interface{}
@@ -78,3 +470,30 @@ func (s *ConfigSuite) TestIfaceToString() {
 		s.Equal(test.expected, actual, "")
 	}
 }
+
+func (s *ConfigSuite) TestConfigDeployTargets() {
+	b := []byte(`
+build:
+  steps:
+    - script:
+        code: make
+deploy:
+  steps:
+    - script:
+        code: echo default
+  staging:
+    - script:
+        code: echo staging
+  production:
+    - script:
+        code: echo production
+    - script:
+        code: echo notify
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+	s.Equal([]*DeployTarget{
+		{Name: "production", Pipeline: "deploy", Steps: 2},
+		{Name: "staging", Pipeline: "deploy", Steps: 1},
+	}, config.DeployTargets())
+}
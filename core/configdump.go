@@ -0,0 +1,116 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/wercker/wercker/util"
+	"gopkg.in/yaml.v2"
+)
+
+// configDumpMask replaces the values of hidden variables in DumpConfig.
+const configDumpMask = "<masked>"
+
+// DumpConfig returns the wercker.yml file, read as the format ConfigFromFile
+// would, as yaml with the anchors and merge keys resolved and the variables
+// from env interpolated. Variables that aren't in env are kept as they are,
+// so the scripts still show what they reference, and hidden variables are
+// masked.
+func DumpConfig(filename string, file []byte, env *util.Environment) ([]byte, error) {
+	data, err := configData(filename, file)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing your wercker.yml:\n  %s", err)
+	}
+	// Merge keys are lost when decoding into a yaml.MapSlice, so the yaml is
+	// decoded again into plain maps and put in the original order
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json", ".toml":
+	default:
+		var merged interface{}
+		err = yaml.Unmarshal(file, &merged)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing your wercker.yml:\n  %s", err)
+		}
+		data = orderLike(merged, data)
+	}
+	return yaml.Marshal(interpolateConfig(data, env))
+}
+
+// orderLike returns v with its maps in the key order of the same maps in
+// order, keys that only v has come last.
+func orderLike(v, order interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		orderMap, _ := order.(yaml.MapSlice)
+		m := yaml.MapSlice{}
+		seen := map[interface{}]bool{}
+		for _, item := range orderMap {
+			if value, ok := v[item.Key]; ok && !seen[item.Key] {
+				m = append(m, yaml.MapItem{Key: item.Key, Value: orderLike(value, item.Value)})
+				seen[item.Key] = true
+			}
+		}
+		rest, _ := toMapSlice(v)
+		for _, item := range rest {
+			if !seen[item.Key] {
+				m = append(m, yaml.MapItem{Key: item.Key, Value: orderLike(item.Value, nil)})
+			}
+		}
+		return m
+	case []interface{}:
+		orderList, _ := order.([]interface{})
+		a := make([]interface{}, len(v))
+		for i, item := range v {
+			var itemOrder interface{}
+			if i < len(orderList) {
+				itemOrder = orderList[i]
+			}
+			a[i] = orderLike(item, itemOrder)
+		}
+		return a
+	}
+	return v
+}
+
+// interpolateConfig interpolates all strings in the decoded config v.
+func interpolateConfig(v interface{}, env *util.Environment) interface{} {
+	if m, ok := toMapSlice(v); ok {
+		for i, item := range m {
+			m[i].Value = interpolateConfig(item.Value, env)
+		}
+		return m
+	}
+	switch v := v.(type) {
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, item := range v {
+			a[i] = interpolateConfig(item, env)
+		}
+		return a
+	case []map[string]interface{}:
+		// toml arrays of tables
+		a := make([]interface{}, len(v))
+		for i, item := range v {
+			a[i] = interpolateConfig(item, env)
+		}
+		return a
+	case string:
+		return env.InterpolateMasked(v, configDumpMask)
+	}
+	return v
+}
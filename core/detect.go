@@ -0,0 +1,86 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// DetectedDefault is reported when no stack was detected
+const DetectedDefault = "default"
+
+// Detection is the result of DetectProject
+type Detection struct {
+	// Detected is the stack, used to fetch a wercker.yml for it
+	Detected string `json:"detected"`
+	// Confidence is the share of all marker files found that point at the
+	// detected stack, 0 when nothing was detected
+	Confidence float64 `json:"confidence"`
+	// Markers are the files that triggered the match
+	Markers []string `json:"markers"`
+}
+
+// detectRule recognizes a stack by the files in the project root
+type detectRule struct {
+	stack string
+	match func(name string) bool
+}
+
+// detectRules in order of precedence, when files of several stacks are
+// found the first one wins
+var detectRules = []detectRule{
+	{"nodejs", func(name string) bool { return name == "package.json" }},
+	{"python", func(name string) bool { return name == "requirements.txt" }},
+	{"ruby", func(name string) bool { return name == "Gemfile" }},
+	{"golang", func(name string) bool { return filepath.Ext(name) == ".go" }},
+}
+
+// DetectProject detects the stack of the project in dir from the files in
+// its root.
+func DetectProject(dir string) (*Detection, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, f := range files {
+		if !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	detection := &Detection{Detected: DetectedDefault, Markers: []string{}}
+	total := 0
+	for _, rule := range detectRules {
+		markers := []string{}
+		for _, name := range names {
+			if rule.match(name) {
+				markers = append(markers, name)
+			}
+		}
+		total += len(markers)
+		if len(markers) > 0 && detection.Detected == DetectedDefault {
+			detection.Detected = rule.stack
+			detection.Markers = markers
+		}
+	}
+	if total > 0 {
+		detection.Confidence = float64(len(detection.Markers)) / float64(total)
+	}
+	return detection, nil
+}
@@ -0,0 +1,73 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type DetectSuite struct {
+	*util.TestSuite
+}
+
+func TestDetectSuite(t *testing.T) {
+	suiteTester := &DetectSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *DetectSuite) project(files ...string) string {
+	dir, err := ioutil.TempDir("", "detect")
+	s.Require().Nil(err)
+	for _, f := range files {
+		s.Require().Nil(ioutil.WriteFile(filepath.Join(dir, f), []byte{}, 0644))
+	}
+	return dir
+}
+
+func (s *DetectSuite) TestDetectProject() {
+	dir := s.project("main.go", "util.go", "README.md")
+	defer os.RemoveAll(dir)
+	detection, err := DetectProject(dir)
+	s.Nil(err)
+	s.Equal("golang", detection.Detected)
+	s.Equal([]string{"main.go", "util.go"}, detection.Markers)
+	s.Equal(1.0, detection.Confidence)
+}
+
+func (s *DetectSuite) TestDetectProjectPrecedence() {
+	dir := s.project("package.json", "main.go")
+	defer os.RemoveAll(dir)
+	detection, err := DetectProject(dir)
+	s.Nil(err)
+	s.Equal("nodejs", detection.Detected)
+	s.Equal([]string{"package.json"}, detection.Markers)
+	s.Equal(0.5, detection.Confidence)
+}
+
+func (s *DetectSuite) TestDetectProjectDefault() {
+	dir := s.project("README.md")
+	defer os.RemoveAll(dir)
+	detection, err := DetectProject(dir)
+	s.Nil(err)
+	s.Equal(DetectedDefault, detection.Detected)
+	s.Empty(detection.Markers)
+	s.Equal(0.0, detection.Confidence)
+}
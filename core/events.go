@@ -106,6 +106,10 @@ type BuildStepFinishedArgs struct {
 	Successful  bool
 	Message     string
 	ArtifactURL string
+	// URLs of the artifacts declared in the step's `artifacts`
+	ArtifactURLs []string
+	// Annotations the step wrote to $WERCKER_REPORT_ANNOTATIONS_FILE
+	Annotations []*Annotation
 	// Only applicable to the store step
 	PackageURL string
 	// Only applicable to the setup environment step
@@ -252,6 +256,9 @@ func (e *NormalizedEmitter) Emit(event interface{}, args interface{}) {
 		if a.Stream == "" {
 			a.Stream = "stdout"
 		}
+		if a.Options != nil {
+			a.Logs = a.Options.MaskSecrets(a.Logs)
+		}
 		e.Emitter.Emit(event, a)
 	// Add options, build, step, order, reset step and order after
 	case BuildStepFinished:
@@ -268,6 +275,12 @@ func (e *NormalizedEmitter) Emit(event interface{}, args interface{}) {
 		if a.Order == 0 {
 			a.Order = e.currentOrder
 		}
+		if a.Options != nil {
+			a.Message = a.Options.MaskSecrets(a.Message)
+			for _, annotation := range a.Annotations {
+				annotation.Message = a.Options.MaskSecrets(annotation.Message)
+			}
+		}
 		e.Emitter.Emit(event, a)
 		e.currentStep = nil
 		e.currentOrder = -1
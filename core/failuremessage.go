@@ -0,0 +1,47 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// FailureMessageData is what the --failure-message-template is executed
+// with.
+type FailureMessageData struct {
+	Step     string
+	ExitCode int
+	Message  string
+	Output   []string
+}
+
+// parseFailureMessageTemplate parses a --failure-message-template.
+func parseFailureMessageTemplate(text string) (*template.Template, error) {
+	return template.New("failure-message").Parse(text)
+}
+
+// FailureMessage renders the --failure-message-template for a failed step.
+func (o *PipelineOptions) FailureMessage(data *FailureMessageData) (string, error) {
+	tmpl, err := parseFailureMessageTemplate(o.FailureMessageTemplate)
+	if err != nil {
+		return "", err
+	}
+	var message bytes.Buffer
+	if err := tmpl.Execute(&message, data); err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
@@ -0,0 +1,62 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// stepLabel is the name a step is shown with in the graph.
+func stepLabel(step *RawStepConfig) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return step.ID
+}
+
+// PipelineGraph renders the pipeline as a Graphviz DOT digraph. Steps run
+// one after the other, so each step points to the next one. The after-steps
+// run once the steps have finished, whether they passed or not.
+func PipelineGraph(name string, pipeline *PipelineConfig) string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "digraph %s {\n", strconv.Quote(name))
+	fmt.Fprintln(b, `  node [shape=box];`)
+	fmt.Fprintln(b, `  "get code" -> "setup environment";`)
+
+	previous := "setup environment"
+	for i, step := range pipeline.Steps {
+		node := fmt.Sprintf("step-%d", i)
+		fmt.Fprintf(b, "  %s [label=%s];\n", strconv.Quote(node), strconv.Quote(stepLabel(step)))
+		fmt.Fprintf(b, "  %s -> %s;\n", strconv.Quote(previous), strconv.Quote(node))
+		previous = node
+	}
+
+	if len(pipeline.AfterSteps) > 0 {
+		fmt.Fprintln(b, `  "finished" [shape=diamond];`)
+		fmt.Fprintf(b, "  %s -> \"finished\";\n", strconv.Quote(previous))
+		previous = "finished"
+		for i, step := range pipeline.AfterSteps {
+			node := fmt.Sprintf("after-step-%d", i)
+			fmt.Fprintf(b, "  %s [label=%s, style=dashed];\n", strconv.Quote(node), strconv.Quote(stepLabel(step)))
+			fmt.Fprintf(b, "  %s -> %s;\n", strconv.Quote(previous), strconv.Quote(node))
+			previous = node
+		}
+	}
+
+	fmt.Fprintln(b, "}")
+	return b.String()
+}
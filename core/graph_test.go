@@ -0,0 +1,61 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type GraphSuite struct {
+	*util.TestSuite
+}
+
+func TestGraphSuite(t *testing.T) {
+	suiteTester := &GraphSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *GraphSuite) TestPipelineGraph() {
+	b := []byte(`
+build:
+  steps:
+    - script:
+        name: run "tests"
+        code: make test
+    - wercker/publish
+  after-steps:
+    - slack-notifier
+`)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+
+	expected := `digraph "build" {
+  node [shape=box];
+  "get code" -> "setup environment";
+  "step-0" [label="run \"tests\""];
+  "setup environment" -> "step-0";
+  "step-1" [label="wercker/publish"];
+  "step-0" -> "step-1";
+  "finished" [shape=diamond];
+  "step-1" -> "finished";
+  "after-step-0" [label="slack-notifier", style=dashed];
+  "finished" -> "after-step-0";
+}
+`
+	s.Equal(expected, PipelineGraph("build", config.PipelinesMap["build"].PipelineConfig))
+}
@@ -15,16 +15,22 @@
 package core
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/pborman/uuid"
@@ -33,6 +39,18 @@ import (
 
 var (
 	DEFAULT_BASE_URL = "https://app.wercker.com"
+
+	artifactRetentionRe = regexp.MustCompile(`^[1-9][0-9]*d$`)
+	sha256Re            = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	imageTagRe          = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// The ways the source can get into the container, see --build-dir-mode.
+// Both mounts use the host directories directly, like --direct-mount.
+const (
+	BuildDirModeReadOnly  = "ro"
+	BuildDirModeCopy      = "copy"
+	BuildDirModeReadWrite = "rw"
 )
 
 // GlobalOptions applicable to everything
@@ -46,15 +64,34 @@ type GlobalOptions struct {
 	// Auth
 	AuthToken      string
 	AuthTokenStore string
+	TokenStorage   string
 }
 
+// Storages for --token-storage
+const (
+	// TokenStorageFile keeps the token in the --auth-token-store file
+	TokenStorageFile = "file"
+	// TokenStorageKeychain keeps the token in the OS keychain
+	TokenStorageKeychain = "keychain"
+)
+
+// KeychainService is the service the token is stored under in the keychain
+const KeychainService = "wercker"
+
 // guessAuthToken will attempt to read from the token store location if
 // no auth token was provided
-func guessAuthToken(c util.Settings, e *util.Environment, authTokenStore string) string {
+func guessAuthToken(c util.Settings, e *util.Environment, authTokenStore, tokenStorage, baseURL string) string {
 	token, _ := c.GlobalString("auth-token")
 	if token != "" {
 		return token
 	}
+	if tokenStorage == TokenStorageKeychain {
+		token, err := util.KeychainGet(KeychainService, baseURL)
+		if err != nil && err != util.ErrKeychainNotFound {
+			util.RootLogger().WithField("Logger", "Options").Errorln(err)
+		}
+		return token
+	}
 	if foundToken, _ := util.Exists(authTokenStore); !foundToken {
 		return ""
 	}
@@ -80,7 +117,15 @@ func NewGlobalOptions(c util.Settings, e *util.Environment) (*GlobalOptions, err
 
 	authTokenStore, _ := c.GlobalString("auth-token-store")
 	authTokenStore = util.ExpandHomePath(authTokenStore, e.Get("HOME"))
-	authToken := guessAuthToken(c, e, authTokenStore)
+	tokenStorage, _ := c.GlobalString("token-storage", TokenStorageFile)
+	switch tokenStorage {
+	case "":
+		tokenStorage = TokenStorageFile
+	case TokenStorageFile, TokenStorageKeychain:
+	default:
+		return nil, fmt.Errorf("Invalid --token-storage %s, expected one of: file, keychain", tokenStorage)
+	}
+	authToken := guessAuthToken(c, e, authTokenStore, tokenStorage, baseURL)
 
 	// If debug is true, than force verbose and do not use colors.
 	if debug {
@@ -97,6 +142,7 @@ func NewGlobalOptions(c util.Settings, e *util.Environment) (*GlobalOptions, err
 
 		AuthToken:      authToken,
 		AuthTokenStore: authTokenStore,
+		TokenStorage:   tokenStorage,
 	}, nil
 }
 
@@ -201,6 +247,43 @@ func guessGitCommit(c util.Settings, e *util.Environment) string {
 	return strings.Trim(out.String(), "\n")
 }
 
+// guessImageCreated returns the org.opencontainers.image.created date of the
+// images we commit. Reproducible builds set SOURCE_DATE_EPOCH, otherwise it is
+// the time of the commit, so building a commit again gives the same date.
+func guessImageCreated(c util.Settings, e *util.Environment, commit string) (string, error) {
+	if epoch := e.Get("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("Invalid SOURCE_DATE_EPOCH %q, it must be a number of seconds", epoch)
+		}
+		return time.Unix(seconds, 0).UTC().Format(time.RFC3339), nil
+	}
+
+	projectPath := guessProjectPath(c, e)
+	if commit == "" || projectPath == "" {
+		return "", nil
+	}
+
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return "", nil
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(git, "show", "-s", "--format=%ct", commit)
+	cmd.Dir = projectPath
+	cmd.Stdout = &out
+	err = cmd.Run()
+	if err != nil {
+		return "", nil
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(out.String()), 10, 64)
+	if err != nil {
+		return "", nil
+	}
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339), nil
+}
+
 func guessGitOwner(c util.Settings, e *util.Environment) string {
 	owner, _ := c.String("git-owner")
 	if owner != "" {
@@ -250,22 +333,69 @@ type KeenOptions struct {
 	KeenProjectID       string
 	KeenProjectWriteKey string
 	ShouldKeenMetrics   bool
+
+	// Collections the build and deploy events are sent to
+	KeenBuildCollection  string
+	KeenDeployCollection string
+
+	// KeenStack and KeenEnvironment identify where the events come from, so
+	// environments sharing a keen project can be told apart
+	KeenStack       int
+	KeenEnvironment string
+
+	// KeenLogSampling is the amount of lines of step output sampled into
+	// the buildStepFinished events, 0 disables it
+	KeenLogSampling int
+
+	// KeenExtraFields are sent in the extra map of every event, so they
+	// can't collide with the fields we send ourselves
+	KeenExtraFields map[string]string
 }
 
 // NewKeenOptions constructor
 func NewKeenOptions(c util.Settings, e *util.Environment, globalOpts *GlobalOptions) (*KeenOptions, error) {
 	keenMetrics, _ := c.Bool("keen-metrics")
 	keenProjectWriteKey, _ := c.String("keen-project-write-key")
+	if keenWriteKeyFile, _ := c.String("keen-write-key-file"); keenWriteKeyFile != "" {
+		keyBytes, err := ioutil.ReadFile(keenWriteKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read --keen-write-key-file: %s", err)
+		}
+		keenProjectWriteKey = strings.TrimSpace(string(keyBytes))
+	}
 	keenProjectID, _ := c.String("keen-project-id")
-
-	if keenMetrics {
-		if keenProjectWriteKey == "" {
-			return nil, errors.New("keen-project-write-key is required")
+	keenBuildCollection, _ := c.String("keen-build-collection")
+	keenDeployCollection, _ := c.String("keen-deploy-collection")
+	keenStack, _ := c.Int("keen-stack")
+	keenEnvironment, _ := c.String("keen-environment")
+	keenLogSampling, _ := c.Int("keen-log-sampling")
+	if keenLogSampling < 0 {
+		return nil, fmt.Errorf("Invalid --keen-log-sampling %d, must be 0 or more", keenLogSampling)
+	}
+	keenExtraFields := make(map[string]string)
+	flagKeenExtraFields, _ := c.StringSlice("keen-extra-field")
+	for _, field := range flagKeenExtraFields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid --keen-extra-field, expected key=value: %s", field)
+		}
+		if _, ok := keenExtraFields[parts[0]]; ok {
+			return nil, fmt.Errorf("Duplicate --keen-extra-field %s", parts[0])
 		}
+		keenExtraFields[parts[0]] = parts[1]
+	}
 
-		if keenProjectID == "" {
-			return nil, errors.New("keen-project-id is required")
+	// Missing credentials disable metrics rather than failing the run, but a
+	// half configured setup is most likely a mistake so we warn about it.
+	if keenMetrics && (keenProjectWriteKey == "" || keenProjectID == "") {
+		logger := util.RootLogger().WithField("Logger", "Options")
+		if keenProjectWriteKey != "" {
+			logger.Warnln("keen-project-write-key is set but keen-project-id is missing")
+		} else if keenProjectID != "" {
+			logger.Warnln("keen-project-id is set but keen-project-write-key is missing")
 		}
+		logger.Infoln("Keen credentials not configured, metrics disabled")
+		keenMetrics = false
 	}
 
 	return &KeenOptions{
@@ -273,6 +403,13 @@ func NewKeenOptions(c util.Settings, e *util.Environment, globalOpts *GlobalOpti
 		KeenProjectID:       keenProjectID,
 		KeenProjectWriteKey: keenProjectWriteKey,
 		ShouldKeenMetrics:   keenMetrics,
+
+		KeenBuildCollection:  keenBuildCollection,
+		KeenDeployCollection: keenDeployCollection,
+		KeenStack:            keenStack,
+		KeenEnvironment:      keenEnvironment,
+		KeenLogSampling:      keenLogSampling,
+		KeenExtraFields:      keenExtraFields,
 	}, nil
 }
 
@@ -308,6 +445,17 @@ func NewReporterOptions(c util.Settings, e *util.Environment, globalOpts *Global
 	}, nil
 }
 
+// Policies for --pull-policy
+const (
+	// PullPolicyAlways pulls the images for every run
+	PullPolicyAlways = "always"
+	// PullPolicyIfNotPresent only pulls the images that are not available
+	// locally
+	PullPolicyIfNotPresent = "if-not-present"
+	// PullPolicyNever never pulls, the images have to be available locally
+	PullPolicyNever = "never"
+)
+
 // PipelineOptions for builds and deploys
 type PipelineOptions struct {
 	*GlobalOptions
@@ -332,13 +480,40 @@ type PipelineOptions struct {
 	ApplicationOwnerName     string
 	ApplicationStartedByName string
 
-	ShouldCommit  bool
-	Repository    string
-	Tag           string
-	Message       string
-	ShouldStoreS3 bool
+	ShouldCommit     bool
+	KeepFailedImages bool
+	Repository       string
+	Tag              string
+	CommitTags       []string
+	ShouldPush       bool
+	Registries       []*PushRegistry
+	DryRunPush       bool
+	Message          string
+	Labels           map[string]string
+	ContainerLabels  map[string]string
+	ImageAnnotations map[string]string
+	ImageCreated     string
+	CommitPaths      []string
+	AnnotateCommit   bool
+	ShouldStoreS3    bool
+
+	ShouldCheckpoint bool
+	ResumeFrom       string
+	RetryFailedBuild bool
+
+	StepCheckpoints     []*StepCheckpoint
+	PushStepCheckpoints bool
+
+	PreparedRepository string
+	PreparedTag        string
+	ShouldPushPrepared bool
+
+	ScanCommand     string
+	ScanNonblocking bool
 
 	WorkingDir string
+	StepStore  string
+	CacheDir   string
 
 	GuestRoot  string
 	MntRoot    string
@@ -350,16 +525,252 @@ type PipelineOptions struct {
 
 	CommandTimeout    int
 	NoResponseTimeout int
+	BuildTimeout      int
+	BoxPullTimeout    int
+	StepTimeoutGrace  int
+	PullPolicy        string
 	ShouldArtifacts   bool
+	NoStore           bool
 	ShouldRemove      bool
 	SourceDir         string
+	BoxTagFromEnv     string
+	ExplainEnv        string
+	ExpandEnvFiles    bool
+	StepOrderStrategy string
+	StepNetwork       string
+	SummaryJSON       string
+	NotifyWebhook     string
+	NotifyOn          []string
+	StepLogDir        string
+	PrintMetadata     bool
+	AnnotationFormat  string
+	LogServer         string
+	OTLPEndpoint      string
+	OTLPLogs          bool
+	DumpEnv           string
+	DumpEnvUnmasked   bool
+	Secrets           []string
+
+	FailOnEmptyArtifact    bool
+	WarnOnEmptyArtifact    bool
+	AllowEmptyPipeline     bool
+	WarnOnLatestTag        bool
+	ForbidLatestTag        bool
+	MinArtifactSize        int64
+	ConcurrentUpload       bool
+	MaxConcurrentUploads   int
+	ArtifactRetention      string
+	InputArtifact          string
+	InputArtifactDir       string
+	ReproducibleArtifacts  bool
+	UploadPartialOnTimeout bool
+	StepWorkingTimeout     int
+
+	AttachOnError     bool
+	DirectMount       bool
+	BuildDirMode      string
+	FailOnDirtySource bool
+	SkipCheckout      bool
+	SourceArchive     string
+	EnableDevSteps    bool
+	PublishPorts      []string
+	EnableVolumes     bool
+	WerckerYml        string
+	ConfigOverlay     string
+	PrebuildScript    string
+
+	CancelFile         string
+	CancelFileInterval int
+
+	FailureMessageTemplate string
+}
+
+// PushRegistry is an extra registry the committed image is pushed to. The
+// password is left out when the options are dumped as JSON, as in the
+// --summary-json.
+type PushRegistry struct {
+	Address  string
+	Username string
+	Password string `json:"-"`
+}
+
+// parsePushRegistry parses a --registry, [username:password@]host[/namespace].
+func parsePushRegistry(value string) (*PushRegistry, error) {
+	registry := &PushRegistry{Address: value}
+	if at := strings.LastIndex(value, "@"); at >= 0 {
+		credentials := strings.SplitN(value[:at], ":", 2)
+		if len(credentials) != 2 || credentials[0] == "" {
+			return nil, fmt.Errorf("Invalid --registry, expected [username:password@]host[/namespace]")
+		}
+		registry.Username = credentials[0]
+		registry.Password = credentials[1]
+		registry.Address = value[at+1:]
+	}
+	registry.Address = strings.TrimSuffix(registry.Address, "/")
+	if registry.Address == "" || strings.Contains(registry.Address, "://") {
+		return nil, fmt.Errorf("Invalid --registry address %q, expected host[/namespace]", registry.Address)
+	}
+	return registry, nil
+}
+
+// Host is the registry host to authenticate against.
+func (r *PushRegistry) Host() string {
+	return strings.SplitN(r.Address, "/", 2)[0]
+}
+
+// Repository returns the name of repository in this registry, the registry
+// host of repository is replaced with the address.
+func (r *PushRegistry) Repository(repository string) string {
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		repository = parts[1]
+	}
+	return fmt.Sprintf("%s/%s", r.Address, repository)
+}
+
+// parseLabel splits a key=value label.
+func parseLabel(label string) (string, string, error) {
+	parts := strings.SplitN(label, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("Invalid label, expected key=value: %s", label)
+	}
+	return parts[0], parts[1], nil
+}
+
+// parseLabels combines the labels from --label-file with the --label flags,
+// the flags override labels from the file. The file contains a key=value
+// label per line, blank lines and lines starting with # are skipped.
+func parseLabels(c util.Settings) (map[string]string, error) {
+	labels := make(map[string]string)
+
+	labelFile, _ := c.String("label-file")
+	if labelFile != "" {
+		f, err := os.Open(labelFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for lineNumber := 1; scanner.Scan(); lineNumber++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, value, err := parseLabel(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", labelFile, lineNumber, err)
+			}
+			labels[key] = value
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	flagLabels, _ := c.StringSlice("label")
+	for _, label := range flagLabels {
+		key, value, err := parseLabel(label)
+		if err != nil {
+			return nil, err
+		}
+		labels[key] = value
+	}
+
+	return labels, nil
+}
+
+// readSecretsFile reads the secrets to mask from path, one per line. A line
+// naming a variable in the host environment, optionally without its X_ or XXX_
+// prefix, masks the value of that variable, any other line is masked as is.
+// The secrets are sorted longest first so a secret containing another one is
+// still masked as a whole.
+func readSecretsFile(path string, e *util.Environment) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	secrets := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		found := false
+		for _, prefix := range []string{"", "X_", "XXX_"} {
+			if value := e.Get(prefix + line); value != "" {
+				secrets = append(secrets, value)
+				found = true
+			}
+		}
+		if !found {
+			secrets = append(secrets, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(sort.Reverse(byLength(secrets)))
+	return secrets, nil
+}
+
+type byLength []string
 
-	AttachOnError  bool
-	DirectMount    bool
-	EnableDevSteps bool
-	PublishPorts   []string
-	EnableVolumes  bool
-	WerckerYml     string
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLength) Less(i, j int) bool { return len(s[i]) < len(s[j]) }
+
+// parseRepositoryTag splits the repo:tag value of flag into its repository
+// and tag, the tag defaults to latest.
+func parseRepositoryTag(c util.Settings, flag string) (string, string, error) {
+	value, _ := c.String(flag)
+	if value == "" {
+		return "", "", nil
+	}
+
+	repository, tag := splitRepositoryTag(value)
+	if repository == "" || tag == "" {
+		return "", "", fmt.Errorf("Invalid value for --%s, expected repo:tag: %s", flag, value)
+	}
+	return repository, tag, nil
+}
+
+// splitRepositoryTag splits repo:tag, the tag defaults to latest.
+func splitRepositoryTag(value string) (string, string) {
+	repository := value
+	tag := "latest"
+	// A colon before the last slash belongs to the registry's port
+	if i := strings.LastIndex(value, ":"); i > strings.LastIndex(value, "/") {
+		repository = value[:i]
+		tag = value[i+1:]
+	}
+	return repository, tag
+}
+
+// StepCheckpoint is an image to commit right after a step passes, see
+// --checkpoint-on-step.
+type StepCheckpoint struct {
+	Step       string
+	Repository string
+	Tag        string
+}
+
+// parseStepCheckpoint parses a --checkpoint-on-step, step:repo:tag where the
+// tag defaults to latest.
+func parseStepCheckpoint(value string) (*StepCheckpoint, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("Invalid value for --checkpoint-on-step, expected step:repo:tag: %s", value)
+	}
+	repository, tag := splitRepositoryTag(parts[1])
+	if repository == "" || tag == "" {
+		return nil, fmt.Errorf("Invalid value for --checkpoint-on-step, expected step:repo:tag: %s", value)
+	}
+	return &StepCheckpoint{Step: parts[0], Repository: repository, Tag: tag}, nil
 }
 
 func guessApplicationID(c util.Settings, e *util.Environment, name string) string {
@@ -377,6 +788,18 @@ func guessApplicationName(c util.Settings, e *util.Environment) (string, error)
 		return applicationName, nil
 	}
 
+	// ... named after the source archive ...
+	sourceArchive, _ := c.String("source-archive")
+	if sourceArchive != "" {
+		base := filepath.Base(sourceArchive)
+		for _, ext := range []string{".tar.gz", ".tgz", ".tar"} {
+			if strings.HasSuffix(base, ext) {
+				return strings.TrimSuffix(base, ext), nil
+			}
+		}
+		return base, nil
+	}
+
 	// Otherwise, check our build target, it can be a url...
 	target, _ := c.String("target")
 	projectURL := ""
@@ -526,12 +949,110 @@ func NewPipelineOptions(c util.Settings, e *util.Environment) (*PipelineOptions,
 
 	repository, _ := c.String("commit")
 	shouldCommit := (repository != "")
+	commitTags, _ := c.StringSlice("commit-tag")
+	for _, commitTag := range commitTags {
+		if !imageTagRe.MatchString(commitTag) {
+			return nil, fmt.Errorf("Invalid --commit-tag %q", commitTag)
+		}
+	}
+	shouldPush, _ := c.Bool("push")
+	if shouldPush && !shouldCommit {
+		return nil, fmt.Errorf("--push requires --commit")
+	}
+	registries := []*PushRegistry{}
+	registryValues, _ := c.StringSlice("registry")
+	for _, value := range registryValues {
+		registry, err := parsePushRegistry(e.Interpolate(value))
+		if err != nil {
+			return nil, err
+		}
+		registries = append(registries, registry)
+	}
+	if len(registries) > 0 && !shouldPush {
+		return nil, fmt.Errorf("--registry requires --push")
+	}
+	keepFailedImages, _ := c.Bool("keep-failed-images")
 	tag := guessTag(c, e)
 	message := guessMessage(c, e)
+	labels, err := parseLabels(c)
+	if err != nil {
+		return nil, err
+	}
+	containerLabels := make(map[string]string)
+	flagContainerLabels, _ := c.StringSlice("container-label")
+	for _, label := range flagContainerLabels {
+		key, value, err := parseLabel(label)
+		if err != nil {
+			return nil, err
+		}
+		containerLabels[key] = value
+	}
+	imageAnnotations := make(map[string]string)
+	flagAnnotations, _ := c.StringSlice("oci-annotation")
+	for _, annotation := range flagAnnotations {
+		key, value, err := parseLabel(annotation)
+		if err != nil {
+			return nil, err
+		}
+		imageAnnotations[key] = value
+	}
+	imageCreated, err := guessImageCreated(c, e, gitOpts.GitCommit)
+	if err != nil {
+		return nil, err
+	}
+	rawCommitPaths, _ := c.String("commit-paths")
+	commitPaths := util.SplitSpaceOrComma(rawCommitPaths)
+	for _, p := range commitPaths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("--commit-paths needs absolute paths, got %q", p)
+		}
+	}
+	annotateCommit, _ := c.Bool("annotate-commit")
 	shouldStoreS3, _ := c.Bool("store-s3")
+	shouldCheckpoint, _ := c.Bool("checkpoint")
+	resumeFrom, _ := c.String("resume-from")
+	retryFailedBuild, _ := c.Bool("retry-failed-build")
+	if retryFailedBuild && resumeFrom != "" {
+		return nil, fmt.Errorf("--retry-failed-build can't be combined with --resume-from")
+	}
+	stepCheckpoints := []*StepCheckpoint{}
+	stepCheckpointValues, _ := c.StringSlice("checkpoint-on-step")
+	for _, value := range stepCheckpointValues {
+		checkpoint, err := parseStepCheckpoint(value)
+		if err != nil {
+			return nil, err
+		}
+		stepCheckpoints = append(stepCheckpoints, checkpoint)
+	}
+	pushStepCheckpoints, _ := c.Bool("push-checkpoint-on-step")
+	if pushStepCheckpoints && len(stepCheckpoints) == 0 {
+		return nil, fmt.Errorf("--push-checkpoint-on-step requires --checkpoint-on-step")
+	}
+	preparedRepository, preparedTag, err := parseRepositoryTag(c, "commit-before-steps")
+	if err != nil {
+		return nil, err
+	}
+	shouldPushPrepared, _ := c.Bool("push-before-steps")
+	if shouldPushPrepared && preparedRepository == "" {
+		return nil, fmt.Errorf("--push-before-steps requires --commit-before-steps")
+	}
+	dryRunPush, _ := c.Bool("dry-run-push")
+	if dryRunPush && !shouldPush && !shouldPushPrepared {
+		return nil, fmt.Errorf("--dry-run-push requires --push or --push-before-steps")
+	}
+	scanCommand, _ := c.String("scan-command")
+	scanNonblocking, _ := c.Bool("scan-nonblocking")
 
 	workingDir, _ := c.String("working-dir")
 	workingDir, _ = filepath.Abs(workingDir)
+	stepStore, _ := c.String("step-store")
+	if stepStore != "" {
+		stepStore, _ = filepath.Abs(util.ExpandHomePath(stepStore, e.Get("HOME")))
+	}
+	cacheDir, _ := c.String("cache-dir")
+	if cacheDir != "" {
+		cacheDir, _ = filepath.Abs(util.ExpandHomePath(cacheDir, e.Get("HOME")))
+	}
 
 	guestRoot, _ := c.String("guest-root")
 	mntRoot, _ := c.String("mnt-root")
@@ -550,18 +1071,167 @@ func NewPipelineOptions(c util.Settings, e *util.Environment) (*PipelineOptions,
 	commandTimeout := int(commandTimeoutFloat * 1000 * 60)
 	noResponseTimeoutFloat, _ := c.Float64("no-response-timeout")
 	noResponseTimeout := int(noResponseTimeoutFloat * 1000 * 60)
+	buildTimeoutFloat, _ := c.Float64("build-timeout")
+	buildTimeout := int(buildTimeoutFloat * 1000 * 60)
+	uploadPartialOnTimeout, _ := c.Bool("upload-partial-on-timeout")
+	pullPolicy, _ := c.String("pull-policy", PullPolicyAlways)
+	switch pullPolicy {
+	case PullPolicyAlways, PullPolicyIfNotPresent, PullPolicyNever:
+	default:
+		return nil, fmt.Errorf("Invalid pull policy %s, expected one of: always, if-not-present, never", pullPolicy)
+	}
+	boxPullTimeoutFloat, _ := c.Float64("box-pull-timeout")
+	boxPullTimeout := int(boxPullTimeoutFloat * 1000 * 60)
+	stepWorkingTimeoutFloat, _ := c.Float64("step-working-timeout")
+	if stepWorkingTimeoutFloat < 0 {
+		return nil, fmt.Errorf("Invalid --step-working-timeout %v, must be 0 or more", stepWorkingTimeoutFloat)
+	}
+	stepWorkingTimeout := int(stepWorkingTimeoutFloat * 1000 * 60)
+	// The grace period is given and stored in seconds, like docker stop
+	stepTimeoutGrace, _ := c.Int("step-timeout-grace")
+	if stepTimeoutGrace < 0 {
+		return nil, fmt.Errorf("Invalid --step-timeout-grace %d, must be 0 or more", stepTimeoutGrace)
+	}
 	shouldArtifacts, _ := c.Bool("artifacts")
+	noStore, _ := c.Bool("no-store")
+	if noStore {
+		// --no-store wins over everything that would upload or push
+		shouldStoreS3 = false
+		shouldPushPrepared = false
+		pushStepCheckpoints = false
+		shouldPush = false
+		registries = []*PushRegistry{}
+		dryRunPush = false
+	}
 	// TODO(termie): switch negative flag
 	shouldRemove, _ := c.Bool("no-remove")
 	shouldRemove = !shouldRemove
 	sourceDir, _ := c.String("source-dir")
+	boxTagFromEnv, _ := c.String("box-tag-from-env")
+	explainEnv, _ := c.String("explain-env")
+	expandEnvFiles, _ := c.Bool("expand-env-files")
+	stepOrderStrategy, _ := c.String("step-order-strategy")
+	if _, err := OrderSteps(nil, stepOrderStrategy); err != nil {
+		return nil, err
+	}
+	allowEmptyPipeline, _ := c.Bool("allow-empty-pipeline")
+	warnOnLatestTag, _ := c.BoolT("warn-on-latest-tag")
+	forbidLatestTag, _ := c.Bool("forbid-latest-tag")
+	stepNetwork, _ := c.String("step-network")
+	if stepNetwork == "" {
+		stepNetwork = StepNetworkDefault
+	}
+	if err := validateStepNetwork(stepNetwork); err != nil {
+		return nil, fmt.Errorf("Invalid --step-network: %s", err)
+	}
+	summaryJSON, _ := c.String("summary-json")
+	notifyWebhook, _ := c.String("notify-webhook")
+	notifyOnString, _ := c.String("notify-on")
+	notifyOn := util.SplitSpaceOrComma(notifyOnString)
+	for _, result := range notifyOn {
+		if result != "failure" && result != "success" {
+			return nil, fmt.Errorf("Invalid --notify-on %s, expected failure or success", result)
+		}
+	}
+	stepLogDir, _ := c.String("step-log-dir")
+	printMetadata, _ := c.Bool("print-metadata")
+	annotationFormat, _ := c.String("annotation-format")
+	switch annotationFormat {
+	case "", AnnotationFormatJSON, AnnotationFormatGitHub:
+	default:
+		return nil, fmt.Errorf("Invalid annotation format %s, expected json or github", annotationFormat)
+	}
+	logServer, _ := c.String("log-server")
+	otlpEndpoint, _ := c.String("otlp-endpoint")
+	otlpLogs, _ := c.Bool("otlp-logs")
+	if otlpLogs && otlpEndpoint == "" {
+		return nil, fmt.Errorf("--otlp-logs requires --otlp-endpoint")
+	}
+	dumpEnv, _ := c.String("dump-env")
+	dumpEnvUnmasked, _ := c.Bool("dump-env-unmasked")
+	secrets := []string{}
+	if secretsFile, _ := c.String("secrets-file"); secretsFile != "" {
+		secrets, err = readSecretsFile(secretsFile, e)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read secrets file: %s", err)
+		}
+	}
+	failOnEmptyArtifact, _ := c.Bool("fail-on-empty-artifact")
+	warnOnEmptyArtifact, _ := c.Bool("warn-on-empty-artifact")
+	minArtifactSize, _ := c.Int("min-artifact-size")
+	concurrentUpload, _ := c.Bool("concurrent-upload")
+	maxConcurrentUploads, _ := c.Int("max-concurrent-uploads", 4)
+	if maxConcurrentUploads < 1 {
+		return nil, fmt.Errorf("Invalid --max-concurrent-uploads %d, must be at least 1", maxConcurrentUploads)
+	}
+	reproducibleArtifacts, _ := c.Bool("reproducible-artifacts")
+	artifactRetention, _ := c.String("artifact-retention")
+	if artifactRetention != "" && !artifactRetentionRe.MatchString(artifactRetention) {
+		return nil, fmt.Errorf("Invalid --artifact-retention %q, expected a number of days like 30d", artifactRetention)
+	}
 
 	attachOnError, _ := c.Bool("attach-on-error")
 	directMount, _ := c.Bool("direct-mount")
+	buildDirMode, _ := c.String("build-dir-mode")
+	switch buildDirMode {
+	case "":
+		buildDirMode = BuildDirModeCopy
+		if directMount {
+			buildDirMode = BuildDirModeReadWrite
+		}
+	case BuildDirModeCopy:
+		directMount = false
+	case BuildDirModeReadOnly, BuildDirModeReadWrite:
+		directMount = true
+	default:
+		return nil, fmt.Errorf("Invalid --build-dir-mode %q, expected ro, copy or rw", buildDirMode)
+	}
+	failOnDirtySource, _ := c.Bool("fail-on-dirty-source")
+	skipCheckout, _ := c.Bool("skip-checkout")
+	if skipCheckout && projectURL != "" {
+		return nil, fmt.Errorf("--skip-checkout can only be used with a local project directory")
+	}
+	sourceArchive, _ := c.String("source-archive")
+	if sourceArchive != "" {
+		if projectURL != "" || directMount || skipCheckout {
+			return nil, fmt.Errorf("--source-archive can't be combined with a project URL, --direct-mount or --skip-checkout")
+		}
+		sourceArchive, _ = filepath.Abs(sourceArchive)
+	}
+	inputArtifact, _ := c.String("input-artifact")
+	inputArtifactDir, _ := c.String("input-artifact-dir")
+	if inputArtifact != "" && (directMount || skipCheckout) {
+		return nil, fmt.Errorf("--input-artifact needs a copy of the source, it can't be used with --direct-mount or --skip-checkout")
+	}
+	if inputArtifactDir != "" {
+		cleaned := filepath.Clean(inputArtifactDir)
+		if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return nil, fmt.Errorf("--input-artifact-dir must be a directory inside the source, got %q", inputArtifactDir)
+		}
+	}
 	enableDevSteps, _ := c.Bool("enable-dev-steps")
 	publishPorts, _ := c.StringSlice("publish")
 	enableVolumes, _ := c.Bool("enable-volumes")
 	werckerYml, _ := c.String("wercker-yml")
+	configOverlay, _ := c.String("config-overlay")
+	prebuildScript, _ := c.String("prebuild-script")
+	if prebuildScript != "" {
+		prebuildScript, _ = filepath.Abs(prebuildScript)
+	}
+	cancelFile, _ := c.String("cancel-file")
+	if cancelFile != "" {
+		cancelFile, _ = filepath.Abs(cancelFile)
+	}
+	// The interval is given in seconds but we store it as milliseconds
+	cancelFileIntervalFloat, _ := c.Float64("cancel-file-interval", 1.0)
+	cancelFileInterval := int(cancelFileIntervalFloat * 1000)
+	if cancelFileInterval < 1 {
+		return nil, fmt.Errorf("Invalid --cancel-file-interval %v, it must be at least 0.001", cancelFileIntervalFloat)
+	}
+	failureMessageTemplate, _ := c.String("failure-message-template")
+	if _, err := parseFailureMessageTemplate(failureMessageTemplate); err != nil {
+		return nil, fmt.Errorf("Invalid --failure-message-template: %s", err)
+	}
 
 	return &PipelineOptions{
 		GlobalOptions: globalOpts,
@@ -584,13 +1254,40 @@ func NewPipelineOptions(c util.Settings, e *util.Environment) (*PipelineOptions,
 		ApplicationOwnerName:     applicationOwnerName,
 		ApplicationStartedByName: applicationStartedByName,
 
-		Message:       message,
-		Tag:           tag,
-		Repository:    repository,
-		ShouldCommit:  shouldCommit,
-		ShouldStoreS3: shouldStoreS3,
+		Message:          message,
+		Tag:              tag,
+		CommitTags:       commitTags,
+		ShouldPush:       shouldPush,
+		Registries:       registries,
+		DryRunPush:       dryRunPush,
+		Repository:       repository,
+		Labels:           labels,
+		ContainerLabels:  containerLabels,
+		ImageAnnotations: imageAnnotations,
+		ImageCreated:     imageCreated,
+		CommitPaths:      commitPaths,
+		AnnotateCommit:   annotateCommit,
+		ShouldCommit:     shouldCommit,
+		KeepFailedImages: keepFailedImages,
+		ShouldStoreS3:    shouldStoreS3,
+
+		ShouldCheckpoint: shouldCheckpoint,
+		ResumeFrom:       resumeFrom,
+		RetryFailedBuild: retryFailedBuild,
+
+		StepCheckpoints:     stepCheckpoints,
+		PushStepCheckpoints: pushStepCheckpoints,
+
+		PreparedRepository: preparedRepository,
+		PreparedTag:        preparedTag,
+		ShouldPushPrepared: shouldPushPrepared,
+
+		ScanCommand:     scanCommand,
+		ScanNonblocking: scanNonblocking,
 
 		WorkingDir: workingDir,
+		StepStore:  stepStore,
+		CacheDir:   cacheDir,
 
 		GuestRoot:  guestRoot,
 		MntRoot:    mntRoot,
@@ -602,19 +1299,189 @@ func NewPipelineOptions(c util.Settings, e *util.Environment) (*PipelineOptions,
 
 		CommandTimeout:    commandTimeout,
 		NoResponseTimeout: noResponseTimeout,
+		BuildTimeout:      buildTimeout,
+		BoxPullTimeout:    boxPullTimeout,
+		StepTimeoutGrace:  stepTimeoutGrace,
+		PullPolicy:        pullPolicy,
 		ShouldArtifacts:   shouldArtifacts,
+		NoStore:           noStore,
 		ShouldRemove:      shouldRemove,
 		SourceDir:         sourceDir,
-
-		AttachOnError:  attachOnError,
-		DirectMount:    directMount,
-		EnableDevSteps: enableDevSteps,
-		PublishPorts:   publishPorts,
-		EnableVolumes:  enableVolumes,
-		WerckerYml:     werckerYml,
+		BoxTagFromEnv:     boxTagFromEnv,
+		ExplainEnv:        explainEnv,
+		ExpandEnvFiles:    expandEnvFiles,
+		StepOrderStrategy: stepOrderStrategy,
+		StepNetwork:       stepNetwork,
+		SummaryJSON:       summaryJSON,
+		NotifyWebhook:     notifyWebhook,
+		NotifyOn:          notifyOn,
+		StepLogDir:        stepLogDir,
+		PrintMetadata:     printMetadata,
+		AnnotationFormat:  annotationFormat,
+		LogServer:         logServer,
+		OTLPEndpoint:      otlpEndpoint,
+		OTLPLogs:          otlpLogs,
+		DumpEnv:           dumpEnv,
+		DumpEnvUnmasked:   dumpEnvUnmasked,
+		Secrets:           secrets,
+
+		FailOnEmptyArtifact:    failOnEmptyArtifact,
+		WarnOnEmptyArtifact:    warnOnEmptyArtifact,
+		AllowEmptyPipeline:     allowEmptyPipeline,
+		WarnOnLatestTag:        warnOnLatestTag,
+		ForbidLatestTag:        forbidLatestTag,
+		MinArtifactSize:        int64(minArtifactSize),
+		ConcurrentUpload:       concurrentUpload,
+		MaxConcurrentUploads:   maxConcurrentUploads,
+		ArtifactRetention:      artifactRetention,
+		InputArtifact:          inputArtifact,
+		InputArtifactDir:       inputArtifactDir,
+		ReproducibleArtifacts:  reproducibleArtifacts,
+		UploadPartialOnTimeout: uploadPartialOnTimeout,
+		StepWorkingTimeout:     stepWorkingTimeout,
+
+		AttachOnError:     attachOnError,
+		DirectMount:       directMount,
+		BuildDirMode:      buildDirMode,
+		FailOnDirtySource: failOnDirtySource,
+		SkipCheckout:      skipCheckout,
+		SourceArchive:     sourceArchive,
+		EnableDevSteps:    enableDevSteps,
+		PublishPorts:      publishPorts,
+		EnableVolumes:     enableVolumes,
+		WerckerYml:        werckerYml,
+		ConfigOverlay:     configOverlay,
+		PrebuildScript:    prebuildScript,
+
+		CancelFile:         cancelFile,
+		CancelFileInterval: cancelFileInterval,
+
+		FailureMessageTemplate: failureMessageTemplate,
 	}, nil
 }
 
+// ResourceLabels are put on every container wercker creates and every image
+// it commits, so they can be told apart from anything else on the host.
+func (o *PipelineOptions) ResourceLabels() map[string]string {
+	labels := map[string]string{
+		"io.wercker":             "true",
+		"io.wercker.pipeline-id": o.PipelineID,
+		"io.wercker.pipeline":    o.Pipeline,
+	}
+	if o.BuildID != "" {
+		labels["io.wercker.build-id"] = o.BuildID
+	}
+	if o.DeployID != "" {
+		labels["io.wercker.deploy-id"] = o.DeployID
+	}
+	if o.ApplicationName != "" {
+		labels["io.wercker.app"] = fmt.Sprintf("%s/%s", o.ApplicationOwnerName, o.ApplicationName)
+	}
+	for k, v := range o.ContainerLabels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// OCIAnnotations are the pre-defined annotation keys of the OCI image-spec
+// that we can derive from the build, the --oci-annotation values override
+// them.
+func (o *PipelineOptions) OCIAnnotations() map[string]string {
+	annotations := map[string]string{}
+	if o.ImageCreated != "" {
+		annotations["org.opencontainers.image.created"] = o.ImageCreated
+	}
+	if o.GitDomain != "" && o.GitOwner != "" && o.GitRepository != "" {
+		annotations["org.opencontainers.image.source"] = fmt.Sprintf("https://%s/%s/%s", o.GitDomain, o.GitOwner, o.GitRepository)
+	}
+	if o.GitCommit != "" {
+		annotations["org.opencontainers.image.revision"] = o.GitCommit
+	}
+	if o.Tag != "" {
+		annotations["org.opencontainers.image.version"] = o.Tag
+	}
+	if o.ApplicationName != "" {
+		annotations["org.opencontainers.image.title"] = o.ApplicationName
+	}
+	for k, v := range o.ImageAnnotations {
+		annotations[k] = v
+	}
+	return annotations
+}
+
+// LogFields are the structured fields that tag the log lines of a run, so
+// aggregated logs can be filtered by build and application.
+func (o *PipelineOptions) LogFields() util.LogFields {
+	buildID := o.BuildID
+	if buildID == "" {
+		buildID = o.DeployID
+	}
+	return util.LogFields{
+		"build_id": buildID,
+		"app":      fmt.Sprintf("%s/%s", o.ApplicationOwnerName, o.ApplicationName),
+	}
+}
+
+// PrebuildEnv is the build metadata passed to the --prebuild-script, in the
+// KEY=value form of os.Environ. Unknown values are left out.
+func (o *PipelineOptions) PrebuildEnv(projectDir string) []string {
+	metadata := [][2]string{
+		{"WERCKER_BUILD_ID", o.BuildID},
+		{"WERCKER_DEPLOY_ID", o.DeployID},
+		{"WERCKER_DEPLOYTARGET_NAME", o.DeployTarget},
+		{"WERCKER_PIPELINE", o.Pipeline},
+		{"WERCKER_PIPELINE_ID", o.PipelineID},
+		{"WERCKER_APPLICATION_ID", o.ApplicationID},
+		{"WERCKER_APPLICATION_NAME", o.ApplicationName},
+		{"WERCKER_APPLICATION_OWNER_NAME", o.ApplicationOwnerName},
+		{"WERCKER_GIT_DOMAIN", o.GitDomain},
+		{"WERCKER_GIT_OWNER", o.GitOwner},
+		{"WERCKER_GIT_REPOSITORY", o.GitRepository},
+		{"WERCKER_GIT_BRANCH", o.GitBranch},
+		{"WERCKER_GIT_COMMIT", o.GitCommit},
+		{"WERCKER_SOURCE_DIR", projectDir},
+	}
+	env := []string{}
+	for _, kv := range metadata {
+		if kv[1] != "" {
+			env = append(env, fmt.Sprintf("%s=%s", kv[0], kv[1]))
+		}
+	}
+	return env
+}
+
+// PushRepositories are the repositories this run will push images to.
+func (o *PipelineOptions) PushRepositories() []string {
+	repositories := []string{}
+	if o.ShouldPushPrepared {
+		repositories = append(repositories, o.PreparedRepository)
+	}
+	if o.ShouldPush {
+		repositories = append(repositories, o.Repository)
+	}
+	return repositories
+}
+
+// ImageLabels are the labels for committed images. The docker API doesn't
+// let us annotate the manifest we push, so the OCI annotations are stored as
+// labels in the image config, where the same keys are used. The --label
+// values override both.
+func (o *PipelineOptions) ImageLabels() map[string]string {
+	labels := o.ResourceLabels()
+	for k, v := range o.OCIAnnotations() {
+		labels[k] = v
+	}
+	for k, v := range o.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// MaskSecrets replaces the values from the --secrets-file in s.
+func (o *PipelineOptions) MaskSecrets(s string) string {
+	return util.MaskSecrets(s, o.Secrets)
+}
+
 // SourcePath returns the path to the source dir
 func (o *PipelineOptions) SourcePath() string {
 	return o.GuestPath("source", o.SourceDir)
@@ -655,6 +1522,14 @@ func (o *PipelineOptions) BuildPath(s ...string) string {
 	return path.Join(o.WorkingDir, "builds", path.Join(s...))
 }
 
+// StepCachePath returns the path of the step cache, see `cache_key`
+func (o *PipelineOptions) StepCachePath() string {
+	if o.CacheDir != "" {
+		return o.CacheDir
+	}
+	return o.WorkingPath("step-cache")
+}
+
 // CachePath returns the path for storing pipeline cache
 func (o *PipelineOptions) CachePath() string {
 	return path.Join(o.WorkingDir, "cache")
@@ -740,6 +1615,9 @@ func NewDeployOptions(c util.Settings, e *util.Environment) (*PipelineOptions, e
 // DetectOptions for detect command
 type DetectOptions struct {
 	*GlobalOptions
+
+	OutputJSON bool
+	NoWrite    bool
 }
 
 // NewDetectOptions constructor
@@ -748,7 +1626,13 @@ func NewDetectOptions(c util.Settings, e *util.Environment) (*DetectOptions, err
 	if err != nil {
 		return nil, err
 	}
-	return &DetectOptions{globalOpts}, nil
+	outputJSON, _ := c.Bool("json")
+	noWrite, _ := c.Bool("no-write")
+	return &DetectOptions{
+		GlobalOptions: globalOpts,
+		OutputJSON:    outputJSON,
+		NoWrite:       noWrite,
+	}, nil
 }
 
 // InspectOptions for inspect command
@@ -765,9 +1649,40 @@ func NewInspectOptions(c util.Settings, e *util.Environment) (*InspectOptions, e
 	return &InspectOptions{pipelineOpts}, nil
 }
 
+// ExecStepOptions for the exec-step command
+type ExecStepOptions struct {
+	*PipelineOptions
+	ContainerID string
+	StepName    string
+}
+
+// NewExecStepOptions constructor
+func NewExecStepOptions(c util.Settings, e *util.Environment) (*ExecStepOptions, error) {
+	pipelineOpts, err := NewBuildOptions(c, e)
+	if err != nil {
+		return nil, err
+	}
+
+	containerID, _ := c.String("container")
+	if containerID == "" {
+		return nil, fmt.Errorf("--container is required")
+	}
+	stepName, _ := c.String("step")
+	if stepName == "" {
+		return nil, fmt.Errorf("--step is required")
+	}
+
+	return &ExecStepOptions{
+		PipelineOptions: pipelineOpts,
+		ContainerID:     containerID,
+		StepName:        stepName,
+	}, nil
+}
+
 // LoginOptions for the login command
 type LoginOptions struct {
 	*GlobalOptions
+	LoginEndpoint string
 }
 
 // NewLoginOptions constructor
@@ -776,7 +1691,19 @@ func NewLoginOptions(c util.Settings, e *util.Environment) (*LoginOptions, error
 	if err != nil {
 		return nil, err
 	}
-	return &LoginOptions{globalOpts}, nil
+
+	loginEndpoint, _ := c.String("login-endpoint")
+	if loginEndpoint != "" {
+		u, err := url.Parse(loginEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid --login-endpoint %q, expected an http or https URL", loginEndpoint)
+		}
+	}
+
+	return &LoginOptions{
+		GlobalOptions: globalOpts,
+		LoginEndpoint: loginEndpoint,
+	}, nil
 }
 
 // LogoutOptions for the login command
@@ -846,6 +1773,48 @@ func NewPullOptions(c util.Settings, e *util.Environment) (*PullOptions, error)
 	}, nil
 }
 
+// VerifyArtifactOptions for the verify-artifact command
+type VerifyArtifactOptions struct {
+	*GlobalOptions
+
+	File     string
+	Sha256   string
+	Manifest string
+	List     bool
+}
+
+// NewVerifyArtifactOptions constructor
+func NewVerifyArtifactOptions(c util.Settings, e *util.Environment) (*VerifyArtifactOptions, error) {
+	globalOpts, err := NewGlobalOptions(c, e)
+	if err != nil {
+		return nil, err
+	}
+
+	file, _ := c.String("file")
+	if file == "" {
+		return nil, fmt.Errorf("--file is required")
+	}
+	sha, _ := c.String("sha256")
+	sha = strings.ToLower(sha)
+	if sha != "" && !sha256Re.MatchString(sha) {
+		return nil, fmt.Errorf("Invalid --sha256 %q, expected 64 hex characters", sha)
+	}
+	manifest, _ := c.String("manifest")
+	if sha != "" && manifest != "" {
+		return nil, fmt.Errorf("--sha256 can't be combined with --manifest")
+	}
+	list, _ := c.Bool("list")
+
+	return &VerifyArtifactOptions{
+		GlobalOptions: globalOpts,
+
+		File:     file,
+		Sha256:   sha,
+		Manifest: manifest,
+		List:     list,
+	}, nil
+}
+
 // VersionOptions contains the options associated with the version
 // command.
 type VersionOptions struct {
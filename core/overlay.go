@@ -0,0 +1,136 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// ApplyConfigOverlay applies overlay, a JSON or YAML merge patch (RFC 7386),
+// to the config in file and returns the result as yaml. Maps are merged
+// recursively, a null removes the key and any other value, lists included,
+// replaces what was there.
+func ApplyConfigOverlay(filename string, file []byte, overlay []byte) ([]byte, error) {
+	config, err := configData(filename, file)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing your wercker.yml:\n  %s", err)
+	}
+
+	var patch interface{}
+	err = yaml.Unmarshal(overlay, &patch)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing the config overlay:\n  %s", err)
+	}
+	if _, ok := toMapSlice(patch); !ok {
+		return nil, fmt.Errorf("The config overlay must be a map")
+	}
+
+	return yaml.Marshal(mergePatch(config, patch))
+}
+
+// configData reads file as the format ConfigFromFile would, keeping the
+// order of keys where the format has one.
+func configData(filename string, file []byte) (interface{}, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(file))
+		decoder.UseNumber()
+		return decodeJSONValue(decoder)
+	case ".toml":
+		var data map[string]interface{}
+		_, err := toml.Decode(string(file), &data)
+		return data, err
+	default:
+		var data yaml.MapSlice
+		err := yaml.Unmarshal(file, &data)
+		return data, err
+	}
+}
+
+// mergePatch applies patch to target as described in RFC 7386.
+func mergePatch(target, patch interface{}) interface{} {
+	patchMap, ok := toMapSlice(patch)
+	if !ok {
+		return patch
+	}
+	targetMap, ok := toMapSlice(target)
+	if !ok {
+		targetMap = yaml.MapSlice{}
+	}
+
+	for _, item := range patchMap {
+		i := indexOfKey(targetMap, item.Key)
+		if item.Value == nil {
+			if i >= 0 {
+				targetMap = append(targetMap[:i], targetMap[i+1:]...)
+			}
+			continue
+		}
+		if i >= 0 {
+			targetMap[i].Value = mergePatch(targetMap[i].Value, item.Value)
+		} else {
+			targetMap = append(targetMap, yaml.MapItem{Key: item.Key, Value: mergePatch(nil, item.Value)})
+		}
+	}
+	return targetMap
+}
+
+func indexOfKey(m yaml.MapSlice, key string) int {
+	for i, item := range m {
+		if item.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// toMapSlice converts the map types the yaml, json and toml decoders give us
+// to a yaml.MapSlice, keys of unordered maps are sorted.
+func toMapSlice(v interface{}) (yaml.MapSlice, bool) {
+	switch m := v.(type) {
+	case yaml.MapSlice:
+		// Copy it so patching doesn't change the original
+		return append(yaml.MapSlice{}, m...), true
+	case map[interface{}]interface{}:
+		s := yaml.MapSlice{}
+		for k, v := range m {
+			s = append(s, yaml.MapItem{Key: fmt.Sprint(k), Value: v})
+		}
+		sort.Sort(mapItemsByKey(s))
+		return s, true
+	case map[string]interface{}:
+		s := yaml.MapSlice{}
+		for k, v := range m {
+			s = append(s, yaml.MapItem{Key: k, Value: v})
+		}
+		sort.Sort(mapItemsByKey(s))
+		return s, true
+	}
+	return nil, false
+}
+
+type mapItemsByKey yaml.MapSlice
+
+func (m mapItemsByKey) Len() int           { return len(m) }
+func (m mapItemsByKey) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m mapItemsByKey) Less(i, j int) bool { return m[i].Key < m[j].Key }
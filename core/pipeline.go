@@ -17,7 +17,9 @@ package core
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/wercker/wercker/util"
@@ -54,8 +56,9 @@ type Pipeline interface {
 	AfterSteps() []Step     // base
 
 	// Methods
-	CommonEnv() [][]string     // base
-	InitEnv(*util.Environment) // impl
+	CommonEnv() [][]string                    // base
+	EnvSources(*util.Environment) []EnvSource // impl
+	InitEnv(*util.Environment)                // impl
 	CollectArtifact(string) (*Artifact, error)
 	CollectCache(string) error
 	LocalSymlink()
@@ -162,6 +165,84 @@ func (p *BasePipeline) Env() *util.Environment {
 	return p.env
 }
 
+// ConfigEnv returns the default environment from the pipeline's `env` section
+// in the wercker.yml, sorted by key. It is applied before anything else, so
+// from lowest to highest precedence the environment is made up of:
+//
+//  1. the pipeline's `env` section in the wercker.yml
+//  2. the wercker variables (CommonEnv and the build or deploy variables)
+//  3. the mirrored and X_ passthru variables from the host environment
+//  4. the step's env_file
+func (p *BasePipeline) ConfigEnv() [][]string {
+	a := [][]string{}
+	if p.config == nil {
+		return a
+	}
+
+	keys := []string{}
+	for key := range p.config.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		a = append(a, []string{key, p.config.Env[key]})
+	}
+	return a
+}
+
+// EnvSource is one of the layers the pipeline environment is made of, they
+// are applied in order so later sources override earlier ones.
+type EnvSource struct {
+	Name   string
+	Env    [][]string
+	Hidden bool
+}
+
+// ApplyEnvSources adds all sources to the pipeline environment.
+func (p *BasePipeline) ApplyEnvSources(sources []EnvSource) {
+	env := p.Env()
+	for _, source := range sources {
+		if source.Hidden {
+			env.Hidden.Update(source.Env)
+		} else {
+			env.Update(source.Env)
+		}
+	}
+}
+
+// ExplainEnv describes where the value of key comes from: each source that
+// sets it, in the order they are applied, and the value that wins. Values
+// from hidden sources are masked.
+func ExplainEnv(key string, sources []EnvSource) []string {
+	lines := []string{}
+	winner := ""
+	found, foundHidden := false, false
+	for _, source := range sources {
+		for _, pair := range source.Env {
+			if pair[0] != key {
+				continue
+			}
+			value := pair[1]
+			if source.Hidden {
+				value = "<masked>"
+			}
+			lines = append(lines, fmt.Sprintf("  %s: %s=%s", source.Name, key, value))
+			// The hidden variables are exported after the visible ones, so
+			// a hidden variable always beats a visible one
+			if source.Hidden || !foundHidden {
+				winner = value
+				found = true
+				foundHidden = foundHidden || source.Hidden
+			}
+		}
+	}
+	if !found {
+		return append(lines, fmt.Sprintf("  %s is not set", key))
+	}
+	return append(lines, fmt.Sprintf("  final: %s=%s", key, winner))
+}
+
 // CommonEnv is shared by both builds and deploys
 func (p *BasePipeline) CommonEnv() [][]string {
 	a := [][]string{
@@ -183,6 +264,45 @@ func (p *BasePipeline) CommonEnv() [][]string {
 	return a
 }
 
+// workingDirEntries are what wercker keeps in its working dir.
+var workingDirEntries = []string{
+	"builds", "cache", "containers", "projects", "steps", "step-cache",
+	"latest", "latest_deploy", "last-run-*.json",
+}
+
+// copySourceCommand copies the mounted source to the pipeline dir. With
+// --skip-checkout the project dir is mounted as-is, so the working dir is
+// left out when it lives inside of it. When it is the project dir itself only
+// the entries wercker keeps in it are left out.
+func (p *BasePipeline) copySourceCommand() string {
+	copyAll := fmt.Sprintf(`cp -r "%s" "%s"`, p.options.MntPath("source"), p.options.GuestPath("source"))
+	if !p.options.SkipCheckout {
+		return copyAll
+	}
+	projectPath, err := filepath.Abs(p.options.ProjectPath)
+	if err != nil {
+		return copyAll
+	}
+	workingDir, err := filepath.Abs(p.options.WorkingDir)
+	if err != nil {
+		return copyAll
+	}
+	rel, err := filepath.Rel(projectPath, workingDir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return copyAll
+	}
+	excludes := []string{filepath.ToSlash(rel)}
+	if rel == "." {
+		excludes = workingDirEntries
+	}
+	excludeArgs := ""
+	for _, exclude := range excludes {
+		excludeArgs += fmt.Sprintf(` --exclude "./%s"`, exclude)
+	}
+	return fmt.Sprintf(`mkdir -p "%s" && tar -C "%s"%s -cf - . | tar -C "%s" -xf -`,
+		p.options.GuestPath("source"), p.options.MntPath("source"), excludeArgs, p.options.GuestPath("source"))
+}
+
 // SetupGuest ensures that the guest is prepared to run the pipeline.
 func (p *BasePipeline) SetupGuest(sessionCtx context.Context, sess *Session) error {
 	sess.HideLogs()
@@ -199,7 +319,7 @@ func (p *BasePipeline) SetupGuest(sessionCtx context.Context, sess *Session) err
 			fmt.Sprintf(`mkdir -p "%s"`, p.options.GuestPath()),
 			// Make sure the output path exists
 			// Copy the source from the mounted directory to the pipeline dir
-			fmt.Sprintf(`cp -r "%s" "%s"`, p.options.MntPath("source"), p.options.GuestPath("source")),
+			p.copySourceCommand(),
 			// Copy the cache from the mounted directory to the pipeline dir
 			fmt.Sprintf(`cp -r "%s" "%s"`, p.options.MntPath("cache"), p.options.GuestPath("cache")),
 		)
@@ -224,6 +344,18 @@ func (p *BasePipeline) SetupGuest(sessionCtx context.Context, sess *Session) err
 
 // ExportEnvironment to the session
 func (p *BasePipeline) ExportEnvironment(sessionCtx context.Context, sess *Session) error {
+	// The passthru FOO_FILE variables are resolved when they are read from
+	// the host, anyone who can change the wercker.yml could read host files
+	// through the others
+	if p.options.ExpandEnvFiles {
+		if err := p.Env().ExpandFiles(); err != nil {
+			return err
+		}
+		if err := p.Env().Hidden.ExpandFiles(); err != nil {
+			return err
+		}
+	}
+
 	exit, _, err := sess.SendChecked(sessionCtx, p.Env().Export()...)
 	if err != nil {
 		return err
@@ -91,3 +91,60 @@ func (s *PipelineSuite) TestIsBuildIDInvalid3() {
 
 	s.Equal(false, ok)
 }
+
+func (s *PipelineSuite) TestExplainEnv() {
+	sources := []EnvSource{
+		{Name: "wercker.yml env", Env: [][]string{{"FOO", "default"}}},
+		{Name: "X_ passthru from host", Env: [][]string{{"FOO", "override"}}},
+		{Name: "XXX_ passthru from host", Env: [][]string{{"FOO", "secret"}, {"TOKEN", "secret"}}, Hidden: true},
+	}
+
+	s.Equal([]string{
+		"  wercker.yml env: FOO=default",
+		"  X_ passthru from host: FOO=override",
+		"  XXX_ passthru from host: FOO=<masked>",
+		"  final: FOO=<masked>",
+	}, ExplainEnv("FOO", sources))
+
+	s.Equal([]string{
+		"  XXX_ passthru from host: TOKEN=<masked>",
+		"  final: TOKEN=<masked>",
+	}, ExplainEnv("TOKEN", sources))
+
+	s.Equal([]string{"  BAR is not set"}, ExplainEnv("BAR", sources))
+
+	// A hidden variable wins even if a visible source comes after it
+	hiddenFirst := []EnvSource{
+		{Name: "XXX_ passthru from host", Env: [][]string{{"FOO", "secret"}}, Hidden: true},
+		{Name: "env_file", Env: [][]string{{"FOO", "visible"}}},
+	}
+	s.Equal([]string{
+		"  XXX_ passthru from host: FOO=<masked>",
+		"  env_file: FOO=visible",
+		"  final: FOO=<masked>",
+	}, ExplainEnv("FOO", hiddenFirst))
+}
+
+func (s *PipelineSuite) TestCopySourceCommand() {
+	options := EmptyPipelineOptions()
+	options.GuestRoot = "/pipeline"
+	options.MntRoot = "/mnt"
+	options.ProjectPath = "/src/app"
+	options.WorkingDir = "/src/app/.wercker"
+	p := NewBasePipeline(BasePipelineOptions{Options: options})
+	s.Equal(`cp -r "/mnt/source" "/pipeline/source"`, p.copySourceCommand())
+
+	options.SkipCheckout = true
+	s.Equal(`mkdir -p "/pipeline/source" && tar -C "/mnt/source" --exclude "./.wercker" -cf - . | tar -C "/pipeline/source" -xf -`, p.copySourceCommand())
+
+	// The working dir is outside of the project
+	options.WorkingDir = "/tmp/wercker"
+	s.Equal(`cp -r "/mnt/source" "/pipeline/source"`, p.copySourceCommand())
+
+	// Excluding "./." would leave out everything
+	options.WorkingDir = "/src/app"
+	cmd := p.copySourceCommand()
+	s.NotContains(cmd, `--exclude "./."`)
+	s.Contains(cmd, `--exclude "./builds"`)
+	s.Contains(cmd, `--exclude "./last-run-*.json"`)
+}
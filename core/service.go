@@ -27,4 +27,5 @@ type ServiceBox interface {
 	Link() string
 	GetID() string
 	GetName() string
+	WaitReady(ctx context.Context) error
 }
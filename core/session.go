@@ -16,6 +16,7 @@ package core
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -220,6 +221,18 @@ func smartSplitLines(line, sentinel string) []string {
 	return lines
 }
 
+var (
+	// ErrCommandTimeout is returned when a command didn't complete within the
+	// command timeout
+	ErrCommandTimeout = errors.New("Command timed out")
+	// ErrNoResponseTimeout is returned when a command didn't output anything
+	// within the no response timeout
+	ErrNoResponseTimeout = errors.New("Command timed out after no response")
+	// ErrStepWorkingTimeout is returned when a step didn't output anything
+	// within the step working timeout
+	ErrStepWorkingTimeout = errors.New("Step timed out after producing no output")
+)
+
 // SendChecked sends commands, waits for them to complete and returns the
 // exit status and output
 // Ways to know a command is done:
@@ -280,7 +293,7 @@ func (s *Session) SendChecked(sessionCtx context.Context, commands ...string) (i
 				continue
 			case <-time.After(time.Duration(s.options.NoResponseTimeout) * time.Millisecond):
 				stopReading <- struct{}{}
-				errChan <- fmt.Errorf("Command timed out after no response")
+				errChan <- ErrNoResponseTimeout
 				return
 			}
 		}
@@ -330,7 +343,7 @@ func (s *Session) SendChecked(sessionCtx context.Context, commands ...string) (i
 	r := <-commandComplete
 	// Pretty up the error messages
 	if r.err == context.DeadlineExceeded {
-		r.err = fmt.Errorf("Command timed out")
+		r.err = ErrCommandTimeout
 	} else if r.err == context.Canceled {
 		r.err = fmt.Errorf("Command cancelled due to error")
 	}
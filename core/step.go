@@ -83,6 +83,14 @@ type Step interface {
 	DisplayName() string
 	Env() *util.Environment
 	Cwd() string
+	EnvFile() string
+	Image() string
+	DependsOn() []string
+	Artifacts() []string
+	CacheKey() []string
+	Network() string
+	CollectAsync() bool
+	IsEnabled(*util.Environment) bool
 	ID() string
 	Name() string
 	Owner() string
@@ -112,6 +120,14 @@ type BaseStepOptions struct {
 	SafeID      string
 	Version     string
 	Cwd         string
+	EnvFile     string
+	Image       string
+	DependsOn   []string
+	Artifacts   []string
+	CacheKey    []string
+	Enabled     string
+	Network     string
+	Collect     string
 }
 
 // BaseStep type for extending
@@ -124,6 +140,14 @@ type BaseStep struct {
 	safeID      string
 	version     string
 	cwd         string
+	envFile     string
+	image       string
+	dependsOn   []string
+	artifacts   []string
+	cacheKey    []string
+	enabled     string
+	network     string
+	collect     string
 }
 
 func NewBaseStep(args BaseStepOptions) *BaseStep {
@@ -136,6 +160,14 @@ func NewBaseStep(args BaseStepOptions) *BaseStep {
 		safeID:      args.SafeID,
 		version:     args.Version,
 		cwd:         args.Cwd,
+		envFile:     args.EnvFile,
+		image:       args.Image,
+		dependsOn:   args.DependsOn,
+		artifacts:   args.Artifacts,
+		cacheKey:    args.CacheKey,
+		enabled:     args.Enabled,
+		network:     args.Network,
+		collect:     args.Collect,
 	}
 }
 
@@ -154,6 +186,116 @@ func (s *BaseStep) Cwd() string {
 	return s.cwd
 }
 
+// EnvFile getter
+func (s *BaseStep) EnvFile() string {
+	return s.envFile
+}
+
+// Image getter
+func (s *BaseStep) Image() string {
+	return s.image
+}
+
+// DependsOn getter
+func (s *BaseStep) DependsOn() []string {
+	return s.dependsOn
+}
+
+// Artifacts getter
+func (s *BaseStep) Artifacts() []string {
+	return s.artifacts
+}
+
+// CacheKey getter, the globs of the files the step's result depends on
+func (s *BaseStep) CacheKey() []string {
+	return s.cacheKey
+}
+
+// Network getter, empty if the step doesn't set it
+func (s *BaseStep) Network() string {
+	return s.network
+}
+
+const (
+	// StepNetworkDefault runs a step with the networking of its container
+	StepNetworkDefault = "default"
+
+	// StepNetworkNone runs a step without network access
+	StepNetworkNone = "none"
+)
+
+// validateStepNetwork checks the `network` property of a step
+func validateStepNetwork(network string) error {
+	if network != StepNetworkDefault && network != StepNetworkNone {
+		return fmt.Errorf("unknown network %q, expected %s or %s", network, StepNetworkDefault, StepNetworkNone)
+	}
+	return nil
+}
+
+const (
+	// StepCollectSync collects the artifacts of a step before the next step
+	StepCollectSync = "sync"
+
+	// StepCollectAsync collects the artifacts of a step while the next steps
+	// run
+	StepCollectAsync = "async"
+)
+
+// validateStepCollect checks the `collect` property of a step
+func validateStepCollect(collect string) error {
+	if collect != StepCollectSync && collect != StepCollectAsync {
+		return fmt.Errorf("unknown collect %q, expected %s or %s", collect, StepCollectSync, StepCollectAsync)
+	}
+	return nil
+}
+
+// CollectAsync getter, whether the `artifacts` of the step are collected and
+// uploaded in the background
+func (s *BaseStep) CollectAsync() bool {
+	return s.collect == StepCollectAsync
+}
+
+// StepNetwork is the network a step runs with: its own `network` property,
+// or --step-network if it doesn't have one.
+func StepNetwork(step Step, options *PipelineOptions) string {
+	if step.Network() != "" {
+		return step.Network()
+	}
+	return options.StepNetwork
+}
+
+// IsEnabled evaluates the `enabled` expression of the step against env. The
+// expression is either a single value, like $RUN_INTEGRATION, or a comparison
+// like $RUN_INTEGRATION == 1 or $TARGET != production. A single value is
+// false when it is empty, 0, false, no or off. Steps without an expression
+// are always enabled.
+// env should be the environment the step runs in. Like in the container, host
+// variables are only in it when passed through with an X_ or XXX_ prefix: a
+// step enabled by $RUN_INTEGRATION needs X_RUN_INTEGRATION=1 on the host.
+func (s *BaseStep) IsEnabled(env *util.Environment) bool {
+	if strings.TrimSpace(s.enabled) == "" {
+		return true
+	}
+	return evalEnabled(s.enabled, env)
+}
+
+func evalEnabled(expr string, env *util.Environment) bool {
+	value := func(v string) string {
+		return strings.Trim(strings.TrimSpace(env.Interpolate(v)), `"'`)
+	}
+	if parts := strings.SplitN(expr, "!=", 2); len(parts) == 2 {
+		return value(parts[0]) != value(parts[1])
+	}
+	if parts := strings.SplitN(expr, "==", 2); len(parts) == 2 {
+		return value(parts[0]) == value(parts[1])
+	}
+	switch strings.ToLower(value(expr)) {
+	case "", "0", "false", "no", "off":
+		return false
+	}
+	return true
+}
+
 // ID getter
 func (s *BaseStep) ID() string {
 	return s.id
@@ -262,6 +404,14 @@ func NewStep(stepConfig *StepConfig, options *PipelineOptions) (*ExternalStep, e
 			safeID:      stepSafeID,
 			version:     version,
 			cwd:         stepConfig.Cwd,
+			envFile:     stepConfig.EnvFile,
+			image:       stepConfig.Image,
+			dependsOn:   stepConfig.DependsOn,
+			artifacts:   stepConfig.Artifacts,
+			cacheKey:    stepConfig.CacheKey,
+			enabled:     stepConfig.Enabled,
+			network:     stepConfig.Network,
+			collect:     stepConfig.Collect,
 		},
 		options: options,
 		data:    data,
@@ -338,26 +488,23 @@ func (s *ExternalStep) Fetch() (string, error) {
 		return "", err
 	}
 
+	// Steps from the --step-store are shared with other builds, local dev
+	// steps never go in there
+	if !stepExists && s.options.StepStore != "" && !strings.HasPrefix(s.url, "file:///") {
+		stepPath, err = s.fetchFromStore()
+		if err != nil {
+			return "", err
+		}
+		stepExists = true
+	}
+
 	if !stepExists {
 		// If we don't have a url already
 		if s.url == "" {
-			// Grab the info about the step from the api
-
-			// TODO(termie): probably don't need these in global options?
-			apiOptions := api.APIOptions{
-				BaseURL:   s.options.GlobalOptions.BaseURL,
-				AuthToken: s.options.GlobalOptions.AuthToken,
-			}
-			client := api.NewAPIClient(&apiOptions)
-			stepInfo, err := client.GetStepVersion(s.Owner(), s.Name(), s.Version())
+			err = s.lookupURL()
 			if err != nil {
-				if apiErr, ok := err.(*api.APIError); ok && apiErr.StatusCode == 404 {
-					return "", fmt.Errorf("The step \"%s\" was not found", s.ID())
-				}
 				return "", err
 			}
-
-			s.url = stepInfo.TarballURL
 		}
 
 		// If we have a file uri let's just copytree it.
@@ -405,6 +552,41 @@ func (s *ExternalStep) Fetch() (string, error) {
 	return hostStepPath, nil
 }
 
+// lookupURL grabs the url of the step tarball from the api.
+func (s *ExternalStep) lookupURL() error {
+	// TODO(termie): probably don't need these in global options?
+	apiOptions := api.APIOptions{
+		BaseURL:   s.options.GlobalOptions.BaseURL,
+		AuthToken: s.options.GlobalOptions.AuthToken,
+	}
+	client := api.NewAPIClient(&apiOptions)
+	stepInfo, err := client.GetStepVersion(s.Owner(), s.Name(), s.Version())
+	if err != nil {
+		if apiErr, ok := err.(*api.APIError); ok && apiErr.StatusCode == 404 {
+			return fmt.Errorf("The step \"%s\" was not found", s.ID())
+		}
+		return err
+	}
+	s.url = stepInfo.TarballURL
+	return nil
+}
+
+// fetchFromStore returns the directory of the step in the --step-store,
+// adding it to the store first if it isn't there yet.
+func (s *ExternalStep) fetchFromStore() (string, error) {
+	store := NewStepStore(s.options.StepStore)
+	if stepPath, ok := store.Lookup(s.owner, s.name, s.version); ok {
+		s.logger.Debugln("Using stored step", s.ID(), "from", stepPath)
+		return stepPath, nil
+	}
+	if s.url == "" {
+		if err := s.lookupURL(); err != nil {
+			return "", err
+		}
+	}
+	return store.Add(s.owner, s.name, s.version, s.url)
+}
+
 // SetupGuest ensures that the guest is ready to run a Step.
 func (s *ExternalStep) SetupGuest(sessionCtx context.Context, sess *Session) error {
 	defer s.LocalSymlink()
@@ -475,6 +657,7 @@ func (s *ExternalStep) InitEnv(env *util.Environment) {
 		[]string{"WERCKER_REPORT_NUMBERS_FILE", s.ReportPath("numbers.ini")},
 		[]string{"WERCKER_REPORT_MESSAGE_FILE", s.ReportPath("message.txt")},
 		[]string{"WERCKER_REPORT_ARTIFACTS_DIR", s.ReportPath("artifacts")},
+		[]string{"WERCKER_REPORT_ANNOTATIONS_FILE", s.ReportPath("annotations")},
 	}
 	s.Env().Update(a)
 
@@ -111,3 +111,21 @@ func (s *StepSuite) TestFetchFileDev() {
 	_, err = step.Fetch()
 	s.Nil(err)
 }
+
+func (s *StepSuite) TestStepIsEnabled() {
+	env := util.NewEnvironment("RUN_INTEGRATION=1", "TARGET=staging", "SKIP=false")
+	enabled := func(expr string) bool {
+		return NewBaseStep(BaseStepOptions{Enabled: expr}).IsEnabled(env)
+	}
+
+	s.True(enabled(""))
+	s.True(enabled("$RUN_INTEGRATION"))
+	s.True(enabled("$RUN_INTEGRATION == 1"))
+	s.True(enabled("${TARGET} != production"))
+	s.True(enabled(`$TARGET == "staging"`))
+
+	s.False(enabled("$SKIP"))
+	s.False(enabled("$MISSING"))
+	s.False(enabled("$RUN_INTEGRATION == 0"))
+	s.False(enabled("$TARGET != staging"))
+}
@@ -0,0 +1,128 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/wercker/wercker/util"
+)
+
+// StepCache remembers which steps with a `cache_key` succeeded for a hash of
+// their inputs, along with their `artifacts`, so a step whose inputs haven't
+// changed can be skipped and its outputs restored.
+type StepCache struct {
+	root string
+}
+
+// NewStepCache constructor
+func NewStepCache(root string) *StepCache {
+	return &StepCache{root: root}
+}
+
+// Path returns a path in the cache entry of key
+func (c *StepCache) Path(key string, s ...string) string {
+	return filepath.Join(c.root, key, filepath.Join(s...))
+}
+
+func (c *StepCache) markerPath(key string) string {
+	return c.Path(key, "success")
+}
+
+// Hit tells whether the step with key succeeded before
+func (c *StepCache) Hit(key string) bool {
+	ok, _ := util.Exists(c.markerPath(key))
+	return ok
+}
+
+// MarkSuccess records that the step with key succeeded, once its outputs
+// are in the cache
+func (c *StepCache) MarkSuccess(key string) error {
+	return writeFileAtomic(c.markerPath(key), []byte(key+"\n"))
+}
+
+// Key hashes the inputs of step: what the step is, the files it was fetched
+// as, the image of the box it runs in, its parameters, its `artifacts` and
+// the contents of the files matching its `cache_key` globs in sourceDir.
+// Directories that match are hashed recursively.
+func (c *StepCache) Key(step Step, boxImageID, sourceDir string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "step %s/%s@%s %s\n", step.Owner(), step.Name(), step.Version(), step.DisplayName())
+	fmt.Fprintf(h, "box %s\n", boxImageID)
+	fmt.Fprintf(h, "image %s\n", step.Image())
+	if external, ok := step.(*ExternalStep); ok {
+		keys := []string{}
+		for k := range external.data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(h, "param %q %q\n", k, external.data[k])
+		}
+		// Versions like * and local steps can change without their
+		// version changing
+		if external.options != nil {
+			if err := hashFiles(h, "code", external.HostPath(), external.HostPath()); err != nil {
+				return "", err
+			}
+		}
+	}
+	for _, output := range step.Artifacts() {
+		fmt.Fprintf(h, "output %s\n", output)
+	}
+
+	for _, pattern := range step.CacheKey() {
+		matches, err := filepath.Glob(filepath.Join(sourceDir, pattern))
+		if err != nil {
+			return "", fmt.Errorf("Invalid cache_key pattern %q: %s", pattern, err)
+		}
+		fmt.Fprintf(h, "input %s\n", pattern)
+		for _, match := range matches {
+			if err := hashFiles(h, "file", sourceDir, match); err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFiles writes the checksum of every regular file in path to h, along
+// with its path relative to root.
+func hashFiles(h io.Writer, kind, root, path string) error {
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		sum, err := util.FileSha256(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %s %s\n", kind, filepath.ToSlash(rel), sum)
+		return nil
+	})
+}
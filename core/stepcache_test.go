@@ -0,0 +1,106 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type StepCacheSuite struct {
+	*util.TestSuite
+}
+
+func TestStepCacheSuite(t *testing.T) {
+	suiteTester := &StepCacheSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *StepCacheSuite) TestKey() {
+	source, err := ioutil.TempDir("", "step-cache-source")
+	s.Require().Nil(err)
+	defer os.RemoveAll(source)
+	lockfile := filepath.Join(source, "package-lock.json")
+	s.Require().Nil(ioutil.WriteFile(lockfile, []byte(`{"a": 1}`), 0644))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(source, "README.md"), []byte("readme"), 0644))
+
+	options := &PipelineOptions{GlobalOptions: &GlobalOptions{}, WorkingDir: source, PipelineID: "build"}
+	step := &ExternalStep{
+		BaseStep: NewBaseStep(BaseStepOptions{
+			DisplayName: "npm install",
+			Name:        "npm-install",
+			SafeID:      "npm-install-1",
+			CacheKey:    []string{"*.json"},
+			Artifacts:   []string{"node_modules"},
+		}),
+		options: options,
+	}
+	s.Require().Nil(os.MkdirAll(step.HostPath(), 0755))
+	s.Require().Nil(ioutil.WriteFile(step.HostPath("run.sh"), []byte("npm install"), 0644))
+	cache := NewStepCache("")
+
+	key, err := cache.Key(step, "sha256:node8", source)
+	s.Nil(err)
+	again, err := cache.Key(step, "sha256:node8", source)
+	s.Nil(err)
+	s.Equal(key, again)
+
+	// Files outside the cache_key don't matter
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(source, "README.md"), []byte("changed"), 0644))
+	unrelated, err := cache.Key(step, "sha256:node8", source)
+	s.Nil(err)
+	s.Equal(key, unrelated)
+
+	s.Require().Nil(ioutil.WriteFile(lockfile, []byte(`{"a": 2}`), 0644))
+	changed, err := cache.Key(step, "sha256:node8", source)
+	s.Nil(err)
+	s.NotEqual(key, changed)
+
+	step.data = map[string]string{"args": "--production"}
+	withParams, err := cache.Key(step, "sha256:node8", source)
+	s.Nil(err)
+	s.NotEqual(changed, withParams)
+
+	otherBox, err := cache.Key(step, "sha256:node10", source)
+	s.Nil(err)
+	s.NotEqual(withParams, otherBox)
+
+	// The step can change without its version changing
+	s.Require().Nil(ioutil.WriteFile(step.HostPath("run.sh"), []byte("npm ci"), 0644))
+	otherCode, err := cache.Key(step, "sha256:node8", source)
+	s.Nil(err)
+	s.NotEqual(withParams, otherCode)
+
+	step.cacheKey = []string{"[invalid"}
+	_, err = cache.Key(step, "sha256:node8", source)
+	s.NotNil(err)
+}
+
+func (s *StepCacheSuite) TestHit() {
+	root, err := ioutil.TempDir("", "step-cache")
+	s.Require().Nil(err)
+	defer os.RemoveAll(root)
+
+	cache := NewStepCache(root)
+	s.False(cache.Hit("abc"))
+	s.Nil(cache.MarkSuccess("abc"))
+	s.True(cache.Hit("abc"))
+	s.False(cache.Hit("def"))
+}
@@ -0,0 +1,109 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Strategies for --step-order-strategy
+const (
+	// StepOrderDeclared runs the steps in the order of the wercker.yml
+	StepOrderDeclared = "declared"
+	// StepOrderAlphabetical runs the steps sorted by display name
+	StepOrderAlphabetical = "alphabetical"
+	// StepOrderDependency runs every step after the steps named in its
+	// `depends-on`, otherwise keeping the declared order
+	StepOrderDependency = "dependency"
+)
+
+// OrderSteps orders steps according to strategy. Steps always run one after
+// the other, there are no parallel groups, so the strategy only decides the
+// position of each step in that single list. The main steps and the
+// after-steps are ordered separately, after-steps always run last.
+func OrderSteps(steps []Step, strategy string) ([]Step, error) {
+	ordered := append([]Step{}, steps...)
+	switch strategy {
+	case "", StepOrderDeclared:
+		return ordered, nil
+	case StepOrderAlphabetical:
+		sort.Stable(stepsByDisplayName(ordered))
+		return ordered, nil
+	case StepOrderDependency:
+		return orderStepsByDependency(ordered)
+	}
+	return nil, fmt.Errorf("Invalid step order strategy %s, expected one of: %s", strategy,
+		strings.Join([]string{StepOrderDeclared, StepOrderAlphabetical, StepOrderDependency}, ", "))
+}
+
+type stepsByDisplayName []Step
+
+func (s stepsByDisplayName) Len() int           { return len(s) }
+func (s stepsByDisplayName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s stepsByDisplayName) Less(i, j int) bool { return s[i].DisplayName() < s[j].DisplayName() }
+
+// orderStepsByDependency does a topological sort of steps, each time picking
+// the first declared step whose dependencies have all been placed.
+func orderStepsByDependency(steps []Step) ([]Step, error) {
+	known := make(map[string]bool)
+	for _, step := range steps {
+		known[step.DisplayName()] = true
+	}
+	for _, step := range steps {
+		for _, dep := range step.DependsOn() {
+			if !known[dep] {
+				return nil, fmt.Errorf("Step %s depends on unknown step %s", step.DisplayName(), dep)
+			}
+		}
+	}
+
+	placed := make(map[string]bool)
+	ordered := []Step{}
+	remaining := steps
+	for len(remaining) > 0 {
+		next := -1
+		for i, step := range remaining {
+			ready := true
+			for _, dep := range step.DependsOn() {
+				if !placed[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			return nil, fmt.Errorf("Steps have circular dependencies: %s", stepNames(remaining))
+		}
+		step := remaining[next]
+		ordered = append(ordered, step)
+		placed[step.DisplayName()] = true
+		remaining = append(append([]Step{}, remaining[:next]...), remaining[next+1:]...)
+	}
+	return ordered, nil
+}
+
+func stepNames(steps []Step) string {
+	names := []string{}
+	for _, step := range steps {
+		names = append(names, step.DisplayName())
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,79 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type StepOrderSuite struct {
+	*util.TestSuite
+}
+
+func TestStepOrderSuite(t *testing.T) {
+	suiteTester := &StepOrderSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func orderTestStep(displayName string, dependsOn ...string) Step {
+	return &ExternalStep{
+		BaseStep: NewBaseStep(BaseStepOptions{
+			DisplayName: displayName,
+			Name:        "script",
+			DependsOn:   dependsOn,
+		}),
+	}
+}
+
+func (s *StepOrderSuite) TestOrderStepsDeclared() {
+	steps := []Step{orderTestStep("b"), orderTestStep("a")}
+	ordered, err := OrderSteps(steps, StepOrderDeclared)
+	s.Nil(err)
+	s.Equal("b, a", stepNames(ordered))
+}
+
+func (s *StepOrderSuite) TestOrderStepsAlphabetical() {
+	steps := []Step{orderTestStep("test"), orderTestStep("build"), orderTestStep("lint")}
+	ordered, err := OrderSteps(steps, StepOrderAlphabetical)
+	s.Nil(err)
+	s.Equal("build, lint, test", stepNames(ordered))
+	s.Equal("test, build, lint", stepNames(steps))
+}
+
+func (s *StepOrderSuite) TestOrderStepsDependency() {
+	steps := []Step{
+		orderTestStep("test", "build"),
+		orderTestStep("lint"),
+		orderTestStep("build", "deps"),
+		orderTestStep("deps"),
+	}
+	ordered, err := OrderSteps(steps, StepOrderDependency)
+	s.Nil(err)
+	s.Equal("lint, deps, build, test", stepNames(ordered))
+}
+
+func (s *StepOrderSuite) TestOrderStepsDependencyErrors() {
+	_, err := OrderSteps([]Step{orderTestStep("test", "missing")}, StepOrderDependency)
+	s.Error(err)
+
+	_, err = OrderSteps([]Step{orderTestStep("a", "b"), orderTestStep("b", "a")}, StepOrderDependency)
+	s.Error(err)
+
+	_, err = OrderSteps([]Step{orderTestStep("a")}, "random")
+	s.Error(err)
+}
@@ -0,0 +1,174 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/wercker/wercker/util"
+)
+
+// StepStore is a content-addressed store of fetched steps that is shared by
+// builds. Every step tarball is extracted once, in sha256/<checksum>, and an
+// index maps owner/name@version to the checksum so a known version is used
+// without downloading it again.
+type StepStore struct {
+	root string
+}
+
+// NewStepStore constructor
+func NewStepStore(root string) *StepStore {
+	return &StepStore{root: root}
+}
+
+// indexPath is the index entry of a step version. Versions like * that can
+// point at another tarball later are never indexed.
+func (s *StepStore) indexPath(owner, name, version string) string {
+	if version == "" || version == "*" {
+		return ""
+	}
+	return filepath.Join(s.root, "index", owner, name, version)
+}
+
+func (s *StepStore) contentPath(checksum string) string {
+	return filepath.Join(s.root, "sha256", checksum)
+}
+
+// Lookup returns the directory of the stored step owner/name@version.
+func (s *StepStore) Lookup(owner, name, version string) (string, bool) {
+	index := s.indexPath(owner, name, version)
+	if index == "" {
+		return "", false
+	}
+	checksum, err := ioutil.ReadFile(index)
+	if err != nil {
+		return "", false
+	}
+	stepPath := s.contentPath(strings.TrimSpace(string(checksum)))
+	if ok, _ := util.Exists(stepPath); !ok {
+		return "", false
+	}
+	return stepPath, true
+}
+
+// downloadLockTimeout is how long a download lock is respected, a build
+// that crashed doesn't get to block resuming its download forever.
+const downloadLockTimeout = time.Hour
+
+// Add downloads the step tarball at url into the store and returns the
+// directory of the step. A tarball that is already stored under another
+// name or version is not extracted again. An interrupted download is resumed
+// the next time the step is added.
+func (s *StepStore) Add(owner, name, version, url string) (string, error) {
+	downloads := filepath.Join(s.root, "downloads")
+	if err := os.MkdirAll(downloads, 0755); err != nil {
+		return "", err
+	}
+	tarball := filepath.Join(downloads, fmt.Sprintf("%s-%s@%s.tar.gz", owner, name, version))
+	// Builds that add the same step at the same time can't share the
+	// download, only the one holding the lock can resume it later
+	if lockDownload(tarball) {
+		defer os.Remove(tarball + ".lock")
+	} else {
+		tarball = fmt.Sprintf("%s-%s", tarball, uuid.NewRandom().String())
+		defer os.Remove(tarball + ".partial")
+		defer os.Remove(tarball + ".partial.validator")
+	}
+	if err := util.FetchResumable(url, tarball); err != nil {
+		return "", err
+	}
+	defer os.Remove(tarball)
+
+	checksum, err := util.FileSha256(tarball)
+	if err != nil {
+		return "", err
+	}
+	stepPath := s.contentPath(checksum)
+	if ok, _ := util.Exists(stepPath); !ok {
+		if err := s.extract(tarball, stepPath); err != nil {
+			return "", err
+		}
+	}
+
+	if index := s.indexPath(owner, name, version); index != "" {
+		if err := writeFileAtomic(index, []byte(checksum+"\n")); err != nil {
+			return "", err
+		}
+	}
+	return stepPath, nil
+}
+
+// lockDownload takes the lock on downloading to path, it returns false if
+// another build holds it.
+func lockDownload(path string) bool {
+	lock := path + ".lock"
+	if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > downloadLockTimeout {
+		os.Remove(lock)
+	}
+	f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// extract untars tarball next to stepPath and moves it in place, so builds
+// sharing the store never see a partially extracted step.
+func (s *StepStore) extract(tarball, stepPath string) error {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmp := fmt.Sprintf("%s-%s", stepPath, uuid.NewRandom().String())
+	if err := util.Untargzip(tmp, f); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, stepPath); err != nil {
+		os.RemoveAll(tmp)
+		// Another build stored the same tarball first
+		if ok, _ := util.Exists(stepPath); ok {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it to path.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s-%s", path, uuid.NewRandom().String())
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type StepStoreSuite struct {
+	*util.TestSuite
+}
+
+func TestStepStoreSuite(t *testing.T) {
+	suiteTester := &StepStoreSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func stepTarball(files map[string]string) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return b.Bytes()
+}
+
+func (s *StepStoreSuite) TestAddAndLookup() {
+	root, err := ioutil.TempDir("", "step-store")
+	s.Require().Nil(err)
+	defer os.RemoveAll(root)
+
+	tarball := stepTarball(map[string]string{"run.sh": "echo hi\n"})
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	store := NewStepStore(root)
+	_, ok := store.Lookup("wercker", "script", "1.0.0")
+	s.False(ok)
+
+	stepPath, err := store.Add("wercker", "script", "1.0.0", server.URL)
+	s.Require().Nil(err)
+	content, err := ioutil.ReadFile(filepath.Join(stepPath, "run.sh"))
+	s.Nil(err)
+	s.Equal("echo hi\n", string(content))
+
+	found, ok := store.Lookup("wercker", "script", "1.0.0")
+	s.True(ok)
+	s.Equal(stepPath, found)
+
+	// The same tarball under another version is stored once
+	other, err := store.Add("wercker", "script", "1.0.1", server.URL)
+	s.Nil(err)
+	s.Equal(stepPath, other)
+	s.Equal(2, requests)
+
+	// Floating versions are never looked up
+	_, err = store.Add("wercker", "script", "*", server.URL)
+	s.Nil(err)
+	_, ok = store.Lookup("wercker", "script", "*")
+	s.False(ok)
+}
+
+func (s *StepStoreSuite) TestAddConcurrently() {
+	root, err := ioutil.TempDir("", "step-store")
+	s.Require().Nil(err)
+	defer os.RemoveAll(root)
+
+	tarball := stepTarball(map[string]string{"run.sh": "echo hi\n"})
+	arrived := make(chan bool, 2)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- true
+		<-release
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	// Both builds are downloading the step before either is done
+	store := NewStepStore(root)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := store.Add("wercker", "script", "1.0.0", server.URL)
+			errs <- err
+		}()
+	}
+	<-arrived
+	<-arrived
+	close(release)
+	s.Nil(<-errs)
+	s.Nil(<-errs)
+
+	stepPath, ok := store.Lookup("wercker", "script", "1.0.0")
+	s.True(ok)
+	content, err := ioutil.ReadFile(filepath.Join(stepPath, "run.sh"))
+	s.Nil(err)
+	s.Equal("echo hi\n", string(content))
+
+	downloads, err := ioutil.ReadDir(filepath.Join(root, "downloads"))
+	s.Nil(err)
+	s.Empty(downloads)
+}
@@ -15,10 +15,14 @@
 package dockerlocal
 
 import (
+	"archive/tar"
+	"bytes"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
@@ -85,20 +89,193 @@ func (a *Artificer) Collect(artifact *core.Artifact) (*core.Artifact, error) {
 		}
 		return nil, err
 	}
+
+	if a.options.ReproducibleArtifacts {
+		outputFile.Close()
+		if err := util.NormalizeTarball(artifact.HostTarPath); err != nil {
+			return nil, err
+		}
+	}
 	return artifact, nil
 }
 
-// Upload an artifact to S3
+// stepArtifactGuestPath resolves a path from `artifacts` in the container,
+// relative paths are relative to the source dir.
+func (a *Artificer) stepArtifactGuestPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(a.options.SourcePath(), p)
+}
+
+// stepArtifactName is the file name of a path from `artifacts`
+func stepArtifactName(p string) string {
+	return strings.Replace(strings.Trim(filepath.Clean(p), "/"), "/", "_", -1)
+}
+
+// CollectStepArtifacts collects the paths a step declared in `artifacts` as
+// separate artifacts, stored under the step. Relative paths are relative to
+// the source dir, paths that don't exist are skipped.
+func (a *Artificer) CollectStepArtifacts(step core.Step, containerID string) ([]*core.Artifact, error) {
+	artifacts := []*core.Artifact{}
+	for _, p := range step.Artifacts() {
+		guestPath := a.stepArtifactGuestPath(p)
+		name := stepArtifactName(p)
+
+		artifact := &core.Artifact{
+			ContainerID:   containerID,
+			GuestPath:     guestPath,
+			HostTarPath:   a.options.HostPath(step.SafeID(), "artifacts", name+".tar"),
+			HostPath:      a.options.HostPath(step.SafeID(), "artifacts", name),
+			ApplicationID: a.options.ApplicationID,
+			BuildID:       a.options.BuildID,
+			DeployID:      a.options.DeployID,
+			BuildStepID:   step.SafeID(),
+			Bucket:        a.options.S3Bucket,
+			ContentType:   "application/x-tar",
+		}
+
+		fullArtifact, err := a.Collect(artifact)
+		if err != nil {
+			if err == util.ErrEmptyTarball {
+				a.logger.WithField("Path", p).Warnln("Step artifact not found, skipping")
+				continue
+			}
+			return nil, err
+		}
+		artifacts = append(artifacts, fullArtifact)
+	}
+	return artifacts, nil
+}
+
+// UploadStep copies the fetched step at hostPath into the container where a
+// pipeline container would have it mounted, so steps can run in containers
+// that weren't started by this run.
+func (a *Artificer) UploadStep(step core.Step, hostPath, containerID string) error {
+	client, err := NewDockerClient(a.dockerOptions)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := util.TarPathWithPrefix(&b, hostPath, step.SafeID()); err != nil {
+		return err
+	}
+	return client.UploadToContainer(containerID, docker.UploadToContainerOptions{
+		InputStream: &b,
+		Path:        a.options.MntPath(),
+	})
+}
+
+// CheckArtifact returns an error if the tarball of artifact contains no files,
+// or if the combined size of its files is less than minSize bytes.
+func CheckArtifact(artifact *core.Artifact, minSize int64) error {
+	f, err := os.Open(artifact.HostTarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	files := 0
+	var size int64
+	tarball := tar.NewReader(f)
+	for {
+		hdr, err := tarball.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		files++
+		size += hdr.Size
+	}
+
+	if files == 0 {
+		return fmt.Errorf("Artifact contains no files")
+	}
+	if size < minSize {
+		return fmt.Errorf("Artifact is %d bytes, expected at least %d bytes", size, minSize)
+	}
+	return nil
+}
+
+// Upload an artifact to S3, with the --artifact-retention hint added to its
+// metadata
 func (a *Artificer) Upload(artifact *core.Artifact) error {
+	meta := artifact.Meta
+	if a.options.ArtifactRetention != "" {
+		meta = make(map[string]*string, len(artifact.Meta)+1)
+		for k, v := range artifact.Meta {
+			meta[k] = v
+		}
+		retention := a.options.ArtifactRetention
+		meta["Retention"] = &retention
+	}
 	return a.store.StoreFromFile(&core.StoreFromFileArgs{
 		Path:        artifact.HostTarPath,
 		Key:         artifact.RemotePath(),
 		ContentType: artifact.ContentType,
 		MaxTries:    3,
-		Meta:        artifact.Meta,
+		Meta:        meta,
 	})
 }
 
+// UploadAll uploads artifacts to S3, at most MaxConcurrentUploads at a time.
+// It returns the first error after the other uploads have finished.
+func (a *Artificer) UploadAll(artifacts []*core.Artifact) error {
+	workers := a.options.MaxConcurrentUploads
+	if workers < 1 {
+		workers = 1
+	}
+
+	var total int64
+	for _, artifact := range artifacts {
+		if info, err := os.Stat(artifact.HostTarPath); err == nil {
+			total += info.Size()
+		}
+	}
+
+	queue := make(chan *core.Artifact)
+	errs := make(chan error, len(artifacts))
+	var l sync.Mutex
+	var done int
+	var uploaded int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for artifact := range queue {
+				err := a.Upload(artifact)
+				if err != nil {
+					errs <- err
+					continue
+				}
+
+				l.Lock()
+				done++
+				if info, err := os.Stat(artifact.HostTarPath); err == nil {
+					uploaded += info.Size()
+				}
+				a.logger.Printf("Uploaded %d/%d artifacts (%d/%d bytes)", done, len(artifacts), uploaded, total)
+				l.Unlock()
+			}
+		}()
+	}
+	for _, artifact := range artifacts {
+		queue <- artifact
+	}
+	close(queue)
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
 // DockerFileCollector impl of FileCollector
 type DockerFileCollector struct {
 	client      *DockerClient
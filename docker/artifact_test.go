@@ -15,12 +15,15 @@
 package dockerlocal
 
 import (
+	"archive/tar"
 	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/core"
 	"github.com/wercker/wercker/util"
 )
 
@@ -154,3 +157,75 @@ func (s *ArtifactSuite) TestDockerFileCollectorMultiNotFound() {
 		s.Equal(err, util.ErrEmptyTarball)
 	}
 }
+
+func (s *ArtifactSuite) TestCheckArtifact() {
+	tmp, err := ioutil.TempDir("", "test-")
+	s.Nil(err)
+	defer os.RemoveAll(tmp)
+
+	writeTarball := func(name string, files map[string]string) *core.Artifact {
+		path := filepath.Join(tmp, name)
+		f, err := os.Create(path)
+		s.Nil(err)
+		defer f.Close()
+
+		tw := tar.NewWriter(f)
+		s.Nil(tw.WriteHeader(&tar.Header{Name: "output/", Typeflag: tar.TypeDir, Mode: 0755}))
+		for file, content := range files {
+			s.Nil(tw.WriteHeader(&tar.Header{Name: "output/" + file, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+			_, err = tw.Write([]byte(content))
+			s.Nil(err)
+		}
+		s.Nil(tw.Close())
+		return &core.Artifact{HostTarPath: path}
+	}
+
+	empty := writeTarball("empty.tar", map[string]string{})
+	s.Error(CheckArtifact(empty, 0))
+
+	small := writeTarball("small.tar", map[string]string{"a": "hello"})
+	s.Nil(CheckArtifact(small, 0))
+	s.Nil(CheckArtifact(small, 5))
+	s.Error(CheckArtifact(small, 6))
+}
+
+func (s *ArtifactSuite) TestUploadStep() {
+	client := DockerOrSkip(s.T())
+
+	container, err := TempBusybox(client)
+	s.Nil(err)
+	defer container.Remove()
+
+	settings := util.NewCheapSettings(map[string]interface{}{
+		"working-dir": s.WorkingDir(),
+	})
+	env := util.NewEnvironment()
+	options, err := core.NewPipelineOptions(settings, env)
+	s.Nil(err)
+	dockerOptions, err := NewDockerOptions(settings, env)
+	s.Nil(err)
+
+	step, err := core.NewStep(&core.StepConfig{
+		ID:   "script",
+		Data: map[string]string{"code": "echo hello"},
+	}, options)
+	s.Nil(err)
+	hostPath, err := step.Fetch()
+	s.Nil(err)
+
+	artificer := NewArtificer(options, dockerOptions)
+	s.Nil(artificer.UploadStep(step, hostPath, container.ID))
+
+	// SetupGuest copies the step from where it is mounted
+	dfc := NewDockerFileCollector(client, container.ID)
+	archive, errs := dfc.Collect(options.MntPath(step.SafeID(), "run.sh"))
+	var b bytes.Buffer
+	select {
+	case err := <-archive.SingleBytes("run.sh", &b):
+		s.Nil(err)
+	case err := <-errs:
+		s.Nil(err)
+		s.T().FailNow()
+	}
+	s.Equal("set -e\necho hello", b.String())
+}
@@ -20,7 +20,10 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/google/shlex"
@@ -47,10 +50,15 @@ type DockerBox struct {
 	repository      string
 	tag             string
 	images          []*docker.Image
+	imageTags       []string
+	imageTagsLock   sync.Mutex
 	logger          *util.LogEntry
 	entrypoint      string
 	image           *docker.Image
 	volumes         []string
+	checkpoint      bool
+	result          string
+	buildInfo       *core.BuildInfo
 }
 
 // NewDockerBox from a name and other references
@@ -114,6 +122,15 @@ func NewDockerBox(boxConfig *core.BoxConfig, options *core.PipelineOptions, dock
 	}, nil
 }
 
+// UseCheckpoint makes the box start from a checkpoint committed by a
+// previous run instead of the configured image.
+func (b *DockerBox) UseCheckpoint(repository, tag string) {
+	b.repository = repository
+	b.tag = tag
+	b.Name = fmt.Sprintf("%s:%s", repository, tag)
+	b.checkpoint = true
+}
+
 func (b *DockerBox) links() []string {
 	serviceLinks := []string{}
 
@@ -138,6 +155,18 @@ func (b *DockerBox) GetTag() string {
 	return b.tag
 }
 
+// GetImageID gets the ID of the image the box runs, or empty string if it
+// hasn't been fetched yet
+func (b *DockerBox) GetImageID() string {
+	if b.container != nil {
+		return b.container.Image
+	}
+	if b.image != nil {
+		return b.image.ID
+	}
+	return ""
+}
+
 // GetID gets the container ID or empty string if we don't have a container
 func (b *DockerBox) GetID() string {
 	if b.container != nil {
@@ -160,9 +189,14 @@ func (b *DockerBox) binds(env *util.Environment) ([]string, error) {
 		if entry.IsDir() || entry.Mode()&os.ModeSymlink == os.ModeSymlink {
 
 			// For local dev we can mount read-write and avoid a copy, so we'll mount
-			// directly in the pipeline path
+			// directly in the pipeline path, --build-dir-mode ro keeps the
+			// source read-only
 			if b.options.DirectMount {
-				binds = append(binds, fmt.Sprintf("%s:%s:rw", b.options.HostPath(entry.Name()), b.options.GuestPath(entry.Name())))
+				mode := "rw"
+				if entry.Name() == "source" && b.options.BuildDirMode == core.BuildDirModeReadOnly {
+					mode = "ro"
+				}
+				binds = append(binds, fmt.Sprintf("%s:%s:%s", b.options.HostPath(entry.Name()), b.options.GuestPath(entry.Name()), mode))
 			} else {
 				binds = append(binds, fmt.Sprintf("%s:%s:ro", b.options.HostPath(entry.Name()), b.options.MntPath(entry.Name())))
 			}
@@ -197,6 +231,13 @@ func (b *DockerBox) RunServices(ctx context.Context, env *util.Environment) erro
 		}
 		links = append(links, service.Link())
 	}
+
+	for _, service := range b.services {
+		err := service.WaitReady(ctx)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -317,6 +358,257 @@ func (b *DockerBox) getContainerName() string {
 	return "wercker-pipeline-" + b.options.PipelineID
 }
 
+func (b *DockerBox) getStepContainerName(step core.Step) string {
+	return fmt.Sprintf("wercker-step-%s-%s", b.options.PipelineID, step.SafeID())
+}
+
+// fetchStepImage makes sure the image of a step container is available, it
+// follows --pull-policy like the box.
+func (b *DockerBox) fetchStepImage(ctx context.Context, image string) error {
+	client := b.client
+	_, err := client.InspectImage(image)
+	if b.dockerOptions.DockerLocal || b.options.PullPolicy == core.PullPolicyNever {
+		if err == docker.ErrNoSuchImage {
+			return fmt.Errorf("Image %s is not available locally and it won't be pulled", image)
+		}
+		return err
+	}
+	if b.options.PullPolicy == core.PullPolicyIfNotPresent {
+		if err == nil {
+			b.logger.WithField("Image", image).Debugln("Image is present, not pulling")
+			return nil
+		}
+		if err != docker.ErrNoSuchImage {
+			return err
+		}
+	}
+
+	e, err := core.EmitterFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	r, w := io.Pipe()
+	defer w.Close()
+
+	go EmitStatus(e, r, b.options)
+
+	repository, tag := docker.ParseRepositoryTag(image)
+	if tag == "" {
+		tag = "latest"
+	}
+	return b.dockerOptions.withRegistryTimeout(ctx, func(ctx context.Context) error {
+		options := docker.PullImageOptions{
+			OutputStream:  w,
+			RawJSONStream: true,
+			Repository:    repository,
+			Tag:           tag,
+			Context:       ctx,
+		}
+		return client.PullImage(options, b.dockerOptions.RegistryAuth(repository, docker.AuthConfiguration{}))
+	})
+}
+
+// RunStepContainer creates and starts a container for a step that runs in
+// its own image instead of the box. It gets the same mounts as the box, so
+// it shares the pipeline's source and steps, and it is linked to the box's
+// services.
+func (b *DockerBox) RunStepContainer(ctx context.Context, env *util.Environment, step core.Step) (*docker.Container, error) {
+	client := b.client
+	image := env.Interpolate(step.Image())
+	b.logger.WithField("Image", image).Debugln("Starting step container:", step.DisplayName())
+
+	err := b.fetchStepImage(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := shlex.Split(b.cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var container *docker.Container
+	err = b.dockerOptions.withDockerOpTimeout("create", b.getStepContainerName(step), func() error {
+		var err error
+		container, err = client.CreateContainer(
+			docker.CreateContainerOptions{
+				Name: b.getStepContainerName(step),
+				Config: &docker.Config{
+					Image:           image,
+					Hostname:        b.dockerOptions.Hostname,
+					Tty:             false,
+					OpenStdin:       true,
+					Cmd:             cmd,
+					Env:             dockerEnv(b.config.Env, env),
+					AttachStdin:     true,
+					AttachStdout:    true,
+					AttachStderr:    true,
+					NetworkDisabled: b.networkDisabled,
+					DNS:             b.dockerOptions.DockerDNS,
+					Labels:          b.options.ResourceLabels(),
+				},
+			})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	binds, err := b.binds(env)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.dockerOptions.withDockerOpTimeout("start", container.ID, func() error {
+		return client.StartContainer(container.ID, &docker.HostConfig{
+			Binds:      binds,
+			Links:      b.links(),
+			DNS:        b.dockerOptions.DockerDNS,
+			ExtraHosts: b.dockerOptions.AddHosts,
+		})
+	})
+	if err != nil {
+		b.RemoveStepContainer(container.ID)
+		return nil, err
+	}
+	return container, nil
+}
+
+// RemoveStepContainer removes a container started by RunStepContainer.
+func (b *DockerBox) RemoveStepContainer(containerID string) error {
+	b.logger.WithField("Container", containerID).Debugln("Removing step container:", containerID)
+	return b.dockerOptions.withDockerOpTimeout("remove", containerID, func() error {
+		return b.client.RemoveContainer(docker.RemoveContainerOptions{
+			ID:            containerID,
+			RemoveVolumes: true,
+			Force:         true,
+		})
+	})
+}
+
+// guestDirs are the pipeline dirs on the guest the steps work on
+var guestDirs = []string{"source", "cache", "output"}
+
+// CopyGuestDirs replaces the source, cache and output dirs in the container
+// dst with the ones in the container src, this is how a step container
+// shares them with the box. With --direct-mount both containers mount them
+// from the host already.
+func (b *DockerBox) CopyGuestDirs(src, dst string) error {
+	if b.options.DirectMount {
+		return nil
+	}
+	for _, name := range guestDirs {
+		guestPath := b.options.GuestPath(name)
+		b.logger.WithField("Path", guestPath).Debugln("Copying guest dir from", src, "to", dst)
+		err := b.client.ExecOne(dst, []string{"rm", "-rf", guestPath}, ioutil.Discard)
+		if err != nil {
+			return err
+		}
+
+		r, w := io.Pipe()
+		downloadErr := make(chan error, 1)
+		go func() {
+			err := b.client.DownloadFromContainer(src, docker.DownloadFromContainerOptions{
+				Path:         guestPath,
+				OutputStream: w,
+			})
+			w.CloseWithError(err)
+			downloadErr <- err
+		}()
+		err = b.client.UploadToContainer(dst, docker.UploadToContainerOptions{
+			InputStream: r,
+			Path:        b.options.GuestPath(),
+		})
+		// Unblocks the download if the upload stopped reading
+		r.CloseWithError(io.ErrClosedPipe)
+		if dlErr := <-downloadErr; dlErr != nil {
+			return dlErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// terminateScript signals the processes of a timed out step, they run in
+// the process group of the shell that is PID 1 of the container. When that
+// is group 1 kill -1 is used, it signals all processes but PID 1 and the
+// script itself. They get SIGTERM and the grace period before SIGKILL.
+const terminateScript = `pgid=$(sed -e 's/^.*) //' /proc/1/stat | cut -d' ' -f3)
+if [ "$pgid" = 1 ]; then target=-1; else target=-$pgid; fi
+kill -TERM $target 2>/dev/null
+i=0
+while [ $i -lt %d ] && kill -0 $target 2>/dev/null; do sleep 1; i=$((i+1)); done
+kill -KILL $target 2>/dev/null
+exit 0`
+
+// TerminateStep stops the processes of a timed out step in the container,
+// they get SIGTERM and --step-timeout-grace seconds to clean up before they
+// are killed. The container keeps running for the after-steps and the
+// artifacts.
+func (b *DockerBox) TerminateStep(containerID string) error {
+	b.logger.WithField("Container", containerID).Debugln("Terminating step in container:", containerID)
+	script := fmt.Sprintf(terminateScript, b.options.StepTimeoutGrace)
+	return b.client.ExecOne(containerID, []string{"sh", "-c", script}, ioutil.Discard)
+}
+
+// DisconnectNetworks disconnects a container from all its networks, for steps
+// with `network: none`. The returned func connects it again with the links
+// and aliases it had, so the services stay reachable by their names.
+func (b *DockerBox) DisconnectNetworks(containerID string) (func() error, error) {
+	client := b.client
+	container, err := client.InspectContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []string
+	if container.HostConfig != nil {
+		links = container.HostConfig.Links
+	}
+
+	type endpoint struct {
+		network string
+		config  *docker.EndpointConfig
+	}
+	disconnected := []endpoint{}
+	reconnect := func() error {
+		var firstErr error
+		for _, e := range disconnected {
+			err := client.ConnectNetwork(e.network, docker.NetworkConnectionOptions{
+				Container:      containerID,
+				EndpointConfig: e.config,
+			})
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	if container.NetworkSettings == nil {
+		return reconnect, nil
+	}
+	for network, settings := range container.NetworkSettings.Networks {
+		b.logger.WithField("Network", network).Debugln("Disconnecting container:", containerID)
+		err := client.DisconnectNetwork(network, docker.NetworkConnectionOptions{Container: containerID})
+		if err != nil {
+			reconnect()
+			return nil, err
+		}
+		disconnected = append(disconnected, endpoint{
+			network: network,
+			config: &docker.EndpointConfig{
+				Links:   links,
+				Aliases: settings.Aliases,
+			},
+		})
+	}
+	return reconnect, nil
+}
+
 // Run creates the container and runs it.
 func (b *DockerBox) Run(ctx context.Context, env *util.Environment) (*docker.Container, error) {
 	err := b.RunServices(ctx, env)
@@ -345,44 +637,65 @@ func (b *DockerBox) Run(ctx context.Context, env *util.Environment) (*docker.Con
 	}
 
 	// Make and start the container
-	container, err := client.CreateContainer(
-		docker.CreateContainerOptions{
-			Name: b.getContainerName(),
-			Config: &docker.Config{
-				Image:           env.Interpolate(b.Name),
-				Tty:             false,
-				OpenStdin:       true,
-				Cmd:             cmd,
-				Env:             myEnv,
-				AttachStdin:     true,
-				AttachStdout:    true,
-				AttachStderr:    true,
-				ExposedPorts:    exposedPorts(b.options.PublishPorts),
-				NetworkDisabled: b.networkDisabled,
-				DNS:             b.dockerOptions.DockerDNS,
-				Entrypoint:      entrypoint,
-				// Volumes: volumes,
-			},
-		})
+	var container *docker.Container
+	err = b.dockerOptions.withDockerOpTimeout("create", b.getContainerName(), func() error {
+		var err error
+		container, err = client.CreateContainer(
+			docker.CreateContainerOptions{
+				Name: b.getContainerName(),
+				Config: &docker.Config{
+					Image:           env.Interpolate(b.Name),
+					Hostname:        b.dockerOptions.Hostname,
+					Tty:             false,
+					OpenStdin:       true,
+					Cmd:             cmd,
+					Env:             myEnv,
+					AttachStdin:     true,
+					AttachStdout:    true,
+					AttachStderr:    true,
+					ExposedPorts:    exposedPorts(b.options.PublishPorts),
+					NetworkDisabled: b.networkDisabled,
+					DNS:             b.dockerOptions.DockerDNS,
+					Entrypoint:      entrypoint,
+					Labels:          b.options.ResourceLabels(),
+					// Volumes: volumes,
+				},
+			})
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	b.logger.Debugln("Docker Container:", container.ID)
 
+	if b.dockerOptions.BoxPrivileged {
+		b.logger.Warnln("Running the box in privileged mode, steps have full access to the host")
+	}
+
 	binds, err := b.binds(env)
 
 	if err != nil {
 		return nil, err
 	}
 
-	client.StartContainer(container.ID, &docker.HostConfig{
-		Binds:        binds,
-		Links:        b.links(),
-		PortBindings: portBindings(b.options.PublishPorts),
-		DNS:          b.dockerOptions.DockerDNS,
+	err = b.dockerOptions.withDockerOpTimeout("start", container.ID, func() error {
+		return client.StartContainer(container.ID, &docker.HostConfig{
+			Binds:        binds,
+			Links:        b.links(),
+			PortBindings: portBindings(b.options.PublishPorts),
+			DNS:          b.dockerOptions.DockerDNS,
+			ExtraHosts:   b.dockerOptions.AddHosts,
+			ShmSize:      b.dockerOptions.BoxShmSize,
+			Privileged:   b.dockerOptions.BoxPrivileged,
+			CapAdd:       b.dockerOptions.CapAdd,
+			CapDrop:      b.dockerOptions.CapDrop,
+		})
 	})
 	b.container = container
+	if err != nil {
+		return nil, err
+	}
 	return container, nil
 }
 
@@ -418,7 +731,13 @@ func (b *DockerBox) Clean() error {
 		}
 	}
 
-	if !b.options.ShouldCommit {
+	// With --keep-failed-images only the images of passing builds go
+	if !b.options.ShouldCommit || (b.options.KeepFailedImages && b.result == "passed") {
+		// An image with several tags can only be removed by ID once the
+		// extra tags are gone
+		for _, name := range b.imageTags {
+			client.RemoveImage(name)
+		}
 		for i := len(b.images) - 1; i >= 0; i-- {
 			b.logger.WithField("Image", b.images[i].ID).Debugln("Removing image:", b.images[i].ID)
 			client.RemoveImage(b.images[i].ID)
@@ -432,13 +751,22 @@ func (b *DockerBox) Clean() error {
 func (b *DockerBox) Restart() (*docker.Container, error) {
 	// TODO(termie): maybe move the container manipulation outside of here?
 	client := b.client
-	err := client.RestartContainer(b.container.ID, 1)
+	err := b.dockerOptions.withDockerOpTimeout("restart", b.container.ID, func() error {
+		return client.RestartContainer(b.container.ID, 1)
+	})
 	if err != nil {
 		return nil, err
 	}
 	return b.container, nil
 }
 
+// UseContainer makes the box use a container it didn't start, like the one
+// exec-step runs a step in, so steps with an image, a network or a timeout
+// can be run next to it. The box doesn't stop or remove it.
+func (b *DockerBox) UseContainer(container *docker.Container) {
+	b.container = container
+}
+
 // AddService needed by this Box
 func (b *DockerBox) AddService(service core.ServiceBox) {
 	b.services = append(b.services, service)
@@ -450,7 +778,9 @@ func (b *DockerBox) Stop() {
 	client := b.client
 	for _, service := range b.services {
 		b.logger.Debugln("Stopping service", service.GetID())
-		err := client.StopContainer(service.GetID(), 1)
+		err := b.dockerOptions.withDockerOpTimeout("stop", service.GetID(), func() error {
+			return client.StopContainer(service.GetID(), 1)
+		})
 
 		if err != nil {
 			if _, ok := err.(*docker.ContainerNotRunning); ok {
@@ -462,7 +792,9 @@ func (b *DockerBox) Stop() {
 	}
 	if b.container != nil {
 		b.logger.Debugln("Stopping container", b.container.ID)
-		err := client.StopContainer(b.container.ID, 1)
+		err := b.dockerOptions.withDockerOpTimeout("stop", b.container.ID, func() error {
+			return client.StopContainer(b.container.ID, 1)
+		})
 
 		if err != nil {
 			if _, ok := err.(*docker.ContainerNotRunning); ok {
@@ -484,21 +816,46 @@ func (b *DockerBox) Fetch(ctx context.Context, env *util.Environment) (*docker.I
 		return nil, err
 	}
 
+	// Checkpoints only exist locally
+	if b.checkpoint {
+		image, err := client.InspectImage(b.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to find checkpoint %s, did the previous run use --checkpoint?", b.Name)
+		}
+		b.image = image
+		return image, nil
+	}
+
 	// Shortcut to speed up local dev
-	if b.dockerOptions.DockerLocal {
+	if b.dockerOptions.DockerLocal || b.options.PullPolicy == core.PullPolicyNever {
 		image, err := client.InspectImage(env.Interpolate(b.Name))
 		if err != nil {
+			if err == docker.ErrNoSuchImage {
+				return nil, fmt.Errorf("Image %s is not available locally and it won't be pulled", env.Interpolate(b.Name))
+			}
 			return nil, err
 		}
 		b.image = image
 		return image, nil
 	}
 
+	if b.options.PullPolicy == core.PullPolicyIfNotPresent {
+		image, err := client.InspectImage(env.Interpolate(b.Name))
+		if err == nil {
+			b.logger.WithField("Image", b.Name).Debugln("Image is present, not pulling")
+			b.image = image
+			return image, nil
+		}
+		if err != docker.ErrNoSuchImage {
+			return nil, err
+		}
+	}
+
 	// Check for access to this image
-	auth := docker.AuthConfiguration{
+	auth := b.dockerOptions.RegistryAuth(env.Interpolate(b.repository), docker.AuthConfiguration{
 		Username: env.Interpolate(b.config.Username),
 		Password: env.Interpolate(b.config.Password),
-	}
+	})
 
 	checkOpts := CheckAccessOptions{
 		Auth:       auth,
@@ -525,16 +882,18 @@ func (b *DockerBox) Fetch(ctx context.Context, env *util.Environment) (*docker.I
 	// emitStatusses in a different go routine
 	go EmitStatus(e, r, b.options)
 
-	options := docker.PullImageOptions{
-		// changeme if we have a private registry
-		// Registry:      "docker.tsuru.io",
-		OutputStream:  w,
-		RawJSONStream: true,
-		Repository:    env.Interpolate(b.repository),
-		Tag:           env.Interpolate(b.tag),
-	}
-
-	err = client.PullImage(options, auth)
+	err = b.dockerOptions.withRegistryTimeout(ctx, func(ctx context.Context) error {
+		options := docker.PullImageOptions{
+			// changeme if we have a private registry
+			// Registry:      "docker.tsuru.io",
+			OutputStream:  w,
+			RawJSONStream: true,
+			Repository:    env.Interpolate(b.repository),
+			Tag:           env.Interpolate(b.tag),
+			Context:       ctx,
+		}
+		return client.PullImage(options, auth)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -555,6 +914,18 @@ func (b *DockerBox) Commit(name, tag, message string) (*docker.Image, error) {
 		"Tag":  tag,
 	}).Debugln("Commit container:", name, tag)
 
+	// Checkpoints and prepared environments need to outlive this run
+	isResult := !b.options.IsCheckpointRepository(name) && name != b.options.PreparedRepository
+
+	if isResult && len(b.options.CommitPaths) > 0 {
+		image, err := b.commitPaths(name, tag)
+		if err != nil {
+			return nil, err
+		}
+		b.images = append(b.images, image)
+		return image, b.tagCommit(image, name)
+	}
+
 	// TODO(termie): maybe move the container manipulation outside of here?
 	client := b.client
 
@@ -564,17 +935,193 @@ func (b *DockerBox) Commit(name, tag, message string) (*docker.Image, error) {
 		Tag:        tag,
 		Message:    "Build completed",
 		Author:     "wercker",
+		Run:        &docker.Config{Labels: b.options.ImageLabels()},
 	}
-	image, err := client.CommitContainer(commitOptions)
+	if b.result != "" {
+		commitOptions.Run.Labels["io.wercker.result"] = b.result
+	}
+	// The daemon merges this with the env of the container
+	if isResult && b.buildInfo != nil {
+		commitOptions.Run.Env = []string{fmt.Sprintf("%s=%s", core.BuildInfoEnv, b.buildInfo.JSON())}
+	}
+	var image *docker.Image
+	err := b.dockerOptions.withDockerOpTimeout("commit", b.container.ID, func() error {
+		var err error
+		image, err = client.CommitContainer(commitOptions)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	b.images = append(b.images, image)
+	if isResult {
+		b.images = append(b.images, image)
+		if err := b.tagCommit(image, name); err != nil {
+			return nil, err
+		}
+	}
 
 	return image, nil
 }
 
+// tagCommit adds the --commit-tag tags to the committed image.
+func (b *DockerBox) tagCommit(image *docker.Image, name string) error {
+	for _, tag := range b.options.CommitTags {
+		b.logger.WithFields(util.LogFields{
+			"Name": name,
+			"Tag":  tag,
+		}).Debugln("Tag image:", name, tag)
+		err := b.client.TagImage(image.ID, docker.TagImageOptions{
+			Repo:  name,
+			Tag:   tag,
+			Force: true,
+		})
+		if err != nil {
+			return err
+		}
+		b.imageTags = append(b.imageTags, fmt.Sprintf("%s:%s", name, tag))
+	}
+	return nil
+}
+
+// commitPaths builds the image for --commit-paths: the listed paths are
+// copied out of the container and into an image built from scratch, so
+// nothing else of the box ends up in it.
+func (b *DockerBox) commitPaths(name, tag string) (*docker.Image, error) {
+	contextDir := b.options.HostPath("commit-paths")
+	if err := os.RemoveAll(contextDir); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(contextDir)
+
+	artificer := NewArtificer(b.options, b.dockerOptions)
+	dockerfile := []string{"FROM scratch"}
+	for i, p := range b.options.CommitPaths {
+		rel := strings.TrimPrefix(path.Clean(p), "/")
+		artifact := &core.Artifact{
+			ContainerID: b.container.ID,
+			GuestPath:   p,
+			HostPath:    filepath.Join(contextDir, "paths", filepath.FromSlash(rel)),
+			HostTarPath: filepath.Join(contextDir, fmt.Sprintf("path-%d.tar", i)),
+		}
+		if _, err := artificer.Collect(artifact); err != nil {
+			if err == util.ErrEmptyTarball {
+				return nil, fmt.Errorf("Nothing to commit at %s", p)
+			}
+			return nil, err
+		}
+		dockerfile = append(dockerfile, fmt.Sprintf("COPY [%q, %q]", path.Join("paths", rel), path.Clean(p)))
+	}
+	if b.buildInfo != nil {
+		dockerfile = append(dockerfile, fmt.Sprintf("ENV %s %q", core.BuildInfoEnv, b.buildInfo.JSON()))
+	}
+
+	dockerfilePath := filepath.Join(contextDir, "Dockerfile")
+	if err := ioutil.WriteFile(dockerfilePath, []byte(strings.Join(dockerfile, "\n")+"\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	labels := b.options.ImageLabels()
+	if b.result != "" {
+		labels["io.wercker.result"] = b.result
+	}
+	imageName := fmt.Sprintf("%s:%s", name, tag)
+	err := b.client.BuildImage(docker.BuildImageOptions{
+		Name:           imageName,
+		ContextDir:     contextDir,
+		Labels:         labels,
+		RmTmpContainer: true,
+		OutputStream:   ioutil.Discard,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.client.InspectImage(imageName)
+}
+
+// SetResult records the result of the build, "passed" or "failed". Images
+// committed after this are labeled with it and it decides whether they are
+// kept with --keep-failed-images.
+func (b *DockerBox) SetResult(result string) {
+	b.result = result
+}
+
+// SetBuildInfo records the build info that the image committed with
+// --commit carries in its config, see --annotate-commit.
+func (b *DockerBox) SetBuildInfo(info *core.BuildInfo) {
+	b.buildInfo = info
+}
+
+// Push pushes a committed image to its registry.
+func (b *DockerBox) Push(ctx context.Context, repository, tag string) error {
+	b.logger.WithFields(util.LogFields{
+		"Repository": repository,
+		"Tag":        tag,
+	}).Debugln("Push image:", repository, tag)
+
+	if b.dockerOptions.DockerLocal {
+		return nil
+	}
+
+	return b.push(ctx, repository, tag, b.dockerOptions.RegistryAuth(repository, docker.AuthConfiguration{}))
+}
+
+// PushTo tags a committed image for registry and pushes it there. It returns
+// the name of the image in registry.
+func (b *DockerBox) PushTo(ctx context.Context, registry *core.PushRegistry, repository, tag string) (string, error) {
+	name := registry.Repository(repository)
+	b.logger.WithFields(util.LogFields{
+		"Repository": name,
+		"Tag":        tag,
+	}).Debugln("Push image:", name, tag)
+
+	err := b.client.TagImage(fmt.Sprintf("%s:%s", repository, tag), docker.TagImageOptions{
+		Repo:  name,
+		Tag:   tag,
+		Force: true,
+	})
+	if err != nil {
+		return name, err
+	}
+	b.imageTagsLock.Lock()
+	b.imageTags = append(b.imageTags, fmt.Sprintf("%s:%s", name, tag))
+	b.imageTagsLock.Unlock()
+
+	if b.dockerOptions.DockerLocal {
+		return name, nil
+	}
+
+	auth := b.dockerOptions.RegistryAuth(name, docker.AuthConfiguration{
+		Username:      registry.Username,
+		Password:      registry.Password,
+		ServerAddress: registry.Host(),
+	})
+	return name, b.push(ctx, name, tag, auth)
+}
+
+func (b *DockerBox) push(ctx context.Context, repository, tag string, auth docker.AuthConfiguration) error {
+	e, err := core.EmitterFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	r, w := io.Pipe()
+	defer w.Close()
+
+	go EmitStatus(e, r, b.options)
+
+	return b.dockerOptions.pushWithRetry(ctx, func(ctx context.Context) error {
+		options := docker.PushImageOptions{
+			Name:          repository,
+			Tag:           tag,
+			OutputStream:  w,
+			RawJSONStream: true,
+			Context:       ctx,
+		}
+		return b.client.PushImage(options, auth)
+	})
+}
+
 // ExportImageOptions are the options available for ExportImage.
 type ExportImageOptions struct {
 	Name         string
@@ -15,12 +15,16 @@
 package dockerlocal
 
 import (
+	"bytes"
+	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/suite"
 	"github.com/wercker/wercker/core"
 	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
 )
 
 func boxByID(s string) (core.Box, error) {
@@ -81,3 +85,183 @@ func (s *BoxSuite) TestPortBindings() {
 		s.Equal(check[2], binding[0].HostPort)
 	}
 }
+
+func (s *BoxSuite) TestCopyGuestDirs() {
+	client := DockerOrSkip(s.T())
+
+	if _, err := client.InspectImage("alpine:3.1"); err != nil {
+		s.Nil(client.PullImage(docker.PullImageOptions{Repository: "alpine", Tag: "3.1"}, docker.AuthConfiguration{}))
+	}
+	startGuest := func(name string) string {
+		container, err := client.CreateContainer(docker.CreateContainerOptions{
+			Name:   name,
+			Config: &docker.Config{Image: "alpine:3.1", Cmd: []string{"sleep", "300"}},
+		})
+		s.Nil(err)
+		s.Nil(client.StartContainer(container.ID, &docker.HostConfig{}))
+		return container.ID
+	}
+	remove := func(id string) {
+		client.RemoveContainer(docker.RemoveContainerOptions{ID: id, RemoveVolumes: true, Force: true})
+	}
+
+	boxID := startGuest("temp-copy-box")
+	defer remove(boxID)
+	stepID := startGuest("temp-copy-step")
+	defer remove(stepID)
+
+	s.Nil(client.ExecOne(boxID, []string{"sh", "-c",
+		"mkdir -p /pipeline/source /pipeline/cache /pipeline/output && echo box > /pipeline/source/file"}, ioutil.Discard))
+	s.Nil(client.ExecOne(stepID, []string{"sh", "-c",
+		"mkdir -p /pipeline/source && echo stale > /pipeline/source/stale"}, ioutil.Discard))
+
+	options := core.EmptyPipelineOptions()
+	options.GuestRoot = "/pipeline"
+	dockerOptions, err := NewDockerOptions(util.NewCheapSettings(nil), util.NewEnvironment())
+	s.Nil(err)
+	box, err := NewDockerBox(&core.BoxConfig{ID: "alpine:3.1"}, options, dockerOptions)
+	s.Nil(err)
+
+	s.Nil(box.CopyGuestDirs(boxID, stepID))
+
+	dfc := NewDockerFileCollector(client, stepID)
+	archive, errs := dfc.Collect("/pipeline/source/file")
+	var b bytes.Buffer
+	select {
+	case err := <-archive.SingleBytes("file", &b):
+		s.Nil(err)
+	case err := <-errs:
+		s.Nil(err)
+		s.T().FailNow()
+	}
+	s.Equal("box\n", b.String())
+
+	// What the box doesn't have is gone from the step container
+	_, errs = dfc.Collect("/pipeline/source/stale")
+	s.Equal(util.ErrEmptyTarball, <-errs)
+}
+
+func (s *BoxSuite) TestDisconnectNetworks() {
+	client := DockerOrSkip(s.T())
+
+	if _, err := client.InspectImage("alpine:3.1"); err != nil {
+		s.Nil(client.PullImage(docker.PullImageOptions{Repository: "alpine", Tag: "3.1"}, docker.AuthConfiguration{}))
+	}
+	network, err := client.CreateNetwork(docker.CreateNetworkOptions{Name: "temp-disconnect-net"})
+	s.Nil(err)
+	defer client.RemoveNetwork(network.ID)
+
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Name:   "temp-disconnect",
+		Config: &docker.Config{Image: "alpine:3.1", Cmd: []string{"sleep", "300"}},
+	})
+	s.Nil(err)
+	defer client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, RemoveVolumes: true, Force: true})
+	s.Nil(client.StartContainer(container.ID, &docker.HostConfig{}))
+	s.Nil(client.ConnectNetwork(network.ID, docker.NetworkConnectionOptions{
+		Container:      container.ID,
+		EndpointConfig: &docker.EndpointConfig{Aliases: []string{"db"}},
+	}))
+
+	box, err := boxByID("alpine:3.1")
+	s.Nil(err)
+	reconnect, err := box.DisconnectNetworks(container.ID)
+	s.Nil(err)
+	inspected, err := client.InspectContainer(container.ID)
+	s.Nil(err)
+	s.Len(inspected.NetworkSettings.Networks, 0)
+
+	s.Nil(reconnect())
+	inspected, err = client.InspectContainer(container.ID)
+	s.Nil(err)
+	s.Contains(inspected.NetworkSettings.Networks["temp-disconnect-net"].Aliases, "db")
+}
+
+func (s *BoxSuite) TestTerminateStep() {
+	client := DockerOrSkip(s.T())
+
+	if _, err := client.InspectImage("alpine:3.1"); err != nil {
+		s.Nil(client.PullImage(docker.PullImageOptions{Repository: "alpine", Tag: "3.1"}, docker.AuthConfiguration{}))
+	}
+	// The shell stands in for the one steps run in, it outlives the step
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Name: "temp-terminate",
+		Config: &docker.Config{
+			Image: "alpine:3.1",
+			Cmd:   []string{"sh", "-c", "sleep 300; touch /terminated; exec sleep 300"},
+		},
+	})
+	s.Nil(err)
+	defer client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, RemoveVolumes: true, Force: true})
+	s.Nil(client.StartContainer(container.ID, &docker.HostConfig{}))
+
+	options := core.EmptyPipelineOptions()
+	options.StepTimeoutGrace = 1
+	dockerOptions, err := NewDockerOptions(util.NewCheapSettings(nil), util.NewEnvironment())
+	s.Nil(err)
+	box, err := NewDockerBox(&core.BoxConfig{ID: "alpine:3.1"}, options, dockerOptions)
+	s.Nil(err)
+
+	s.Nil(box.TerminateStep(container.ID))
+
+	inspected, err := client.InspectContainer(container.ID)
+	s.Nil(err)
+	s.True(inspected.State.Running)
+	var b bytes.Buffer
+	s.Nil(client.ExecOne(container.ID, []string{"sh", "-c", "test -f /terminated && echo terminated"}, &b))
+	s.Contains(b.String(), "terminated")
+}
+
+func (s *BoxSuite) TestFetchStepImagePullPolicy() {
+	DockerOrSkip(s.T())
+
+	options := core.EmptyPipelineOptions()
+	options.PullPolicy = core.PullPolicyNever
+	dockerOptions, err := NewDockerOptions(util.NewCheapSettings(nil), util.NewEnvironment())
+	s.Nil(err)
+	box, err := NewDockerBox(&core.BoxConfig{ID: "alpine:3.1"}, options, dockerOptions)
+	s.Nil(err)
+
+	// No emitter in the context, so this fails if it tries to pull
+	err = box.fetchStepImage(context.Background(), "wercker/no-such-step-image:never")
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "won't be pulled")
+}
+
+func (s *BoxSuite) TestServiceWaitReady() {
+	client := DockerOrSkip(s.T())
+
+	if _, err := client.InspectImage("alpine:3.1"); err != nil {
+		s.Nil(client.PullImage(docker.PullImageOptions{Repository: "alpine", Tag: "3.1"}, docker.AuthConfiguration{}))
+	}
+	// The service takes a moment to start listening
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Name: "temp-service-ready",
+		Config: &docker.Config{
+			Image: "alpine:3.1",
+			Cmd:   []string{"sh", "-c", "sleep 2; exec nc -l -p 5432"},
+		},
+	})
+	s.Nil(err)
+	defer client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, RemoveVolumes: true, Force: true})
+	s.Nil(client.StartContainer(container.ID, &docker.HostConfig{}))
+
+	dockerOptions, err := NewDockerOptions(util.NewCheapSettings(nil), util.NewEnvironment())
+	s.Nil(err)
+	dockerOptions.ServicePollInterval = 100 * time.Millisecond
+	dockerOptions.ServiceReadyTimeout = 30 * time.Second
+	service := func(config *core.BoxConfig) *InternalServiceBox {
+		config.ID = "alpine:3.1"
+		box, err := NewInternalServiceBox(config, core.EmptyPipelineOptions(), dockerOptions)
+		s.Nil(err)
+		box.container = container
+		return box
+	}
+
+	s.Nil(service(&core.BoxConfig{ReadyPort: 5432}).WaitReady(context.Background()))
+	s.Nil(service(&core.BoxConfig{ReadyCommand: "true"}).WaitReady(context.Background()))
+
+	dockerOptions.ServiceReadyTimeout = time.Second
+	s.NotNil(service(&core.BoxConfig{ReadyPort: 5433}).WaitReady(context.Background()))
+	s.NotNil(service(&core.BoxConfig{ReadyCommand: "false"}).WaitReady(context.Background()))
+}
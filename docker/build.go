@@ -42,8 +42,12 @@ func (b *DockerBuild) LocalSymlink() {
 
 // InitEnv sets up the internal state of the environment for the build
 func (b *DockerBuild) InitEnv(hostEnv *util.Environment) {
-	env := b.Env()
+	b.ApplyEnvSources(b.EnvSources(hostEnv))
+}
 
+// EnvSources returns the layers of the build environment in the order they
+// are applied.
+func (b *DockerBuild) EnvSources(hostEnv *util.Environment) []core.EnvSource {
 	a := [][]string{
 		[]string{"BUILD", "true"},
 		[]string{"CI", "true"},
@@ -56,11 +60,14 @@ func (b *DockerBuild) InitEnv(hostEnv *util.Environment) {
 		[]string{"WERCKER_GIT_COMMIT", b.options.GitCommit},
 	}
 
-	env.Update(b.CommonEnv())
-	env.Update(a)
-	env.Update(hostEnv.GetMirror())
-	env.Update(hostEnv.GetPassthru().Ordered())
-	env.Hidden.Update(hostEnv.GetHiddenPassthru().Ordered())
+	return []core.EnvSource{
+		{Name: "wercker.yml env", Env: b.ConfigEnv()},
+		{Name: "wercker", Env: b.CommonEnv()},
+		{Name: "build", Env: a},
+		{Name: "mirrored from host", Env: hostEnv.GetMirror()},
+		{Name: "X_ passthru from host", Env: hostEnv.GetPassthru().Ordered()},
+		{Name: "XXX_ passthru from host", Env: hostEnv.GetHiddenPassthru().Ordered(), Hidden: true},
+	}
 }
 
 // DockerRepo calculates our repo name
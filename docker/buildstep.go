@@ -0,0 +1,226 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/google/shlex"
+	"github.com/pborman/uuid"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+// DockerBuildStep builds a Dockerfile from the source dir and optionally
+// pushes the result. It takes the same auth, repository, tag and registry
+// options as the docker-push step.
+type DockerBuildStep struct {
+	*DockerPushStep
+	dockerfile   string
+	contextDir   string
+	buildArgs    []docker.BuildArg
+	target       string
+	shouldPush   bool
+	noCache      bool
+	pullParent   bool
+	buildTimeout int
+}
+
+// NewDockerBuildStep is a special step for doing docker builds
+func NewDockerBuildStep(stepConfig *core.StepConfig, options *core.PipelineOptions, dockerOptions *DockerOptions) (*DockerBuildStep, error) {
+	name := "docker-build"
+	displayName := "docker build"
+	if stepConfig.Name != "" {
+		displayName = stepConfig.Name
+	}
+
+	// Add a random number to the name to prevent collisions on disk
+	stepSafeID := fmt.Sprintf("%s-%s", name, uuid.NewRandom().String())
+
+	baseStep := core.NewBaseStep(core.BaseStepOptions{
+		DisplayName: displayName,
+		Env:         &util.Environment{},
+		ID:          name,
+		Name:        name,
+		Owner:       "wercker",
+		SafeID:      stepSafeID,
+		Version:     util.Version(),
+		DependsOn:   stepConfig.DependsOn,
+		Artifacts:   stepConfig.Artifacts,
+		Enabled:     stepConfig.Enabled,
+	})
+
+	dockerPushStep := &DockerPushStep{
+		BaseStep:      baseStep,
+		data:          stepConfig.Data,
+		dockerOptions: dockerOptions,
+		options:       options,
+		logger:        util.RootLogger().WithField("Logger", "DockerBuildStep"),
+	}
+
+	return &DockerBuildStep{DockerPushStep: dockerPushStep}, nil
+}
+
+// InitEnv parses our data into our config
+func (s *DockerBuildStep) InitEnv(env *util.Environment) {
+	s.DockerPushStep.InitEnv(env)
+
+	s.dockerfile = "Dockerfile"
+	if dockerfile, ok := s.data["dockerfile"]; ok {
+		s.dockerfile = env.Interpolate(dockerfile)
+	}
+
+	s.contextDir = "."
+	if contextDir, ok := s.data["context"]; ok {
+		s.contextDir = env.Interpolate(contextDir)
+	}
+
+	if buildArgs, ok := s.data["build-args"]; ok {
+		parsedArgs, err := shlex.Split(buildArgs)
+		if err == nil {
+			s.buildArgs = []docker.BuildArg{}
+			for _, arg := range parsedArgs {
+				pair := strings.SplitN(env.Interpolate(arg), "=", 2)
+				buildArg := docker.BuildArg{Name: pair[0]}
+				if len(pair) == 2 {
+					buildArg.Value = pair[1]
+				}
+				s.buildArgs = append(s.buildArgs, buildArg)
+			}
+		}
+	}
+
+	if target, ok := s.data["target"]; ok {
+		s.target = env.Interpolate(target)
+	}
+
+	if push, ok := s.data["push"]; ok {
+		shouldPush, err := strconv.ParseBool(push)
+		if err == nil {
+			s.shouldPush = shouldPush
+		}
+	}
+
+	if noCache, ok := s.data["no-cache"]; ok {
+		s.noCache = noCache == "true"
+	}
+
+	if pull, ok := s.data["pull"]; ok {
+		s.pullParent = pull == "true"
+	}
+}
+
+// Execute copies the build context out of the container, builds the
+// Dockerfile and tags the image, pushing it if `push` is set
+func (s *DockerBuildStep) Execute(ctx context.Context, sess *core.Session) (int, error) {
+	client, err := NewDockerClient(s.dockerOptions)
+	if err != nil {
+		return 1, err
+	}
+	e, err := core.EmitterFromContext(ctx)
+	if err != nil {
+		return 1, err
+	}
+
+	if s.repository == "" {
+		return 1, fmt.Errorf("docker-build requires a repository")
+	}
+	if len(s.tags) == 0 {
+		s.tags = []string{"latest"}
+	}
+
+	// This is clearly only relevant to docker so we're going to dig into the
+	// transport internals a little bit to get the container ID
+	dt := sess.Transport().(*DockerTransport)
+	containerID := dt.containerID
+
+	artificer := NewArtificer(s.options, s.dockerOptions)
+	buildContext, err := artificer.Collect(&core.Artifact{
+		ContainerID: containerID,
+		GuestPath:   filepath.Join(s.options.SourcePath(), s.contextDir),
+		HostPath:    s.options.HostPath(s.SafeID(), "context"),
+		HostTarPath: s.options.HostPath(s.SafeID(), "context.tar"),
+	})
+	if err != nil {
+		if err == util.ErrEmptyTarball {
+			return 1, fmt.Errorf("Build context %s not found", s.contextDir)
+		}
+		return 1, err
+	}
+
+	name := fmt.Sprintf("%s:%s", s.repository, s.tags[0])
+	s.logger.WithFields(util.LogFields{
+		"Dockerfile": s.dockerfile,
+		"Context":    s.contextDir,
+		"Target":     s.target,
+		"Image":      name,
+	}).Debug("Build image")
+
+	buildOpts := docker.BuildImageOptions{
+		Name:           name,
+		Dockerfile:     s.dockerfile,
+		ContextDir:     buildContext.HostPath,
+		BuildArgs:      s.buildArgs,
+		Target:         s.target,
+		Labels:         s.options.ImageLabels(),
+		NoCache:        s.noCache,
+		Pull:           s.pullParent,
+		RmTmpContainer: true,
+		OutputStream:   &logsWriter{e},
+	}
+	if err := client.BuildImage(buildOpts); err != nil {
+		s.logger.Errorln("Failed to build image:", err)
+		return 1, err
+	}
+
+	image, err := client.InspectImage(name)
+	if err != nil {
+		return 1, err
+	}
+	s.logger.WithField("Image", image.ID).Debug("Build completed")
+
+	err = ScanImage(s.options, e, name)
+	if err != nil {
+		s.logger.Errorln(err)
+		return 1, err
+	}
+
+	if !s.shouldPush {
+		for _, tag := range s.tags[1:] {
+			tagOpts := docker.TagImageOptions{
+				Repo:  s.repository,
+				Tag:   tag,
+				Force: s.forceTags,
+			}
+			if err := client.TagImage(image.ID, tagOpts); err != nil {
+				return 1, err
+			}
+		}
+		return 0, nil
+	}
+
+	auth := s.dockerOptions.RegistryAuth(s.repository, docker.AuthConfiguration{
+		Username:      s.username,
+		Password:      s.password,
+		Email:         s.email,
+		ServerAddress: s.authServer,
+	})
+	return s.tagAndPush(ctx, image.ID, e, client, auth)
+}
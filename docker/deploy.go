@@ -45,8 +45,12 @@ func (b *DockerDeploy) LocalSymlink() {
 
 // InitEnv sets up the internal state of the environment for the build
 func (d *DockerDeploy) InitEnv(hostEnv *util.Environment) {
-	env := d.Env()
+	d.ApplyEnvSources(d.EnvSources(hostEnv))
+}
 
+// EnvSources returns the layers of the deploy environment in the order they
+// are applied.
+func (d *DockerDeploy) EnvSources(hostEnv *util.Environment) []core.EnvSource {
 	a := [][]string{
 		[]string{"DEPLOY", "true"},
 		[]string{"WERCKER_DEPLOY_ID", d.options.DeployID},
@@ -62,11 +66,14 @@ func (d *DockerDeploy) InitEnv(hostEnv *util.Environment) {
 		a = append(a, []string{"WERCKER_DEPLOYTARGET_NAME", d.options.DeployTarget})
 	}
 
-	env.Update(d.CommonEnv())
-	env.Update(a)
-	env.Update(hostEnv.GetMirror())
-	env.Update(hostEnv.GetPassthru().Ordered())
-	env.Hidden.Update(hostEnv.GetHiddenPassthru().Ordered())
+	return []core.EnvSource{
+		{Name: "wercker.yml env", Env: d.ConfigEnv()},
+		{Name: "wercker", Env: d.CommonEnv()},
+		{Name: "deploy", Env: a},
+		{Name: "mirrored from host", Env: hostEnv.GetMirror()},
+		{Name: "X_ passthru from host", Env: hostEnv.GetPassthru().Ordered()},
+		{Name: "XXX_ passthru from host", Env: hostEnv.GetHiddenPassthru().Ordered(), Hidden: true},
+	}
 }
 
 // DockerRepo returns the name where we might store this in docker
@@ -74,6 +74,42 @@ or the --docker-host command-line flag.`, options.DockerHost)
 	return nil
 }
 
+// CheckRegistryAuth asks the Docker daemon to log in to the registry of
+// repository with the credentials we would push to it with, username and
+// password are used instead of the registry token when given.
+func CheckRegistryAuth(options *DockerOptions, repository, username, password string) error {
+	if options.DockerLocal {
+		return nil
+	}
+	client, err := NewDockerClient(options)
+	if err != nil {
+		return err
+	}
+	auth := options.RegistryAuth(repository, docker.AuthConfiguration{
+		Username:      username,
+		Password:      password,
+		ServerAddress: repositoryRegistry(repository),
+	})
+	if auth.Username == "" && auth.Password == "" {
+		return fmt.Errorf("No registry credentials to push %s with, see --registry-auth-from-token-store", repository)
+	}
+	err = client.AuthCheck(&auth)
+	if err != nil {
+		return fmt.Errorf("Registry credentials for %s were rejected: %s", repository, err)
+	}
+	return nil
+}
+
+// repositoryRegistry returns the registry host in a repository name, or an
+// empty string for the Docker Hub, which is what the daemon defaults to.
+func repositoryRegistry(name string) string {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+	return ""
+}
+
 // GenerateDockerID will generate a cryptographically random 256 bit hex Docker
 // identifier.
 func GenerateDockerID() (string, error) {
@@ -122,7 +158,11 @@ func NewDockerClient(options *DockerOptions) (*DockerClient, error) {
 			return nil, err
 		}
 	}
-	return &DockerClient{Client: client, logger: logger}, nil
+	dockerClient := &DockerClient{Client: client, logger: logger}
+	if err := options.waitForDaemon(dockerClient); err != nil {
+		return nil, err
+	}
+	return dockerClient, nil
 }
 
 // RunAndAttach gives us a raw connection to a newly run container
@@ -428,6 +468,9 @@ func NewDockerScratchPushStep(stepConfig *core.StepConfig, options *core.Pipelin
 		Owner:       "wercker",
 		SafeID:      stepSafeID,
 		Version:     util.Version(),
+		DependsOn:   stepConfig.DependsOn,
+		Artifacts:   stepConfig.Artifacts,
+		Enabled:     stepConfig.Enabled,
 	})
 
 	dockerPushStep := &DockerPushStep{
@@ -657,12 +700,12 @@ func (s *DockerScratchPushStep) Execute(ctx context.Context, sess *core.Session)
 	}).Debug("Scratch push to registry")
 
 	// Check the auth
-	auth := docker.AuthConfiguration{
+	auth := s.dockerOptions.RegistryAuth(s.repository, docker.AuthConfiguration{
 		Username:      s.username,
 		Password:      s.password,
 		Email:         s.email,
 		ServerAddress: s.authServer,
-	}
+	})
 
 	if !s.dockerOptions.DockerLocal {
 		checkOpts := CheckAccessOptions{
@@ -691,7 +734,7 @@ func (s *DockerScratchPushStep) Execute(ctx context.Context, sess *core.Session)
 		return -1, err
 	}
 	e, err := core.EmitterFromContext(ctx)
-	return s.tagAndPush(layerID, e, client, auth)
+	return s.tagAndPush(ctx, layerID, e, client, auth)
 }
 
 // CollectArtifact is copied from the build, we use this to get the layer
@@ -784,6 +827,9 @@ func NewDockerPushStep(stepConfig *core.StepConfig, options *core.PipelineOption
 		Owner:       "wercker",
 		SafeID:      stepSafeID,
 		Version:     util.Version(),
+		DependsOn:   stepConfig.DependsOn,
+		Artifacts:   stepConfig.Artifacts,
+		Enabled:     stepConfig.Enabled,
 	})
 
 	return &DockerPushStep{
@@ -960,12 +1006,12 @@ func (s *DockerPushStep) Execute(ctx context.Context, sess *core.Session) (int,
 	dt := sess.Transport().(*DockerTransport)
 	containerID := dt.containerID
 
-	auth := docker.AuthConfiguration{
+	auth := s.dockerOptions.RegistryAuth(s.repository, docker.AuthConfiguration{
 		Username:      s.username,
 		Password:      s.password,
 		Email:         s.email,
 		ServerAddress: s.authServer,
-	}
+	})
 
 	if !s.dockerOptions.DockerLocal {
 		checkOpts := CheckAccessOptions{
@@ -987,6 +1033,12 @@ func (s *DockerPushStep) Execute(ctx context.Context, sess *core.Session) (int,
 	}
 	s.logger.Debugln("Init env:", s.data)
 
+	// The labels from the step override the resource labels
+	labels := s.options.ResourceLabels()
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+
 	config := docker.Config{
 		Cmd:          s.cmd,
 		Entrypoint:   s.entrypoint,
@@ -994,7 +1046,7 @@ func (s *DockerPushStep) Execute(ctx context.Context, sess *core.Session) (int,
 		User:         s.user,
 		Env:          s.env,
 		StopSignal:   s.stopSignal,
-		Labels:       s.labels,
+		Labels:       labels,
 		ExposedPorts: s.ports,
 		Volumes:      s.volumes,
 	}
@@ -1019,10 +1071,16 @@ func (s *DockerPushStep) Execute(ctx context.Context, sess *core.Session) (int,
 	}
 	s.logger.WithField("Image", i).Debug("Commit completed")
 
-	return s.tagAndPush(i.ID, e, client, auth)
+	err = ScanImage(s.options, e, fmt.Sprintf("%s:%s", s.repository, s.tags[0]))
+	if err != nil {
+		s.logger.Errorln(err)
+		return 1, err
+	}
+
+	return s.tagAndPush(ctx, i.ID, e, client, auth)
 }
 
-func (s *DockerPushStep) tagAndPush(imageID string, e *core.NormalizedEmitter, client *DockerClient, auth docker.AuthConfiguration) (int, error) {
+func (s *DockerPushStep) tagAndPush(ctx context.Context, imageID string, e *core.NormalizedEmitter, client *DockerClient, auth docker.AuthConfiguration) (int, error) {
 	// Create a pipe since we want a io.Reader but Docker expects a io.Writer
 	r, w := io.Pipe()
 
@@ -1042,14 +1100,19 @@ func (s *DockerPushStep) tagAndPush(imageID string, e *core.NormalizedEmitter, c
 			return 1, err
 		}
 	}
-	pushOpts := docker.PushImageOptions{
-		Name:          s.repository,
-		Registry:      s.registry,
-		OutputStream:  w,
-		RawJSONStream: true,
-	}
-	if !s.dockerOptions.DockerLocal {
-		err := client.PushImage(pushOpts, auth)
+	if s.options.NoStore {
+		s.logger.Println("Skipping push, --no-store is set:", s.repository)
+	} else if !s.dockerOptions.DockerLocal {
+		err := s.dockerOptions.pushWithRetry(ctx, func(ctx context.Context) error {
+			pushOpts := docker.PushImageOptions{
+				Name:          s.repository,
+				Registry:      s.registry,
+				OutputStream:  w,
+				RawJSONStream: true,
+				Context:       ctx,
+			}
+			return client.PushImage(pushOpts, auth)
+		})
 		if err != nil {
 			s.logger.Errorln("Failed to push:", err)
 			return 1, err
@@ -16,10 +16,18 @@ package dockerlocal
 
 import (
 	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/suite"
 	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
 )
 
 type DockerSuite struct {
@@ -31,6 +39,14 @@ func TestDockerSuite(t *testing.T) {
 	suite.Run(t, suiteTester)
 }
 
+func (s *DockerSuite) TestRepositoryRegistry() {
+	s.Equal("quay.io", repositoryRegistry("quay.io/wercker/app"))
+	s.Equal("localhost:5000", repositoryRegistry("localhost:5000/app"))
+	s.Equal("localhost", repositoryRegistry("localhost/app"))
+	s.Equal("", repositoryRegistry("wercker/app"))
+	s.Equal("", repositoryRegistry("app"))
+}
+
 func (s *DockerSuite) TestNormalizeRegistry() {
 	quay := "https://quay.io/v1/"
 	dock := "https://registry.hub.docker.com/v1/"
@@ -53,6 +69,159 @@ func (s *DockerSuite) TestNormalizeRepo() {
 	s.Equal("mongo", normalizeRepo("mongo"))
 }
 
+func (s *DockerSuite) TestRegistryAuthHost() {
+	opts := &DockerOptions{
+		RegistryAuthToken: "the-token",
+		RegistryAuthHost:  "wcr.io",
+	}
+	s.Equal("the-token", opts.RegistryAuth("wcr.io/wercker/app", docker.AuthConfiguration{}).Password)
+
+	// The token never goes to the Docker Hub or other registries
+	s.Equal(docker.AuthConfiguration{}, opts.RegistryAuth("wercker/app", docker.AuthConfiguration{}))
+	s.Equal(docker.AuthConfiguration{}, opts.RegistryAuth("alpine", docker.AuthConfiguration{}))
+	s.Equal(docker.AuthConfiguration{}, opts.RegistryAuth("quay.io/wercker/app", docker.AuthConfiguration{}))
+	auth := opts.RegistryAuth("quay.io/wercker/app", docker.AuthConfiguration{Username: "user", Password: "pass"})
+	s.Equal("pass", auth.Password)
+}
+
+func (s *DockerSuite) TestValidateHostname() {
+	s.Nil(validateHostname("wercker"))
+	s.Nil(validateHostname("build-1.example.com"))
+
+	s.Error(validateHostname("-wercker"))
+	s.Error(validateHostname("wercker-"))
+	s.Error(validateHostname("wer_cker"))
+	s.Error(validateHostname("example..com"))
+	s.Error(validateHostname(strings.Repeat("a", 64)))
+}
+
+func (s *DockerSuite) TestValidateAddHost() {
+	s.Nil(validateAddHost("db:10.0.0.2"))
+	s.Nil(validateAddHost("db.local:::1"))
+
+	s.Error(validateAddHost("db"))
+	s.Error(validateAddHost("db:"))
+	s.Error(validateAddHost("db:not-an-ip"))
+	s.Error(validateAddHost("d_b:10.0.0.2"))
+}
+
+func (s *DockerSuite) TestParseShmSize() {
+	size, err := parseShmSize("512m")
+	s.Nil(err)
+	s.Equal(int64(512*1024*1024), size)
+
+	size, err = parseShmSize("2GB")
+	s.Nil(err)
+	s.Equal(int64(2*1024*1024*1024), size)
+
+	size, err = parseShmSize("1048576")
+	s.Nil(err)
+	s.Equal(int64(1048576), size)
+
+	_, err = parseShmSize("0")
+	s.Error(err)
+	_, err = parseShmSize("big")
+	s.Error(err)
+	_, err = parseShmSize("1t")
+	s.Error(err)
+}
+
+func (s *DockerSuite) TestMaxImageSize() {
+	size, err := parseByteSize("--max-image-size", "2g")
+	s.Nil(err)
+	s.Equal(int64(2*1024*1024*1024), size)
+
+	_, err = parseByteSize("--max-image-size", "huge")
+	s.Error(err)
+	s.Contains(err.Error(), "--max-image-size")
+
+	s.Equal("512 B", formatSize(512))
+	s.Equal("1.5 KiB", formatSize(1536))
+	s.Equal("2.0 GiB", formatSize(2*1024*1024*1024))
+
+	// Without a limit the docker daemon isn't asked about the image
+	s.Nil(CheckImageSize(&DockerOptions{}, "wercker/nonexistent:latest"))
+}
+
+func (s *DockerSuite) TestRegistryAuthRefresh() {
+	tmp, err := ioutil.TempFile("", "wercker-token-")
+	s.Nil(err)
+	defer os.Remove(tmp.Name())
+	tmp.WriteString("new-token\n")
+	tmp.Close()
+
+	opts := &DockerOptions{
+		RegistryAuthToken:    "old-token",
+		RegistryAuthHost:     "wcr.io",
+		RegistryTokenStore:   tmp.Name(),
+		RegistryTokenRefresh: time.Minute,
+		registryTokenRead:    time.Now(),
+	}
+	s.Equal("old-token", opts.RegistryAuth("wcr.io/wercker/app", docker.AuthConfiguration{}).Password)
+
+	opts.registryTokenRead = time.Now().Add(-2 * time.Minute)
+	auth := opts.RegistryAuth("wcr.io/wercker/app", docker.AuthConfiguration{})
+	s.Equal("token", auth.Username)
+	s.Equal("new-token", auth.Password)
+
+	// Explicit credentials are left alone
+	auth = opts.RegistryAuth("wcr.io/wercker/app", docker.AuthConfiguration{Username: "user", Password: "pass"})
+	s.Equal("pass", auth.Password)
+}
+
+func (s *DockerSuite) TestRegistryAuthConcurrentRefresh() {
+	tmp, err := ioutil.TempFile("", "wercker-token-")
+	s.Nil(err)
+	defer os.Remove(tmp.Name())
+	tmp.WriteString("new-token\n")
+	tmp.Close()
+
+	// Every push refreshes the expired token at the same time, go test -race
+	// catches unguarded writes
+	opts := &DockerOptions{
+		RegistryAuthToken:    "old-token",
+		RegistryAuthHost:     "wcr.io",
+		RegistryTokenStore:   tmp.Name(),
+		RegistryTokenRefresh: time.Nanosecond,
+	}
+	pushes := []func() error{}
+	for i := 0; i < 4; i++ {
+		pushes = append(pushes, func() error {
+			if auth := opts.RegistryAuth("wcr.io/wercker/app", docker.AuthConfiguration{}); auth.Password != "new-token" {
+				return fmt.Errorf("unexpected token %s", auth.Password)
+			}
+			return nil
+		})
+	}
+	opts.RegistryPushConcurrency = len(pushes)
+	s.Equal([]error{nil, nil, nil, nil}, opts.PushConcurrently(pushes))
+}
+
+func (s *DockerSuite) TestPushConcurrently() {
+	options := &DockerOptions{RegistryPushConcurrency: 2}
+	var l sync.Mutex
+	running, maxRunning := 0, 0
+	push := func(err error) func() error {
+		return func() error {
+			l.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			l.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			l.Lock()
+			running--
+			l.Unlock()
+			return err
+		}
+	}
+	failed := fmt.Errorf("failed")
+	errs := options.PushConcurrently([]func() error{push(nil), push(failed), push(nil), push(nil)})
+	s.Equal([]error{nil, failed, nil, nil}, errs)
+	s.Equal(2, maxRunning)
+}
+
 func (s *DockerSuite) TestPing() {
 	client := DockerOrSkip(s.T())
 	err := client.Ping()
@@ -70,3 +239,23 @@ func (s *DockerSuite) TestGenerateDockerID() {
 	// The ID needs to be 256 bits
 	s.Equal(256, len(b)*8)
 }
+
+func (s *DockerSuite) TestRegistryTimeout() {
+	opts := &DockerOptions{RegistryTimeout: 10 * time.Millisecond}
+	attempts := 0
+	err := opts.pushWithRetry(context.Background(), func(ctx context.Context) error {
+		attempts++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	s.IsType(&RegistryTimeoutError{}, err)
+	s.Equal(registryPushAttempts, attempts)
+
+	attempts = 0
+	err = opts.pushWithRetry(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return nil
+	})
+	s.Nil(err)
+	s.Equal(1, attempts)
+}
@@ -0,0 +1,55 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import "fmt"
+
+// formatSize formats a size in bytes for humans, like 1.5 GiB
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// CheckImageSize returns an error when image is larger than --max-image-size.
+// The size includes all of the image's layers, like docker images shows it.
+func CheckImageSize(options *DockerOptions, image string) error {
+	if options.MaxImageSize <= 0 {
+		return nil
+	}
+	client, err := NewDockerClient(options)
+	if err != nil {
+		return err
+	}
+	inspected, err := client.InspectImage(image)
+	if err != nil {
+		return err
+	}
+	size := inspected.VirtualSize
+	if size == 0 {
+		size = inspected.Size
+	}
+	if size > options.MaxImageSize {
+		return fmt.Errorf("Image %s is %s, larger than the --max-image-size of %s", image, formatSize(size), formatSize(options.MaxImageSize))
+	}
+	return nil
+}
@@ -16,11 +16,21 @@ package dockerlocal
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fsouza/go-dockerclient"
+	"github.com/wercker/wercker/core"
 	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
 )
 
 // DockerOptions for our docker client
@@ -30,6 +40,250 @@ type DockerOptions struct {
 	DockerCertPath  string
 	DockerDNS       []string
 	DockerLocal     bool
+	Hostname        string
+	AddHosts        []string
+	BoxShmSize      int64
+
+	// BoxPrivileged, CapAdd and CapDrop loosen or tighten the isolation of
+	// the box container. By default it gets docker's default capabilities.
+	// Privileged mode and most added capabilities let the steps escape to
+	// the host, they should only be used for trusted code.
+	BoxPrivileged bool
+	CapAdd        []string
+	CapDrop       []string
+
+	// RegistryAuthToken is used to authenticate against the registry when no
+	// other credentials are given, see --registry-auth-from-token-store. It
+	// is only sent to RegistryAuthHost, the wercker registry.
+	RegistryAuthToken string
+	RegistryAuthHost  string
+
+	// RegistryTokenStore is the file RegistryAuthToken was read from. Long
+	// builds can outlive that token, so it is read again before use when it
+	// is older than RegistryTokenRefresh.
+	RegistryTokenStore   string
+	RegistryTokenRefresh time.Duration
+	registryTokenRead    time.Time
+
+	// RegistryTimeout is the deadline for a single pull or push, a push
+	// that times out is retried up to registryPushAttempts times.
+	RegistryTimeout time.Duration
+
+	// RegistryPushConcurrency is the amount of pushes that run at the same
+	// time. The push API has no control over the uploads of the layers of a
+	// single push, that is up to the daemon.
+	RegistryPushConcurrency int
+
+	// MaxImageSize is the largest the committed image may be before it is
+	// pushed, in bytes. 0 doesn't limit it.
+	MaxImageSize int64
+
+	// ServicePollInterval and ServiceReadyTimeout control how services with a
+	// readiness check are waited for before the steps start.
+	ServicePollInterval time.Duration
+	ServiceReadyTimeout time.Duration
+
+	// DockerConnectRetries is the amount of times NewDockerClient tries to
+	// reach the daemon again when it doesn't respond. daemonReady is set
+	// once it did, so later clients don't check again.
+	DockerConnectRetries int
+	daemonReady          int32
+
+	// DockerOpTimeout is the deadline for the container operations of a box,
+	// so a wedged daemon fails the build instead of hanging it.
+	DockerOpTimeout time.Duration
+}
+
+// Defaults for ServicePollInterval and ServiceReadyTimeout
+const (
+	defaultServicePollInterval = 1 * time.Second
+	defaultServiceReadyTimeout = 2 * time.Minute
+)
+
+// registryPushAttempts is the amount of times a push is tried when it hits
+// the RegistryTimeout
+const registryPushAttempts = 3
+
+// RegistryTimeoutError is returned when a registry operation takes longer
+// than the RegistryTimeout.
+type RegistryTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *RegistryTimeoutError) Error() string {
+	return fmt.Sprintf("Registry operation timed out after %s", e.Timeout)
+}
+
+// withRegistryTimeout runs f with a context that expires after the
+// RegistryTimeout, if one is set.
+func (o *DockerOptions) withRegistryTimeout(ctx context.Context, f func(context.Context) error) error {
+	if o.RegistryTimeout <= 0 {
+		return f(ctx)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, o.RegistryTimeout)
+	defer cancel()
+	err := f(timeoutCtx)
+	// If the parent context is done the build itself was stopped, that
+	// takes precedence over our own deadline
+	if err != nil && ctx.Err() == nil && timeoutCtx.Err() == context.DeadlineExceeded {
+		return &RegistryTimeoutError{Timeout: o.RegistryTimeout}
+	}
+	return err
+}
+
+// DockerOpTimeoutError is returned when a container operation takes longer
+// than the DockerOpTimeout.
+type DockerOpTimeoutError struct {
+	Op      string
+	Target  string
+	Timeout time.Duration
+}
+
+func (e *DockerOpTimeoutError) Error() string {
+	return fmt.Sprintf("Docker operation %s on %s timed out after %s", e.Op, e.Target, e.Timeout)
+}
+
+// withDockerOpTimeout runs f, the container operation op on target, and
+// gives up on it after the DockerOpTimeout, if one is set. Most calls of the
+// docker client don't take a context, so f is left running in the
+// background when it times out.
+func (o *DockerOptions) withDockerOpTimeout(op, target string, f func() error) error {
+	if o.DockerOpTimeout <= 0 {
+		return f()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(o.DockerOpTimeout):
+		return &DockerOpTimeoutError{Op: op, Target: target, Timeout: o.DockerOpTimeout}
+	}
+}
+
+// pushWithRetry runs push with the RegistryTimeout, trying again when it
+// times out.
+func (o *DockerOptions) pushWithRetry(ctx context.Context, push func(context.Context) error) error {
+	var err error
+	for attempt := 1; attempt <= registryPushAttempts; attempt++ {
+		err = o.withRegistryTimeout(ctx, push)
+		if _, ok := err.(*RegistryTimeoutError); !ok {
+			return err
+		}
+		util.RootLogger().WithField("Logger", "Docker").Warnf("Push timed out (attempt %d of %d)", attempt, registryPushAttempts)
+	}
+	return err
+}
+
+// PushConcurrently runs pushes, at most RegistryPushConcurrency at a time, and
+// returns their errors in the same order.
+func (o *DockerOptions) PushConcurrently(pushes []func() error) []error {
+	workers := o.RegistryPushConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	errs := make([]error, len(pushes))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				errs[j] = pushes[j]()
+			}
+		}()
+	}
+	for j := range pushes {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+	return errs
+}
+
+// dockerConnectBackoff is the wait before the first retry to reach the docker
+// daemon, it doubles with every retry
+const dockerConnectBackoff = 500 * time.Millisecond
+
+// waitForDaemon pings the daemon through client, retrying up to
+// DockerConnectRetries times with a backoff.
+func (o *DockerOptions) waitForDaemon(client *DockerClient) error {
+	if o.DockerConnectRetries <= 0 || atomic.LoadInt32(&o.daemonReady) == 1 {
+		return nil
+	}
+
+	backoff := dockerConnectBackoff
+	var err error
+	for attempt := 0; attempt <= o.DockerConnectRetries; attempt++ {
+		if attempt > 0 {
+			util.RootLogger().WithField("Logger", "Docker").Warnf("Docker is not responding, retrying in %s (retry %d of %d)", backoff, attempt, o.DockerConnectRetries)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		err = client.Ping()
+		if err == nil {
+			atomic.StoreInt32(&o.daemonReady, 1)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unable to connect to Docker at %s after %d attempts: %s", o.DockerHost, o.DockerConnectRetries+1, err)
+}
+
+// registryTokenUsername is the username the wercker registry expects when
+// authenticating with an auth token
+const registryTokenUsername = "token"
+
+// defaultRegistryAuthHost is the host of the wercker registry
+const defaultRegistryAuthHost = "wcr.io"
+
+// registryTokenLock guards the refresh of the registry token, pushes run
+// concurrently with --registry-push-concurrency. DockerOptions gets copied,
+// so the lock can't live in it.
+var registryTokenLock sync.Mutex
+
+// RegistryAuth returns auth for repository with the stored wercker token
+// filled in if auth doesn't contain any credentials, a token is available
+// and repository is in the wercker registry.
+func (o *DockerOptions) RegistryAuth(repository string, auth docker.AuthConfiguration) docker.AuthConfiguration {
+	registryTokenLock.Lock()
+	defer registryTokenLock.Unlock()
+	if o.RegistryAuthToken == "" || auth.Username != "" || auth.Password != "" {
+		return auth
+	}
+	if o.RegistryAuthHost == "" || repositoryRegistry(repository) != o.RegistryAuthHost {
+		return auth
+	}
+	o.refreshRegistryToken()
+	auth.Username = registryTokenUsername
+	auth.Password = o.RegistryAuthToken
+	return auth
+}
+
+// refreshRegistryToken reads the registry token from the token store again
+// if it has expired according to RegistryTokenRefresh.
+func (o *DockerOptions) refreshRegistryToken() {
+	if o.RegistryTokenStore == "" || o.RegistryTokenRefresh <= 0 {
+		return
+	}
+	if time.Since(o.registryTokenRead) < o.RegistryTokenRefresh {
+		return
+	}
+
+	logger := util.RootLogger().WithField("Logger", "Docker")
+	logger.Debugln("Refreshing registry token from", o.RegistryTokenStore)
+	tokenBytes, err := ioutil.ReadFile(o.RegistryTokenStore)
+	if err != nil {
+		logger.WithField("Error", err).Warnln("Unable to refresh registry token")
+		return
+	}
+	if token := strings.TrimSpace(string(tokenBytes)); token != "" {
+		o.RegistryAuthToken = token
+	}
+	o.registryTokenRead = time.Now()
 }
 
 func guessAndUpdateDockerOptions(opts *DockerOptions, e *util.Environment) {
@@ -50,7 +304,8 @@ func guessAndUpdateDockerOptions(opts *DockerOptions, e *util.Environment) {
 	if _, err := os.Stat(unixSocket); err == nil {
 		unixSocket = fmt.Sprintf("unix://%s", unixSocket)
 		client, err := NewDockerClient(&DockerOptions{
-			DockerHost: unixSocket,
+			DockerHost:           unixSocket,
+			DockerConnectRetries: opts.DockerConnectRetries,
 		})
 		if err == nil {
 			_, err = client.Version()
@@ -100,6 +355,67 @@ func guessAndUpdateDockerOptions(opts *DockerOptions, e *util.Environment) {
 	logger.Println(f.Info("No Docker host found, falling back to default", opts.DockerHost))
 }
 
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// validateHostname checks hostname is a legal RFC 1123 hostname.
+func validateHostname(hostname string) error {
+	if len(hostname) > 253 {
+		return fmt.Errorf("Invalid hostname %q, it is longer than 253 characters", hostname)
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if len(label) > 63 || !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("Invalid hostname %q", hostname)
+		}
+	}
+	return nil
+}
+
+// validateAddHost checks host is in the name:ip format used by
+// docker run --add-host.
+func validateAddHost(host string) error {
+	parts := strings.SplitN(host, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid add-host %q, expected name:ip", host)
+	}
+	if err := validateHostname(parts[0]); err != nil {
+		return fmt.Errorf("Invalid add-host %q: %s", host, err)
+	}
+	if net.ParseIP(parts[1]) == nil {
+		return fmt.Errorf("Invalid add-host %q, %q is not an IP address", host, parts[1])
+	}
+	return nil
+}
+
+// shmSizeUnits are the suffixes accepted by parseShmSize
+var shmSizeUnits = map[string]int64{
+	"":  1,
+	"b": 1,
+	"k": 1024,
+	"m": 1024 * 1024,
+	"g": 1024 * 1024 * 1024,
+}
+
+var shmSizePattern = regexp.MustCompile(`^(\d+)([bkmg]?)b?$`)
+
+// parseShmSize parses a size like 64m or 2g, the format used by
+// docker run --shm-size.
+func parseShmSize(size string) (int64, error) {
+	return parseByteSize("shm size", size)
+}
+
+// parseByteSize parses a size like 64m or 2g, what names the size in errors.
+func parseByteSize(what, size string) (int64, error) {
+	matches := shmSizePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(size)))
+	if matches == nil {
+		return 0, fmt.Errorf("Invalid %s %q, expected a number with an optional b, k, m or g suffix", what, size)
+	}
+	n, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid %s %q", what, size)
+	}
+	return n * shmSizeUnits[matches[2]], nil
+}
+
 // NewDockerOptions constructor
 func NewDockerOptions(c util.Settings, e *util.Environment) (*DockerOptions, error) {
 	dockerHost, _ := c.String("docker-host")
@@ -107,13 +423,114 @@ func NewDockerOptions(c util.Settings, e *util.Environment) (*DockerOptions, err
 	dockerCertPath, _ := c.String("docker-cert-path")
 	dockerDNS, _ := c.StringSlice("docker-dns")
 	dockerLocal, _ := c.Bool("docker-local")
+	registryAuthFromTokenStore, _ := c.Bool("registry-auth-from-token-store")
+	registryAuthHost, _ := c.String("registry-auth-host", defaultRegistryAuthHost)
+	hostname, _ := c.String("hostname")
+	addHosts, _ := c.StringSlice("add-host")
+	boxShmSizeString, _ := c.String("box-shm-size")
+	boxPrivileged, _ := c.Bool("box-privileged")
+	capAdd, _ := c.StringSlice("cap-add")
+	capDrop, _ := c.StringSlice("cap-drop")
+
+	if hostname != "" {
+		if err := validateHostname(hostname); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, host := range addHosts {
+		if err := validateAddHost(host); err != nil {
+			return nil, err
+		}
+	}
+
+	var boxShmSize int64
+	if boxShmSizeString != "" {
+		var err error
+		boxShmSize, err = parseShmSize(boxShmSizeString)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var maxImageSize int64
+	if maxImageSizeString, _ := c.String("max-image-size"); maxImageSizeString != "" && maxImageSizeString != "0" {
+		var err error
+		maxImageSize, err = parseByteSize("--max-image-size", maxImageSizeString)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The global options already prefer an explicit --auth-token over the
+	// one saved by `wercker login`
+	var registryAuthToken, registryTokenStore string
+	if registryAuthFromTokenStore {
+		globalOpts, err := core.NewGlobalOptions(c, e)
+		if err != nil {
+			return nil, err
+		}
+		registryAuthToken = globalOpts.AuthToken
+		// Only a token from the store file can be refreshed
+		if authToken, _ := c.GlobalString("auth-token"); authToken == "" && globalOpts.TokenStorage == core.TokenStorageFile {
+			registryTokenStore = globalOpts.AuthTokenStore
+		}
+	}
+	registryTokenRefreshFloat, _ := c.Float64("registry-token-refresh")
+	registryTokenRefresh := time.Duration(registryTokenRefreshFloat * float64(time.Minute))
+	registryTimeoutFloat, _ := c.Float64("registry-timeout")
+	registryTimeout := time.Duration(registryTimeoutFloat * float64(time.Minute))
+	registryPushConcurrency, _ := c.Int("registry-push-concurrency", 1)
+	if registryPushConcurrency < 1 {
+		return nil, fmt.Errorf("Invalid --registry-push-concurrency %d, must be 1 or more", registryPushConcurrency)
+	}
+	servicePollIntervalFloat, _ := c.Float64("service-poll-interval")
+	servicePollInterval := time.Duration(servicePollIntervalFloat * float64(time.Second))
+	if servicePollInterval <= 0 {
+		servicePollInterval = defaultServicePollInterval
+	}
+	dockerOpTimeoutFloat, _ := c.Float64("docker-op-timeout")
+	dockerOpTimeout := time.Duration(dockerOpTimeoutFloat * float64(time.Minute))
+	dockerConnectRetries, _ := c.Int("docker-connect-retries")
+	if dockerConnectRetries < 0 {
+		return nil, fmt.Errorf("Invalid --docker-connect-retries %d, must be 0 or more", dockerConnectRetries)
+	}
+	serviceReadyTimeoutFloat, _ := c.Float64("service-ready-timeout")
+	serviceReadyTimeout := time.Duration(serviceReadyTimeoutFloat * float64(time.Minute))
+	if serviceReadyTimeout <= 0 {
+		serviceReadyTimeout = defaultServiceReadyTimeout
+	}
 
 	speculativeOptions := &DockerOptions{
-		DockerHost:      dockerHost,
-		DockerTLSVerify: dockerTLSVerify,
-		DockerCertPath:  dockerCertPath,
-		DockerDNS:       dockerDNS,
-		DockerLocal:     dockerLocal,
+		DockerHost:        dockerHost,
+		DockerTLSVerify:   dockerTLSVerify,
+		DockerCertPath:    dockerCertPath,
+		DockerDNS:         dockerDNS,
+		DockerLocal:       dockerLocal,
+		Hostname:          hostname,
+		AddHosts:          addHosts,
+		BoxShmSize:        boxShmSize,
+		BoxPrivileged:     boxPrivileged,
+		CapAdd:            capAdd,
+		CapDrop:           capDrop,
+		RegistryAuthToken: registryAuthToken,
+		RegistryAuthHost:  registryAuthHost,
+
+		RegistryTokenStore:   registryTokenStore,
+		RegistryTokenRefresh: registryTokenRefresh,
+		registryTokenRead:    time.Now(),
+		RegistryTimeout:      registryTimeout,
+
+		RegistryPushConcurrency: registryPushConcurrency,
+
+		MaxImageSize: maxImageSize,
+
+		ServicePollInterval: servicePollInterval,
+		ServiceReadyTimeout: serviceReadyTimeout,
+
+		DockerConnectRetries: dockerConnectRetries,
+
+		DockerOpTimeout: dockerOpTimeout,
 	}
 
 	// We're going to try out a few settings and set DockerHost if
@@ -46,6 +46,15 @@ func NewDockerPipeline(name string, config *core.Config, options *core.PipelineO
 	}
 	boxConfig := rawBoxConfig.BoxConfig
 
+	// Let the environment pin the box tag without editing the config
+	if options.BoxTagFromEnv != "" && options.HostEnv != nil {
+		if tag := options.HostEnv.Get(options.BoxTagFromEnv); tag != "" {
+			boxConfigCopy := *boxConfig
+			boxConfigCopy.Tag = tag
+			boxConfig = &boxConfigCopy
+		}
+	}
+
 	// Select this pipeline's service or the global config
 	servicesConfig := pipelineConfig.Services
 	if servicesConfig == nil {
@@ -81,7 +90,7 @@ func NewDockerPipeline(name string, config *core.Config, options *core.PipelineO
 		return nil, err
 	}
 
-	steps := []core.Step{initStep}
+	var steps []core.Step
 	for _, stepConfig := range stepsConfig {
 		step, err := NewStep(stepConfig.StepConfig, options, dockerOptions)
 		if err != nil {
@@ -93,6 +102,11 @@ func NewDockerPipeline(name string, config *core.Config, options *core.PipelineO
 			steps = append(steps, step)
 		}
 	}
+	steps, err = core.OrderSteps(steps, options.StepOrderStrategy)
+	if err != nil {
+		return nil, err
+	}
+	steps = append([]core.Step{initStep}, steps...)
 
 	var afterSteps []core.Step
 	for _, stepConfig := range afterStepsConfig {
@@ -106,11 +120,27 @@ func NewDockerPipeline(name string, config *core.Config, options *core.PipelineO
 			afterSteps = append(afterSteps, step)
 		}
 	}
+	afterSteps, err = core.OrderSteps(afterSteps, options.StepOrderStrategy)
+	if err != nil {
+		return nil, err
+	}
 	// if we found some valid after steps, prepend init
 	if len(afterSteps) > 0 {
 		afterSteps = append([]core.Step{initStep}, afterSteps...)
 	}
 
+	// Start from the checkpoint committed after the step preceding the one
+	// we are resuming from
+	if options.ResumeFrom != "" {
+		index, err := core.FindResumeStep(steps, options.ResumeFrom)
+		if err != nil {
+			return nil, err
+		}
+		if index > 0 {
+			box.UseCheckpoint(core.CheckpointRepository(options), core.CheckpointTag(index-1, steps[index-1]))
+		}
+	}
+
 	logger := util.RootLogger().WithField("Logger", "Pipeline")
 	base := core.NewBasePipeline(core.BasePipelineOptions{
 		Options:    options,
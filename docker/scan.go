@@ -0,0 +1,69 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+)
+
+// logsWriter emits everything written to it as logs.
+type logsWriter struct {
+	e *core.NormalizedEmitter
+}
+
+func (w *logsWriter) Write(p []byte) (int, error) {
+	w.e.Emit(core.Logs, &core.LogsArgs{
+		Logs: string(p),
+	})
+	return len(p), nil
+}
+
+// ScanImage runs the --scan-command for image, with {image} replaced by the
+// image reference. A failing scan returns an error unless --scan-nonblocking
+// is set, in which case it is only logged.
+func ScanImage(options *core.PipelineOptions, e *core.NormalizedEmitter, image string) error {
+	if options.ScanCommand == "" {
+		return nil
+	}
+	logger := util.RootLogger().WithField("Logger", "Scan")
+
+	command := strings.Replace(options.ScanCommand, "{image}", image, -1)
+	e.Emit(core.Logs, &core.LogsArgs{
+		Logs: fmt.Sprintf("Scanning image %s\n", image),
+	})
+
+	w := &logsWriter{e}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = os.Environ()
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	err = fmt.Errorf("Image scan failed for %s: %s", image, err)
+	if options.ScanNonblocking {
+		logger.WithField("Error", err).Warnln("Ignoring failed image scan, --scan-nonblocking is set")
+		return nil
+	}
+	return err
+}
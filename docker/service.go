@@ -17,7 +17,9 @@ package dockerlocal
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/google/shlex"
@@ -143,19 +145,24 @@ func (b *InternalServiceBox) Run(ctx context.Context, env *util.Environment, lin
 		cmdInfo = append(cmdInfo, origCmd...)
 	}
 
-	container, err := client.CreateContainer(
-		docker.CreateContainerOptions{
-			Name: b.getContainerName(),
-			Config: &docker.Config{
-				Image:           b.Name,
-				Cmd:             cmd,
-				Env:             myEnv,
-				NetworkDisabled: b.networkDisabled,
-				DNS:             b.dockerOptions.DockerDNS,
-				Entrypoint:      entrypoint,
-			},
-		})
-
+	var container *docker.Container
+	err = b.dockerOptions.withDockerOpTimeout("create", b.getContainerName(), func() error {
+		var err error
+		container, err = client.CreateContainer(
+			docker.CreateContainerOptions{
+				Name: b.getContainerName(),
+				Config: &docker.Config{
+					Image:           b.Name,
+					Cmd:             cmd,
+					Env:             myEnv,
+					NetworkDisabled: b.networkDisabled,
+					DNS:             b.dockerOptions.DockerDNS,
+					Entrypoint:      entrypoint,
+					Labels:          b.options.ResourceLabels(),
+				},
+			})
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -172,11 +179,16 @@ func (b *InternalServiceBox) Run(ctx context.Context, env *util.Environment, lin
 		b.logger.Println(f.Info(fmt.Sprintf("Starting service %s", b.ShortName), strings.Join(out, " ")))
 	}
 
-	client.StartContainer(container.ID, &docker.HostConfig{
-		DNS:   b.dockerOptions.DockerDNS,
-		Links: links,
+	err = b.dockerOptions.withDockerOpTimeout("start", container.ID, func() error {
+		return client.StartContainer(container.ID, &docker.HostConfig{
+			DNS:   b.dockerOptions.DockerDNS,
+			Links: links,
+		})
 	})
 	b.container = container
+	if err != nil {
+		return nil, err
+	}
 
 	go func() {
 		status, err := client.WaitContainer(container.ID)
@@ -215,3 +227,92 @@ func (b *InternalServiceBox) Run(ctx context.Context, env *util.Environment, lin
 
 	return container, nil
 }
+
+// WaitReady polls the readiness check of the service every
+// ServicePollInterval until it passes, it fails when the service isn't ready
+// within ServiceReadyTimeout. Services without a check are ready right away.
+func (b *InternalServiceBox) WaitReady(ctx context.Context) error {
+	if b.config.ReadyPort == 0 && b.config.ReadyCommand == "" {
+		return nil
+	}
+
+	client, err := NewDockerClient(b.dockerOptions)
+	if err != nil {
+		return err
+	}
+
+	b.logger.Debugln("Waiting for service to be ready:", b.ShortName)
+	timeout := time.After(b.dockerOptions.ServiceReadyTimeout)
+	for {
+		err = b.checkReady(client)
+		if err == nil {
+			return nil
+		}
+		b.logger.WithField("Error", err).Debugln("Service not ready:", b.ShortName)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("Service %s was not ready after %s: %s", b.ShortName, b.dockerOptions.ServiceReadyTimeout, err)
+		case <-time.After(b.dockerOptions.ServicePollInterval):
+		}
+	}
+}
+
+// checkReady runs the readiness check once, both checks run in the service
+// container so they don't depend on the host reaching the container's IP
+func (b *InternalServiceBox) checkReady(client *DockerClient) error {
+	if b.config.ReadyPort != 0 {
+		exitCode, err := execExitCode(client, b.container.ID, readyPortCommand(b.config.ReadyPort))
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("Nothing listens on ready-port %d", b.config.ReadyPort)
+		}
+	}
+
+	if b.config.ReadyCommand != "" {
+		exitCode, err := execExitCode(client, b.container.ID, b.config.ReadyCommand)
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("ready-command exited with %d", exitCode)
+		}
+	}
+	return nil
+}
+
+// readyPortCommand checks the TCP sockets of the container's network
+// namespace for one listening on port, images rarely have nc.
+func readyPortCommand(port int) string {
+	return fmt.Sprintf("grep -qsE ':%04X [0-9A-F]+:[0-9A-F]+ 0A' /proc/net/tcp /proc/net/tcp6", port)
+}
+
+// execExitCode runs command with sh in the container and returns its exit
+// code.
+func execExitCode(client *DockerClient, containerID, command string) (int, error) {
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{"/bin/sh", "-c", command},
+		Container:    containerID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = client.StartExec(exec.ID, docker.StartExecOptions{
+		OutputStream: ioutil.Discard,
+		ErrorStream:  ioutil.Discard,
+	})
+	if err != nil {
+		return 0, err
+	}
+	inspect, err := client.InspectExec(exec.ID)
+	if err != nil {
+		return 0, err
+	}
+	return inspect.ExitCode, nil
+}
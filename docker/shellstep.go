@@ -56,6 +56,9 @@ func NewShellStep(stepConfig *core.StepConfig, options *core.PipelineOptions, do
 		Owner:       "wercker",
 		SafeID:      stepSafeID,
 		Version:     util.Version(),
+		DependsOn:   stepConfig.DependsOn,
+		Artifacts:   stepConfig.Artifacts,
+		Enabled:     stepConfig.Enabled,
 	})
 
 	return &ShellStep{
@@ -0,0 +1,87 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+)
+
+// SaveStepCache stores the `artifacts` of step from the container in the
+// step cache entry of key and marks the entry as a success. Paths that don't
+// exist are skipped, like with CollectStepArtifacts.
+func (a *Artificer) SaveStepCache(cache *core.StepCache, key string, step core.Step, containerID string) error {
+	// Start from an empty entry, a failed save may have left files behind
+	if err := os.RemoveAll(cache.Path(key)); err != nil {
+		return err
+	}
+	for _, p := range step.Artifacts() {
+		name := stepArtifactName(p)
+		artifact := &core.Artifact{
+			ContainerID: containerID,
+			GuestPath:   a.stepArtifactGuestPath(p),
+			HostTarPath: cache.Path(key, "outputs", name+".tar"),
+			HostPath:    cache.Path(key, "outputs", name),
+		}
+		if _, err := a.Collect(artifact); err != nil {
+			if err == util.ErrEmptyTarball {
+				a.logger.WithField("Path", p).Warnln("Step output not found, not caching it")
+				continue
+			}
+			return err
+		}
+		// Only the tarball is needed to restore it
+		if err := os.RemoveAll(artifact.HostPath); err != nil {
+			return err
+		}
+	}
+	return cache.MarkSuccess(key)
+}
+
+// RestoreStepCache copies the `artifacts` of step stored in the step cache
+// entry of key back into the container.
+func (a *Artificer) RestoreStepCache(cache *core.StepCache, key string, step core.Step, containerID string) error {
+	client, err := NewDockerClient(a.dockerOptions)
+	if err != nil {
+		return err
+	}
+	for _, p := range step.Artifacts() {
+		tarPath := cache.Path(key, "outputs", stepArtifactName(p)+".tar")
+		if ok, _ := util.Exists(tarPath); !ok {
+			continue
+		}
+		if err := a.uploadTarball(client, containerID, tarPath, filepath.Dir(a.stepArtifactGuestPath(p))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadTarball extracts the tarball at tarPath into dir in the container
+func (a *Artificer) uploadTarball(client *DockerClient, containerID, tarPath, dir string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return client.UploadToContainer(containerID, docker.UploadToContainerOptions{
+		InputStream: f,
+		Path:        dir,
+	})
+}
@@ -132,6 +132,7 @@ func (s *StoreContainerStep) Execute(ctx context.Context, sess *core.Session) (i
 		Tag:        tag,
 		Author:     "wercker",
 		Message:    message,
+		Run:        &docker.Config{Labels: s.options.ImageLabels()},
 	}
 	s.logger.Debugln("Commit container:", containerID)
 	i, err := client.CommitContainer(commitOpts)
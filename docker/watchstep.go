@@ -68,6 +68,9 @@ func NewWatchStep(stepConfig *core.StepConfig, options *core.PipelineOptions, do
 		Owner:       "wercker",
 		SafeID:      stepSafeID,
 		Version:     util.Version(),
+		DependsOn:   stepConfig.DependsOn,
+		Artifacts:   stepConfig.Artifacts,
+		Enabled:     stepConfig.Enabled,
 	})
 
 	return &WatchStep{
@@ -0,0 +1,46 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/wercker/wercker/core"
+)
+
+// NewAnnotationHandler will create a new AnnotationHandler printing to w.
+func NewAnnotationHandler(format string, w io.Writer) *AnnotationHandler {
+	return &AnnotationHandler{format: format, w: w}
+}
+
+// AnnotationHandler prints the annotations of finished steps, so CI systems
+// can pick them up from the output.
+type AnnotationHandler struct {
+	format string
+	w      io.Writer
+}
+
+// ListenTo will add eventhandlers to e.
+func (h *AnnotationHandler) ListenTo(e *core.NormalizedEmitter) {
+	e.AddListener(core.BuildStepFinished, h.BuildStepFinished)
+}
+
+// BuildStepFinished responds to the BuildStepFinished event.
+func (h *AnnotationHandler) BuildStepFinished(args *core.BuildStepFinishedArgs) {
+	for _, annotation := range args.Annotations {
+		fmt.Fprintln(h.w, core.FormatAnnotation(annotation, h.format))
+	}
+}
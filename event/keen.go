@@ -0,0 +1,87 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	keenBaseURL        = "https://api.keen.io/3.0"
+	keenRequestTimeout = 10 * time.Second
+)
+
+// keenClient posts events to the keen.io API.
+type keenClient struct {
+	baseURL   string
+	projectID string
+	writeKey  string
+	client    *http.Client
+}
+
+// newKeenClient constructor
+func newKeenClient(projectID, writeKey string) *keenClient {
+	return &keenClient{
+		baseURL:   keenBaseURL,
+		projectID: projectID,
+		writeKey:  writeKey,
+		client:    &http.Client{Timeout: keenRequestTimeout},
+	}
+}
+
+// keenError is a response from keen.io that isn't a success.
+type keenError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *keenError) Error() string {
+	return fmt.Sprintf("keen.io returned status code %d: %s", e.StatusCode, e.Message)
+}
+
+// AddEvent adds event to collection.
+func (c *keenClient) AddEvent(collection string, event interface{}) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	u := fmt.Sprintf("%s/projects/%s/events/%s", c.baseURL, url.QueryEscape(c.projectID), url.QueryEscape(collection))
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", c.writeKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return &keenError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return nil
+}
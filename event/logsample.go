@@ -0,0 +1,99 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"regexp"
+	"strings"
+)
+
+// maxSampledLineLength truncates sampled lines so a single minified blob
+// doesn't blow up the event.
+const maxSampledLineLength = 500
+
+var errorLineRe = regexp.MustCompile(`(?i)\b(error|fatal|panic|fail(ed|ure)?)\b`)
+
+// logSample keeps a bounded sample of the output of a step: the first and
+// last max lines, and the first max lines that look like errors.
+type logSample struct {
+	max     int
+	lines   int
+	head    []string
+	tail    []string
+	errors  []string
+	partial string
+}
+
+func newLogSample(max int) *logSample {
+	return &logSample{max: max}
+}
+
+// Write adds a chunk of output, lines may be split across chunks. Only as
+// much of an unfinished line is kept as will be sampled of it.
+func (s *logSample) Write(chunk string) {
+	lines := strings.Split(s.partial+chunk, "\n")
+	s.partial = truncateSampledLine(lines[len(lines)-1])
+	for _, line := range lines[:len(lines)-1] {
+		s.add(line)
+	}
+}
+
+func truncateSampledLine(line string) string {
+	if len(line) > maxSampledLineLength {
+		return line[:maxSampledLineLength]
+	}
+	return line
+}
+
+func (s *logSample) add(line string) {
+	line = truncateSampledLine(strings.TrimRight(line, "\r"))
+	s.lines++
+
+	if len(s.head) < s.max {
+		s.head = append(s.head, line)
+	} else {
+		s.tail = append(s.tail, line)
+		if len(s.tail) > s.max {
+			s.tail = s.tail[1:]
+		}
+	}
+
+	if len(s.errors) < s.max && errorLineRe.MatchString(line) {
+		s.errors = append(s.errors, line)
+	}
+}
+
+// Payload returns the sample for the keen event.
+func (s *logSample) Payload() *metricsLogSample {
+	if s.partial != "" {
+		s.add(s.partial)
+		s.partial = ""
+	}
+	return &metricsLogSample{
+		Lines:  s.lines,
+		Head:   s.head,
+		Tail:   s.tail,
+		Errors: s.errors,
+	}
+}
+
+// metricsLogSample is the sampled step output we're reporting to keen. Part
+// of MetricsPayload.
+type metricsLogSample struct {
+	Lines  int      `json:"lines"`
+	Head   []string `json:"head,omitempty"`
+	Tail   []string `json:"tail,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
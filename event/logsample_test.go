@@ -0,0 +1,73 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type LogSampleSuite struct {
+	*util.TestSuite
+}
+
+func TestLogSampleSuite(t *testing.T) {
+	suiteTester := &LogSampleSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *LogSampleSuite) TestSample() {
+	sample := newLogSample(2)
+	for i := 1; i <= 5; i++ {
+		sample.Write(fmt.Sprintf("line %d\n", i))
+	}
+	sample.Write("Build FAILED\r\n")
+	sample.Write("error: one\nerror: two\n")
+
+	payload := sample.Payload()
+	s.Equal(8, payload.Lines)
+	s.Equal([]string{"line 1", "line 2"}, payload.Head)
+	s.Equal([]string{"error: one", "error: two"}, payload.Tail)
+	s.Equal([]string{"Build FAILED", "error: one"}, payload.Errors)
+}
+
+func (s *LogSampleSuite) TestSplitLines() {
+	sample := newLogSample(10)
+	sample.Write("compil")
+	sample.Write("ing\nfailed to link")
+
+	// The unterminated last line counts too
+	payload := sample.Payload()
+	s.Equal([]string{"compiling", "failed to link"}, payload.Head)
+	s.Equal([]string{"failed to link"}, payload.Errors)
+}
+
+func (s *LogSampleSuite) TestLongLines() {
+	sample := newLogSample(10)
+	// A progress bar or minified blob without newlines
+	for i := 0; i < 1000; i++ {
+		sample.Write(strings.Repeat("=", 100))
+		s.True(len(sample.partial) <= maxSampledLineLength)
+	}
+	sample.Write("\ndone\n")
+
+	payload := sample.Payload()
+	s.Equal(2, payload.Lines)
+	s.Equal([]string{strings.Repeat("=", maxSampledLineLength), "done"}, payload.Head)
+}
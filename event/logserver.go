@@ -0,0 +1,315 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// logServerHistory is the amount of recent events replayed to viewers
+	// that connect after the run has started.
+	logServerHistory = 1000
+
+	// logServerViewerBuffer is the amount of events a viewer can fall
+	// behind before it gets disconnected.
+	logServerViewerBuffer = 256
+)
+
+// NewLogServer will create a new LogServer listening on addr.
+func NewLogServer(addr string) (*LogServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &LogServer{
+		listener: listener,
+		viewers:  make(map[chan *ServerEvent]struct{}),
+		logger:   util.RootLogger().WithField("Logger", "LogServer"),
+	}
+
+	go func() {
+		err := http.Serve(listener, s.handler())
+		if err != nil {
+			s.logger.WithField("Error", err).Debugln("Log server stopped")
+		}
+	}()
+	s.logger.Infoln("Serving events on", listener.Addr())
+
+	return s, nil
+}
+
+// A LogServer streams the events of a run to local viewers, as server-sent
+// events on /events and as JSON messages on the /ws websocket. It stops when
+// the pipeline finishes.
+type LogServer struct {
+	listener net.Listener
+	l        sync.Mutex
+	history  []*ServerEvent
+	viewers  map[chan *ServerEvent]struct{}
+	closed   bool
+	logger   *util.LogEntry
+}
+
+func (s *LogServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.serveSSE)
+	mux.Handle("/ws", websocket.Handler(s.serveWebsocket))
+	return mux
+}
+
+// Close stops accepting viewers and disconnects the connected ones once they
+// received the events sent so far.
+func (s *LogServer) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for viewer := range s.viewers {
+		delete(s.viewers, viewer)
+		close(viewer)
+	}
+	return s.listener.Close()
+}
+
+// ServerEvent is a single structured event sent to the viewers.
+type ServerEvent struct {
+	Type string      `json:"type"`
+	Time string      `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// ServerStep describes the step an event belongs to.
+type ServerStep struct {
+	DisplayName string `json:"displayName"`
+	Name        string `json:"name"`
+	Order       int    `json:"order"`
+}
+
+func newServerStep(step core.Step, order int) *ServerStep {
+	if step == nil {
+		return nil
+	}
+	return &ServerStep{
+		DisplayName: step.DisplayName(),
+		Name:        step.Name(),
+		Order:       order,
+	}
+}
+
+// ListenTo will add eventhandlers to e.
+func (s *LogServer) ListenTo(e *core.NormalizedEmitter) {
+	e.AddListener(core.BuildStarted, s.BuildStarted)
+	e.AddListener(core.BuildStepStarted, s.BuildStepStarted)
+	e.AddListener(core.BuildStepFinished, s.BuildStepFinished)
+	e.AddListener(core.BuildFinished, s.BuildFinished)
+	e.AddListener(core.FullPipelineFinished, s.FullPipelineFinished)
+	e.AddListener(core.Logs, s.Logs)
+}
+
+// BuildStarted responds to the BuildStarted event.
+func (s *LogServer) BuildStarted(args *core.BuildStartedArgs) {
+	s.publish("buildStarted", nil)
+}
+
+// BuildStepStarted responds to the BuildStepStarted event.
+func (s *LogServer) BuildStepStarted(args *core.BuildStepStartedArgs) {
+	s.publish("stepStarted", map[string]interface{}{
+		"step": newServerStep(args.Step, args.Order),
+	})
+}
+
+// BuildStepFinished responds to the BuildStepFinished event.
+func (s *LogServer) BuildStepFinished(args *core.BuildStepFinishedArgs) {
+	s.publish("stepFinished", map[string]interface{}{
+		"step":        newServerStep(args.Step, args.Order),
+		"successful":  args.Successful,
+		"message":     args.Message,
+		"artifactUrl": args.ArtifactURL,
+	})
+}
+
+// BuildFinished responds to the BuildFinished event.
+func (s *LogServer) BuildFinished(args *core.BuildFinishedArgs) {
+	s.publish("buildFinished", map[string]interface{}{
+		"result": args.Result,
+	})
+}
+
+// FullPipelineFinished responds to the FullPipelineFinished event, it is the
+// last event so the server is closed.
+func (s *LogServer) FullPipelineFinished(args *core.FullPipelineFinishedArgs) {
+	s.publish("pipelineFinished", map[string]interface{}{
+		"mainSuccessful":      args.MainSuccessful,
+		"ranAfterSteps":       args.RanAfterSteps,
+		"afterStepSuccessful": args.AfterStepSuccessful,
+	})
+	if err := s.Close(); err != nil {
+		s.logger.WithField("Error", err).Debugln("Unable to close log server")
+	}
+}
+
+// Logs responds to the Logs event, hidden logs are never sent.
+func (s *LogServer) Logs(args *core.LogsArgs) {
+	if args.Hidden {
+		return
+	}
+	s.publish("logs", map[string]interface{}{
+		"step":   newServerStep(args.Step, args.Order),
+		"stream": args.Stream,
+		"logs":   args.Logs,
+	})
+}
+
+// publish stores the event for late viewers and sends it to the connected
+// ones. Viewers that can't keep up are disconnected instead of blocking the
+// build.
+func (s *LogServer) publish(eventType string, data interface{}) {
+	ev := &ServerEvent{
+		Type: eventType,
+		Time: time.Now().Format(time.RFC3339Nano),
+		Data: data,
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.history = append(s.history, ev)
+	if len(s.history) > logServerHistory {
+		s.history = s.history[len(s.history)-logServerHistory:]
+	}
+
+	for viewer := range s.viewers {
+		select {
+		case viewer <- ev:
+		default:
+			s.logger.Debugln("Viewer is too slow, disconnecting")
+			delete(s.viewers, viewer)
+			close(viewer)
+		}
+	}
+}
+
+// subscribe registers a new viewer and returns its channel, which starts
+// with the recent history. Once the server is closed the channel is closed
+// too.
+func (s *LogServer) subscribe() chan *ServerEvent {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	viewer := make(chan *ServerEvent, logServerViewerBuffer+len(s.history))
+	for _, ev := range s.history {
+		viewer <- ev
+	}
+	if s.closed {
+		close(viewer)
+		return viewer
+	}
+	s.viewers[viewer] = struct{}{}
+	return viewer
+}
+
+// unsubscribe removes viewer, if it is still registered.
+func (s *LogServer) unsubscribe(viewer chan *ServerEvent) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if _, ok := s.viewers[viewer]; ok {
+		delete(s.viewers, viewer)
+		close(viewer)
+	}
+}
+
+func (s *LogServer) serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	viewer := s.subscribe()
+	defer s.unsubscribe(viewer)
+
+	closed := w.(http.CloseNotifier).CloseNotify()
+	for {
+		select {
+		case ev, ok := <-viewer:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(ev)
+			if err != nil {
+				s.logger.WithField("Error", err).Debugln("Unable to marshal event")
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b)
+			flusher.Flush()
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (s *LogServer) serveWebsocket(ws *websocket.Conn) {
+	defer ws.Close()
+
+	viewer := s.subscribe()
+	defer s.unsubscribe(viewer)
+
+	// Viewers don't send anything, reading is how we notice they went away
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(gone)
+	}()
+
+	for {
+		select {
+		case ev, ok := <-viewer:
+			if !ok {
+				return
+			}
+			err := websocket.JSON.Send(ws, ev)
+			if err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
@@ -0,0 +1,129 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/websocket"
+)
+
+type LogServerSuite struct {
+	*util.TestSuite
+}
+
+func TestLogServerSuite(t *testing.T) {
+	suiteTester := &LogServerSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *LogServerSuite) newLogServer() *LogServer {
+	ls, err := NewLogServer("127.0.0.1:0")
+	s.Require().Nil(err)
+	return ls
+}
+
+func (s *LogServerSuite) dial(addr string) *websocket.Conn {
+	ws, err := websocket.Dial("ws://"+addr+"/ws", "", "http://localhost/")
+	s.Require().Nil(err)
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	return ws
+}
+
+func (s *LogServerSuite) receive(ws *websocket.Conn) *ServerEvent {
+	ev := &ServerEvent{}
+	s.Require().Nil(websocket.JSON.Receive(ws, ev))
+	return ev
+}
+
+// waitViewers waits until ls has n viewers.
+func (s *LogServerSuite) waitViewers(ls *LogServer, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ls.l.Lock()
+		viewers := len(ls.viewers)
+		ls.l.Unlock()
+		if viewers == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Fail("Timed out waiting for viewers", "want %d", n)
+}
+
+func (s *LogServerSuite) TestWebsocket() {
+	ls := s.newLogServer()
+	defer ls.Close()
+	server := httptest.NewServer(ls.handler())
+	defer server.Close()
+
+	// Viewers that connect late get the history first
+	ls.BuildStarted(&core.BuildStartedArgs{})
+	ws := s.dial(server.Listener.Addr().String())
+	defer ws.Close()
+	s.Equal("buildStarted", s.receive(ws).Type)
+
+	s.waitViewers(ls, 1)
+	ls.Logs(&core.LogsArgs{Logs: "the-secret\n", Hidden: true})
+	ls.Logs(&core.LogsArgs{Logs: "compiling\n", Stream: "stdout"})
+	ev := s.receive(ws)
+	s.Equal("logs", ev.Type)
+	s.Equal("compiling\n", ev.Data.(map[string]interface{})["logs"])
+}
+
+func (s *LogServerSuite) TestWebsocketViewerGone() {
+	ls := s.newLogServer()
+	defer ls.Close()
+	server := httptest.NewServer(ls.handler())
+	defer server.Close()
+
+	ws := s.dial(server.Listener.Addr().String())
+	s.waitViewers(ls, 1)
+
+	// Nothing is published, the server only notices by reading
+	ws.Close()
+	s.waitViewers(ls, 0)
+}
+
+func (s *LogServerSuite) TestClosesWhenPipelineFinishes() {
+	ls := s.newLogServer()
+	addr := ls.listener.Addr().String()
+	ws := s.dial(addr)
+	defer ws.Close()
+	s.waitViewers(ls, 1)
+
+	ls.FullPipelineFinished(&core.FullPipelineFinishedArgs{MainSuccessful: true})
+	s.Equal("pipelineFinished", s.receive(ws).Type)
+
+	// The viewer is disconnected after the last event
+	ev := &ServerEvent{}
+	err := websocket.JSON.Receive(ws, ev)
+	s.NotNil(err)
+	s.False(strings.Contains(err.Error(), "timeout"), err.Error())
+
+	_, err = net.Dial("tcp", addr)
+	s.NotNil(err)
+
+	// Events emitted after the end are dropped
+	ls.Logs(&core.LogsArgs{Logs: "late\n"})
+	s.Len(ls.history, 1)
+}
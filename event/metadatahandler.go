@@ -0,0 +1,86 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+)
+
+// NewMetadataHandler will create a new MetadataHandler printing to w.
+func NewMetadataHandler(w io.Writer) *MetadataHandler {
+	return &MetadataHandler{w: w}
+}
+
+// MetadataHandler prints the metadata of the run as shell assignments when
+// the pipeline finishes, so it can be captured with eval. Logs are written to
+// stderr, so stdout only contains the metadata.
+type MetadataHandler struct {
+	w           io.Writer
+	image       string
+	artifactURL string
+	failedStep  string
+}
+
+// ListenTo will add eventhandlers to e.
+func (h *MetadataHandler) ListenTo(e *core.NormalizedEmitter) {
+	e.AddListener(core.BuildStepsAdded, h.BuildStepsAdded)
+	e.AddListener(core.BuildStepFinished, h.BuildStepFinished)
+	e.AddListener(core.FullPipelineFinished, h.FullPipelineFinished)
+}
+
+// BuildStepsAdded responds to the BuildStepsAdded event.
+func (h *MetadataHandler) BuildStepsAdded(args *core.BuildStepsAddedArgs) {
+	if args.Options.ShouldCommit && args.Build != nil {
+		h.image = fmt.Sprintf("%s:%s", args.Build.DockerRepo(), args.Build.DockerTag())
+	}
+}
+
+// BuildStepFinished responds to the BuildStepFinished event.
+func (h *MetadataHandler) BuildStepFinished(args *core.BuildStepFinishedArgs) {
+	if args.PackageURL != "" {
+		h.artifactURL = args.PackageURL
+	}
+	if !args.Successful && h.failedStep == "" && args.Step != nil {
+		h.failedStep = args.Step.DisplayName()
+	}
+}
+
+// FullPipelineFinished prints the metadata.
+func (h *MetadataHandler) FullPipelineFinished(args *core.FullPipelineFinishedArgs) {
+	result := "failed"
+	if args.MainSuccessful {
+		result = "passed"
+	}
+
+	metadata := [][]string{
+		{"WERCKER_PIPELINE", args.Options.Pipeline},
+		{"WERCKER_BUILD_ID", args.Options.BuildID},
+		{"WERCKER_DEPLOY_ID", args.Options.DeployID},
+		{"WERCKER_RESULT", result},
+		{"WERCKER_FAILED_STEP", h.failedStep},
+		{"WERCKER_IMAGE", h.image},
+		{"WERCKER_ARTIFACT_URL", h.artifactURL},
+	}
+	for _, pair := range metadata {
+		if pair[1] == "" {
+			continue
+		}
+		fmt.Fprintf(h.w, "%s=%s\n", pair[0], util.ShellQuote(pair[1]))
+	}
+}
@@ -17,9 +17,10 @@ package event
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"sync"
 	"time"
 
-	"github.com/inconshreveable/go-keen"
 	"github.com/wercker/wercker/core"
 	"github.com/wercker/wercker/util"
 )
@@ -34,23 +35,54 @@ func NewMetricsHandler(opts *core.PipelineOptions) (*MetricsEventHandler, error)
 		return nil, errors.New("No KeenProjectID specified")
 	}
 
-	keenInstance := &keen.Client{
-		WriteKey:  opts.KeenProjectWriteKey,
-		ProjectID: opts.KeenProjectID,
-	}
+	h := newMetricsHandler(newKeenClient(opts.KeenProjectID, opts.KeenProjectWriteKey))
+	h.logSampling = opts.KeenLogSampling
+	go h.run()
 
-	versions := util.GetVersions()
+	return h, nil
+}
 
+// newMetricsHandler makes a MetricsEventHandler sending to keen, run still
+// has to be started.
+func newMetricsHandler(keen *keenClient) *MetricsEventHandler {
 	return &MetricsEventHandler{
-		keen:      keenInstance,
-		versions:  versions,
-		startStep: make(map[string]time.Time),
-	}, nil
+		keen:           keen,
+		versions:       util.GetVersions(),
+		logSamples:     make(map[string]*logSample),
+		startStep:      make(map[string]time.Time),
+		queue:          make(chan *metricsEvent, metricsQueueSize),
+		done:           make(chan struct{}),
+		initialBackoff: metricsInitialBackoff,
+		maxBackoff:     metricsMaxBackoff,
+		logger:         util.RootLogger().WithField("Logger", "Metrics"),
+	}
+}
+
+const (
+	// metricsQueueSize is the amount of events that can be waiting to be
+	// sent before new events get dropped.
+	metricsQueueSize = 100
+
+	// metricsMaxAttempts is the amount of times a rate limited event is
+	// retried before it gets dropped.
+	metricsMaxAttempts = 5
+
+	metricsInitialBackoff = 1 * time.Second
+	metricsMaxBackoff     = 30 * time.Second
+
+	// metricsCloseTimeout is the time Close waits for the queue to drain.
+	metricsCloseTimeout = 10 * time.Second
+)
+
+// metricsEvent is a single payload waiting to be sent to keen.
+type metricsEvent struct {
+	collection string
+	payload    *MetricsPayload
 }
 
 // A MetricsEventHandler reporting to keen.io.
 type MetricsEventHandler struct {
-	keen                *keen.Client
+	keen                *keenClient
 	startStep           map[string]time.Time
 	startBuild          time.Time
 	versions            *util.Versions
@@ -58,6 +90,21 @@ type MetricsEventHandler struct {
 	numBuildAfterSteps  int
 	numDeploySteps      int
 	numDeployAfterSteps int
+
+	logSampling int
+	logSamples  map[string]*logSample
+	sampleLock  sync.Mutex
+
+	queue    chan *metricsEvent
+	done     chan struct{}
+	logger   *util.LogEntry
+	l        sync.Mutex
+	closed   bool
+	dropped  int
+	deferred int
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
 }
 
 // ListenTo will add eventhandlers to e.
@@ -65,9 +112,14 @@ func (h *MetricsEventHandler) ListenTo(e *core.NormalizedEmitter) {
 	e.AddListener(core.BuildStepStarted, h.BuildStepStarted)
 	e.AddListener(core.BuildStepFinished, h.BuildStepFinished)
 	e.AddListener(core.BuildStepsAdded, h.BuildStepsAdded)
+	if h.logSampling > 0 {
+		e.AddListener(core.Logs, h.Logs)
+	}
 
 	e.AddListener(core.BuildStarted, h.BuildStarted)
 	e.AddListener(core.BuildFinished, h.BuildFinished)
+
+	e.AddListener(core.FullPipelineFinished, h.FullPipelineFinished)
 }
 
 func newMetricsKeenPayload(now time.Time) *metricsKeenPayload {
@@ -150,6 +202,7 @@ func (h *MetricsEventHandler) BuildStepFinished(args *core.BuildStepFinishedArgs
 		Duration:  &duration,
 		Success:   &args.Successful,
 		Message:   args.Message,
+		LogSample: h.takeLogSample(args.Step),
 	}
 	h.sendPayload(&sendPayloadArgs{
 		p:         p,
@@ -160,6 +213,40 @@ func (h *MetricsEventHandler) BuildStepFinished(args *core.BuildStepFinishedArgs
 	})
 }
 
+// Logs samples the output of the steps for --keen-log-sampling. The logs are
+// already masked by the emitter.
+func (h *MetricsEventHandler) Logs(args *core.LogsArgs) {
+	if args.Hidden || args.Step == nil || args.Stream == "stdin" {
+		return
+	}
+
+	h.sampleLock.Lock()
+	defer h.sampleLock.Unlock()
+	sample, ok := h.logSamples[args.Step.SafeID()]
+	if !ok {
+		sample = newLogSample(h.logSampling)
+		h.logSamples[args.Step.SafeID()] = sample
+	}
+	sample.Write(args.Logs)
+}
+
+// takeLogSample returns the sampled output of step and forgets about it.
+func (h *MetricsEventHandler) takeLogSample(step core.Step) *metricsLogSample {
+	h.sampleLock.Lock()
+	defer h.sampleLock.Unlock()
+	sample, ok := h.logSamples[step.SafeID()]
+	if !ok {
+		return nil
+	}
+	delete(h.logSamples, step.SafeID())
+	return sample.Payload()
+}
+
+// FullPipelineFinished flushes the events that are still queued.
+func (h *MetricsEventHandler) FullPipelineFinished(args *core.FullPipelineFinishedArgs) {
+	h.Close()
+}
+
 // BuildStepsAdded handles the BuildStepsAdded event.
 func (h *MetricsEventHandler) BuildStepsAdded(args *core.BuildStepsAddedArgs) {
 	if args.Options.BuildID != "" {
@@ -198,7 +285,8 @@ func (h *MetricsEventHandler) sendPayload(args *sendPayloadArgs) {
 		OwnerName: args.options.ApplicationOwnerName,
 	}
 	p.SentCli = h.versions
-	p.Stack = 5
+	p.Stack = getStack(args.options)
+	p.Environment = args.options.KeenEnvironment
 	p.NumBuildSteps = h.numBuildSteps
 	p.NumBuildAfterSteps = h.numBuildAfterSteps
 	p.NumDeploySteps = h.numDeploySteps
@@ -206,7 +294,112 @@ func (h *MetricsEventHandler) sendPayload(args *sendPayloadArgs) {
 	p.PipelineName = pipelineName
 	p.BoxName = boxName
 	p.BoxTag = boxTag
-	h.keen.AddEvent(collection, p)
+	if len(args.options.KeenExtraFields) > 0 {
+		p.Extra = args.options.KeenExtraFields
+	}
+	h.enqueue(&metricsEvent{collection: collection, payload: p})
+}
+
+// enqueue adds ev to the queue without blocking. If the queue is full, or the
+// handler is already closed, the event is dropped.
+func (h *MetricsEventHandler) enqueue(ev *metricsEvent) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	if h.closed {
+		h.dropped++
+		return
+	}
+
+	select {
+	case h.queue <- ev:
+	default:
+		h.dropped++
+		h.logger.WithField("Event", ev.payload.Event).Debugln("Metrics queue is full, dropping event")
+	}
+}
+
+// run sends the queued events to keen until the queue is closed.
+func (h *MetricsEventHandler) run() {
+	defer close(h.done)
+
+	for ev := range h.queue {
+		h.deliver(ev)
+	}
+}
+
+// deliver sends ev to keen. When keen responds with a rate limit, it will
+// back off and retry the event a few times before dropping it.
+func (h *MetricsEventHandler) deliver(ev *metricsEvent) {
+	backoff := h.initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := h.keen.AddEvent(ev.collection, ev.payload)
+		if err == nil {
+			return
+		}
+
+		if !isRateLimited(err) {
+			h.logger.WithField("Error", err).Debugln("Unable to send metrics event")
+			return
+		}
+
+		if attempt >= metricsMaxAttempts {
+			h.addDropped()
+			h.logger.WithField("Event", ev.payload.Event).Debugln("Metrics rate limited, dropping event")
+			return
+		}
+
+		h.addDeferred()
+		h.logger.WithField("Backoff", backoff).Debugln("Metrics rate limited, backing off")
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > h.maxBackoff {
+			backoff = h.maxBackoff
+		}
+	}
+}
+
+func (h *MetricsEventHandler) addDropped() {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.dropped++
+}
+
+func (h *MetricsEventHandler) addDeferred() {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.deferred++
+}
+
+// Close stops accepting new events and waits for the queued events to be
+// sent. It logs the amount of dropped and deferred events.
+func (h *MetricsEventHandler) Close() {
+	h.l.Lock()
+	if h.closed {
+		h.l.Unlock()
+		return
+	}
+	h.closed = true
+	close(h.queue)
+	h.l.Unlock()
+
+	select {
+	case <-h.done:
+	case <-time.After(metricsCloseTimeout):
+		h.logger.Debugln("Timed out waiting for metrics queue to drain")
+	}
+
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.logger.Infof("Metrics finished: %d events dropped, %d events deferred", h.dropped+len(h.queue), h.deferred)
+}
+
+// isRateLimited checks if err is the result of keen responding with a
+// 429 Too Many Requests.
+func isRateLimited(err error) bool {
+	keenErr, ok := err.(*keenError)
+	return ok && keenErr.StatusCode == http.StatusTooManyRequests
 }
 
 type metricsKeenPayload struct {
@@ -246,6 +439,7 @@ type MetricsPayload struct {
 	Timestamp    int64               `json:"timestamp"`
 	Event        string              `json:"event"`
 	Stack        int                 `json:"stack,omitempty"`
+	Environment  string              `json:"environment,omitempty"`
 	SentCli      *util.Versions      `json:"wercker,omitempty"`
 	Grappler     *util.Versions      `json:"grappler,omitempty"`
 	PipelineName string              `json:"pipelineName,omitempty"`
@@ -272,8 +466,12 @@ type MetricsPayload struct {
 	Duration  *int64 `json:"duration,omitempty"`
 	StartedBy string `json:"startedBy,omitempty"`
 
+	LogSample *metricsLogSample `json:"logSample,omitempty"`
+
 	VCS                       string                     `json:"versionControl,omitempty"`
 	MetricsApplicationPayload *metricsApplicationPayload `json:"application,omitempty"`
+
+	Extra map[string]string `json:"extra,omitempty"`
 }
 
 func getPipelineName(options *core.PipelineOptions) string {
@@ -289,12 +487,28 @@ func getPipelineName(options *core.PipelineOptions) string {
 	return ""
 }
 
+// getStack returns the stack reported to keen, falling back to 5.
+func getStack(options *core.PipelineOptions) int {
+	if options.KeenStack != 0 {
+		return options.KeenStack
+	}
+	return 5
+}
+
+// getCollection returns the keen collection for the pipeline, falling back
+// to build-events and deploy-events.
 func getCollection(options *core.PipelineOptions) string {
 	if options.BuildID != "" {
+		if options.KeenBuildCollection != "" {
+			return options.KeenBuildCollection
+		}
 		return "build-events"
 	}
 
 	if options.DeployID != "" {
+		if options.KeenDeployCollection != "" {
+			return options.KeenDeployCollection
+		}
 		return "deploy-events"
 	}
 
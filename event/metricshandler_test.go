@@ -0,0 +1,139 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type MetricsHandlerSuite struct {
+	*util.TestSuite
+}
+
+func TestMetricsHandlerSuite(t *testing.T) {
+	suiteTester := &MetricsHandlerSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+// keenServer responds with the next status code of statuses to every event,
+// the last one is repeated.
+type keenServer struct {
+	*httptest.Server
+	l        sync.Mutex
+	statuses []int
+	requests int
+}
+
+func newKeenServer(statuses ...int) *keenServer {
+	k := &keenServer{statuses: statuses}
+	k.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k.l.Lock()
+		status := k.statuses[0]
+		if len(k.statuses) > 1 {
+			k.statuses = k.statuses[1:]
+		}
+		k.requests++
+		k.l.Unlock()
+		w.WriteHeader(status)
+		// A body that mentions 429 isn't a rate limit
+		fmt.Fprintf(w, `{"message": "failed after 429 ms"}`)
+	}))
+	return k
+}
+
+func (k *keenServer) Requests() int {
+	k.l.Lock()
+	defer k.l.Unlock()
+	return k.requests
+}
+
+func (k *keenServer) handler() *MetricsEventHandler {
+	keen := newKeenClient("project", "write-key")
+	keen.baseURL = k.URL
+	h := newMetricsHandler(keen)
+	h.initialBackoff = time.Millisecond
+	h.maxBackoff = 2 * time.Millisecond
+	return h
+}
+
+func testMetricsEvent() *metricsEvent {
+	return &metricsEvent{collection: "build-events", payload: &MetricsPayload{Event: "buildFinished"}}
+}
+
+func (s *MetricsHandlerSuite) TestIsRateLimited() {
+	s.True(isRateLimited(&keenError{StatusCode: http.StatusTooManyRequests}))
+	s.False(isRateLimited(&keenError{StatusCode: http.StatusInternalServerError, Message: "429 Too Many Requests"}))
+	s.False(isRateLimited(fmt.Errorf("dial tcp 10.0.0.1:429: connection refused")))
+}
+
+func (s *MetricsHandlerSuite) TestDeliverRetriesRateLimited() {
+	k := newKeenServer(http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusCreated)
+	defer k.Close()
+	h := k.handler()
+
+	h.deliver(testMetricsEvent())
+	s.Equal(3, k.Requests())
+	s.Equal(2, h.deferred)
+	s.Equal(0, h.dropped)
+}
+
+func (s *MetricsHandlerSuite) TestDeliverDropsAfterMaxAttempts() {
+	k := newKeenServer(http.StatusTooManyRequests)
+	defer k.Close()
+	h := k.handler()
+
+	h.deliver(testMetricsEvent())
+	s.Equal(metricsMaxAttempts, k.Requests())
+	s.Equal(metricsMaxAttempts-1, h.deferred)
+	s.Equal(1, h.dropped)
+}
+
+func (s *MetricsHandlerSuite) TestDeliverDoesNotRetryOtherErrors() {
+	k := newKeenServer(http.StatusInternalServerError)
+	defer k.Close()
+	h := k.handler()
+
+	h.deliver(testMetricsEvent())
+	s.Equal(1, k.Requests())
+	s.Equal(0, h.deferred)
+}
+
+func (s *MetricsHandlerSuite) TestQueue() {
+	k := newKeenServer(http.StatusCreated)
+	defer k.Close()
+	h := k.handler()
+
+	// Nothing is sending yet, so the queue fills up
+	for i := 0; i < metricsQueueSize+1; i++ {
+		h.enqueue(testMetricsEvent())
+	}
+	s.Equal(1, h.dropped)
+
+	go h.run()
+	h.Close()
+	s.Equal(metricsQueueSize, k.Requests())
+
+	// Events after Close are dropped
+	h.enqueue(testMetricsEvent())
+	s.Equal(2, h.dropped)
+}
@@ -0,0 +1,220 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+)
+
+// maskedValue replaces the value of options that look like secrets.
+const maskedValue = "********"
+
+// secretOptionNames are substrings of option names whose values we mask.
+var secretOptionNames = []string{"Key", "Secret", "Token", "Password"}
+
+// NewSummaryHandler will create a new SummaryHandler writing to path.
+func NewSummaryHandler(path string) (*SummaryHandler, error) {
+	return &SummaryHandler{
+		path:      path,
+		summary:   &Summary{},
+		startStep: make(map[string]time.Time),
+		logger:    util.RootLogger().WithField("Logger", "Summary"),
+	}, nil
+}
+
+// A SummaryHandler collects the events of a run and writes them to a single
+// JSON file once the full pipeline has finished.
+type SummaryHandler struct {
+	path       string
+	summary    *Summary
+	startStep  map[string]time.Time
+	startBuild time.Time
+	logger     *util.LogEntry
+}
+
+// Summary is the JSON document describing a run.
+type Summary struct {
+	Options             map[string]interface{} `json:"options"`
+	Steps               []*SummaryStep         `json:"steps"`
+	AfterSteps          []*SummaryStep         `json:"afterSteps"`
+	Results             []*SummaryStepResult   `json:"results"`
+	ArtifactURL         string                 `json:"artifactUrl,omitempty"`
+	Result              string                 `json:"result"`
+	MainSuccessful      bool                   `json:"mainSuccessful"`
+	RanAfterSteps       bool                   `json:"ranAfterSteps"`
+	AfterStepSuccessful bool                   `json:"afterStepSuccessful"`
+	StartedAt           string                 `json:"startedAt"`
+	FinishedAt          string                 `json:"finishedAt"`
+	Duration            float64                `json:"duration"`
+}
+
+// SummaryStep is a step as resolved from the wercker.yml.
+type SummaryStep struct {
+	DisplayName string `json:"displayName"`
+	Owner       string `json:"owner"`
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+}
+
+// SummaryStepResult is the outcome of a step that was run.
+type SummaryStepResult struct {
+	DisplayName  string             `json:"displayName"`
+	Order        int                `json:"order"`
+	Success      bool               `json:"success"`
+	Message      string             `json:"message,omitempty"`
+	ArtifactURL  string             `json:"artifactUrl,omitempty"`
+	ArtifactURLs []string           `json:"artifactUrls,omitempty"`
+	Annotations  []*core.Annotation `json:"annotations,omitempty"`
+	Duration     float64            `json:"duration"`
+}
+
+// ListenTo will add eventhandlers to e.
+func (h *SummaryHandler) ListenTo(e *core.NormalizedEmitter) {
+	e.AddListener(core.BuildStarted, h.BuildStarted)
+	e.AddListener(core.BuildStepsAdded, h.BuildStepsAdded)
+	e.AddListener(core.BuildStepStarted, h.BuildStepStarted)
+	e.AddListener(core.BuildStepFinished, h.BuildStepFinished)
+	e.AddListener(core.BuildFinished, h.BuildFinished)
+	e.AddListener(core.FullPipelineFinished, h.FullPipelineFinished)
+}
+
+// BuildStarted responds to the BuildStarted event.
+func (h *SummaryHandler) BuildStarted(args *core.BuildStartedArgs) {
+	h.startBuild = time.Now()
+	h.summary.StartedAt = h.startBuild.Format(time.RFC3339)
+	h.summary.Options = maskedOptions(args.Options)
+}
+
+// BuildStepsAdded responds to the BuildStepsAdded event.
+func (h *SummaryHandler) BuildStepsAdded(args *core.BuildStepsAddedArgs) {
+	h.summary.Steps = newSummarySteps(args.Steps)
+	h.summary.AfterSteps = newSummarySteps(args.AfterSteps)
+}
+
+// BuildStepStarted responds to the BuildStepStarted event.
+func (h *SummaryHandler) BuildStepStarted(args *core.BuildStepStartedArgs) {
+	h.startStep[args.Step.SafeID()] = time.Now()
+}
+
+// BuildStepFinished responds to the BuildStepFinished event.
+func (h *SummaryHandler) BuildStepFinished(args *core.BuildStepFinishedArgs) {
+	var duration float64
+	if begin, ok := h.startStep[args.Step.SafeID()]; ok {
+		duration = time.Now().Sub(begin).Seconds()
+		delete(h.startStep, args.Step.SafeID())
+	}
+
+	if args.PackageURL != "" {
+		h.summary.ArtifactURL = args.PackageURL
+	}
+
+	h.summary.Results = append(h.summary.Results, &SummaryStepResult{
+		DisplayName:  args.Step.DisplayName(),
+		Order:        args.Order,
+		Success:      args.Successful,
+		Message:      args.Message,
+		ArtifactURL:  args.ArtifactURL,
+		ArtifactURLs: args.ArtifactURLs,
+		Annotations:  args.Annotations,
+		Duration:     duration,
+	})
+}
+
+// BuildFinished responds to the BuildFinished event.
+func (h *SummaryHandler) BuildFinished(args *core.BuildFinishedArgs) {
+	h.summary.Result = args.Result
+}
+
+// FullPipelineFinished writes the summary to disk.
+func (h *SummaryHandler) FullPipelineFinished(args *core.FullPipelineFinishedArgs) {
+	now := time.Now()
+	h.summary.FinishedAt = now.Format(time.RFC3339)
+	h.summary.Duration = now.Sub(h.startBuild).Seconds()
+	h.summary.MainSuccessful = args.MainSuccessful
+	h.summary.RanAfterSteps = args.RanAfterSteps
+	h.summary.AfterStepSuccessful = args.AfterStepSuccessful
+
+	b, err := json.MarshalIndent(h.summary, "", "  ")
+	if err != nil {
+		h.logger.WithField("Error", err).Error("Unable to marshal summary")
+		return
+	}
+
+	err = ioutil.WriteFile(h.path, b, 0644)
+	if err != nil {
+		h.logger.WithField("Error", err).Error("Unable to write summary")
+	}
+}
+
+func newSummarySteps(steps []core.Step) []*SummaryStep {
+	summarySteps := []*SummaryStep{}
+	for _, step := range steps {
+		summarySteps = append(summarySteps, &SummaryStep{
+			DisplayName: step.DisplayName(),
+			Owner:       step.Owner(),
+			Name:        step.Name(),
+			Version:     step.Version(),
+		})
+	}
+	return summarySteps
+}
+
+// maskedOptions flattens options, including the embedded *Options structs,
+// into a map and masks anything that looks like a secret.
+func maskedOptions(options interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	v := reflect.Indirect(reflect.ValueOf(options))
+	if v.Kind() != reflect.Struct {
+		return m
+	}
+
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		if field.PkgPath != "" || field.Name == "HostEnv" {
+			continue
+		}
+
+		if field.Anonymous && strings.HasSuffix(field.Name, "Options") {
+			if value.IsNil() {
+				continue
+			}
+			for k, nested := range maskedOptions(value.Interface()) {
+				m[k] = nested
+			}
+			continue
+		}
+
+		m[field.Name] = value.Interface()
+		for _, secret := range secretOptionNames {
+			if strings.Contains(field.Name, secret) && !isEmptyValue(value) {
+				m[field.Name] = maskedValue
+			}
+		}
+	}
+	return m
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
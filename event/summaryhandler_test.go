@@ -0,0 +1,56 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+)
+
+type SummaryHandlerSuite struct {
+	*util.TestSuite
+}
+
+func TestSummaryHandlerSuite(t *testing.T) {
+	suiteTester := &SummaryHandlerSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *SummaryHandlerSuite) TestMasksSecrets() {
+	options := core.EmptyPipelineOptions()
+	options.AuthToken = "the-auth-token"
+	options.Registries = []*core.PushRegistry{
+		&core.PushRegistry{Address: "quay.io/wercker", Username: "robot", Password: "the-password"},
+	}
+
+	path := filepath.Join(s.WorkingDir(), "summary.json")
+	h, err := NewSummaryHandler(path)
+	s.Nil(err)
+	h.BuildStarted(&core.BuildStartedArgs{Options: options})
+	h.FullPipelineFinished(&core.FullPipelineFinishedArgs{Options: options})
+
+	b, err := ioutil.ReadFile(path)
+	s.Nil(err)
+	summary := string(b)
+	s.Contains(summary, "quay.io/wercker")
+	s.Contains(summary, "robot")
+	s.NotContains(summary, "the-password")
+	s.NotContains(summary, "the-auth-token")
+}
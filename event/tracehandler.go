@@ -0,0 +1,400 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+)
+
+// OTLP span kinds and status codes, see opentelemetry-proto trace.proto
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOk         = 1
+	otlpStatusError      = 2
+)
+
+// OTLP log severities, see opentelemetry-proto logs.proto
+const (
+	otlpSeverityInfo  = 9
+	otlpSeverityError = 17
+)
+
+// otlpStepLogLimit is the amount of output of a single step that is exported
+// as logs, the rest is replaced by a single record saying it was truncated.
+const otlpStepLogLimit = 1024 * 1024
+
+// NewTraceHandler will create a new TraceHandler exporting to the OTLP/HTTP
+// collector at endpoint. With exportLogs the output of the steps is exported
+// as logs as well.
+func NewTraceHandler(endpoint string, exportLogs bool) (*TraceHandler, error) {
+	endpoint = strings.TrimSuffix(strings.TrimRight(endpoint, "/"), "/v1/traces")
+	traceID, err := randomID(16)
+	if err != nil {
+		return nil, err
+	}
+	return &TraceHandler{
+		endpoint:   endpoint + "/v1/traces",
+		client:     &http.Client{Timeout: 10 * time.Second},
+		traceID:    traceID,
+		steps:      make(map[string]*otlpSpan),
+		logger:     util.RootLogger().WithField("Logger", "Trace"),
+		exportLogs: exportLogs,
+		logsURL:    endpoint + "/v1/logs",
+		logBytes:   make(map[string]int),
+	}, nil
+}
+
+// A TraceHandler records a span for the build with a child span for every
+// step, and exports them as OpenTelemetry traces once the full pipeline has
+// finished.
+type TraceHandler struct {
+	endpoint string
+	client   *http.Client
+	traceID  string
+	build    *otlpSpan
+	steps    map[string]*otlpSpan
+	spans    []*otlpSpan
+	logger   *util.LogEntry
+
+	exportLogs bool
+	logsURL    string
+	// l guards steps, records and logBytes, Logs is called from the
+	// goroutines reading the output of the steps
+	l        sync.Mutex
+	records  []*otlpLogRecord
+	logBytes map[string]int
+}
+
+type otlpSpan struct {
+	TraceID           string           `json:"traceId"`
+	SpanID            string           `json:"spanId"`
+	ParentSpanID      string           `json:"parentSpanId,omitempty"`
+	Name              string           `json:"name"`
+	Kind              int              `json:"kind"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+	Attributes        []*otlpAttribute `json:"attributes"`
+	Status            *otlpStatus      `json:"status,omitempty"`
+
+	start time.Time
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string                 `json:"timeUnixNano"`
+	SeverityNumber int                    `json:"severityNumber"`
+	SeverityText   string                 `json:"severityText"`
+	Body           map[string]interface{} `json:"body"`
+	Attributes     []*otlpAttribute       `json:"attributes"`
+	TraceID        string                 `json:"traceId"`
+	SpanID         string                 `json:"spanId,omitempty"`
+}
+
+// ListenTo will add eventhandlers to e.
+func (h *TraceHandler) ListenTo(e *core.NormalizedEmitter) {
+	e.AddListener(core.BuildStarted, h.BuildStarted)
+	e.AddListener(core.BuildStepStarted, h.BuildStepStarted)
+	e.AddListener(core.BuildStepFinished, h.BuildStepFinished)
+	e.AddListener(core.BuildFinished, h.BuildFinished)
+	e.AddListener(core.FullPipelineFinished, h.FullPipelineFinished)
+	if h.exportLogs {
+		e.AddListener(core.Logs, h.Logs)
+	}
+}
+
+// BuildStarted starts the span of the build.
+func (h *TraceHandler) BuildStarted(args *core.BuildStartedArgs) {
+	h.build = h.startSpan(args.Options.Pipeline, "")
+	h.build.attribute("wercker.pipeline", args.Options.Pipeline)
+	h.build.attribute("wercker.pipeline_id", args.Options.PipelineID)
+	if args.Options.ApplicationName != "" {
+		h.build.attribute("wercker.application", fmt.Sprintf("%s/%s", args.Options.ApplicationOwnerName, args.Options.ApplicationName))
+	}
+}
+
+// BuildStepStarted starts a span for the step.
+func (h *TraceHandler) BuildStepStarted(args *core.BuildStepStartedArgs) {
+	parent := ""
+	if h.build != nil {
+		parent = h.build.SpanID
+	}
+	span := h.startSpan(args.Step.DisplayName(), parent)
+	span.attribute("wercker.step.name", args.Step.Name())
+	span.attribute("wercker.step.order", args.Order)
+	h.l.Lock()
+	h.steps[args.Step.SafeID()] = span
+	h.l.Unlock()
+}
+
+// BuildStepFinished ends the span of the step.
+func (h *TraceHandler) BuildStepFinished(args *core.BuildStepFinishedArgs) {
+	h.l.Lock()
+	span, ok := h.steps[args.Step.SafeID()]
+	delete(h.steps, args.Step.SafeID())
+	h.l.Unlock()
+	if !ok {
+		return
+	}
+	span.end(args.Successful, args.Message)
+}
+
+// BuildFinished records the result of the main steps.
+func (h *TraceHandler) BuildFinished(args *core.BuildFinishedArgs) {
+	if h.build != nil {
+		h.build.attribute("wercker.result", args.Result)
+	}
+}
+
+// Logs records the output as log records of the span of its step, or of the
+// build span for output outside of a step. Hidden logs are never exported, the
+// emitter has already masked the secrets.
+func (h *TraceHandler) Logs(args *core.LogsArgs) {
+	if args.Hidden || args.Logs == "" {
+		return
+	}
+
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	spanID := ""
+	stepID := ""
+	if args.Step != nil {
+		stepID = args.Step.SafeID()
+		if span, ok := h.steps[stepID]; ok {
+			spanID = span.SpanID
+		}
+	} else if h.build != nil {
+		spanID = h.build.SpanID
+	}
+
+	logs := args.Logs
+	exported := h.logBytes[stepID]
+	if exported >= otlpStepLogLimit {
+		return
+	}
+	if exported+len(logs) > otlpStepLogLimit {
+		logs = logs[:otlpStepLogLimit-exported] + fmt.Sprintf("\n[output truncated after %d bytes]", otlpStepLogLimit)
+	}
+	h.logBytes[stepID] = exported + len(args.Logs)
+
+	severityNumber, severityText := otlpSeverityInfo, "INFO"
+	if args.Stream == "stderr" {
+		severityNumber, severityText = otlpSeverityError, "ERROR"
+	}
+	record := &otlpLogRecord{
+		TimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		SeverityNumber: severityNumber,
+		SeverityText:   severityText,
+		Body:           map[string]interface{}{"stringValue": logs},
+		Attributes: []*otlpAttribute{
+			{Key: "log.iostream", Value: map[string]interface{}{"stringValue": args.Stream}},
+		},
+		TraceID: h.traceID,
+		SpanID:  spanID,
+	}
+	if args.Step != nil {
+		record.Attributes = append(record.Attributes,
+			&otlpAttribute{Key: "wercker.step.name", Value: map[string]interface{}{"stringValue": args.Step.Name()}})
+	}
+	h.records = append(h.records, record)
+}
+
+// FullPipelineFinished ends the build span, after the after-steps, and
+// exports all spans.
+func (h *TraceHandler) FullPipelineFinished(args *core.FullPipelineFinishedArgs) {
+	if h.build == nil {
+		return
+	}
+	success := args.MainSuccessful && (!args.RanAfterSteps || args.AfterStepSuccessful)
+	h.build.end(success, "")
+
+	err := h.export()
+	if err != nil {
+		h.logger.WithField("Error", err).Warnln("Unable to export traces")
+	}
+	if h.exportLogs {
+		err = h.exportRecords()
+		if err != nil {
+			h.logger.WithField("Error", err).Warnln("Unable to export logs")
+		}
+	}
+}
+
+func (h *TraceHandler) startSpan(name, parent string) *otlpSpan {
+	spanID, err := randomID(8)
+	if err != nil {
+		h.logger.WithField("Error", err).Debug("Unable to generate span id")
+	}
+	span := &otlpSpan{
+		TraceID:      h.traceID,
+		SpanID:       spanID,
+		ParentSpanID: parent,
+		Name:         name,
+		Kind:         otlpSpanKindInternal,
+		Attributes:   []*otlpAttribute{},
+		start:        time.Now(),
+	}
+	span.StartTimeUnixNano = strconv.FormatInt(span.start.UnixNano(), 10)
+	h.spans = append(h.spans, span)
+	return span
+}
+
+func (s *otlpSpan) end(success bool, message string) {
+	now := time.Now()
+	s.EndTimeUnixNano = strconv.FormatInt(now.UnixNano(), 10)
+	s.attribute("wercker.success", success)
+	s.attribute("wercker.duration", now.Sub(s.start).Seconds())
+	s.Status = &otlpStatus{Code: otlpStatusOk}
+	if !success {
+		s.Status = &otlpStatus{Code: otlpStatusError, Message: message}
+	}
+}
+
+func (s *otlpSpan) attribute(key string, value interface{}) {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		// int64 values are strings in the OTLP JSON encoding
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	s.Attributes = append(s.Attributes, &otlpAttribute{Key: key, Value: v})
+}
+
+// export sends the finished spans to the collector using the JSON encoding
+// of OTLP/HTTP.
+func (h *TraceHandler) export() error {
+	spans := []*otlpSpan{}
+	for _, span := range h.spans {
+		if span.EndTimeUnixNano != "" {
+			spans = append(spans, span)
+		}
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": otlpResource(),
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "wercker"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	err := h.post(h.endpoint, payload)
+	if err != nil {
+		return err
+	}
+	h.logger.Debugln("Exported", len(spans), "spans to", h.endpoint)
+	return nil
+}
+
+// exportRecords sends the recorded step output to the collector using the
+// JSON encoding of OTLP/HTTP.
+func (h *TraceHandler) exportRecords() error {
+	h.l.Lock()
+	records := h.records
+	h.l.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+
+	payload := map[string]interface{}{
+		"resourceLogs": []interface{}{
+			map[string]interface{}{
+				"resource": otlpResource(),
+				"scopeLogs": []interface{}{
+					map[string]interface{}{
+						"scope":      map[string]interface{}{"name": "wercker"},
+						"logRecords": records,
+					},
+				},
+			},
+		},
+	}
+	err := h.post(h.logsURL, payload)
+	if err != nil {
+		return err
+	}
+	h.logger.Debugln("Exported", len(records), "log records to", h.logsURL)
+	return nil
+}
+
+// post sends payload as JSON to the collector at url.
+func (h *TraceHandler) post(url string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	res, err := h.client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Collector returned status code %d", res.StatusCode)
+	}
+	return nil
+}
+
+// otlpResource describes wercker as the producer of the telemetry.
+func otlpResource() map[string]interface{} {
+	return map[string]interface{}{
+		"attributes": []*otlpAttribute{
+			{Key: "service.name", Value: map[string]interface{}{"stringValue": "wercker"}},
+			{Key: "service.version", Value: map[string]interface{}{"stringValue": util.Version()}},
+		},
+	}
+}
+
+// randomID returns n random bytes, hex encoded as OTLP expects for trace and
+// span ids.
+func randomID(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
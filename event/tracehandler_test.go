@@ -0,0 +1,263 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+)
+
+type TraceHandlerSuite struct {
+	*util.TestSuite
+}
+
+func TestTraceHandlerSuite(t *testing.T) {
+	suiteTester := &TraceHandlerSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+// collector records the payloads posted to it by path and responds with
+// status.
+type collector struct {
+	*httptest.Server
+	l        sync.Mutex
+	status   int
+	payloads map[string][]map[string]interface{}
+}
+
+func newCollector(status int) *collector {
+	c := &collector{status: status, payloads: make(map[string][]map[string]interface{})}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		payload := map[string]interface{}{}
+		json.Unmarshal(b, &payload)
+		c.l.Lock()
+		c.payloads[r.URL.Path] = append(c.payloads[r.URL.Path], payload)
+		c.l.Unlock()
+		w.WriteHeader(c.status)
+	}))
+	return c
+}
+
+func (c *collector) Payloads(path string) []map[string]interface{} {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.payloads[path]
+}
+
+// spans returns the spans of the only payload posted to /v1/traces.
+func (c *collector) spans() []interface{} {
+	payloads := c.Payloads("/v1/traces")
+	if len(payloads) != 1 {
+		return nil
+	}
+	resourceSpans := payloads[0]["resourceSpans"].([]interface{})
+	scopeSpans := resourceSpans[0].(map[string]interface{})["scopeSpans"].([]interface{})
+	return scopeSpans[0].(map[string]interface{})["spans"].([]interface{})
+}
+
+func attributeValue(span map[string]interface{}, key string) interface{} {
+	for _, a := range span["attributes"].([]interface{}) {
+		attribute := a.(map[string]interface{})
+		if attribute["key"] == key {
+			for _, v := range attribute["value"].(map[string]interface{}) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func (s *TraceHandlerSuite) newStep(name string) core.Step {
+	step, err := core.NewStep(&core.StepConfig{ID: "script", Name: name}, core.EmptyPipelineOptions())
+	s.Nil(err)
+	return step
+}
+
+func (s *TraceHandlerSuite) TestExportsSpans() {
+	c := newCollector(http.StatusOK)
+	defer c.Close()
+
+	// The signal path is stripped and added again
+	h, err := NewTraceHandler(c.URL+"/v1/traces", false)
+	s.Nil(err)
+
+	options := core.EmptyPipelineOptions()
+	options.Pipeline = "build"
+	step := s.newStep("compile")
+	h.BuildStarted(&core.BuildStartedArgs{Options: options})
+	h.BuildStepStarted(&core.BuildStepStartedArgs{Options: options, Step: step, Order: 2})
+	h.BuildStepFinished(&core.BuildStepFinishedArgs{Options: options, Step: step, Successful: false, Message: "exit code 1"})
+	h.BuildFinished(&core.BuildFinishedArgs{Options: options, Result: "failed"})
+	h.FullPipelineFinished(&core.FullPipelineFinishedArgs{Options: options, MainSuccessful: false})
+
+	spans := c.spans()
+	s.Len(spans, 2)
+	build := spans[0].(map[string]interface{})
+	compile := spans[1].(map[string]interface{})
+
+	s.Equal("build", build["name"])
+	s.Equal(h.traceID, build["traceId"])
+	s.Equal("failed", attributeValue(build, "wercker.result"))
+	s.Equal(float64(otlpStatusError), build["status"].(map[string]interface{})["code"])
+
+	s.Equal("compile", compile["name"])
+	s.Equal(h.traceID, compile["traceId"])
+	s.Equal(build["spanId"], compile["parentSpanId"])
+	s.Equal("script", attributeValue(compile, "wercker.step.name"))
+	// int64 values are strings in the OTLP JSON encoding
+	s.Equal("2", attributeValue(compile, "wercker.step.order"))
+	s.Equal(false, attributeValue(compile, "wercker.success"))
+	status := compile["status"].(map[string]interface{})
+	s.Equal(float64(otlpStatusError), status["code"])
+	s.Equal("exit code 1", status["message"])
+
+	// Logs are only exported when asked for
+	s.Len(c.Payloads("/v1/logs"), 0)
+}
+
+func (s *TraceHandlerSuite) TestSkipsUnfinishedSpans() {
+	c := newCollector(http.StatusOK)
+	defer c.Close()
+	h, err := NewTraceHandler(c.URL, false)
+	s.Nil(err)
+
+	options := core.EmptyPipelineOptions()
+	options.Pipeline = "build"
+	h.BuildStarted(&core.BuildStartedArgs{Options: options})
+	h.BuildStepStarted(&core.BuildStepStartedArgs{Options: options, Step: s.newStep("compile")})
+	h.FullPipelineFinished(&core.FullPipelineFinishedArgs{Options: options, MainSuccessful: true})
+
+	spans := c.spans()
+	s.Len(spans, 1)
+	build := spans[0].(map[string]interface{})
+	s.Equal("build", build["name"])
+	s.Equal(float64(otlpStatusOk), build["status"].(map[string]interface{})["code"])
+}
+
+func (s *TraceHandlerSuite) TestExportCollectorError() {
+	c := newCollector(http.StatusServiceUnavailable)
+	defer c.Close()
+	h, err := NewTraceHandler(c.URL, false)
+	s.Nil(err)
+
+	options := core.EmptyPipelineOptions()
+	h.BuildStarted(&core.BuildStartedArgs{Options: options})
+	h.build.end(true, "")
+	s.NotNil(h.export())
+	s.Len(c.Payloads("/v1/traces"), 1)
+}
+
+// logRecords returns the log records of the only payload posted to /v1/logs.
+func (c *collector) logRecords() []interface{} {
+	payloads := c.Payloads("/v1/logs")
+	if len(payloads) != 1 {
+		return nil
+	}
+	resourceLogs := payloads[0]["resourceLogs"].([]interface{})
+	scopeLogs := resourceLogs[0].(map[string]interface{})["scopeLogs"].([]interface{})
+	return scopeLogs[0].(map[string]interface{})["logRecords"].([]interface{})
+}
+
+func (s *TraceHandlerSuite) TestExportsLogs() {
+	c := newCollector(http.StatusOK)
+	defer c.Close()
+	h, err := NewTraceHandler(c.URL, true)
+	s.Nil(err)
+
+	options := core.EmptyPipelineOptions()
+	step := s.newStep("compile")
+	h.BuildStarted(&core.BuildStartedArgs{Options: options})
+	h.Logs(&core.LogsArgs{Logs: "setting up\n", Stream: "stdout"})
+	h.BuildStepStarted(&core.BuildStepStartedArgs{Options: options, Step: step})
+	h.Logs(&core.LogsArgs{Step: step, Logs: "compiling\n", Stream: "stdout"})
+	h.Logs(&core.LogsArgs{Step: step, Logs: "the-secret\n", Stream: "stdout", Hidden: true})
+	h.Logs(&core.LogsArgs{Step: step, Logs: "it broke\n", Stream: "stderr"})
+	h.BuildStepFinished(&core.BuildStepFinishedArgs{Options: options, Step: step, Successful: false})
+	h.FullPipelineFinished(&core.FullPipelineFinishedArgs{Options: options})
+
+	records := c.logRecords()
+	s.Len(records, 3)
+	build := records[0].(map[string]interface{})
+	s.Equal("setting up\n", build["body"].(map[string]interface{})["stringValue"])
+	s.Equal(h.build.SpanID, build["spanId"])
+
+	compiling := records[1].(map[string]interface{})
+	s.Equal("compiling\n", compiling["body"].(map[string]interface{})["stringValue"])
+	s.Equal("INFO", compiling["severityText"])
+	s.Equal(h.traceID, compiling["traceId"])
+	s.Equal("stdout", attributeValue(compiling, "log.iostream"))
+	s.Equal("script", attributeValue(compiling, "wercker.step.name"))
+	s.NotEqual(h.build.SpanID, compiling["spanId"])
+
+	broke := records[2].(map[string]interface{})
+	s.Equal("ERROR", broke["severityText"])
+	s.Equal(compiling["spanId"], broke["spanId"])
+}
+
+func (s *TraceHandlerSuite) TestTruncatesLogs() {
+	c := newCollector(http.StatusOK)
+	defer c.Close()
+	h, err := NewTraceHandler(c.URL, true)
+	s.Nil(err)
+
+	step := s.newStep("compile")
+	h.BuildStepStarted(&core.BuildStepStartedArgs{Step: step})
+	h.Logs(&core.LogsArgs{Step: step, Logs: strings.Repeat("a", otlpStepLogLimit-1), Stream: "stdout"})
+	h.Logs(&core.LogsArgs{Step: step, Logs: "bc", Stream: "stdout"})
+	h.Logs(&core.LogsArgs{Step: step, Logs: "dropped", Stream: "stdout"})
+	s.Nil(h.exportRecords())
+
+	records := c.logRecords()
+	s.Len(records, 2)
+	body := records[1].(map[string]interface{})["body"].(map[string]interface{})["stringValue"]
+	s.Equal(fmt.Sprintf("b\n[output truncated after %d bytes]", otlpStepLogLimit), body)
+}
+
+func (s *TraceHandlerSuite) TestLogsWhileStepsRun() {
+	c := newCollector(http.StatusOK)
+	defer c.Close()
+	h, err := NewTraceHandler(c.URL, true)
+	s.Nil(err)
+
+	// The output of a step is read in another goroutine than the one
+	// emitting the step events, and can still arrive as the next step starts
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		step := s.newStep(fmt.Sprintf("step-%d", i))
+		h.BuildStepStarted(&core.BuildStepStartedArgs{Step: step})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				h.Logs(&core.LogsArgs{Step: step, Logs: "output\n", Stream: "stdout"})
+			}
+		}()
+		h.BuildStepFinished(&core.BuildStepFinishedArgs{Step: step, Successful: true})
+	}
+	wg.Wait()
+	s.Nil(h.exportRecords())
+	s.Len(c.logRecords(), 40)
+}
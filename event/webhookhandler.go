@@ -0,0 +1,167 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+)
+
+const (
+	// webhookAttempts is the amount of times the payload is posted before
+	// giving up.
+	webhookAttempts = 3
+
+	webhookRequestTimeout = 10 * time.Second
+	webhookBackoff        = 2 * time.Second
+
+	// webhookWaitTimeout is how long FullPipelineFinished waits for the
+	// webhook to be delivered.
+	webhookWaitTimeout = 30 * time.Second
+)
+
+// NewWebhookHandler will create a new WebhookHandler posting to url when the
+// result of the build is in notifyOn ("success" or "failure").
+func NewWebhookHandler(url string, notifyOn []string) *WebhookHandler {
+	return &WebhookHandler{
+		url:      url,
+		notifyOn: notifyOn,
+		client:   &http.Client{Timeout: webhookRequestTimeout},
+		logger:   util.RootLogger().WithField("Logger", "Webhook"),
+	}
+}
+
+// A WebhookHandler posts the result of the build as JSON to a webhook. The
+// post happens in the background, so a slow webhook doesn't hold up the
+// after-steps.
+type WebhookHandler struct {
+	url        string
+	notifyOn   []string
+	client     *http.Client
+	logger     *util.LogEntry
+	start      time.Time
+	failedStep string
+	done       chan struct{}
+}
+
+// WebhookPayload is the JSON posted to the webhook.
+type WebhookPayload struct {
+	Result          string `json:"result"`
+	Pipeline        string `json:"pipeline"`
+	Application     string `json:"application,omitempty"`
+	BuildID         string `json:"buildId,omitempty"`
+	DeployID        string `json:"deployId,omitempty"`
+	FailedStep      string `json:"failedStep,omitempty"`
+	DurationSeconds int64  `json:"duration"`
+}
+
+// ListenTo will add eventhandlers to e.
+func (h *WebhookHandler) ListenTo(e *core.NormalizedEmitter) {
+	e.AddListener(core.BuildStarted, h.BuildStarted)
+	e.AddListener(core.BuildStepFinished, h.BuildStepFinished)
+	e.AddListener(core.BuildFinished, h.BuildFinished)
+	e.AddListener(core.FullPipelineFinished, h.FullPipelineFinished)
+}
+
+// BuildStarted responds to the BuildStarted event.
+func (h *WebhookHandler) BuildStarted(args *core.BuildStartedArgs) {
+	h.start = time.Now()
+}
+
+// BuildStepFinished responds to the BuildStepFinished event.
+func (h *WebhookHandler) BuildStepFinished(args *core.BuildStepFinishedArgs) {
+	if !args.Successful && h.failedStep == "" && args.Step != nil {
+		h.failedStep = args.Step.DisplayName()
+	}
+}
+
+// BuildFinished starts posting the result to the webhook.
+func (h *WebhookHandler) BuildFinished(args *core.BuildFinishedArgs) {
+	notify := "failure"
+	if args.Result == "passed" {
+		notify = "success"
+	}
+	if !util.ContainsString(h.notifyOn, notify) {
+		return
+	}
+
+	payload := &WebhookPayload{
+		Result:          args.Result,
+		Pipeline:        args.Options.Pipeline,
+		BuildID:         args.Options.BuildID,
+		DeployID:        args.Options.DeployID,
+		FailedStep:      h.failedStep,
+		DurationSeconds: int64(time.Since(h.start).Seconds()),
+	}
+	if args.Options.ApplicationName != "" {
+		payload.Application = fmt.Sprintf("%s/%s", args.Options.ApplicationOwnerName, args.Options.ApplicationName)
+	}
+
+	h.done = make(chan struct{})
+	go func() {
+		defer close(h.done)
+		err := h.post(payload)
+		if err != nil {
+			h.logger.WithField("Error", err).Warnln("Unable to notify webhook")
+		}
+	}()
+}
+
+// FullPipelineFinished waits a while for the webhook to be delivered.
+func (h *WebhookHandler) FullPipelineFinished(args *core.FullPipelineFinishedArgs) {
+	if h.done == nil {
+		return
+	}
+	select {
+	case <-h.done:
+	case <-time.After(webhookWaitTimeout):
+		h.logger.Warnln("Timed out waiting for webhook")
+	}
+}
+
+// post sends payload to the webhook, retrying failed attempts.
+func (h *WebhookHandler) post(payload *WebhookPayload) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = h.postOnce(b)
+		if err == nil || attempt >= webhookAttempts {
+			return err
+		}
+		h.logger.WithField("Error", err).Debugln("Webhook failed, retrying")
+		time.Sleep(webhookBackoff)
+	}
+}
+
+func (h *WebhookHandler) postOnce(b []byte) error {
+	res, err := h.client.Post(h.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Webhook returned status code %d", res.StatusCode)
+	}
+	return nil
+}
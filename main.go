@@ -21,6 +21,7 @@ import (
 )
 
 func main() {
+	defer cmd.HandleCrash()
 	app := cmd.GetApp()
 	app.Run(os.Args)
 }
@@ -101,6 +101,32 @@ func (s *OptionsSuite) TestGlobalOptions() {
 	run(s, globalFlags, emptyFlags, test, args)
 }
 
+func (s *OptionsSuite) TestTokenStorage() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewGlobalOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(core.TokenStorageFile, opts.TokenStorage)
+	}
+	run(s, globalFlags, emptyFlags, test, defaultArgs())
+
+	// --auth-token wins, so the keychain isn't consulted here
+	args := append([]string{"wercker", "--token-storage", "keychain"}, defaultArgs()[1:]...)
+	test = func(c *cli.Context) {
+		opts, err := core.NewGlobalOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(core.TokenStorageKeychain, opts.TokenStorage)
+		s.Equal("test-token", opts.AuthToken)
+	}
+	run(s, globalFlags, emptyFlags, test, args)
+
+	args = append([]string{"wercker", "--token-storage", "plaintext"}, defaultArgs()[1:]...)
+	test = func(c *cli.Context) {
+		_, err := core.NewGlobalOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, emptyFlags, test, args)
+}
+
 func (s *OptionsSuite) TestGuessAuthToken() {
 	tmpFile, err := ioutil.TempFile("", "test-auth-token")
 	s.Nil(err)
@@ -226,13 +252,82 @@ func (s *OptionsSuite) TestKeenOptions() {
 	run(s, globalFlags, pipelineFlags, test, args)
 }
 
-func (s *OptionsSuite) TestKeenMissingOptions() {
+func (s *OptionsSuite) TestKeenWriteKeyFile() {
+	tmpFile, err := ioutil.TempFile("", "test-keen-key")
+	s.Require().Nil(err)
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write([]byte("file-key\n"))
+	s.Nil(err)
+	tmpFile.Close()
+
+	args := defaultArgs(
+		"--keen-metrics",
+		"--keen-project-id", "test-id",
+		"--keen-project-write-key", "test-key",
+		"--keen-write-key-file", tmpFile.Name(),
+	)
 	test := func(c *cli.Context) {
+		e := emptyEnv()
+		gOpts, err := core.NewGlobalOptions(util.NewCLISettings(c), e)
+		opts, err := core.NewKeenOptions(util.NewCLISettings(c), e, gOpts)
+		s.Nil(err)
+		s.Equal(true, opts.ShouldKeenMetrics)
+		s.Equal("file-key", opts.KeenProjectWriteKey)
+	}
+	run(s, globalFlags, cmd.KeenFlags, test, args)
+
+	test = func(c *cli.Context) {
+		e := emptyEnv()
+		gOpts, err := core.NewGlobalOptions(util.NewCLISettings(c), e)
+		_, err = core.NewKeenOptions(util.NewCLISettings(c), e, gOpts)
+		s.NotNil(err)
+	}
+	run(s, globalFlags, cmd.KeenFlags, test, defaultArgs("--keen-write-key-file", "/does/not/exist"))
+}
+
+func (s *OptionsSuite) TestKeenExtraField() {
+	test := func(c *cli.Context) {
+		e := emptyEnv()
+		gOpts, err := core.NewGlobalOptions(util.NewCLISettings(c), e)
+		opts, err := core.NewKeenOptions(util.NewCLISettings(c), e, gOpts)
+		s.Nil(err)
+		s.Equal(map[string]string{"team": "platform", "cost-center": "a=b"}, opts.KeenExtraFields)
+	}
+	run(s, globalFlags, cmd.KeenFlags, test, defaultArgs("--keen-extra-field", "team=platform", "--keen-extra-field", "cost-center=a=b"))
+
+	test = func(c *cli.Context) {
 		e := emptyEnv()
 		gOpts, err := core.NewGlobalOptions(util.NewCLISettings(c), e)
 		_, err = core.NewKeenOptions(util.NewCLISettings(c), e, gOpts)
 		s.NotNil(err)
 	}
+	run(s, globalFlags, cmd.KeenFlags, test, defaultArgs("--keen-extra-field", "team"))
+	run(s, globalFlags, cmd.KeenFlags, test, defaultArgs("--keen-extra-field", "team=a", "--keen-extra-field", "team=b"))
+}
+
+func (s *OptionsSuite) TestKeenCollectionOptions() {
+	test := func(c *cli.Context) {
+		e := emptyEnv()
+		gOpts, err := core.NewGlobalOptions(util.NewCLISettings(c), e)
+		opts, err := core.NewKeenOptions(util.NewCLISettings(c), e, gOpts)
+		s.Nil(err)
+		s.Equal("build-events", opts.KeenBuildCollection)
+		s.Equal("staging-deploy-events", opts.KeenDeployCollection)
+	}
+	args := defaultArgs(
+		"--keen-deploy-collection", "staging-deploy-events",
+	)
+	run(s, globalFlags, cmd.KeenFlags, test, args)
+}
+
+func (s *OptionsSuite) TestKeenMissingOptions() {
+	test := func(c *cli.Context) {
+		e := emptyEnv()
+		gOpts, err := core.NewGlobalOptions(util.NewCLISettings(c), e)
+		opts, err := core.NewKeenOptions(util.NewCLISettings(c), e, gOpts)
+		s.Nil(err)
+		s.Equal(false, opts.ShouldKeenMetrics)
+	}
 
 	missingID := defaultArgs(
 		"--keen-metrics",
@@ -244,8 +339,13 @@ func (s *OptionsSuite) TestKeenMissingOptions() {
 		"--keen-project-id", "test-id",
 	)
 
+	missingBoth := defaultArgs(
+		"--keen-metrics",
+	)
+
 	run(s, globalFlags, cmd.KeenFlags, test, missingID)
 	run(s, globalFlags, cmd.KeenFlags, test, missingKey)
+	run(s, globalFlags, cmd.KeenFlags, test, missingBoth)
 }
 
 func (s *OptionsSuite) TestReporterOptions() {
@@ -298,6 +398,102 @@ func (s *OptionsSuite) TestTagEscaping() {
 	run(s, globalFlags, pipelineFlags, test, args)
 }
 
+func (s *OptionsSuite) TestExpandEnvFiles() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.False(opts.ExpandEnvFiles)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs())
+
+	test = func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.True(opts.ExpandEnvFiles)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--expand-env-files"))
+}
+
+func (s *OptionsSuite) TestLabels() {
+	tempDir, err := ioutil.TempDir("", "wercker-test-")
+	s.Nil(err)
+	defer os.RemoveAll(tempDir)
+
+	labelFile := filepath.Join(tempDir, "labels.txt")
+	content := "# provenance\n\norg.example.commit=abc123\norg.example.url=http://example.com/?a=b\nshared=file\n"
+	s.Nil(ioutil.WriteFile(labelFile, []byte(content), 0644))
+
+	args := defaultArgs("--label-file", labelFile, "--label", "shared=flag", "--label", "extra=1")
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(map[string]string{
+			"org.example.commit": "abc123",
+			"org.example.url":    "http://example.com/?a=b",
+			"shared":             "flag",
+			"extra":              "1",
+		}, opts.Labels)
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+}
+
+func (s *OptionsSuite) TestSecretsFile() {
+	tempDir, err := ioutil.TempDir("", "wercker-test-")
+	s.Nil(err)
+	defer os.RemoveAll(tempDir)
+
+	secretsFile := filepath.Join(tempDir, "secrets.txt")
+	s.Nil(ioutil.WriteFile(secretsFile, []byte("# names or values\nAPI_TOKEN\nliteral\n"), 0644))
+
+	args := defaultArgs("--secrets-file", secretsFile)
+	test := func(c *cli.Context) {
+		e := util.NewEnvironment("XXX_API_TOKEN=tok3n-value")
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), e)
+		s.Nil(err)
+		s.Equal([]string{"tok3n-value", "literal"}, opts.Secrets)
+		s.Equal("token ******** and ********", opts.MaskSecrets("token tok3n-value and literal"))
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+}
+
+func (s *OptionsSuite) TestInvalidLabelFile() {
+	tempDir, err := ioutil.TempDir("", "wercker-test-")
+	s.Nil(err)
+	defer os.RemoveAll(tempDir)
+
+	labelFile := filepath.Join(tempDir, "labels.txt")
+	s.Nil(ioutil.WriteFile(labelFile, []byte("no-value\n"), 0644))
+
+	args := defaultArgs("--label-file", labelFile)
+	test := func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Error(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+}
+
+func (s *OptionsSuite) TestPullPolicy() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(core.PullPolicyAlways, opts.PullPolicy)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs())
+
+	test = func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(core.PullPolicyIfNotPresent, opts.PullPolicy)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--pull-policy", "if-not-present"))
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Error(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--pull-policy", "sometimes"))
+}
+
 func (s *OptionsSuite) TestWorkingDir() {
 	tempDir, err := ioutil.TempDir("", "wercker-test-")
 	s.Nil(err)
@@ -327,3 +523,490 @@ func (s *OptionsSuite) TestWorkingDirCWD() {
 
 	run(s, globalFlags, pipelineFlags, test, args)
 }
+
+func (s *OptionsSuite) TestResourceLabels() {
+	args := defaultArgs("--build-id", "build-1", "--container-label", "team=infra", "--label", "team=release")
+	test := func(c *cli.Context) {
+		opts, err := core.NewBuildOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+
+		labels := opts.ResourceLabels()
+		s.Equal("true", labels["io.wercker"])
+		s.Equal("build-1", labels["io.wercker.build-id"])
+		s.Equal("infra", labels["team"])
+		_, ok := labels["io.wercker.deploy-id"]
+		s.False(ok)
+
+		s.Equal("release", opts.ImageLabels()["team"])
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+}
+
+func (s *OptionsSuite) TestBuildTimeout() {
+	args := defaultArgs("--build-timeout", "1.5", "--upload-partial-on-timeout")
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(90000, opts.BuildTimeout)
+		s.Equal(true, opts.UploadPartialOnTimeout)
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+}
+
+func (s *OptionsSuite) TestMaxConcurrentUploads() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(4, opts.MaxConcurrentUploads)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs())
+
+	invalid := func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, invalid, defaultArgs("--max-concurrent-uploads", "0"))
+}
+
+func (s *OptionsSuite) TestNotifyOn() {
+	args := defaultArgs("--notify-webhook", "https://example.com/hook", "--notify-on", "failure")
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal("https://example.com/hook", opts.NotifyWebhook)
+		s.Equal([]string{"failure"}, opts.NotifyOn)
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+
+	invalid := func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, invalid, defaultArgs("--notify-on", "always"))
+}
+
+func (s *OptionsSuite) TestOCIAnnotations() {
+	args := defaultArgs(
+		"--git-domain", "github.com",
+		"--git-owner", "wercker",
+		"--git-repository", "wercker",
+		"--git-commit", "abc123",
+		"--oci-annotation", "org.opencontainers.image.vendor=Wercker",
+		"--label", "org.opencontainers.image.revision=override",
+	)
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+
+		annotations := opts.OCIAnnotations()
+		s.Equal("https://github.com/wercker/wercker", annotations["org.opencontainers.image.source"])
+		s.Equal("abc123", annotations["org.opencontainers.image.revision"])
+		s.Equal("Wercker", annotations["org.opencontainers.image.vendor"])
+		// There's no such commit to take the time from
+		_, ok := annotations["org.opencontainers.image.created"]
+		s.False(ok)
+
+		labels := opts.ImageLabels()
+		s.Equal("override", labels["org.opencontainers.image.revision"])
+		s.Equal("true", labels["io.wercker"])
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+
+	test = func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), util.NewEnvironment("SOURCE_DATE_EPOCH=1500000000"))
+		s.Nil(err)
+		s.Equal("2017-07-14T02:40:00Z", opts.OCIAnnotations()["org.opencontainers.image.created"])
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+
+	invalid := func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), util.NewEnvironment("SOURCE_DATE_EPOCH=yesterday"))
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, invalid, args)
+}
+
+func (s *OptionsSuite) TestCommitPaths() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal([]string{"/app/bin", "/etc/app.conf"}, opts.CommitPaths)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--commit-paths", "/app/bin,/etc/app.conf"))
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--commit-paths", "app/bin"))
+}
+
+func (s *OptionsSuite) TestLogFields() {
+	args := defaultArgs("--deploy-id", "fake-deploy-id", "--application-owner-name", "wercker", "--application-name", "sentcli")
+	test := func(c *cli.Context) {
+		opts, err := core.NewDeployOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		fields := opts.LogFields()
+		s.Equal("fake-deploy-id", fields["build_id"])
+		s.Equal("wercker/sentcli", fields["app"])
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+}
+
+func (s *OptionsSuite) TestArtifactRetention() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal("30d", opts.ArtifactRetention)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--artifact-retention", "30d"))
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--artifact-retention", "a month"))
+}
+
+func (s *OptionsSuite) TestLoginEndpoint() {
+	loginFlags := cmd.FlagsFor(cmd.LoginFlagSet)
+	test := func(c *cli.Context) {
+		opts, err := core.NewLoginOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal("https://sso.example.com/token", opts.LoginEndpoint)
+		s.Equal("http://example.com/base-url", opts.BaseURL)
+	}
+	run(s, globalFlags, loginFlags, test, defaultArgs("--login-endpoint", "https://sso.example.com/token"))
+
+	test = func(c *cli.Context) {
+		_, err := core.NewLoginOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, loginFlags, test, defaultArgs("--login-endpoint", "sso.example.com/token"))
+}
+
+func (s *OptionsSuite) TestCommitTags() {
+	args := defaultArgs("--commit", "wercker/app", "--tag", "v1.2.3", "--commit-tag", "latest", "--commit-tag", "v1", "--push")
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal([]string{"latest", "v1"}, opts.CommitTags)
+		s.True(opts.ShouldPush)
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--push"))
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--commit", "wercker/app", "--commit-tag", "not:valid"))
+}
+
+func (s *OptionsSuite) TestRegistries() {
+	args := defaultArgs("--commit", "quay.io/wercker/app", "--push",
+		"--registry", "mirror.example.com/team",
+		"--registry", "robot:$MIRROR_PASSWORD@localhost:5000/")
+	test := func(c *cli.Context) {
+		e := emptyEnv()
+		e.Add("MIRROR_PASSWORD", "s3cr3t")
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), e)
+		s.Require().Nil(err)
+		s.Require().Equal(2, len(opts.Registries))
+
+		mirror := opts.Registries[0]
+		s.Equal("mirror.example.com", mirror.Host())
+		s.Equal("", mirror.Username)
+		s.Equal("mirror.example.com/team/wercker/app", mirror.Repository(opts.Repository))
+
+		local := opts.Registries[1]
+		s.Equal("localhost:5000", local.Host())
+		s.Equal("robot", local.Username)
+		s.Equal("s3cr3t", local.Password)
+		s.Equal("localhost:5000/wercker/app", local.Repository(opts.Repository))
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--registry", "mirror.example.com"))
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--commit", "wercker/app", "--push", "--registry", "https://mirror.example.com"))
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--commit", "wercker/app", "--push", "--registry", "robot@mirror.example.com"))
+}
+
+func (s *OptionsSuite) TestCheckpointOnStep() {
+	args := defaultArgs(
+		"--checkpoint-on-step", "install deps:localhost:5000/app-deps:v1",
+		"--checkpoint-on-step", "npm-install:app-deps",
+		"--push-checkpoint-on-step")
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Require().Nil(err)
+		s.Require().Equal(2, len(opts.StepCheckpoints))
+		s.Equal(&core.StepCheckpoint{Step: "install deps", Repository: "localhost:5000/app-deps", Tag: "v1"}, opts.StepCheckpoints[0])
+		s.Equal(&core.StepCheckpoint{Step: "npm-install", Repository: "app-deps", Tag: "latest"}, opts.StepCheckpoints[1])
+		s.True(opts.PushStepCheckpoints)
+		s.True(opts.IsCheckpointRepository("app-deps"))
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--checkpoint-on-step", "install deps"))
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--push-checkpoint-on-step"))
+}
+
+func (s *OptionsSuite) TestStepTimeoutGrace() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(10, opts.StepTimeoutGrace)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs())
+
+	test = func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(30, opts.StepTimeoutGrace)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--step-timeout-grace", "30"))
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--step-timeout-grace", "-1"))
+}
+
+func (s *OptionsSuite) TestStepWorkingTimeout() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(0, opts.StepWorkingTimeout)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs())
+
+	test = func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(90*1000, opts.StepWorkingTimeout)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--step-working-timeout", "1.5"))
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--step-working-timeout", "-1"))
+}
+
+func (s *OptionsSuite) TestFailureMessageTemplate() {
+	args := defaultArgs("--failure-message-template", "{{.Step}} failed ({{.ExitCode}}): {{range .Output}}{{.}};{{end}}")
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Require().Nil(err)
+		message, err := opts.FailureMessage(&core.FailureMessageData{
+			Step:     "test",
+			ExitCode: 2,
+			Output:   []string{"FAIL: TestApp", "exit status 2"},
+		})
+		s.Nil(err)
+		s.Equal("test failed (2): FAIL: TestApp;exit status 2;", message)
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--failure-message-template", "{{.Step"))
+}
+
+func (s *OptionsSuite) TestDryRunPush() {
+	args := defaultArgs("--commit", "quay.io/wercker/app", "--push", "--dry-run-push")
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.True(opts.DryRunPush)
+		s.Equal([]string{"quay.io/wercker/app"}, opts.PushRepositories())
+	}
+	run(s, globalFlags, pipelineFlags, test, args)
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--dry-run-push"))
+}
+
+func (s *OptionsSuite) TestKeenLogSampling() {
+	test := func(c *cli.Context) {
+		e := emptyEnv()
+		gOpts, err := core.NewGlobalOptions(util.NewCLISettings(c), e)
+		opts, err := core.NewKeenOptions(util.NewCLISettings(c), e, gOpts)
+		s.Nil(err)
+		s.Equal(20, opts.KeenLogSampling)
+	}
+	run(s, globalFlags, cmd.KeenFlags, test, defaultArgs("--keen-log-sampling", "20"))
+}
+
+func (s *OptionsSuite) TestKeenStackOptions() {
+	test := func(c *cli.Context) {
+		e := emptyEnv()
+		gOpts, err := core.NewGlobalOptions(util.NewCLISettings(c), e)
+		opts, err := core.NewKeenOptions(util.NewCLISettings(c), e, gOpts)
+		s.Nil(err)
+		s.Equal(5, opts.KeenStack)
+		s.Equal("staging", opts.KeenEnvironment)
+	}
+	run(s, globalFlags, cmd.KeenFlags, test, defaultArgs("--keen-environment", "staging"))
+}
+
+func (s *OptionsSuite) TestBuildDirMode() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(core.BuildDirModeCopy, opts.BuildDirMode)
+		s.False(opts.DirectMount)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs())
+
+	test = func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(core.BuildDirModeReadWrite, opts.BuildDirMode)
+		s.True(opts.DirectMount)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--direct-mount"))
+
+	test = func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal(core.BuildDirModeReadOnly, opts.BuildDirMode)
+		s.True(opts.DirectMount)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--build-dir-mode", "ro"))
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--build-dir-mode", "overlay"))
+}
+
+func (s *OptionsSuite) TestSourceArchive() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal("/tmp/code.tar.gz", opts.SourceArchive)
+		s.Equal("code", opts.ApplicationName)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--source-archive", "/tmp/code.tar.gz"))
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--source-archive", "/tmp/code.tar.gz", "--skip-checkout"))
+}
+
+func (s *OptionsSuite) TestPrebuildScript() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewBuildOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal("/tmp/prepare.sh", opts.PrebuildScript)
+		env := opts.PrebuildEnv("/tmp/source")
+		s.Contains(env, "WERCKER_BUILD_ID="+opts.BuildID)
+		s.NotContains(env, "WERCKER_DEPLOY_ID=")
+		s.Contains(env, "WERCKER_SOURCE_DIR=/tmp/source")
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--prebuild-script", "/tmp/prepare.sh"))
+}
+
+func (s *OptionsSuite) TestCancelFile() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal("/tmp/cancel", opts.CancelFile)
+		s.Equal(500, opts.CancelFileInterval)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--cancel-file", "/tmp/cancel", "--cancel-file-interval", "0.5"))
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--cancel-file-interval", "0"))
+	// Rounds down to 0ms
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--cancel-file-interval", "0.0001"))
+}
+
+func (s *OptionsSuite) TestOTLPLogs() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.True(opts.OTLPLogs)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--otlp-endpoint", "http://localhost:4318", "--otlp-logs"))
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--otlp-logs"))
+}
+
+func (s *OptionsSuite) TestLatestTag() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.True(opts.WarnOnLatestTag)
+		s.False(opts.ForbidLatestTag)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs())
+
+	test = func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.False(opts.WarnOnLatestTag)
+		s.True(opts.ForbidLatestTag)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--warn-on-latest-tag=false", "--forbid-latest-tag"))
+}
+
+func (s *OptionsSuite) TestAllowEmptyPipeline() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.False(opts.AllowEmptyPipeline)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs())
+
+	test = func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.True(opts.AllowEmptyPipeline)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--allow-empty-pipeline"))
+}
+
+func (s *OptionsSuite) TestInputArtifact() {
+	test := func(c *cli.Context) {
+		opts, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.Nil(err)
+		s.Equal("/tmp/output.tar", opts.InputArtifact)
+		s.Equal("build", opts.InputArtifactDir)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--input-artifact", "/tmp/output.tar", "--input-artifact-dir", "build"))
+
+	test = func(c *cli.Context) {
+		_, err := core.NewPipelineOptions(util.NewCLISettings(c), emptyEnv())
+		s.NotNil(err)
+	}
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--input-artifact", "/tmp/output.tar", "--direct-mount"))
+	run(s, globalFlags, pipelineFlags, test, defaultArgs("--input-artifact", "/tmp/output.tar", "--input-artifact-dir", "../outside"))
+}
@@ -16,13 +16,16 @@ package util
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var (
@@ -297,3 +300,54 @@ func (p *ArchiveBytes) Process(hdr *tar.Header, r io.Reader) (*tar.Header, io.Re
 	_, err := io.Copy(p, r)
 	return hdr, r, err
 }
+
+// isGzipped checks for the gzip magic bytes without consuming them
+func isGzipped(br *bufio.Reader) bool {
+	magic, err := br.Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// VerifyTarball reads a whole tarball, gzipped or not, to check that it is
+// well-formed and not truncated. It returns the top-level entries.
+func VerifyTarball(r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+	var stream io.Reader = br
+	if isGzipped(br) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		stream = gz
+	}
+
+	topLevel := []string{}
+	seen := make(map[string]bool)
+	tarball := tar.NewReader(stream)
+	for {
+		hdr, err := tarball.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(ioutil.Discard, tarball); err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(hdr.Name)), "./")
+		if name == "." || name == "" {
+			continue
+		}
+		top := strings.SplitN(name, "/", 2)[0]
+		if !seen[top] {
+			seen[top] = true
+			topLevel = append(topLevel, top)
+		}
+	}
+	if len(topLevel) == 0 {
+		return nil, ErrEmptyTarball
+	}
+	return topLevel, nil
+}
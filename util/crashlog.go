@@ -0,0 +1,158 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// CrashLog is a logrus hook keeping the last log lines in memory, so they
+// can be written to a crash file when wercker panics.
+type CrashLog struct {
+	path    string
+	lines   []string
+	next    int
+	full    bool
+	context map[string]string
+	l       sync.Mutex
+}
+
+// NewCrashLog keeps the last size log lines, to be written to path.
+func NewCrashLog(path string, size int) *CrashLog {
+	return &CrashLog{
+		path:    path,
+		lines:   make([]string, size),
+		context: make(map[string]string),
+	}
+}
+
+// Levels implements logrus.Hook, we want every level.
+func (c *CrashLog) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook, it adds the entry to the buffer.
+func (c *CrashLog) Fire(entry *logrus.Entry) error {
+	keys := []string{}
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%s %-5s %s", entry.Time.Format(time.RFC3339), strings.ToUpper(entry.Level.String()), strings.TrimRight(entry.Message, "\n"))
+	for _, k := range keys {
+		fmt.Fprintf(b, " %s=%v", k, entry.Data[k])
+	}
+	c.add(b.String())
+	return nil
+}
+
+func (c *CrashLog) add(line string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if len(c.lines) == 0 {
+		return
+	}
+	c.lines[c.next] = line
+	c.next = (c.next + 1) % len(c.lines)
+	if c.next == 0 {
+		c.full = true
+	}
+}
+
+// Lines returns the buffered lines, oldest first.
+func (c *CrashLog) Lines() []string {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if !c.full {
+		return append([]string{}, c.lines[:c.next]...)
+	}
+	return append(append([]string{}, c.lines[c.next:]...), c.lines[:c.next]...)
+}
+
+// SetContext records what wercker is doing, like the current step, to be
+// included in the crash file.
+func (c *CrashLog) SetContext(key, value string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.context[key] = value
+}
+
+// Write writes the crash file with the panic value, the stack trace, the
+// context and the buffered log lines.
+func (c *CrashLog) Write(recovered interface{}) error {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "wercker %s crashed at %s\n\n", FullVersion(), time.Now().Format(time.RFC3339))
+	fmt.Fprintf(b, "panic: %v\n\n%s\n", recovered, debug.Stack())
+
+	c.l.Lock()
+	keys := []string{}
+	for k := range c.context {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(b, "Context:")
+	for _, k := range keys {
+		fmt.Fprintf(b, "  %s: %s\n", k, c.context[k])
+	}
+	c.l.Unlock()
+
+	lines := c.Lines()
+	fmt.Fprintf(b, "\nLast %d log lines:\n", len(lines))
+	for _, line := range lines {
+		fmt.Fprintln(b, line)
+	}
+	// The context and the log lines can hold secrets, a crash log left over
+	// from before might still be readable by others
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(c.path, b.Bytes(), 0600)
+}
+
+var rootCrashLog *CrashLog
+
+// SetCrashLog makes c the crash log for the root logger.
+func SetCrashLog(c *CrashLog) {
+	rootCrashLog = c
+	rootLogger.Hooks.Add(c)
+}
+
+// SetCrashContext records context for the crash log, if there is one.
+func SetCrashContext(key, value string) {
+	if rootCrashLog != nil {
+		rootCrashLog.SetContext(key, value)
+	}
+}
+
+// WriteCrashLog writes the crash log for recovered, if there is one, and
+// returns the path it was written to.
+func WriteCrashLog(recovered interface{}) (string, error) {
+	if rootCrashLog == nil {
+		return "", nil
+	}
+	return rootCrashLog.path, rootCrashLog.Write(recovered)
+}
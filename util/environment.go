@@ -16,6 +16,7 @@ package util
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 )
@@ -39,6 +40,15 @@ func NewEnvironment(env ...string) *Environment {
 		e.Add(pair[0], pair[1])
 	}
 
+	// Only the passthru variables end up in the pipeline, leave the rest of
+	// the host environment alone
+	err := e.expandFiles(func(key string) bool {
+		return strings.HasPrefix(key, "X_") || strings.HasPrefix(key, "XXX_")
+	})
+	if err != nil {
+		rootLogger.WithField("Error", err).Warnln("Unable to expand environment")
+	}
+
 	return &e
 }
 
@@ -54,16 +64,65 @@ func (e *Environment) Add(key, value string) {
 	if e.Map == nil {
 		e.Map = make(map[string]string)
 	}
+	key = e.key(key)
 	if _, ok := e.Map[key]; !ok {
 		e.Order = append(e.Order, key)
 	}
 	e.Map[key] = value
 }
 
+// Remove an individual record.
+func (e *Environment) Remove(key string) {
+	key = e.key(key)
+	if _, ok := e.Map[key]; !ok {
+		return
+	}
+	delete(e.Map, key)
+	for i, k := range e.Order {
+		if k == key {
+			e.Order = append(e.Order[:i], e.Order[i+1:]...)
+			break
+		}
+	}
+}
+
+// fileSuffix marks variables that point to a file containing the value.
+const fileSuffix = "_FILE"
+
+// ExpandFiles follows the _FILE convention: FOO_FILE=/run/secrets/foo sets
+// FOO to the contents of /run/secrets/foo. The FOO_FILE record is removed so
+// only the resolved value is passed on. A FOO that is already set wins.
+func (e *Environment) ExpandFiles() error {
+	return e.expandFiles(func(string) bool { return true })
+}
+
+func (e *Environment) expandFiles(include func(string) bool) error {
+	for _, key := range append([]string{}, e.Order...) {
+		if !strings.HasSuffix(key, fileSuffix) || key == fileSuffix || !include(key) {
+			continue
+		}
+
+		name := strings.TrimSuffix(key, fileSuffix)
+		path := e.Map[key]
+		e.Remove(key)
+
+		if _, ok := e.Map[name]; ok || path == "" {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Unable to read file for %s: %s", name, err)
+		}
+		e.Add(name, strings.TrimSuffix(string(content), "\n"))
+	}
+	return nil
+}
+
 // Get an individual record.
 func (e *Environment) Get(key string) string {
 	if e.Map != nil {
-		if val, ok := e.Map[key]; ok {
+		if val, ok := e.Map[e.key(key)]; ok {
 			return val
 		}
 	}
@@ -79,6 +138,27 @@ func (e *Environment) Export() []string {
 	return s
 }
 
+// DotEnv returns the environment as lines for a dotenv file. The variables
+// are prefixed with X_ and the hidden variables with XXX_, so loading the
+// file passes them through to the pipeline again. Unless unmasked is set the
+// values of hidden variables are replaced.
+func (e *Environment) DotEnv(unmasked bool) []string {
+	s := []string{}
+	for _, key := range e.Order {
+		s = append(s, fmt.Sprintf(`X_%s=%q`, key, e.Map[key]))
+	}
+	if e.Hidden != nil {
+		for _, key := range e.Hidden.Order {
+			value := e.Hidden.Map[key]
+			if !unmasked {
+				value = "<masked>"
+			}
+			s = append(s, fmt.Sprintf(`XXX_%s=%q`, key, value))
+		}
+	}
+	return s
+}
+
 // Ordered returns a [][]string of the items in the env.
 // Used only for debugging
 func (e *Environment) Ordered() [][]string {
@@ -89,11 +169,78 @@ func (e *Environment) Ordered() [][]string {
 	return a
 }
 
+// envExpand is turned off with --env-expand=false
+var envExpand = true
+
+// SetEnvExpand globally enables or disables Interpolate.
+func SetEnvExpand(enabled bool) {
+	envExpand = enabled
+}
+
+// envCaseInsensitive is turned on with --env-case-insensitive
+var envCaseInsensitive = false
+
+// SetEnvCaseInsensitive globally makes the keys of environments case
+// insensitive, Path and PATH are the same variable then. The casing of the
+// first record added is kept.
+func SetEnvCaseInsensitive(enabled bool) {
+	envCaseInsensitive = enabled
+}
+
+// key returns the key of the existing record matching key, if keys are case
+// insensitive, otherwise key itself.
+func (e *Environment) key(key string) string {
+	if !envCaseInsensitive {
+		return key
+	}
+	if _, ok := e.Map[key]; ok {
+		return key
+	}
+	for _, k := range e.Order {
+		if strings.EqualFold(k, key) {
+			return k
+		}
+	}
+	return key
+}
+
 // Interpolate is a naive interpolator that attempts to replace variables
-// identified by $VAR with the value of the VAR pipeline environment variable
+// identified by $VAR with the value of the VAR pipeline environment variable,
+// $$ is an escaped $.
 // NOTE(termie): This will check the hidden env, too.
 func (e *Environment) Interpolate(s string) string {
-	return os.Expand(s, e.GetInclHidden)
+	if !envExpand {
+		return s
+	}
+	return os.Expand(s, func(key string) string {
+		if key == "$" {
+			return "$"
+		}
+		return e.GetInclHidden(key)
+	})
+}
+
+// InterpolateMasked is Interpolate for showing values to the user: variables
+// that aren't set are kept as they are and the values of hidden variables are
+// replaced by mask.
+func (e *Environment) InterpolateMasked(s, mask string) string {
+	if !envExpand {
+		return s
+	}
+	return os.Expand(s, func(key string) string {
+		if key == "$" {
+			return "$"
+		}
+		if value, ok := e.Map[e.key(key)]; ok {
+			return value
+		}
+		if e.Hidden != nil {
+			if _, ok := e.Hidden.Map[e.Hidden.key(key)]; ok {
+				return mask
+			}
+		}
+		return "${" + key + "}"
+	})
 }
 
 var mirroredEnv = [...]string{
@@ -142,13 +289,13 @@ func (e *Environment) GetMirror() [][]string {
 // hidden environment.
 func (e *Environment) GetInclHidden(key string) string {
 	if e.Map != nil {
-		if val, ok := e.Map[key]; ok {
+		if val, ok := e.Map[e.key(key)]; ok {
 			return val
 		}
 	}
 
 	if e.Hidden != nil && e.Hidden.Map != nil {
-		if val, ok := e.Hidden.Map[key]; ok {
+		if val, ok := e.Hidden.Map[e.Hidden.key(key)]; ok {
 			return val
 		}
 	}
@@ -15,6 +15,9 @@
 package util
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -55,6 +58,37 @@ func (s *EnvironmentSuite) TestInterpolate() {
 	s.Equal(env.Interpolate("$PRIVATE"), "zed", "Xs should be stripped.")
 	s.Equal(env.Interpolate("$OTHER"), "otter", "XXXs should be stripped.")
 	s.Equal(env.Interpolate("one two $PUBLIC bar"), "one two foo bar", "interpolation should work in middle of string.")
+	s.Equal(env.Interpolate("$${PUBLIC} $PUBLIC"), "${PUBLIC} foo", "$$ should be a literal $.")
+}
+
+func (s *EnvironmentSuite) TestInterpolateDisabled() {
+	env := NewEnvironment("PUBLIC=foo")
+	SetEnvExpand(false)
+	defer SetEnvExpand(true)
+	s.Equal("${PUBLIC} $$", env.Interpolate("${PUBLIC} $$"))
+}
+
+func (s *EnvironmentSuite) TestCaseInsensitive() {
+	SetEnvCaseInsensitive(true)
+	defer SetEnvCaseInsensitive(false)
+	env := NewEnvironment("Path=/usr/bin")
+	env.Add("PATH", "/usr/local/bin")
+	s.Equal("/usr/local/bin", env.Get("path"))
+	s.Equal([]string{`export Path="/usr/local/bin"`}, env.Export())
+	env.Remove("PATH")
+	s.Equal(0, len(env.Order))
+}
+
+func (s *EnvironmentSuite) TestCaseSensitive() {
+	env := NewEnvironment("Path=/usr/bin", "PATH=/usr/local/bin")
+	s.Equal("/usr/bin", env.Get("Path"))
+	s.Equal("", env.Get("path"))
+}
+
+func (s *EnvironmentSuite) TestInterpolateMasked() {
+	env := NewEnvironment("PUBLIC=foo")
+	env.Hidden.Add("SECRET", "bar")
+	s.Equal("foo <masked> ${UNSET} $", env.InterpolateMasked("$PUBLIC $SECRET $UNSET $$", "<masked>"))
 }
 
 func (s *EnvironmentSuite) TestOrdered() {
@@ -68,3 +102,41 @@ func (s *EnvironmentSuite) TestExport() {
 	expected := []string{`export PUBLIC="foo"`, `export X_PRIVATE="zed"`}
 	s.Equal(env.Export(), expected)
 }
+
+func (s *EnvironmentSuite) TestDotEnv() {
+	env := NewEnvironment("PUBLIC=foo bar")
+	env.Hidden.Add("SECRET", "hunter2")
+	s.Equal([]string{`X_PUBLIC="foo bar"`, `XXX_SECRET="<masked>"`}, env.DotEnv(false))
+	s.Equal([]string{`X_PUBLIC="foo bar"`, `XXX_SECRET="hunter2"`}, env.DotEnv(true))
+}
+
+func (s *EnvironmentSuite) TestExpandFiles() {
+	tmp, err := ioutil.TempDir("", "test-")
+	s.Nil(err)
+	defer os.RemoveAll(tmp)
+
+	secret := filepath.Join(tmp, "secret")
+	s.Nil(ioutil.WriteFile(secret, []byte("hunter2\n"), 0600))
+
+	env := NewEnvironment("PUBLIC=foo", "SECRET_FILE="+secret, "SET=bar", "SET_FILE="+secret)
+	s.Nil(env.ExpandFiles())
+	s.Equal("hunter2", env.Get("SECRET"))
+	s.Equal("bar", env.Get("SET"), "Variables that are already set should win.")
+	s.Equal(3, len(env.Ordered()), "_FILE variables should be removed.")
+
+	env = NewEnvironment("MISSING_FILE=" + filepath.Join(tmp, "missing"))
+	s.Error(env.ExpandFiles())
+}
+
+func (s *EnvironmentSuite) TestExpandFilesPassthru() {
+	tmp, err := ioutil.TempDir("", "test-")
+	s.Nil(err)
+	defer os.RemoveAll(tmp)
+
+	secret := filepath.Join(tmp, "secret")
+	s.Nil(ioutil.WriteFile(secret, []byte("hunter2"), 0600))
+
+	env := NewEnvironment("XXX_SECRET_FILE="+secret, "HOST_FILE="+secret)
+	s.Equal("hunter2", env.GetHiddenPassthru().Get("SECRET"))
+	s.Equal(secret, env.Get("HOST_FILE"), "Only passthru variables are expanded.")
+}
@@ -0,0 +1,123 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// ErrKeychainNotFound is returned when the keychain has no secret for the
+// service and account
+var ErrKeychainNotFound = errors.New("No secret found in the keychain")
+
+// keychainCommand returns the command line to run op ("get", "set" or
+// "delete") against the keychain of goos, and what to write to its stdin.
+// Secrets always go on stdin, so they don't show up in the process list.
+func keychainCommand(goos, op, service, account, secret string) ([]string, string, error) {
+	switch goos {
+	case "darwin":
+		switch op {
+		case "get":
+			return []string{"security", "find-generic-password", "-s", service, "-a", account, "-w"}, "", nil
+		case "set":
+			// security only reads the password from its arguments, so the
+			// command is given to its interactive mode instead
+			command := []string{"add-generic-password", "-U", "-s", service, "-a", account, "-w", secret}
+			for i, arg := range command {
+				command[i] = securityQuote(arg)
+			}
+			return []string{"security", "-i"}, strings.Join(command, " ") + "\n", nil
+		case "delete":
+			return []string{"security", "delete-generic-password", "-s", service, "-a", account}, "", nil
+		}
+	case "linux", "freebsd", "openbsd":
+		attributes := []string{"service", service, "account", account}
+		switch op {
+		case "get":
+			return append([]string{"secret-tool", "lookup"}, attributes...), "", nil
+		case "set":
+			return append([]string{"secret-tool", "store", "--label", service}, attributes...), secret, nil
+		case "delete":
+			return append([]string{"secret-tool", "clear"}, attributes...), "", nil
+		}
+	default:
+		return nil, "", fmt.Errorf("The keychain is not supported on %s", goos)
+	}
+	return nil, "", fmt.Errorf("Unknown keychain operation %s", op)
+}
+
+// securityQuote quotes s as an argument for the interactive mode of security
+func securityQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// runKeychain runs op against the OS keychain, handing secret to the tool
+func runKeychain(op, service, account, secret string) (string, error) {
+	args, stdin, err := keychainCommand(runtime.GOOS, op, service, account, secret)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok && op != "set" {
+			// Both tools exit non-zero when there is no such secret
+			return "", ErrKeychainNotFound
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%s: %s", err, msg)
+		}
+		return "", fmt.Errorf("Unable to %s secret with %s: %s", op, args[0], err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// KeychainGet reads the secret for service and account from the OS keychain
+// (macOS Keychain or a libsecret secret service).
+func KeychainGet(service, account string) (string, error) {
+	secret, err := runKeychain("get", service, account, "")
+	if err == nil && secret == "" {
+		return "", ErrKeychainNotFound
+	}
+	return secret, err
+}
+
+// KeychainSet stores secret for service and account in the OS keychain,
+// replacing an existing one.
+func KeychainSet(service, account, secret string) error {
+	_, err := runKeychain("set", service, account, secret)
+	return err
+}
+
+// KeychainDelete removes the secret for service and account from the OS
+// keychain, it is not an error if there is none.
+func KeychainDelete(service, account string) error {
+	_, err := runKeychain("delete", service, account, "")
+	if err == ErrKeychainNotFound {
+		return nil
+	}
+	return err
+}
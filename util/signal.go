@@ -18,6 +18,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"time"
 )
 
 // SignalHandler is a little struct to hold our signal handling functions
@@ -106,6 +107,43 @@ func (s *SignalMonkey) Register(sig os.Signal) {
 	}()
 }
 
+// Trigger handles the registered signal as if it was received by the process.
+func (s *SignalMonkey) Trigger() {
+	if s.notify == nil {
+		return
+	}
+	select {
+	case s.notify <- s.signal:
+	default:
+		// A signal is already waiting to be handled
+	}
+}
+
+// WatchCancelFile polls every interval for path to exist and calls cancel
+// once when it does. The returned function stops the polling.
+func WatchCancelFile(path string, interval time.Duration, cancel func()) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := os.Stat(path); err == nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
 var globalSigint = NewSignalMonkey()
 var globalSigterm = NewSignalMonkey()
 
@@ -16,15 +16,18 @@ package util
 
 import (
 	"archive/tar"
+	"bufio"
 	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -55,6 +58,27 @@ func Exists(path string) (bool, error) {
 	return false, err
 }
 
+// SetTempDir makes dir the base directory for all temporary files created by
+// this process, making sure it exists and is writable first.
+func SetTempDir(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "wercker-")
+	if err != nil {
+		return fmt.Errorf("Temp dir is not writable: %s", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	// ioutil.TempDir and ioutil.TempFile fall back to os.TempDir, which
+	// reads TMPDIR
+	return os.Setenv("TMPDIR", dir)
+}
+
 // FetchTarball tries to fetch a tarball
 // For now this is pretty naive and useless, but we are doing it in a couple
 // places and this is a fine stub to expand upon.
@@ -70,6 +94,84 @@ func FetchTarball(url string) (*http.Response, error) {
 	return resp, nil
 }
 
+// FetchResumable downloads url to path. An interrupted download is kept in
+// path.partial and continued with a range request the next time, if the
+// server supports it and the ETag or Last-Modified it sent for the download
+// still matches.
+func FetchResumable(url, path string) error {
+	partial := path + ".partial"
+	validatorPath := partial + ".validator"
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	// Without a validator we can't tell whether the partial download is of
+	// the same tarball, so it is only continued with one
+	validator, _ := ioutil.ReadFile(validatorPath)
+	if offset > 0 && len(validator) > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(validator))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range or the tarball changed, start over
+		if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+			return err
+		}
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		os.Remove(validatorPath)
+		if validator := rangeValidator(resp); validator != "" {
+			if err := ioutil.WriteFile(validatorPath, []byte(validator), 0644); err != nil {
+				return err
+			}
+		}
+	default:
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// Don't get stuck on a partial download that can't be continued
+			os.Remove(partial)
+			os.Remove(validatorPath)
+		}
+		return fmt.Errorf("Bad status code fetching %s: %d", url, resp.StatusCode)
+	}
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	os.Remove(validatorPath)
+	return os.Rename(partial, path)
+}
+
+// rangeValidator returns what to send as If-Range when continuing the
+// download of resp, a weak ETag can't be used for range requests.
+func rangeValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
 // UntarOne writes the contents up a single file to dst
 func UntarOne(name string, dst io.Writer, src io.ReadCloser) error {
 	// ungzipped, err := gzip.NewReader(src)
@@ -107,10 +209,24 @@ func Untargzip(path string, r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	tarball := tar.NewReader(ungzipped)
-
 	defer ungzipped.Close()
 
+	return untar(path, ungzipped)
+}
+
+// ExtractTarball untars a tarball, gzipped or not, to a path
+func ExtractTarball(path string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if isGzipped(br) {
+		return Untargzip(path, br)
+	}
+	return untar(path, br)
+}
+
+// untar extracts the tarball in r to a path
+func untar(path string, r io.Reader) error {
+	tarball := tar.NewReader(r)
+
 	// We have to treat things differently for git-archives
 	isGitArchive := false
 
@@ -145,6 +261,10 @@ func Untargzip(path string, r io.Reader) error {
 		}
 
 		fpath := filepath.Join(path, name)
+		// Don't let entries like ../../etc/passwd escape the path
+		if rel, err := filepath.Rel(path, fpath); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("Invalid path in tarball: %s", hdr.Name)
+		}
 		if hdr.FileInfo().IsDir() {
 			err = os.MkdirAll(fpath, 0755)
 			if err != nil {
@@ -152,22 +272,30 @@ func Untargzip(path string, r io.Reader) error {
 			}
 			continue
 		}
-		file, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE, hdr.FileInfo().Mode())
-		defer file.Close()
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode())
 		if err != nil {
 			return err
 		}
 		_, err = io.Copy(file, tarball)
+		file.Close()
 		if err != nil {
 			return err
 		}
-		file.Close()
 	}
 	return nil
 }
 
 // TarPath makes a tarball out of a directory
 func TarPath(writer io.Writer, root string) error {
+	return TarPathWithPrefix(writer, root, "")
+}
+
+// TarPathWithPrefix makes a tarball out of a directory with all the names
+// in it under prefix
+func TarPathWithPrefix(writer io.Writer, root, prefix string) error {
 	tw := tar.NewWriter(writer)
 	defer tw.Close()
 	walkFn := func(path string, info os.FileInfo, err error) error {
@@ -191,7 +319,7 @@ func TarPath(writer io.Writer, root string) error {
 		}
 		hdr.Uid = 0
 		hdr.Gid = 0
-		hdr.Name = newPath
+		hdr.Name = filepath.ToSlash(filepath.Join(prefix, newPath))
 		err = tw.WriteHeader(hdr)
 		if err != nil {
 			return err
@@ -210,6 +338,121 @@ func TarPath(writer io.Writer, root string) error {
 	return nil
 }
 
+// tarEntry is a header in a tarball and the offset of its data.
+type tarEntry struct {
+	hdr    *tar.Header
+	offset int64
+}
+
+// tarEntries sorts tarEntry by name
+type tarEntries []tarEntry
+
+func (t tarEntries) Len() int           { return len(t) }
+func (t tarEntries) Less(i, j int) bool { return t[i].hdr.Name < t[j].hdr.Name }
+func (t tarEntries) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// NormalizeTarball rewrites the tarball at p so it only depends on the names
+// and contents of its entries: entries are sorted by name, mtimes are reset
+// to the epoch, owners to root and permissions to 0755 for directories and
+// executables and 0644 for everything else.
+func NormalizeTarball(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Remember where the data of each entry starts so we can copy it in
+	// sorted order without keeping it in memory.
+	entries := tarEntries{}
+	counter := NewCounterReader(f)
+	tarball := tar.NewReader(counter)
+	for {
+		hdr, err := tarball.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		entries = append(entries, tarEntry{hdr: hdr, offset: counter.Count()})
+	}
+	sort.Stable(entries)
+
+	out, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.ModTime = time.Unix(0, 0)
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+		hdr.Uid = 0
+		hdr.Gid = 0
+		hdr.Uname = ""
+		hdr.Gname = ""
+		hdr.Xattrs = nil
+		switch {
+		case hdr.Typeflag == tar.TypeSymlink:
+			hdr.Mode = 0777
+		case hdr.Typeflag == tar.TypeDir, hdr.Mode&0111 != 0:
+			hdr.Mode = 0755
+		default:
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Size > 0 {
+			if _, err := io.Copy(tw, io.NewSectionReader(f, e.offset, hdr.Size)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), p)
+}
+
+// secretMask replaces secrets in output
+const secretMask = "********"
+
+// minSecretLineLength keeps MaskSecrets from masking short lines of a
+// multi-line secret, they would match all over the place
+const minSecretLineLength = 4
+
+// MaskSecrets replaces every occurrence of the secrets in s. The lines of a
+// multi-line secret are also masked by themselves, output often contains
+// only part of such a secret.
+func MaskSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		s = strings.Replace(s, secret, secretMask, -1)
+		if !strings.Contains(secret, "\n") {
+			continue
+		}
+		for _, line := range strings.Split(secret, "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) < minSecretLineLength {
+				continue
+			}
+			s = strings.Replace(s, line, secretMask, -1)
+		}
+	}
+	return s
+}
+
 // Finisher is a helper class for running something either right away or
 // at `defer` time.
 type Finisher struct {
@@ -231,9 +474,10 @@ func (f *Finisher) Finish(result interface{}) {
 	f.callback(result)
 }
 
-// Counter is a simple struct
+// Counter is a simple struct, Total is the number Current counts up to
 type Counter struct {
 	Current int
+	Total   int
 	l       sync.Mutex
 }
 
@@ -248,6 +492,43 @@ func (c *Counter) Increment() int {
 	return current
 }
 
+// ListedFile is a file found by ListFiles.
+type ListedFile struct {
+	Path string
+	Size int64
+}
+
+// ListFiles returns the regular files below root, with paths relative to
+// root, in lexical order. Directories in skip are left out completely.
+func ListFiles(root string, skip []string) ([]ListedFile, error) {
+	files := []ListedFile{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if abspath, _ := filepath.Abs(p); ContainsString(skip, abspath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		// root is a file itself
+		if rel == "." {
+			rel = filepath.Base(p)
+		}
+		files = append(files, ListedFile{Path: rel, Size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
 // ContainsString checks if the array items contains the string target.
 // TODO(bvdberg): write units tests
 func ContainsString(items []string, target string) bool {
@@ -320,6 +601,11 @@ func QueryString(opts interface{}) map[string]interface{} {
 	return items
 }
 
+// ShellQuote quotes s so a POSIX shell reads it back as a single word.
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 func SplitSpaceOrComma(str string) []string {
 	return strings.FieldsFunc(str, func(c rune) bool {
 		return unicode.IsSpace(c) || c == ','
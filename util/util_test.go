@@ -15,7 +15,16 @@
 package util
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -51,6 +60,86 @@ func (s *UtilSuite) TestCounterIncrement2() {
 	s.Equal(4, n2, "expected second increment to be 4")
 }
 
+func (s *UtilSuite) TestWatchCancelFile() {
+	dir, err := ioutil.TempDir("", "cancel")
+	s.Require().Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cancel")
+
+	cancelled := make(chan struct{}, 1)
+	stop := WatchCancelFile(path, 10*time.Millisecond, func() {
+		cancelled <- struct{}{}
+	})
+	defer stop()
+
+	select {
+	case <-cancelled:
+		s.Fail("cancelled before the file was created")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Require().Nil(ioutil.WriteFile(path, []byte{}, 0644))
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		s.Fail("not cancelled after the file was created")
+	}
+}
+
+func (s *UtilSuite) TestFetchResumable() {
+	dir, err := ioutil.TempDir("", "fetch")
+	s.Require().Nil(err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("0123456789")
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "step.tar.gz", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	target := filepath.Join(dir, "step.tar.gz")
+	fetch := func() string {
+		s.Nil(FetchResumable(server.URL, target))
+		fetched, err := ioutil.ReadFile(target)
+		s.Nil(err)
+		exists, _ := Exists(target + ".partial")
+		s.False(exists)
+		exists, _ = Exists(target + ".partial.validator")
+		s.False(exists)
+		return string(fetched)
+	}
+
+	// An interrupted download keeps what it got and the ETag
+	interrupted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Length", "10")
+		w.Write(content[:4])
+	}))
+	defer interrupted.Close()
+	s.NotNil(FetchResumable(interrupted.URL, target))
+	partial, err := ioutil.ReadFile(target + ".partial")
+	s.Nil(err)
+	s.Equal("0123", string(partial))
+	validator, err := ioutil.ReadFile(target + ".partial.validator")
+	s.Nil(err)
+	s.Equal(`"v1"`, string(validator))
+
+	// Continue it while the tarball is the same
+	s.Equal("0123456789", fetch())
+
+	// The tarball changed since, so it's downloaded again
+	content = []byte("abcdefghij")
+	etag = `"v2"`
+	s.Require().Nil(ioutil.WriteFile(target+".partial", []byte("0123"), 0644))
+	s.Require().Nil(ioutil.WriteFile(target+".partial.validator", []byte(`"v1"`), 0644))
+	s.Equal("abcdefghij", fetch())
+
+	// Without a validator the partial download can't be trusted
+	s.Require().Nil(ioutil.WriteFile(target+".partial", []byte("0123"), 0644))
+	s.Equal("abcdefghij", fetch())
+}
+
 func (s *UtilSuite) TestMinInt() {
 	testSteps := []struct {
 		input    []int
@@ -109,3 +198,255 @@ func (s *UtilSuite) TestSplitFunc() {
 		s.Equal(len(test.output), 2)
 	}
 }
+
+func (s *UtilSuite) TestSetTempDir() {
+	base, err := ioutil.TempDir("", "wercker-test-")
+	s.Require().Nil(err)
+	defer os.RemoveAll(base)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+
+	dir := filepath.Join(base, "scratch")
+	err = SetTempDir(dir)
+	s.Nil(err)
+	s.Equal(dir, os.TempDir())
+
+	f, err := ioutil.TempFile("", "check-")
+	s.Require().Nil(err)
+	f.Close()
+	s.Equal(dir, filepath.Dir(f.Name()))
+}
+
+func (s *UtilSuite) TestMaskSecrets() {
+	secrets := []string{"hunter22", "-----BEGIN KEY-----\nc2VjcmV0\n-----END KEY-----", ""}
+
+	s.Equal("password is ********!", MaskSecrets("password is hunter22!", secrets))
+	s.Equal("key: ********", MaskSecrets("key: -----BEGIN KEY-----\nc2VjcmV0\n-----END KEY-----", secrets))
+	s.Equal("line ********\n", MaskSecrets("line c2VjcmV0\n", secrets))
+	s.Equal("nothing to see", MaskSecrets("nothing to see", secrets))
+}
+
+func (s *UtilSuite) TestCrashLog() {
+	tmp, err := ioutil.TempDir("", "wercker-test-")
+	s.Require().Nil(err)
+	defer os.RemoveAll(tmp)
+
+	logger := NewLogger()
+	logger.Out = ioutil.Discard
+	crashLog := NewCrashLog(filepath.Join(tmp, "crash.log"), 2)
+	logger.Hooks.Add(crashLog)
+
+	logger.Infoln("first-line")
+	s.Equal(1, len(crashLog.Lines()))
+
+	logger.Infoln("two")
+	logger.WithField("Step", "test").Warnln("three")
+	lines := crashLog.Lines()
+	s.Require().Equal(2, len(lines))
+	s.Contains(lines[0], "INFO  two")
+	s.Contains(lines[1], "WARNING three Step=test")
+
+	// A crash log from before is replaced
+	s.Nil(ioutil.WriteFile(filepath.Join(tmp, "crash.log"), []byte("old"), 0644))
+	crashLog.SetContext("step", "test")
+	s.Nil(crashLog.Write("boom"))
+	info, err := os.Stat(filepath.Join(tmp, "crash.log"))
+	s.Require().Nil(err)
+	s.Equal(os.FileMode(0600), info.Mode().Perm())
+	b, err := ioutil.ReadFile(filepath.Join(tmp, "crash.log"))
+	s.Nil(err)
+	s.Contains(string(b), "panic: boom")
+	s.Contains(string(b), "  step: test")
+	s.Contains(string(b), "WARNING three")
+	s.NotContains(string(b), "first-line")
+}
+
+func (s *UtilSuite) TestShellQuote() {
+	s.Equal("'plain'", ShellQuote("plain"))
+	s.Equal("''", ShellQuote(""))
+	s.Equal(`'it'\''s $HOME'`, ShellQuote("it's $HOME"))
+}
+
+func (s *UtilSuite) TestNormalizeTarball() {
+	write := func(p string, mtime time.Time, names ...string) {
+		f, err := os.Create(p)
+		s.Require().NoError(err)
+		defer f.Close()
+		tw := tar.NewWriter(f)
+		for _, name := range names {
+			s.Require().NoError(tw.WriteHeader(&tar.Header{
+				Name:    name,
+				Mode:    0600,
+				Uid:     1000,
+				Uname:   "builder",
+				Size:    int64(len(name)),
+				ModTime: mtime,
+			}))
+			_, err := tw.Write([]byte(name))
+			s.Require().NoError(err)
+		}
+		s.Require().NoError(tw.Close())
+	}
+
+	tmp, err := ioutil.TempDir("", "test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(tmp)
+
+	a := filepath.Join(tmp, "a.tar")
+	b := filepath.Join(tmp, "b.tar")
+	write(a, time.Now(), "output/b", "output/a")
+	write(b, time.Now().Add(time.Hour), "output/a", "output/b")
+	s.Require().NoError(NormalizeTarball(a))
+	s.Require().NoError(NormalizeTarball(b))
+
+	ab, err := ioutil.ReadFile(a)
+	s.Require().NoError(err)
+	bb, err := ioutil.ReadFile(b)
+	s.Require().NoError(err)
+	s.Equal(ab, bb)
+
+	f, err := os.Open(a)
+	s.Require().NoError(err)
+	defer f.Close()
+	tarball := tar.NewReader(f)
+	hdr, err := tarball.Next()
+	s.Require().NoError(err)
+	s.Equal("output/a", hdr.Name)
+	s.Equal(int64(0644), hdr.Mode)
+	s.Equal(0, hdr.Uid)
+	s.Equal("", hdr.Uname)
+	content, err := ioutil.ReadAll(tarball)
+	s.Require().NoError(err)
+	s.Equal("output/a", string(content))
+}
+
+func (s *UtilSuite) TestVerifyTarball() {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{"bin/", "bin/app", "README"} {
+		body := "content"
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}
+		if name == "bin/" {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Size = 0
+			body = ""
+		}
+		s.Require().Nil(tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(body))
+		s.Require().Nil(err)
+	}
+	s.Require().Nil(tw.Close())
+	s.Require().Nil(gz.Close())
+
+	gzipped := buf.Bytes()
+	topLevel, err := VerifyTarball(bytes.NewReader(gzipped))
+	s.Nil(err)
+	s.Equal([]string{"bin", "README"}, topLevel)
+
+	gzr, err := gzip.NewReader(bytes.NewReader(gzipped))
+	s.Require().Nil(err)
+	plain, err := ioutil.ReadAll(gzr)
+	s.Require().Nil(err)
+	_, err = VerifyTarball(bytes.NewReader(plain[:len(plain)/2]))
+	s.NotNil(err)
+}
+
+func (s *UtilSuite) TestManifestDigest() {
+	dir, err := ioutil.TempDir("", "manifest")
+	s.Require().Nil(err)
+	defer os.RemoveAll(dir)
+
+	manifest := filepath.Join(dir, "SHA256SUMS")
+	content := "ABC123  output.tar\ndef456 *other.tar.gz\n"
+	s.Require().Nil(ioutil.WriteFile(manifest, []byte(content), 0644))
+
+	digest, err := ManifestDigest(manifest, "/tmp/output.tar")
+	s.Nil(err)
+	s.Equal("abc123", digest)
+
+	digest, err = ManifestDigest(manifest, "other.tar.gz")
+	s.Nil(err)
+	s.Equal("def456", digest)
+
+	_, err = ManifestDigest(manifest, "missing.tar")
+	s.NotNil(err)
+}
+
+func (s *UtilSuite) TestListFiles() {
+	dir, err := ioutil.TempDir("", "list")
+	s.Require().Nil(err)
+	defer os.RemoveAll(dir)
+
+	s.Require().Nil(os.MkdirAll(filepath.Join(dir, "bin"), 0755))
+	s.Require().Nil(os.MkdirAll(filepath.Join(dir, ".wercker", "builds"), 0755))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(dir, "bin", "app"), []byte("binary"), 0644))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hi"), 0644))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(dir, ".wercker", "builds", "log"), []byte("log"), 0644))
+
+	files, err := ListFiles(dir, []string{filepath.Join(dir, ".wercker")})
+	s.Nil(err)
+	s.Equal([]ListedFile{
+		{Path: "README", Size: 2},
+		{Path: filepath.Join("bin", "app"), Size: 6},
+	}, files)
+}
+
+func (s *UtilSuite) TestExtractTarball() {
+	dir, err := ioutil.TempDir("", "extract")
+	s.Require().Nil(err)
+	defer os.RemoveAll(dir)
+
+	tarball := func(name string) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		body := "content"
+		s.Require().Nil(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}))
+		_, err := tw.Write([]byte(body))
+		s.Require().Nil(err)
+		s.Require().Nil(tw.Close())
+		return buf
+	}
+
+	err = ExtractTarball(dir, tarball("output/app"))
+	s.Nil(err)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "output", "app"))
+	s.Nil(err)
+	s.Equal("content", string(content))
+
+	// Extracting over a longer file replaces all of it
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(dir, "output", "app"), []byte("longer content"), 0644))
+	err = ExtractTarball(dir, tarball("output/app"))
+	s.Nil(err)
+	content, err = ioutil.ReadFile(filepath.Join(dir, "output", "app"))
+	s.Nil(err)
+	s.Equal("content", string(content))
+
+	err = ExtractTarball(filepath.Join(dir, "input"), tarball("../../escaped"))
+	s.NotNil(err)
+	_, err = os.Stat(filepath.Join(dir, "..", "escaped"))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *UtilSuite) TestKeychainCommand() {
+	args, stdin, err := keychainCommand("darwin", "get", "wercker", "https://app.wercker.com", "")
+	s.Nil(err)
+	s.Equal([]string{"security", "find-generic-password", "-s", "wercker", "-a", "https://app.wercker.com", "-w"}, args)
+	s.Equal("", stdin)
+
+	// The token is never an argument
+	args, stdin, err = keychainCommand("darwin", "set", "wercker", "https://app.wercker.com", `to"k\en`)
+	s.Nil(err)
+	s.Equal([]string{"security", "-i"}, args)
+	s.Equal(`"add-generic-password" "-U" "-s" "wercker" "-a" "https://app.wercker.com" "-w" "to\"k\\en"`+"\n", stdin)
+
+	args, stdin, err = keychainCommand("linux", "set", "wercker", "https://app.wercker.com", "token")
+	s.Nil(err)
+	s.Equal([]string{"secret-tool", "store", "--label", "wercker", "service", "wercker", "account", "https://app.wercker.com"}, args)
+	s.Equal("token", stdin)
+
+	_, _, err = keychainCommand("windows", "get", "wercker", "https://app.wercker.com", "")
+	s.NotNil(err)
+
+	_, _, err = keychainCommand("linux", "list", "wercker", "https://app.wercker.com", "")
+	s.NotNil(err)
+}